@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	lib "github.com/whawty/auth/store"
+)
+
+// errAccessDenied is returned by Store.Authenticate if the password is correct but the access
+// rules don't allow the user to use the requested service.
+var errAccessDenied = errors.New("access denied")
+
+type accessRule struct {
+	service string
+	realm   string
+	admin   bool
+	groups  []string
+	deny    bool
+}
+
+// accessControl holds the access rules of the listener configuration. The first rule matching
+// the service and realm of a request decides whether the user may authenticate. If no rule
+// matches access is granted.
+type accessControl struct {
+	rules []accessRule
+}
+
+func newAccessControl(config []accessRuleConfig) (*accessControl, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+	ac := &accessControl{}
+	for i, rc := range config {
+		r := accessRule{service: rc.Service, realm: rc.Realm, admin: rc.Admin, groups: rc.Groups, deny: rc.Deny}
+		if r.service == "" {
+			r.service = "*"
+		}
+		if r.realm == "" {
+			r.realm = "*"
+		}
+		if _, err := path.Match(r.service, ""); err != nil {
+			return nil, fmt.Errorf("access rule %d: invalid service pattern '%s': %v", i+1, r.service, err)
+		}
+		if _, err := path.Match(r.realm, ""); err != nil {
+			return nil, fmt.Errorf("access rule %d: invalid realm pattern '%s': %v", i+1, r.realm, err)
+		}
+		for _, group := range r.groups {
+			if !lib.IsValidGroupName(group) {
+				return nil, fmt.Errorf("access rule %d: group name '%s' is invalid", i+1, group)
+			}
+		}
+		if r.deny && (r.admin || len(r.groups) > 0) {
+			return nil, fmt.Errorf("access rule %d: deny can't be combined with admin or groups", i+1)
+		}
+		ac.rules = append(ac.rules, r)
+	}
+	return ac, nil
+}
+
+func (r accessRule) matches(service, realm string) bool {
+	serviceOk, _ := path.Match(r.service, service)
+	realmOk, _ := path.Match(r.realm, realm)
+	return serviceOk && realmOk
+}
+
+// allows checks whether the user may use service and realm. groups must return the groups of
+// the user, not including the admin group. It is only called if the matching rule requires the
+// user to be a member of some group.
+func (ac *accessControl) allows(isAdmin bool, service, realm string, groups func() ([]string, error)) (bool, error) {
+	for _, r := range ac.rules {
+		if !r.matches(service, realm) {
+			continue
+		}
+		if r.deny {
+			return false, nil
+		}
+		if len(r.groups) == 0 {
+			return !r.admin || isAdmin, nil
+		}
+		if r.admin && isAdmin {
+			return true, nil
+		}
+		userGroups, err := groups()
+		if err != nil {
+			return false, err
+		}
+		if isAdmin {
+			userGroups = append(userGroups, lib.AdminGroup)
+		}
+		for _, group := range r.groups {
+			for _, g := range userGroups {
+				if g == group {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
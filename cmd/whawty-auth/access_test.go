@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAccessControlInvalid(t *testing.T) {
+	for _, config := range [][]accessRuleConfig{
+		{{Service: "["}},
+		{{Realm: "["}},
+		{{Groups: []string{"not a group"}}},
+		{{Deny: true, Admin: true}},
+		{{Deny: true, Groups: []string{"staff"}}},
+	} {
+		if _, err := newAccessControl(config); err == nil {
+			t.Fatalf("access rules %+v should be rejected", config)
+		}
+	}
+	ac, err := newAccessControl(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ac != nil {
+		t.Fatal("no access rules should result in no access control")
+	}
+}
+
+func TestAccessControlAllows(t *testing.T) {
+	ac, err := newAccessControl([]accessRuleConfig{
+		{Service: "sshd", Admin: true},
+		{Service: "imap", Groups: []string{"staff", "mail"}},
+		{Service: "smtp", Realm: "example.org"},
+		{Service: "smtp", Deny: true},
+		{Service: "", Realm: "blocked.example.org", Deny: true},
+		{Service: "ldap"},
+		{Service: "mail-*", Admin: true, Groups: []string{"mail"}},
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testvectors := []struct {
+		service string
+		realm   string
+		isAdmin bool
+		groups  []string
+		allowed bool
+	}{
+		{"sshd", "", false, nil, false},
+		{"sshd", "", true, nil, true},
+		{"imap", "", false, nil, false},
+		{"imap", "", false, []string{"other"}, false},
+		{"imap", "", false, []string{"other", "mail"}, true},
+		{"imap", "", true, nil, false},
+		{"smtp", "example.org", false, nil, true},
+		{"smtp", "example.com", false, nil, false},
+		{"smtp", "", false, nil, false},
+		{"pop3", "blocked.example.org", true, nil, false},
+		{"ldap", "blocked.example.org", false, nil, false},
+		{"ldap", "", false, nil, true},
+		{"mail-relay", "", false, nil, false},
+		{"mail-relay", "", false, []string{"mail"}, true},
+		{"mail-relay", "", true, nil, true},
+		{"pop3", "", false, nil, true},
+		{"", "", false, nil, true},
+	}
+	for _, v := range testvectors {
+		groupsCalled := false
+		allowed, err := ac.allows(v.isAdmin, v.service, v.realm, func() ([]string, error) {
+			groupsCalled = true
+			return v.groups, nil
+		})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if allowed != v.allowed {
+			t.Fatalf("service '%s', realm '%s', admin %t, groups %v: expected allowed=%t", v.service, v.realm, v.isAdmin, v.groups, v.allowed)
+		}
+		if groupsCalled && v.service != "imap" && v.service != "mail-relay" {
+			t.Fatalf("service '%s': groups should only be fetched for rules with groups", v.service)
+		}
+	}
+
+	errGroups := errors.New("no groups")
+	if _, err := ac.allows(false, "imap", "", func() ([]string, error) { return nil, errGroups }); err != errGroups {
+		t.Fatalf("expected error %v, got %v", errGroups, err)
+	}
+}
+
+func TestCheckAccessEmptyService(t *testing.T) {
+	s := &Store{}
+	if allowed, err := s.CheckAccess("alice", false); err != nil || !allowed {
+		t.Fatalf("without access rules access should be granted (err: %v)", err)
+	}
+
+	ac, err := newAccessControl([]accessRuleConfig{{Service: "imap"}, {Deny: true}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s = s.WithAccessControl(ac)
+	for _, service := range []string{"", "sshd"} {
+		if allowed, err := s.WithService(service, "").CheckAccess("alice", true); err != nil || allowed {
+			t.Fatalf("access to service '%s' should be denied (err: %v)", service, err)
+		}
+	}
+	if allowed, err := s.WithService("imap", "").CheckAccess("alice", false); err != nil || !allowed {
+		t.Fatalf("access to service 'imap' should be granted (err: %v)", err)
+	}
+	if allowed, err := s.WithAccessControl(nil).CheckAccess("alice", false); err != nil || !allowed {
+		t.Fatalf("access control should be disabled (err: %v)", err)
+	}
+}
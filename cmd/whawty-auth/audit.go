@@ -0,0 +1,487 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	lib "github.com/whawty/auth/store"
+)
+
+// Audit actions which are not hook events.
+const (
+	auditActionInit         = "init"
+	auditActionAuthenticate = "authenticate"
+)
+
+// Results of audit records. Failed authentications use auditResultFailed, authentications
+// rejected by the access rules auditResultDenied. All other errors are auditResultError.
+const (
+	auditResultOK     = "ok"
+	auditResultFailed = "failed"
+	auditResultDenied = "denied"
+	auditResultError  = "error"
+)
+
+// auditTailSize is the number of bytes read from the end of the log to find the hash of the last
+// record.
+const auditTailSize = 64 * 1024 // TODO: hardcoded value
+
+// auditQueryLimit is the default and auditQueryMaxLimit the maximum number of records returned by
+// a query of the audit log.
+const (
+	auditQueryLimit    = 100  // TODO: hardcoded value
+	auditQueryMaxLimit = 1000 // TODO: hardcoded value
+)
+
+// auditLog is nil unless the audit log has been enabled using --audit-log.
+var auditLog *auditLogger
+
+// auditInfo describes who uses an interface of the store and how.
+type auditInfo struct {
+	actor    string
+	listener string
+	source   string
+}
+
+// auditRecord is a single line of the audit log. If the hash chain is enabled every record
+// contains the hash of the previous one and its own hash, which is the SHA-256 of the line
+// without the hash member.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Store    string    `json:"store"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	Details  string    `json:"details,omitempty"`
+	Listener string    `json:"listener,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Prev     string    `json:"prev,omitempty"`
+}
+
+var auditHashRe = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+type auditLogger struct {
+	path            string
+	chain           bool
+	authentications bool
+	defaultActor    string
+	mutex           sync.Mutex
+	file            *os.File
+	last            string
+	size            int64
+	loginsMutex     sync.Mutex
+	logins          map[string]map[string]*auditLogins
+}
+
+// auditLogins holds the times of the last successful and failed authentication of a user.
+type auditLogins struct {
+	last       time.Time
+	lastFailed time.Time
+}
+
+// auditFilter selects records of the audit log. Empty fields match all records.
+type auditFilter struct {
+	store  string
+	target string
+	actor  string
+	action string
+	since  time.Time
+	until  time.Time
+}
+
+func (f *auditFilter) match(record *auditRecord) bool {
+	if f.store != "" && record.Store != f.store {
+		return false
+	}
+	if f.target != "" && record.Target != f.target {
+		return false
+	}
+	if f.actor != "" && record.Actor != f.actor {
+		return false
+	}
+	if f.action != "" && record.Action != f.action {
+		return false
+	}
+	if !f.until.IsZero() && record.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+func newAuditLogger(path string, chain, authentications bool, defaultActor string) (l *auditLogger, err error) {
+	l = &auditLogger{path: path, chain: chain, authentications: authentications, defaultActor: defaultActor}
+	if l.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	go func() {
+		for range reopen {
+			if err := l.reopen(); err != nil {
+				wl.Printf("audit: error reopening log: %v", err)
+			}
+		}
+	}()
+	return
+}
+
+// reopen opens the log file again, this is used to rotate it. The hash chain continues in the
+// new file.
+func (l *auditLogger) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.chain {
+		// other processes might have written to the old file since our last write
+		if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_SH); err == nil {
+			if last, err := l.lastHash(); err == nil {
+				l.last = last
+			}
+		}
+	}
+	l.file.Close()
+	l.file = file
+	l.size = -1
+	wdl.Printf("audit: reopened '%s'", l.path)
+	return nil
+}
+
+// lastHash returns the hash of the last record in the log. Other processes might have written
+// to the log as well, so the hash is only taken from memory if the size of the log has not
+// changed since the last write. An empty log continues the chain of the previous one.
+func (l *auditLogger) lastHash() (string, error) {
+	info, err := l.file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() == 0 || info.Size() == l.size {
+		return l.last, nil
+	}
+
+	offset := info.Size() - auditTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err = l.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	if m := auditHashRe.FindSubmatch(lines[len(lines)-1]); m != nil {
+		return string(m[1]), nil
+	}
+	return "", nil
+}
+
+func (l *auditLogger) write(record auditRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	fd := int(l.file.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN) //nolint:errcheck
+
+	// the time is set while holding the locks so the records of the log are in order
+	record.Time = time.Now()
+	var err error
+	if l.chain {
+		if record.Prev, err = l.lastHash(); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if l.chain {
+		sum := sha256.Sum256(line)
+		hash := hex.EncodeToString(sum[:])
+		line = append(line[:len(line)-1], []byte(`,"hash":"`+hash+`"}`)...)
+		l.last = hash
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if info, err := l.file.Stat(); err == nil {
+		l.size = info.Size()
+	}
+	l.updateLogins(&record)
+	return nil
+}
+
+// record writes record to the audit log, an empty actor is replaced by the default actor.
+func (l *auditLogger) record(record auditRecord) {
+	if l == nil {
+		return
+	}
+	if record.Actor == "" {
+		record.Actor = l.defaultActor
+	}
+	if err := l.write(record); err != nil {
+		wl.Printf("audit: error writing record: %v", err)
+	}
+}
+
+// query returns up to limit records of the current log which match filter, newest first. The
+// search starts before the byte offset cursor, an empty cursor starts at the end of the log. The
+// returned cursor continues the search, it is empty if the start of the log has been reached.
+// Cursors become invalid once the log is rotated.
+func (l *auditLogger) query(filter auditFilter, cursor string, limit int) (records []auditRecord, next string, err error) {
+	if limit <= 0 || limit > auditQueryMaxLimit {
+		limit = auditQueryLimit
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pos := info.Size()
+	if cursor != "" {
+		if pos, err = strconv.ParseInt(cursor, 10, 64); err != nil || pos < 0 || pos > info.Size() {
+			return nil, "", fmt.Errorf("invalid cursor: '%s'", cursor)
+		}
+	}
+	records = []auditRecord{}
+
+	// buf holds the part of the log between pos and the start of the last record processed
+	var buf []byte
+	for {
+		idx := bytes.LastIndexByte(bytes.TrimRight(buf, "\n"), '\n')
+		if idx < 0 && pos > 0 {
+			n := pos
+			if n > auditTailSize {
+				n = auditTailSize
+			}
+			chunk := make([]byte, n, n+int64(len(buf)))
+			if _, err = file.ReadAt(chunk, pos-n); err != nil && err != io.EOF {
+				return nil, "", err
+			}
+			buf = append(chunk, buf...)
+			pos -= n
+			continue
+		}
+
+		line := bytes.TrimRight(buf[idx+1:], "\n")
+		buf = buf[:idx+1]
+		if len(line) > 0 {
+			record := auditRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				wdl.Printf("audit: ignoring malformed record at offset %d: %v", pos+int64(len(buf)), err)
+			} else {
+				if !filter.since.IsZero() && record.Time.Before(filter.since) {
+					return records, "", nil
+				}
+				if filter.match(&record) {
+					records = append(records, record)
+				}
+			}
+		}
+		if idx < 0 {
+			return records, "", nil
+		}
+		if len(records) >= limit {
+			return records, strconv.FormatInt(pos+int64(len(buf)), 10), nil
+		}
+	}
+}
+
+// loadLogins builds the index of the last authentications of all users from the current log.
+// Records of the authentications of all stores are used, so this needs to be called with
+// l.loginsMutex held.
+func (l *auditLogger) loadLogins() {
+	l.logins = make(map[string]map[string]*auditLogins)
+	file, err := os.Open(l.path)
+	if err != nil {
+		wl.Printf("audit: error reading last logins: %v", err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, auditTailSize), auditTailSize)
+	for scanner.Scan() {
+		record := auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			l.addLogin(&record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		wl.Printf("audit: error reading last logins: %v", err)
+	}
+}
+
+func (l *auditLogger) addLogin(record *auditRecord) {
+	if record.Action != auditActionAuthenticate || record.Result == auditResultError {
+		return
+	}
+	users, exists := l.logins[record.Store]
+	if !exists {
+		users = make(map[string]*auditLogins)
+		l.logins[record.Store] = users
+	}
+	logins, exists := users[record.Target]
+	if !exists {
+		logins = &auditLogins{}
+		users[record.Target] = logins
+	}
+	if record.Result == auditResultOK {
+		if record.Time.After(logins.last) {
+			logins.last = record.Time
+		}
+	} else if record.Time.After(logins.lastFailed) {
+		logins.lastFailed = record.Time
+	}
+}
+
+// updateLogins adds record to the index of the last authentications once it has been built.
+func (l *auditLogger) updateLogins(record *auditRecord) {
+	l.loginsMutex.Lock()
+	defer l.loginsMutex.Unlock()
+	if l.logins != nil {
+		l.addLogin(record)
+	}
+}
+
+// lastLogins sets the times of the last successful and failed authentication of all users in
+// list of the store at storeDir. This is only available if authentications are recorded. Only
+// the current log is read, so logins recorded in rotated files are lost once the index is rebuilt,
+// the login state of --state-dir doesn't have this limitation.
+func (l *auditLogger) lastLogins(storeDir string, list lib.UserListFull) {
+	if l == nil || !l.authentications {
+		return
+	}
+	l.loginsMutex.Lock()
+	defer l.loginsMutex.Unlock()
+	if l.logins == nil {
+		l.loadLogins()
+	}
+	for username, logins := range l.logins[storeDir] {
+		user, exists := list[username]
+		if !exists {
+			continue
+		}
+		if !logins.last.IsZero() {
+			last := logins.last
+			user.LastLogin = &last
+		}
+		if !logins.lastFailed.IsZero() {
+			lastFailed := logins.lastFailed
+			user.LastFailedLogin = &lastFailed
+		}
+		list[username] = user
+	}
+}
+
+// auditResult returns the result and error message of an action for the audit log.
+func auditResult(err error) (string, string) {
+	switch err {
+	case nil:
+		return auditResultOK, ""
+	case errAccessDenied:
+		return auditResultDenied, err.Error()
+	}
+	return auditResultError, err.Error()
+}
+
+// auditSource returns the address of the peer for the audit log.
+func auditSource(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// cliActor is the actor of all changes made using the command line.
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return fmt.Sprintf("cli:%d", os.Getuid())
+}
+
+// verifyAuditLog checks the hash chain of the records in r. prev is the hash of the last record
+// of the previous file, an empty prev accepts any chain. It returns the hash of the last record.
+func verifyAuditLog(r io.Reader, prev string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, auditTailSize), auditTailSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		m := auditHashRe.FindSubmatchIndex(line)
+		if m == nil {
+			return "", fmt.Errorf("line %d: record has no hash", n)
+		}
+		hash := string(line[m[2]:m[3]])
+		content := append(append([]byte{}, line[:m[0]]...), '}')
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != hash {
+			return "", fmt.Errorf("line %d: hash doesn't match the record", n)
+		}
+		record := auditRecord{}
+		if err := json.Unmarshal(content, &record); err != nil {
+			return "", fmt.Errorf("line %d: %v", n, err)
+		}
+		if prev != "" && record.Prev != prev {
+			return "", fmt.Errorf("line %d: record doesn't follow the previous one", n)
+		}
+		prev = hash
+	}
+	return prev, scanner.Err()
+}
@@ -0,0 +1,268 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuditLogger(t *testing.T, chain bool) *auditLogger {
+	l, err := newAuditLogger(filepath.Join(t.TempDir(), "audit.log"), chain, true, "test")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	t.Cleanup(func() { l.file.Close() })
+	return l
+}
+
+func (l *auditLogger) testRecord(t *testing.T, actor, action, target string) {
+	if err := l.write(auditRecord{Store: "/store", Actor: actor, Action: action, Target: target, Result: auditResultOK}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	l := newTestAuditLogger(t, true)
+	for i := 0; i < 5; i++ {
+		l.testRecord(t, "admin", hookEventUpdate, fmt.Sprintf("user%d", i))
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	last, err := verifyAuditLog(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal("verifying the log failed:", err)
+	}
+	if last != l.last {
+		t.Fatalf("verify returned '%s' as last hash, expected '%s'", last, l.last)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(nil), "prev"); err != nil {
+		t.Fatal("verifying an empty log failed:", err)
+	}
+
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	tampered := strings.Join(lines[:2], "") + strings.Replace(lines[2], `"user2"`, `"user9"`, 1) + strings.Join(lines[3:], "")
+	if _, err := verifyAuditLog(bytes.NewReader([]byte(tampered)), ""); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("modified record should be detected in line 3, got: %v", err)
+	}
+	removed := strings.Join(lines[:2], "") + strings.Join(lines[3:], "")
+	if _, err := verifyAuditLog(bytes.NewReader([]byte(removed)), ""); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("removed record should be detected in line 3, got: %v", err)
+	}
+	unhashed := string(data) + `{"time":"2024-01-01T00:00:00Z","store":"/store","actor":"admin","action":"update","result":"ok"}` + "\n"
+	if _, err := verifyAuditLog(bytes.NewReader([]byte(unhashed)), ""); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Fatalf("record without hash should be detected in line 6, got: %v", err)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(data), last); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("log not following prev should be detected in line 1, got: %v", err)
+	}
+}
+
+func TestAuditLogVerifyRotated(t *testing.T) {
+	l := newTestAuditLogger(t, true)
+	l.testRecord(t, "admin", hookEventAdd, "alice")
+	l.testRecord(t, "admin", hookEventAdd, "bob")
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// another process writes to the old file before the log is reopened
+	other, err := newAuditLogger(l.path+".1", true, true, "other")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	other.testRecord(t, "other", hookEventRemove, "bob")
+	other.file.Close()
+	if err := l.reopen(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	l.testRecord(t, "admin", hookEventAdd, "carol")
+
+	old, err := os.ReadFile(l.path + ".1")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	current, err := os.ReadFile(l.path)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	prev, err := verifyAuditLog(bytes.NewReader(old), "")
+	if err != nil {
+		t.Fatal("verifying the rotated log failed:", err)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(current), prev); err != nil {
+		t.Fatal("the chain should continue in the new log:", err)
+	}
+}
+
+func TestAuditLogTimeOrder(t *testing.T) {
+	l := newTestAuditLogger(t, false)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 50; j++ {
+				l.record(auditRecord{Store: "/store", Action: hookEventUpdate, Target: fmt.Sprintf("user%d", i), Result: auditResultOK})
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	records, _, err := l.query(auditFilter{}, "", auditQueryMaxLimit)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(records) != 200 {
+		t.Fatalf("expected 200 records, got %d", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Time.After(records[i-1].Time) {
+			t.Fatalf("record %d is newer than the one written after it", i)
+		}
+	}
+	if records[0].Actor != "test" {
+		t.Fatalf("records without actor should use the default actor, got '%s'", records[0].Actor)
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	l := newTestAuditLogger(t, true)
+	// enough records to span several chunks of auditTailSize
+	const count = 1000
+	for i := 0; i < count; i++ {
+		action := hookEventUpdate
+		if i%10 == 0 {
+			action = hookEventSetAdmin
+		}
+		l.testRecord(t, fmt.Sprintf("admin%d", i%2), action, fmt.Sprintf("user%04d", i))
+	}
+	if info, err := l.file.Stat(); err != nil || info.Size() < 2*auditTailSize {
+		t.Fatalf("the log should be larger than two chunks (err: %v)", err)
+	}
+
+	// paging through the complete log returns every record once, newest first
+	var all []auditRecord
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > count/auditQueryLimit {
+			t.Fatal("too many pages")
+		}
+		records, next, err := l.query(auditFilter{}, cursor, 0)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if next != "" && len(records) != auditQueryLimit {
+			t.Fatalf("page %d has %d records, expected %d", pages, len(records), auditQueryLimit)
+		}
+		all = append(all, records...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(all) != count {
+		t.Fatalf("expected %d records, got %d", count, len(all))
+	}
+	for i, record := range all {
+		if expected := fmt.Sprintf("user%04d", count-1-i); record.Target != expected {
+			t.Fatalf("record %d has target '%s', expected '%s'", i, record.Target, expected)
+		}
+	}
+
+	// filters are applied before the limit
+	records, next, err := l.query(auditFilter{action: hookEventSetAdmin, actor: "admin0"}, "", 30)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(records) != 30 || next == "" {
+		t.Fatalf("expected a full page of 30 records and a cursor, got %d records and cursor '%s'", len(records), next)
+	}
+	for _, record := range records {
+		if record.Action != hookEventSetAdmin || record.Actor != "admin0" {
+			t.Fatalf("record doesn't match the filter: %+v", record)
+		}
+	}
+	records, next, err = l.query(auditFilter{action: hookEventSetAdmin, actor: "admin0"}, next, 0)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(records) != count/10-30 || next != "" {
+		t.Fatalf("expected the remaining %d records, got %d and cursor '%s'", count/10-30, len(records), next)
+	}
+	if records, _, err = l.query(auditFilter{target: "user0500"}, "", 0); err != nil || len(records) != 1 {
+		t.Fatalf("expected exactly one record for 'user0500', got %d (err: %v)", len(records), err)
+	}
+
+	// since stops the search, until skips newer records
+	since := all[99].Time
+	records, _, err = l.query(auditFilter{since: since}, "", auditQueryMaxLimit)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, record := range records {
+		if record.Time.Before(since) {
+			t.Fatalf("record from %v is older than since %v", record.Time, since)
+		}
+	}
+	if len(records) < 100 {
+		t.Fatalf("expected at least 100 records since %v, got %d", since, len(records))
+	}
+	until := all[count-100].Time
+	records, _, err = l.query(auditFilter{until: until}, "", auditQueryMaxLimit)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, record := range records {
+		if record.Time.After(until) {
+			t.Fatalf("record from %v is newer than until %v", record.Time, until)
+		}
+	}
+	if len(records) < 100 {
+		t.Fatalf("expected at least 100 records until %v, got %d", until, len(records))
+	}
+	if records, _, err = l.query(auditFilter{since: time.Now().Add(time.Hour)}, "", 0); err != nil || len(records) != 0 {
+		t.Fatalf("expected no records from the future, got %d (err: %v)", len(records), err)
+	}
+
+	for _, cursor := range []string{"x", "-1", "99999999999"} {
+		if _, _, err := l.query(auditFilter{}, cursor, 0); err == nil {
+			t.Fatalf("cursor '%s' should be rejected", cursor)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"os"
+	"time"
+)
+
+var (
+	authCacheHits          = expvar.NewInt("authcache_hits")
+	authCacheMisses        = expvar.NewInt("authcache_misses")
+	authCacheEvictions     = expvar.NewInt("authcache_evictions")
+	authCacheInvalidations = expvar.NewInt("authcache_invalidations")
+	authCacheEntries       = expvar.NewInt("authcache_entries")
+)
+
+type authCacheEntry struct {
+	pwHash      []byte
+	isAdmin     bool
+	lastChanged time.Time
+	file        os.FileInfo
+	expires     time.Time
+}
+
+// authCache remembers successful authentications for a short time. The password is never
+// stored, entries only contain a HMAC of username and password using a random key which
+// is generated on startup. The cache is not safe for concurrent use and must only be
+// accessed from the dispatcher of the store.
+type authCache struct {
+	key     []byte
+	ttl     time.Duration
+	size    int
+	entries map[string]authCacheEntry
+}
+
+func newAuthCache(ttl time.Duration, size int) (*authCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	if size <= 0 {
+		return nil, errors.New("the size of the authentication cache must be > 0")
+	}
+	c := &authCache{ttl: ttl, size: size}
+	c.key = make([]byte, sha256.Size)
+	if _, err := rand.Read(c.key); err != nil {
+		return nil, err
+	}
+	c.entries = make(map[string]authCacheEntry)
+	return c, nil
+}
+
+func (c *authCache) hash(username, password string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func isSameHashFile(a, b os.FileInfo) bool {
+	return a.Name() == b.Name() && os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// lookup returns the cached result for username and password. file is the current file info of
+// the hash file and is used to detect changes which were not made using this agent.
+func (c *authCache) lookup(username, password string, file os.FileInfo) (entry authCacheEntry, ok bool) {
+	if c == nil {
+		return
+	}
+	if entry, ok = c.entries[username]; !ok {
+		authCacheMisses.Add(1)
+		return
+	}
+	if time.Now().After(entry.expires) || !isSameHashFile(entry.file, file) {
+		c.invalidate(username)
+		authCacheMisses.Add(1)
+		return entry, false
+	}
+	if !hmac.Equal(entry.pwHash, c.hash(username, password)) {
+		authCacheMisses.Add(1)
+		return entry, false
+	}
+	authCacheHits.Add(1)
+	return entry, true
+}
+
+func (c *authCache) add(username, password string, file os.FileInfo, isAdmin bool, lastChanged time.Time) {
+	if c == nil {
+		return
+	}
+	if _, exists := c.entries[username]; !exists && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[username] = authCacheEntry{
+		pwHash:      c.hash(username, password),
+		isAdmin:     isAdmin,
+		lastChanged: lastChanged,
+		file:        file,
+		expires:     time.Now().Add(c.ttl),
+	}
+	authCacheEntries.Set(int64(len(c.entries)))
+}
+
+// evict removes all expired entries. If this doesn't free up any space the entry
+// which expires next gets removed.
+func (c *authCache) evict() {
+	now := time.Now()
+	var oldest string
+	for username, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, username)
+			authCacheEvictions.Add(1)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+			oldest = username
+		}
+	}
+	if len(c.entries) >= c.size && oldest != "" {
+		delete(c.entries, oldest)
+		authCacheEvictions.Add(1)
+	}
+	authCacheEntries.Set(int64(len(c.entries)))
+}
+
+func (c *authCache) invalidate(username string) {
+	if c == nil {
+		return
+	}
+	if _, exists := c.entries[username]; exists {
+		delete(c.entries, username)
+		authCacheInvalidations.Add(1)
+		authCacheEntries.Set(int64(len(c.entries)))
+	}
+}
+
+func (c *authCache) flush() {
+	if c == nil {
+		return
+	}
+	authCacheInvalidations.Add(int64(len(c.entries)))
+	c.entries = make(map[string]authCacheEntry)
+	authCacheEntries.Set(0)
+}
@@ -0,0 +1,245 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHashFile(t *testing.T, dir, name, content string) os.FileInfo {
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	file, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return file
+}
+
+func TestAuthCacheDisabled(t *testing.T) {
+	c, err := newAuthCache(0, 10)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if c != nil {
+		t.Fatal("a ttl of 0 should disable the cache")
+	}
+	// all methods must work on a disabled cache
+	c.add("alice", "secret", nil, false, time.Now())
+	if _, ok := c.lookup("alice", "secret", nil); ok {
+		t.Fatal("disabled cache shouldn't return entries")
+	}
+	c.invalidate("alice")
+	c.flush()
+
+	if _, err := newAuthCache(time.Minute, 0); err == nil {
+		t.Fatal("a size of 0 should be an error")
+	}
+}
+
+func TestAuthCacheLookup(t *testing.T) {
+	dir := t.TempDir()
+	file := newTestHashFile(t, dir, "alice.user", "hash")
+	lastChanged := time.Unix(1600000000, 0)
+
+	c, err := newAuthCache(time.Minute, 10)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, ok := c.lookup("alice", "secret", file); ok {
+		t.Fatal("lookup in an empty cache shouldn't succeed")
+	}
+
+	c.add("alice", "secret", file, true, lastChanged)
+	if entry, ok := c.lookup("alice", "secret", file); !ok {
+		t.Fatal("lookup of cached password should succeed")
+	} else if !entry.isAdmin || !entry.lastChanged.Equal(lastChanged) {
+		t.Fatalf("cached entry is wrong: %+v", entry)
+	}
+	if _, ok := c.lookup("alice", "wrong", file); ok {
+		t.Fatal("lookup with wrong password shouldn't succeed")
+	}
+	if _, ok := c.lookup("alice", "", file); ok {
+		t.Fatal("lookup with empty password shouldn't succeed")
+	}
+	if _, ok := c.lookup("bob", "secret", file); ok {
+		t.Fatal("lookup of other user shouldn't succeed")
+	}
+	if _, ok := c.lookup("alice", "secret", file); !ok {
+		t.Fatal("wrong passwords shouldn't remove the entry")
+	}
+
+	c.invalidate("alice")
+	if _, ok := c.lookup("alice", "secret", file); ok {
+		t.Fatal("lookup after invalidate shouldn't succeed")
+	}
+
+	c.add("alice", "secret", file, false, lastChanged)
+	c.flush()
+	if _, ok := c.lookup("alice", "secret", file); ok {
+		t.Fatal("lookup after flush shouldn't succeed")
+	}
+}
+
+func TestAuthCacheExpiry(t *testing.T) {
+	dir := t.TempDir()
+	file := newTestHashFile(t, dir, "alice.user", "hash")
+
+	c, err := newAuthCache(50*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	c.add("alice", "secret", file, false, time.Now())
+	if _, ok := c.lookup("alice", "secret", file); !ok {
+		t.Fatal("lookup of cached password should succeed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.lookup("alice", "secret", file); ok {
+		t.Fatal("lookup of expired entry shouldn't succeed")
+	}
+	if _, exists := c.entries["alice"]; exists {
+		t.Fatal("expired entry should have been removed")
+	}
+}
+
+func TestAuthCacheFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "alice.user")
+	mtime := time.Unix(1700000000, 0)
+
+	changes := []struct {
+		name   string
+		change func(t *testing.T) os.FileInfo
+	}{
+		{"mtime", func(t *testing.T) os.FileInfo {
+			other := mtime.Add(time.Second)
+			if err := os.Chtimes(filename, other, other); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			file, _ := os.Stat(filename)
+			return file
+		}},
+		{"size", func(t *testing.T) os.FileInfo {
+			return newTestHashFile(t, dir, "alice.user", "longer hash")
+		}},
+		{"same-file", func(t *testing.T) os.FileInfo {
+			// a new file with the same name, size and mtime
+			newTestHashFile(t, dir, "alice.new", "hash")
+			if err := os.Rename(filepath.Join(dir, "alice.new"), filename); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			file, _ := os.Stat(filename)
+			return file
+		}},
+		{"name", func(t *testing.T) os.FileInfo {
+			// e.g. the user became an admin
+			if err := os.Rename(filename, filepath.Join(dir, "alice.admin")); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			file, _ := os.Stat(filepath.Join(dir, "alice.admin"))
+			return file
+		}},
+	}
+	for _, change := range changes {
+		os.Remove(filepath.Join(dir, "alice.admin"))
+		file := newTestHashFile(t, dir, "alice.user", "hash")
+
+		c, err := newAuthCache(time.Minute, 10)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		c.add("alice", "secret", file, false, time.Now())
+		if _, ok := c.lookup("alice", "secret", file); !ok {
+			t.Fatalf("%s: lookup of cached password should succeed", change.name)
+		}
+		changed := change.change(t)
+		if _, ok := c.lookup("alice", "secret", changed); ok {
+			t.Fatalf("%s: lookup after the hash file has changed shouldn't succeed", change.name)
+		}
+		if _, exists := c.entries["alice"]; exists {
+			t.Fatalf("%s: entry should have been removed", change.name)
+		}
+	}
+}
+
+func TestAuthCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	file := newTestHashFile(t, dir, "user.user", "hash")
+
+	c, err := newAuthCache(time.Minute, 3)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for i := 0; i < 3; i++ {
+		c.add(fmt.Sprintf("user%d", i), "secret", file, false, time.Now())
+	}
+	// updating an existing entry must not evict anything
+	c.add("user1", "secret", file, false, time.Now())
+	if len(c.entries) != 3 {
+		t.Fatalf("cache should contain 3 entries but has %d", len(c.entries))
+	}
+
+	// the entry which expires next gets evicted
+	c.add("user3", "secret", file, false, time.Now())
+	if len(c.entries) != 3 {
+		t.Fatalf("cache should contain 3 entries but has %d", len(c.entries))
+	}
+	if _, exists := c.entries["user0"]; exists {
+		t.Fatal("oldest entry should have been evicted")
+	}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		if _, ok := c.lookup(username, "secret", file); !ok {
+			t.Fatalf("lookup of '%s' should succeed", username)
+		}
+	}
+
+	// expired entries get evicted first
+	entry := c.entries["user3"]
+	entry.expires = time.Now().Add(-time.Second)
+	c.entries["user3"] = entry
+	c.add("user4", "secret", file, false, time.Now())
+	if _, exists := c.entries["user3"]; exists {
+		t.Fatal("expired entry should have been evicted")
+	}
+	if len(c.entries) != 3 {
+		t.Fatalf("cache should contain 3 entries but has %d", len(c.entries))
+	}
+}
@@ -32,41 +32,159 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spreadspace/tlsconfig"
 	"gopkg.in/yaml.v3"
 )
 
 type saslauthdConfig struct {
-	Listen []string `yaml:"listen"`
+	Listen    []string `yaml:"listen"`
+	AuthCache bool     `yaml:"auth-cache"`
+}
+
+type dovecotConfig struct {
+	Listen    []string `yaml:"listen"`
+	AuthCache bool     `yaml:"auth-cache"`
+}
+
+type oidcClientConfig struct {
+	ID           string   `yaml:"id"`
+	Secret       string   `yaml:"secret"`
+	RedirectURIs []string `yaml:"redirect-uris"`
+}
+
+type oidcConfig struct {
+	Issuer        string             `yaml:"issuer"`
+	SigningKey    string             `yaml:"signing-key"`
+	TokenLifetime time.Duration      `yaml:"token-lifetime"`
+	Clients       []oidcClientConfig `yaml:"clients"`
+}
+
+type webUpgradesConfig struct {
+	Secret     string `yaml:"secret"`
+	ClientCert bool   `yaml:"client-cert"`
 }
 
 type httpConfig struct {
-	Listen []string `yaml:"listen"`
+	Listen           []string           `yaml:"listen"`
+	AuthCache        bool               `yaml:"auth-cache"`
+	Metrics          bool               `yaml:"metrics"`
+	ForwardAuthRealm string             `yaml:"forward-auth-realm"`
+	SessionLifetime  time.Duration      `yaml:"session-lifetime"`
+	OIDC             *oidcConfig        `yaml:"oidc"`
+	Upgrades         *webUpgradesConfig `yaml:"upgrades"`
 }
 
 type httpsConfig struct {
-	Listen []string             `yaml:"listen"`
-	TLS    *tlsconfig.TLSConfig `yaml:"tls"`
+	Listen           []string             `yaml:"listen"`
+	TLS              *tlsconfig.TLSConfig `yaml:"tls"`
+	AuthCache        bool                 `yaml:"auth-cache"`
+	Metrics          bool                 `yaml:"metrics"`
+	ForwardAuthRealm string               `yaml:"forward-auth-realm"`
+	SessionLifetime  time.Duration        `yaml:"session-lifetime"`
+	OIDC             *oidcConfig          `yaml:"oidc"`
+	Upgrades         *webUpgradesConfig   `yaml:"upgrades"`
+}
+
+type ldapSearchConfig struct {
+	Users           bool   `yaml:"users"`
+	ServiceDN       string `yaml:"service-dn"`
+	ServicePassword string `yaml:"service-password"`
+}
+
+type ldapDirectoryConfig struct {
+	Service      string            `yaml:"service"`
+	BaseDN       string            `yaml:"base-dn"`
+	GroupsDN     string            `yaml:"groups-dn"`
+	BindPatterns []string          `yaml:"bind-patterns"`
+	Anonymous    bool              `yaml:"anonymous"`
+	Attributes   map[string]string `yaml:"attributes"`
+	Search       *ldapSearchConfig `yaml:"search"`
 }
 
 type ldapConfig struct {
-	Listen []string             `yaml:"listen"`
-	TLS    *tlsconfig.TLSConfig `yaml:"tls"`
+	Listen    []string             `yaml:"listen"`
+	TLS       *tlsconfig.TLSConfig `yaml:"tls"`
+	AuthCache bool                 `yaml:"auth-cache"`
+	Directory ldapDirectoryConfig  `yaml:",inline"`
 }
 
 type ldapsConfig struct {
-	Listen []string             `yaml:"listen"`
-	TLS    *tlsconfig.TLSConfig `yaml:"tls"`
+	Listen    []string             `yaml:"listen"`
+	TLS       *tlsconfig.TLSConfig `yaml:"tls"`
+	AuthCache bool                 `yaml:"auth-cache"`
+	Directory ldapDirectoryConfig  `yaml:",inline"`
+}
+
+type radiusClientConfig struct {
+	Address                     string `yaml:"address"`
+	Secret                      string `yaml:"secret"`
+	RequireMessageAuthenticator bool   `yaml:"require-message-authenticator"`
+}
+
+type radiusConfig struct {
+	Listen    []string             `yaml:"listen"`
+	Clients   []radiusClientConfig `yaml:"clients"`
+	AuthCache bool                 `yaml:"auth-cache"`
+}
+
+type replicationConfig struct {
+	Listen       []string             `yaml:"listen"`
+	TLS          *tlsconfig.TLSConfig `yaml:"tls"`
+	PingInterval time.Duration        `yaml:"ping-interval"`
+	Timeout      time.Duration        `yaml:"timeout"`
+	Buffer       int                  `yaml:"buffer"`
+}
+
+type replicaConfig struct {
+	Master  string               `yaml:"master"`
+	TLS     *tlsconfig.TLSConfig `yaml:"tls"`
+	MaxLag  time.Duration        `yaml:"max-lag"`
+	Timeout time.Duration        `yaml:"timeout"`
+}
+
+type accessRuleConfig struct {
+	Service string   `yaml:"service"`
+	Realm   string   `yaml:"realm"`
+	Admin   bool     `yaml:"admin"`
+	Groups  []string `yaml:"groups"`
+	Deny    bool     `yaml:"deny"`
+}
+
+type tenantConfig struct {
+	Name            string               `yaml:"name"`
+	Store           string               `yaml:"store"`
+	DoUpgrades      string               `yaml:"do-upgrades"`
+	PolicyType      string               `yaml:"policy-type"`
+	PolicyCondition string               `yaml:"policy-condition"`
+	HooksDir        string               `yaml:"hooks-dir"`
+	HooksConfig     string               `yaml:"hooks-config"`
+	StateDir        string               `yaml:"state-dir"`
+	ReadOnly        bool                 `yaml:"read-only"`
+	Realms          []string             `yaml:"realms"`
+	Hosts           []string             `yaml:"hosts"`
+	PathPrefix      string               `yaml:"path-prefix"`
+	LDAP            *ldapDirectoryConfig `yaml:"ldap"`
+	Access          []accessRuleConfig   `yaml:"access"`
 }
 
 type listenerConfig struct {
-	SASLAuthd *saslauthdConfig `yaml:"saslauthd"`
-	HTTP      *httpConfig      `yaml:"http"`
-	HTTPs     *httpsConfig     `yaml:"https"`
-	LDAP      *ldapConfig      `yaml:"ldap"`
-	LDAPs     *ldapsConfig     `yaml:"ldaps"`
+	SASLAuthd   *saslauthdConfig   `yaml:"saslauthd"`
+	Dovecot     *dovecotConfig     `yaml:"dovecot"`
+	HTTP        *httpConfig        `yaml:"http"`
+	HTTPs       *httpsConfig       `yaml:"https"`
+	LDAP        *ldapConfig        `yaml:"ldap"`
+	LDAPs       *ldapsConfig       `yaml:"ldaps"`
+	Radius      *radiusConfig      `yaml:"radius"`
+	Replication *replicationConfig `yaml:"replication"`
+	Replica     *replicaConfig     `yaml:"replica"`
+	Access      []accessRuleConfig `yaml:"access"`
+	Tenants     []tenantConfig     `yaml:"tenants"`
 }
 
 func readListenerConfig(configfile string) (*listenerConfig, error) {
@@ -85,3 +203,169 @@ func readListenerConfig(configfile string) (*listenerConfig, error) {
 	}
 	return c, nil
 }
+
+type remoteUpgradeConfig struct {
+	Concurrency int                  `yaml:"concurrency"`
+	QueueSize   int                  `yaml:"queue-size"`
+	Timeout     time.Duration        `yaml:"timeout"`
+	MaxAge      time.Duration        `yaml:"max-age"`
+	QueueDir    string               `yaml:"queue-dir"`
+	QueueKey    string               `yaml:"queue-key"`
+	Secret      string               `yaml:"secret"`
+	TLS         *tlsconfig.TLSConfig `yaml:"tls"`
+}
+
+// readRemoteUpgradeConfig reads the configuration for remote upgrades. If configfile is empty
+// the defaults are used.
+func readRemoteUpgradeConfig(configfile string) (*remoteUpgradeConfig, error) {
+	c := &remoteUpgradeConfig{}
+	if configfile != "" {
+		file, err := os.Open(configfile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err = decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("Error parsing config file: %s", err)
+		}
+	}
+
+	if c.Concurrency <= 0 {
+		c.Concurrency = 10
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1000
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = time.Hour
+	}
+	return c, nil
+}
+
+type hookSettings struct {
+	RateLimit time.Duration `yaml:"rate-limit"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+type webhookConfig struct {
+	Name      string               `yaml:"name"`
+	URL       string               `yaml:"url"`
+	Secret    string               `yaml:"secret"`
+	Events    []string             `yaml:"events"`
+	Timeout   time.Duration        `yaml:"timeout"`
+	MaxAge    time.Duration        `yaml:"max-age"`
+	QueueSize int                  `yaml:"queue-size"`
+	TLS       *tlsconfig.TLSConfig `yaml:"tls"`
+}
+
+type webhooksConfig struct {
+	QueueDir  string          `yaml:"queue-dir"`
+	Endpoints []webhookConfig `yaml:"endpoints"`
+}
+
+type hooksConfig struct {
+	hookSettings `yaml:",inline"`
+	Concurrency  int                     `yaml:"concurrency"`
+	Hooks        map[string]hookSettings `yaml:"hooks"`
+	Webhooks     *webhooksConfig         `yaml:"webhooks"`
+}
+
+// settings returns the settings for the hook name, values which are not overridden for this hook
+// are taken from the defaults.
+func (c *hooksConfig) settings(name string) hookSettings {
+	s := c.hookSettings
+	if o, exists := c.Hooks[name]; exists {
+		if o.RateLimit > 0 {
+			s.RateLimit = o.RateLimit
+		}
+		if o.Timeout > 0 {
+			s.Timeout = o.Timeout
+		}
+	}
+	return s
+}
+
+// readHooksConfig reads the configuration for the hooks runner. If configfile is empty the
+// defaults are used.
+func readHooksConfig(configfile string) (*hooksConfig, error) {
+	c := &hooksConfig{}
+	if configfile != "" {
+		file, err := os.Open(configfile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err = decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("Error parsing config file: %s", err)
+		}
+	}
+
+	if c.RateLimit <= 0 {
+		c.RateLimit = 5 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Minute
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 4
+	}
+	for name := range c.Hooks {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("Error parsing config file: invalid hook name '%s'", name)
+		}
+	}
+	if c.Webhooks != nil {
+		if err := c.Webhooks.validate(); err != nil {
+			return nil, fmt.Errorf("Error parsing config file: %s", err)
+		}
+	}
+	return c, nil
+}
+
+// validate checks the configuration of the webhooks and applies the defaults.
+func (c *webhooksConfig) validate() error {
+	names := make(map[string]bool)
+	for i := range c.Endpoints {
+		e := &c.Endpoints[i]
+		if e.Name == "" || e.Name != filepath.Base(e.Name) || strings.HasPrefix(e.Name, ".") {
+			return fmt.Errorf("invalid webhook name '%s'", e.Name)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("webhook '%s' is configured more than once", e.Name)
+		}
+		names[e.Name] = true
+
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return fmt.Errorf("webhook '%s': %v", e.Name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook '%s': url must be either http or https", e.Name)
+		}
+		if e.Secret == "" {
+			return fmt.Errorf("webhook '%s': secret is missing", e.Name)
+		}
+		if len(e.Events) == 0 {
+			e.Events = []string{hookEventAdd, hookEventRemove, hookEventUpdate, hookEventSetAdmin}
+		}
+		if e.Timeout <= 0 {
+			e.Timeout = 10 * time.Second
+		}
+		if e.MaxAge <= 0 {
+			e.MaxAge = 24 * time.Hour
+		}
+		if e.QueueSize <= 0 {
+			e.QueueSize = 1000
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/whawty/auth/dovecot"
+)
+
+func dovecotCallback(login, password, service, path string, store *Store) (ok bool, msg string, err error) {
+	wdl.Printf("dovecot auth request on '%s': [user=%s] [service=%s]", path, login, service)
+
+	store, username := store.ForLogin(login, "")
+	ok, _, _, err = store.WithAppPasswords(true, "dovecot", service).WithService(service, "").WithListener("dovecot:"+path).Authenticate(username, password)
+	if err == errAccessDenied {
+		return false, fmt.Sprintf("access to service '%s' denied", service), nil
+	}
+	if err != nil || !ok {
+		if err != nil {
+			wdl.Printf("dovecot auth request on '%s' failed for '%s': %v", path, login, err)
+		}
+		return false, authFailedMessage, nil
+	}
+	return true, "successfully authenticated", nil
+}
+
+func runDovecotAuthSocket(path string, store *Store) error {
+	os.Remove(path)
+	s, err := dovecot.NewServer(path, func(log string, pwd string, srv string) (bool, string, error) {
+		return dovecotCallback(log, pwd, srv, path, store)
+	})
+	if err != nil {
+		return err
+	}
+	wl.Printf("dovecot: listening on '%s'", path)
+
+	defer os.Remove(path)
+	if err := s.Run(); err != nil {
+		wl.Printf("error on dovecot auth socket '%s': %s", path, err)
+	}
+	return nil
+}
+
+func runDovecotAuthSocketListener(listener *net.UnixListener, store *Store) error {
+	path := listener.Addr().String()
+	s, err := dovecot.NewServerFromListener(listener, func(log string, pwd string, srv string) (bool, string, error) {
+		return dovecotCallback(log, pwd, srv, path, store)
+	})
+	if err != nil {
+		return err
+	}
+	wl.Printf("dovecot: listening on '%s'", path)
+
+	if err := s.Run(); err != nil {
+		wl.Printf("error on dovecot auth socket '%s': %s", path, err)
+	}
+	return nil
+}
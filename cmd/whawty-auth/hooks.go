@@ -31,91 +31,274 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Hook events, hooks are always called with the sole argument 'update' so hooks which don't care
+// about the events keep working.
+const (
+	hookEventAdd               = "add"
+	hookEventRemove            = "remove"
+	hookEventUpdate            = "update"
+	hookEventExpire            = "expire"
+	hookEventReset             = "reset"
+	hookEventRewrap            = "rewrap"
+	hookEventReencrypt         = "reencrypt"
+	hookEventSetAdmin          = "set-admin"
+	hookEventSetGroup          = "set-group"
+	hookEventAddAppPassword    = "add-app-password"
+	hookEventRemoveAppPassword = "remove-app-password"
+	hookEventUpgrade           = "upgrade"
+	hookEventReplicate         = "replicate"
+	hookEventReload            = "reload"
+	hookEventLoginFailure      = "login-failure"
+	hookEventTest              = "test"
+)
+
+// hookOutputLimit is the number of bytes of output which are kept for every hook run.
+const hookOutputLimit = 16 * 1024 // TODO: hardcoded value
+
+var (
+	hooksRunning  = expvar.NewInt("hooks_running")
+	hooksRuns     = expvar.NewMap("hooks_runs")
+	hooksFailures = expvar.NewMap("hooks_failures")
+)
+
+type hookEvent struct {
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newHookEvent(event, username string) hookEvent {
+	return hookEvent{Type: event, Username: username, Time: time.Now()}
+}
+
+// String returns the event as it is passed in WHAWTY_AUTH_EVENTS.
+func (e hookEvent) String() string {
+	if e.Username == "" {
+		return e.Type
+	}
+	return e.Type + ":" + e.Username
+}
+
+// hookPayload is written to the standard input of every hook.
+type hookPayload struct {
+	Store  string      `json:"store"`
+	Events []hookEvent `json:"events"`
+}
+
+// hookStatus holds the result of the last call of a hook together with some counters.
+type hookStatus struct {
+	Name       string    `json:"name"`
+	Runs       uint64    `json:"runs"`
+	Failures   uint64    `json:"failures"`
+	LastRun    time.Time `json:"lastrun"`
+	Duration   float64   `json:"duration"`
+	ExitStatus int       `json:"exitstatus"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+}
+
+// hookOutput collects the output of a hook up to hookOutputLimit bytes.
+type hookOutput struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	if n := hookOutputLimit - o.buf.Len(); n < len(p) {
+		o.truncated = true
+		if n > 0 {
+			o.buf.Write(p[:n])
+		}
+		return len(p), nil
+	}
+	return o.buf.Write(p)
+}
+
+type hookQueue struct {
+	active  bool
+	pending []hookEvent
+}
+
 type HooksCaller struct {
-	Notify    chan bool
-	NewStore  chan string
-	dir       string
-	store     string
-	rateLimit time.Duration
-	pending   uint
+	Notify   chan hookEvent
+	NewStore chan string
+	dir      string
+	config   *hooksConfig
+	queues   map[string]*hookQueue
+	expired  chan string
+	slots    chan struct{}
+	webhooks []*webhookSender
+	mutex    sync.Mutex
+	store    string
+	status   map[string]*hookStatus
 }
 
-func runHook(executeable, store string) {
+func (h *HooksCaller) runHook(name, store string, events []hookEvent) (status hookStatus) {
+	executeable := filepath.Join(h.dir, path.Clean("/"+name))
+	settings := h.config.settings(name)
+
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+	hooksRunning.Add(1)
+	defer hooksRunning.Add(-1)
+
 	wdl.Printf("Hooks: calling '%s'", executeable)
+	status = hookStatus{Name: name, LastRun: time.Now(), ExitStatus: -1}
+	defer func() { status = h.record(status) }()
 
-	cmd := exec.Command(executeable, "update")
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	cmd.Stdin = nil
-	cmd.Env = append(os.Environ(), fmt.Sprintf("WHAWTY_AUTH_STORE=%s", store))
+	payload, err := json.Marshal(hookPayload{Store: store, Events: events})
+	if err != nil {
+		status.Error = fmt.Sprintf("error encoding events: %v", err)
+		wl.Printf("Hooks: '%s': %s", executeable, status.Error)
+		return status
+	}
+	names := make([]string, len(events))
+	for i, event := range events {
+		names[i] = event.String()
+	}
 
-	if err := cmd.Start(); err != nil {
-		wl.Printf("Hooks: error calling '%s': %v", executeable, err)
-		return
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	output := &hookOutput{}
+	cmd := exec.CommandContext(ctx, executeable, "update")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("WHAWTY_AUTH_STORE=%s", store), fmt.Sprintf("WHAWTY_AUTH_EVENTS=%s", strings.Join(names, " ")))
+	cmd.WaitDelay = time.Second // TODO: hardcoded value
+
+	err = cmd.Run()
+	status.Duration = time.Since(status.LastRun).Seconds()
+	if cmd.ProcessState != nil {
+		status.ExitStatus = cmd.ProcessState.ExitCode()
+	}
+	status.Output = output.buf.String()
+	if output.truncated {
+		status.Output += "\n[output truncated]"
 	}
 
-	go func() {
-		exited := make(chan error)
-		go func() {
-			exited <- cmd.Wait()
-		}()
-
-		t := time.NewTimer(time.Minute) // TODO: hardcoded value
-		defer t.Stop()
-
-		for {
-			select {
-			case <-t.C:
-				wl.Printf("Hooks: killing long running hook '%s'", executeable)
-				cmd.Process.Kill() //nolint:errcheck
-			case err := <-exited:
-				if err != nil {
-					wl.Printf("Hooks: '%s': %v", executeable, err)
-				} else {
-					wdl.Printf("Hooks: '%s': %s", executeable, cmd.ProcessState)
-				}
-				return
-			}
+	for _, line := range strings.Split(strings.TrimRight(status.Output, "\n"), "\n") {
+		if line != "" {
+			wl.Printf("Hooks: '%s': %s", executeable, line)
 		}
-	}()
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status.Error = fmt.Sprintf("killed after running for more than %v", settings.Timeout)
+		wl.Printf("Hooks: '%s': %s", executeable, status.Error)
+	case err != nil:
+		status.Error = err.Error()
+		wl.Printf("Hooks: '%s': %s", executeable, status.Error)
+	default:
+		wdl.Printf("Hooks: '%s': %s", executeable, cmd.ProcessState)
+	}
+	return status
+}
+
+// record updates the counters and the status of the hook and returns the updated status.
+func (h *HooksCaller) record(status hookStatus) hookStatus {
+	hooksRuns.Add(status.Name, 1)
+	if status.Error != "" {
+		hooksFailures.Add(status.Name, 1)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if last, exists := h.status[status.Name]; exists {
+		status.Runs = last.Runs
+		status.Failures = last.Failures
+	}
+	status.Runs++
+	if status.Error != "" {
+		status.Failures++
+	}
+	h.status[status.Name] = &status
+	return status
+}
+
+// Status returns the status of all hooks which have been called so far.
+func (h *HooksCaller) Status() []hookStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status := make([]hookStatus, 0, len(h.status))
+	for _, s := range h.status {
+		status = append(status, *s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Test calls all hooks with the event and waits for them to finish. Unlike events sent to Notify
+// this ignores the rate limits.
+func (h *HooksCaller) Test(event hookEvent) ([]hookStatus, error) {
+	if h.dir == "" {
+		return nil, errors.New("no hooks directory is configured")
+	}
+	names, err := h.listHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	store := h.store
+	h.mutex.Unlock()
+
+	status := make([]hookStatus, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			status[i] = h.runHook(name, store, []hookEvent{event})
+		}(i, name)
+	}
+	wg.Wait()
+	return status, nil
 }
 
-func (h *HooksCaller) runAllHooks() {
+// listHooks returns the names of all hooks in the hooks directory.
+func (h *HooksCaller) listHooks() ([]string, error) {
 	dir, err := os.Open(h.dir)
 	if err != nil {
-		wl.Printf("Hooks: error opening hooks directory: %v", err)
-		return
+		return nil, fmt.Errorf("error opening hooks directory: %v", err)
 	}
 	defer dir.Close()
 
 	var dirInfo os.FileInfo
 	if dirInfo, err = dir.Stat(); err != nil {
-		wl.Printf("Hooks: error opening hooks directory: %v", err)
-		return
+		return nil, fmt.Errorf("error opening hooks directory: %v", err)
 	}
 
 	if !dirInfo.IsDir() {
-		wl.Printf("Hooks: '%s' is not a directory", h.dir)
-		return
+		return nil, fmt.Errorf("'%s' is not a directory", h.dir)
 	}
 	if dirInfo.Mode()&02 != 0 {
-		wl.Printf("Hooks: '%s' is world-writable - won't call any hook scripts from here", h.dir)
-		return
+		return nil, fmt.Errorf("'%s' is world-writable - won't call any hook scripts from here", h.dir)
 	}
 
 	var files []os.FileInfo
 	if files, err = dir.Readdir(0); err != nil {
-		wl.Printf("Hooks: error reading hooks directory: %v", err)
+		return nil, fmt.Errorf("error reading hooks directory: %v", err)
 	}
+	var names []string
 	for _, file := range files {
 		if strings.HasPrefix(file.Name(), ".") { // hidden files
 			continue
@@ -130,42 +313,131 @@ func (h *HooksCaller) runAllHooks() {
 			continue
 		}
 
-		runHook(filepath.Join(h.dir, path.Clean("/"+file.Name())), h.store)
+		names = append(names, file.Name())
 	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// start calls the hook in the background. The hook won't be called again until its rate limit
+// has expired, events which arrive in the meantime are queued.
+func (h *HooksCaller) start(name string, events []hookEvent) {
+	h.mutex.Lock()
+	store := h.store
+	h.mutex.Unlock()
+
+	go h.runHook(name, store, events)
+	time.AfterFunc(h.config.settings(name).RateLimit, func() { h.expired <- name })
+}
+
+// StartWebhooks starts delivering events to the configured webhook endpoints. Only the agent does
+// this since the queues must not be shared by several processes.
+func (h *HooksCaller) StartWebhooks() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.webhooks != nil {
+		return nil
+	}
+	webhooks, err := runWebhookSenders(h.config.Webhooks, h.store)
+	if err != nil {
+		return err
+	}
+	h.webhooks = webhooks
+	return nil
+}
+
+// sendWebhooks hands the event over to all webhook endpoints.
+func (h *HooksCaller) sendWebhooks(event hookEvent) {
+	h.mutex.Lock()
+	webhooks := h.webhooks
+	store := h.store
+	h.mutex.Unlock()
+	if len(webhooks) == 0 {
+		return
+	}
+
+	e, err := newWebhookEvent(store, event)
+	if err != nil {
+		wl.Printf("Hooks: error creating webhook event: %v", err)
+		return
+	}
+	for _, w := range webhooks {
+		w.Notify <- e
+	}
+}
+
+// WebhooksStatus returns the delivery state of all webhook endpoints.
+func (h *HooksCaller) WebhooksStatus() []webhookStatus {
+	h.mutex.Lock()
+	webhooks := h.webhooks
+	h.mutex.Unlock()
+
+	status := make([]webhookStatus, 0, len(webhooks))
+	for _, w := range webhooks {
+		status = append(status, w.Status())
+	}
+	return status
 }
 
 func (h *HooksCaller) run() {
-	if h.dir == "" { // just consume requests and do nothing
-		for {
-			select {
-			case <-h.Notify:
-			case <-h.NewStore:
+	notify := func(event hookEvent) {
+		h.sendWebhooks(event)
+		if h.dir == "" {
+			return
+		}
+		names, err := h.listHooks()
+		if err != nil {
+			wl.Printf("Hooks: %v", err)
+			return
+		}
+		for _, name := range names {
+			q, exists := h.queues[name]
+			if !exists {
+				q = &hookQueue{}
+				h.queues[name] = q
+			}
+			if q.active {
+				q.pending = coalesceHookEvents(q.pending, event)
+				continue
 			}
+			h.start(name, []hookEvent{event})
+			q.active = true
 		}
 	}
-
-	t := time.NewTimer(h.rateLimit)
-	t.Stop()
 	for {
 		select {
-		case <-t.C:
-			if h.pending > 1 {
-				h.runAllHooks()
+		case name := <-h.expired:
+			q := h.queues[name]
+			if len(q.pending) == 0 {
+				delete(h.queues, name)
+				continue
 			}
-			h.pending = 0
-		case <-h.Notify:
-			if h.pending == 0 {
-				h.runAllHooks()
-				t.Reset(h.rateLimit)
-			}
-			h.pending++
+			h.start(name, q.pending)
+			q.pending = nil
+		case event := <-h.Notify:
+			notify(event)
 		case s := <-h.NewStore:
+			h.mutex.Lock()
 			h.store = s
+			h.mutex.Unlock()
+			notify(newHookEvent(hookEventReload, ""))
+		}
+	}
+}
+
+// coalesceHookEvents adds event to events unless an event of the same type for the same user is
+// already pending, in this case only its time gets updated.
+func coalesceHookEvents(events []hookEvent, event hookEvent) []hookEvent {
+	for i := range events {
+		if events[i].Type == event.Type && events[i].Username == event.Username {
+			events[i].Time = event.Time
+			return events
 		}
 	}
+	return append(events, event)
 }
 
-func NewHooksCaller(hooksDir, storeDir string) (h *HooksCaller, err error) {
+func NewHooksCaller(hooksDir, storeDir string, config *hooksConfig) (h *HooksCaller, err error) {
 	if hooksDir != "" {
 		var d os.FileInfo
 		if d, err = os.Stat(hooksDir); err != nil {
@@ -177,12 +449,15 @@ func NewHooksCaller(hooksDir, storeDir string) (h *HooksCaller, err error) {
 	}
 
 	h = &HooksCaller{}
-	h.Notify = make(chan bool, 32)
+	h.Notify = make(chan hookEvent, 32)
 	h.NewStore = make(chan string, 1)
 	h.dir = hooksDir
+	h.config = config
+	h.queues = make(map[string]*hookQueue)
+	h.expired = make(chan string)
+	h.slots = make(chan struct{}, config.Concurrency)
 	h.store = storeDir
-	h.rateLimit = 5 * time.Second // TODO: hardcoded value
-	h.pending = 0
+	h.status = make(map[string]*hookStatus)
 	go h.run()
 	return
 }
@@ -0,0 +1,241 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHooksCaller creates a hooks directory containing the shell scripts and a caller using it.
+func newTestHooksCaller(t *testing.T, scripts map[string]string, config hooksConfig) *HooksCaller {
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if config.RateLimit == 0 {
+		config.RateLimit = time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = 4
+	}
+	h, err := NewHooksCaller(dir, "/path/to/store", &config)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return h
+}
+
+// waitForLines waits until the file contains at least n lines and returns them.
+func waitForLines(t *testing.T, filename string, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(filename)
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(data) > 0 && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("'%s' contains %d lines, expected %d", filename, len(lines), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCoalesceHookEvents(t *testing.T) {
+	t0 := time.Now()
+	t1 := t0.Add(time.Second)
+
+	var events []hookEvent
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventUpdate, Username: "alice", Time: t0})
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventUpdate, Username: "bob", Time: t0})
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventRemove, Username: "alice", Time: t0})
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventReload, Time: t0})
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventUpdate, Username: "alice", Time: t1})
+	events = coalesceHookEvents(events, hookEvent{Type: hookEventReload, Time: t1})
+
+	expected := []hookEvent{
+		{Type: hookEventUpdate, Username: "alice", Time: t1},
+		{Type: hookEventUpdate, Username: "bob", Time: t0},
+		{Type: hookEventRemove, Username: "alice", Time: t0},
+		{Type: hookEventReload, Time: t1},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("event %d: expected %v, got %v", i, expected[i], events[i])
+		}
+	}
+}
+
+func TestHookEventString(t *testing.T) {
+	if s := newHookEvent(hookEventUpdate, "alice").String(); s != "update:alice" {
+		t.Fatalf("unexpected event string '%s'", s)
+	}
+	if s := newHookEvent(hookEventReload, "").String(); s != "reload" {
+		t.Fatalf("unexpected event string '%s'", s)
+	}
+}
+
+func TestHooksPayload(t *testing.T) {
+	out := t.TempDir()
+	h := newTestHooksCaller(t, map[string]string{
+		"record": `echo "$1 $WHAWTY_AUTH_STORE $WHAWTY_AUTH_EVENTS" >> "` + out + `/calls"` + "\n" +
+			`cat >> "` + out + `/payloads"; echo >> "` + out + `/payloads"` + "\n",
+	}, hooksConfig{hookSettings: hookSettings{RateLimit: 200 * time.Millisecond}})
+
+	h.Notify <- newHookEvent(hookEventAdd, "alice")
+	h.Notify <- newHookEvent(hookEventUpdate, "bob")
+	h.Notify <- newHookEvent(hookEventSetAdmin, "alice")
+	h.Notify <- newHookEvent(hookEventUpdate, "bob")
+
+	calls := waitForLines(t, filepath.Join(out, "calls"), 2)
+	expected := []string{
+		"update /path/to/store add:alice",
+		"update /path/to/store update:bob set-admin:alice",
+	}
+	if len(calls) != len(expected) || calls[0] != expected[0] || calls[1] != expected[1] {
+		t.Fatalf("events arriving within the rate limit should be coalesced into one call, got: %q", calls)
+	}
+
+	payloads := waitForLines(t, filepath.Join(out, "payloads"), 2)
+	var payload hookPayload
+	if err := json.Unmarshal([]byte(payloads[1]), &payload); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if payload.Store != "/path/to/store" || len(payload.Events) != 2 {
+		t.Fatalf("unexpected payload: %s", payloads[1])
+	}
+	if payload.Events[0].Type != hookEventUpdate || payload.Events[0].Username != "bob" || payload.Events[0].Time.IsZero() {
+		t.Fatalf("unexpected event in payload: %+v", payload.Events[0])
+	}
+}
+
+func TestHookOutput(t *testing.T) {
+	output := &hookOutput{}
+	chunk := strings.Repeat("x", hookOutputLimit/2+1)
+	for i := 0; i < 3; i++ {
+		if n, err := output.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("the output should be consumed completely, got %d, %v", n, err)
+		}
+	}
+	if output.buf.Len() != hookOutputLimit || !output.truncated {
+		t.Fatalf("the output should be truncated to %d bytes, got %d", hookOutputLimit, output.buf.Len())
+	}
+
+	output = &hookOutput{}
+	output.Write([]byte("hello"))
+	if output.buf.String() != "hello" || output.truncated {
+		t.Fatal("short output should be kept completely")
+	}
+}
+
+func TestHooksRun(t *testing.T) {
+	h := newTestHooksCaller(t, map[string]string{
+		"chatty":  "head -c 20000 /dev/zero | tr '\\0' x\n",
+		"failing": "echo something went wrong >&2\nexit 3\n",
+		"slow":    "sleep 10\n",
+	}, hooksConfig{Hooks: map[string]hookSettings{"slow": {Timeout: 100 * time.Millisecond}}})
+
+	status := h.runHook("chatty", h.store, []hookEvent{newHookEvent(hookEventTest, "")})
+	if status.Error != "" || status.ExitStatus != 0 || !strings.HasSuffix(status.Output, "\n[output truncated]") {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if len(status.Output) != hookOutputLimit+len("\n[output truncated]") {
+		t.Fatalf("the output should be truncated to %d bytes, got %d", hookOutputLimit, len(status.Output))
+	}
+
+	status = h.runHook("failing", h.store, []hookEvent{newHookEvent(hookEventTest, "")})
+	if status.Error == "" || status.ExitStatus != 3 || status.Output != "something went wrong\n" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	start := time.Now()
+	status = h.runHook("slow", h.store, []hookEvent{newHookEvent(hookEventTest, "")})
+	if !strings.HasPrefix(status.Error, "killed after running for more than") || status.ExitStatus != -1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("the hook should have been killed after its timeout, it took %v", d)
+	}
+}
+
+func TestHooksTest(t *testing.T) {
+	out := t.TempDir()
+	h := newTestHooksCaller(t, map[string]string{
+		"a-ok":      `echo "$WHAWTY_AUTH_EVENTS" > "` + out + `/events"` + "\n" + "echo done\n",
+		"b-failing": "exit 1\n",
+		".hidden":   "exit 0\n",
+	}, hooksConfig{})
+	if err := os.WriteFile(filepath.Join(h.dir, "not-executable"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		status, err := h.Test(newHookEvent(hookEventTest, "alice"))
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(status) != 2 || status[0].Name != "a-ok" || status[1].Name != "b-failing" {
+			t.Fatalf("only executable, non-hidden hooks should be called: %+v", status)
+		}
+		if status[0].Error != "" || status[0].Output != "done\n" || status[0].Runs != uint64(i) || status[0].Failures != 0 {
+			t.Fatalf("unexpected status: %+v", status[0])
+		}
+		if status[1].Error == "" || status[1].ExitStatus != 1 || status[1].Runs != uint64(i) || status[1].Failures != uint64(i) {
+			t.Fatalf("unexpected status: %+v", status[1])
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "events")); err != nil || string(data) != "test:alice\n" {
+		t.Fatalf("the hook should be called synchronously with the test event, got %q, %v", data, err)
+	}
+
+	status := h.Status()
+	if len(status) != 2 || status[0].Name != "a-ok" || status[0].Runs != 2 || status[1].Failures != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	h.dir = ""
+	if _, err := h.Test(newHookEvent(hookEventTest, "")); err == nil {
+		t.Fatal("testing hooks without a hooks directory should fail")
+	}
+}
@@ -31,28 +31,434 @@
 package main
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/glauth/ldap"
+	storeLib "github.com/whawty/auth/store"
 )
 
 type ldapHandler struct {
-	store *Store
+	store     *Store
+	config    *ldapDirectoryConfig
+	baseDN    ldapDN
+	groupsDN  ldapDN
+	serviceDN ldapDN
+	patterns  []ldapBindPattern
+	binds     *ldapBinds
+}
+
+// ldapBinds remembers for every connection whether the current bind used an app password.
+// Connections are identified by their remote address which doesn't change when a connection
+// gets upgraded using StartTLS.
+type ldapBinds struct {
+	mutex       sync.Mutex
+	appPassword map[string]bool
+}
+
+func newLDAPBinds() *ldapBinds {
+	return &ldapBinds{appPassword: make(map[string]bool)}
+}
+
+func (b *ldapBinds) set(conn net.Conn, appPassword bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if appPassword {
+		b.appPassword[conn.RemoteAddr().String()] = true
+	} else {
+		delete(b.appPassword, conn.RemoteAddr().String())
+	}
+}
+
+func (b *ldapBinds) usedAppPassword(conn net.Conn) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.appPassword[conn.RemoteAddr().String()]
+}
+
+func (b *ldapBinds) Close(boundDN string, conn net.Conn) error {
+	b.set(conn, false)
+	return nil
+}
+
+// newLDAPHandler creates the handler for the default store or, if tenant is true, for the store
+// of a tenant. Tenants are addressed by their base-dn, so they need one and all names they accept
+// for binds must be located below it.
+func newLDAPHandler(store *Store, config *ldapDirectoryConfig, tenant bool) (h ldapHandler, err error) {
+	service := config.Service
+	if service == "" {
+		service = "ldap"
+	}
+	h.store = store.WithService(service, "")
+	h.config = config
+	if h.baseDN, err = parseDN(config.BaseDN); err != nil {
+		return h, fmt.Errorf("ldap: base-dn: %v", err)
+	}
+	if h.groupsDN, err = parseDN(config.GroupsDN); err != nil {
+		return h, fmt.Errorf("ldap: groups-dn: %v", err)
+	}
+	if tenant && len(h.baseDN) == 0 {
+		return h, errors.New("ldap: tenants need a base-dn")
+	}
+	if config.Search != nil {
+		if len(h.baseDN) == 0 {
+			return h, errors.New("ldap: search needs a base-dn to be configured")
+		}
+		if config.Search.ServiceDN != "" {
+			if h.serviceDN, err = parseDN(config.Search.ServiceDN); err != nil {
+				return h, fmt.Errorf("ldap: service-dn: %v", err)
+			}
+			if config.Search.ServicePassword == "" {
+				return h, errors.New("ldap: the service account needs a password")
+			}
+			if tenant && !h.serviceDN.IsDescendantOf(h.baseDN) {
+				return h, fmt.Errorf("ldap: service-dn '%s' is outside of base-dn '%s'", h.serviceDN, h.baseDN)
+			}
+		}
+	}
+
+	patterns := config.BindPatterns
+	if len(patterns) == 0 {
+		if !tenant {
+			patterns = []string{"%s@*", "%s"}
+		}
+		if len(h.baseDN) > 0 {
+			patterns = append(patterns, "uid=%s,"+h.baseDN.String())
+		}
+	}
+	for _, pattern := range patterns {
+		p, err := newLDAPBindPattern(pattern)
+		if err != nil {
+			return h, err
+		}
+		if p.isDN() && len(h.baseDN) > 0 && !p.parent.Equal(h.baseDN) && !p.parent.IsDescendantOf(h.baseDN) {
+			return h, fmt.Errorf("ldap: bind pattern '%s' is outside of base-dn '%s'", pattern, h.baseDN)
+		}
+		if tenant && !p.isDN() {
+			return h, fmt.Errorf("ldap: bind pattern '%s' is not a DN, which is not supported for tenants", pattern)
+		}
+		h.patterns = append(h.patterns, p)
+	}
+	return h, nil
+}
+
+func (h ldapHandler) userDN(username string) ldapDN {
+	return append(ldapDN{{{Type: "uid", Value: username}}}, h.baseDN...)
+}
+
+// bindUsername returns the username for bindDN using the first matching bind pattern. If bindDN
+// is a distinguished name only patterns which are DNs themselves are considered.
+func (h ldapHandler) bindUsername(bindDN string) (string, bool) {
+	if !strings.Contains(bindDN, "=") {
+		for _, p := range h.patterns {
+			if username, ok := p.matchName(bindDN); ok {
+				return username, true
+			}
+		}
+		return "", false
+	}
+
+	dn, err := parseDN(bindDN)
+	if err != nil {
+		wdl.Printf("ldap: ignoring bind with invalid DN '%s': %v", bindDN, err)
+		return "", false
+	}
+	for _, p := range h.patterns {
+		if username, ok := p.matchDN(dn); ok {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+func (h ldapHandler) isServiceAccount(bindDN string) bool {
+	if len(h.serviceDN) == 0 || !strings.Contains(bindDN, "=") {
+		return false
+	}
+	dn, err := parseDN(bindDN)
+	return err == nil && dn.Equal(h.serviceDN)
 }
 
 func (h ldapHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
-	username, _, _ := strings.Cut(bindDN, "@")
-	if ok, _, _, _ := h.store.Authenticate(username, bindSimplePw); !ok {
+	if bindSimplePw == "" {
+		if bindDN != "" {
+			// unauthenticated binds, see RFC 4513 section 5.1.2
+			wdl.Printf("ldap: refusing unauthenticated bind for '%s'", bindDN)
+			return ldap.LDAPResultUnwillingToPerform, nil
+		}
+		if !h.config.Anonymous {
+			wdl.Printf("ldap: refusing anonymous bind")
+			return ldap.LDAPResultInappropriateAuthentication, nil
+		}
+		h.binds.set(conn, false)
+		return ldap.LDAPResultSuccess, nil
+	}
+
+	if h.isServiceAccount(bindDN) {
+		if subtle.ConstantTimeCompare([]byte(bindSimplePw), []byte(h.config.Search.ServicePassword)) != 1 {
+			wdl.Printf("ldap: bind failed for service account '%s'", bindDN)
+			return ldap.LDAPResultInvalidCredentials, nil
+		}
+		h.binds.set(conn, false)
+		return ldap.LDAPResultSuccess, nil
+	}
+
+	username, ok := h.bindUsername(bindDN)
+	if !ok {
+		wdl.Printf("ldap: bind DN '%s' does not match any bind pattern", bindDN)
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
+	ok, _, _, appPassword, err := h.store.WithSource(auditSource(conn.RemoteAddr())).AuthenticateWithAppPasswords(username, bindSimplePw)
+	if !ok {
+		if err == errAccessDenied {
+			return ldap.LDAPResultInsufficientAccessRights, nil
+		}
+		if err != nil {
+			wdl.Printf("ldap: bind failed for '%s': %v", username, err)
+		}
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+	h.binds.set(conn, appPassword != "")
 	return ldap.LDAPResultSuccess, nil
 }
 
-func runLDAPsListener(listener *net.TCPListener, config *ldapsConfig, store *Store) error {
+// maySearch checks whether boundDN is allowed to search the directory. Anonymous searches
+// are never allowed.
+func (h ldapHandler) maySearch(boundDN string) bool {
+	if h.config.Search == nil || boundDN == "" {
+		return false
+	}
+	return h.config.Search.Users || h.isServiceAccount(boundDN)
+}
+
+func (h ldapHandler) groupDN(group string) ldapDN {
+	return append(ldapDN{{{Type: "cn", Value: group}}}, h.groupsDN...)
+}
+
+func (h ldapHandler) userEntry(username string, groups []string) (*ldap.Entry, error) {
+	entry := &ldap.Entry{DN: h.userDN(username).String()}
+	entry.Attributes = []*ldap.EntryAttribute{
+		{Name: "objectClass", Values: []string{"top", "person", "inetOrgPerson"}},
+		{Name: "uid", Values: []string{username}},
+		{Name: "cn", Values: []string{username}},
+	}
+	if len(h.groupsDN) > 0 && len(groups) > 0 {
+		memberOf := &ldap.EntryAttribute{Name: "memberOf"}
+		for _, group := range groups {
+			memberOf.Values = append(memberOf.Values, h.groupDN(group).String())
+		}
+		entry.Attributes = append(entry.Attributes, memberOf)
+	}
+	if len(h.config.Attributes) == 0 {
+		return entry, nil
+	}
+
+	aux, err := h.store.GetAuxData(username)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(h.config.Attributes))
+	for name := range h.config.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value, exists := aux[h.config.Attributes[name]]; exists {
+			entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: name, Values: []string{string(value)}})
+		}
+	}
+	return entry, nil
+}
+
+func (h ldapHandler) groupEntry(group string, members []string) *ldap.Entry {
+	return &ldap.Entry{
+		DN: h.groupDN(group).String(),
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "objectClass", Values: []string{"top", "groupOfNames"}},
+			{Name: "cn", Values: []string{group}},
+			{Name: "member", Values: members},
+		},
+	}
+}
+
+// entries returns the directory entries of all users with supported hashes as well as an
+// entry for every group these users are members of. Admins are members of the group 'admins'.
+func (h ldapHandler) entries() ([]*ldap.Entry, error) {
+	list, err := h.store.ListFull()
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(list))
+	for username, user := range list {
+		if user.IsValid && user.IsSupported {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+
+	var entries []*ldap.Entry
+	members := make(map[string][]string)
+	for _, username := range usernames {
+		groups := list[username].Groups
+		if list[username].IsAdmin {
+			groups = append(groups, storeLib.AdminGroup)
+			sort.Strings(groups)
+		}
+		entry, err := h.userEntry(username, groups)
+		if err != nil {
+			wl.Printf("ldap: failed to fetch aux data of '%s': %v", username, err)
+			continue
+		}
+		entries = append(entries, entry)
+		for _, group := range groups {
+			members[group] = append(members[group], entry.DN)
+		}
+	}
+	if len(h.groupsDN) == 0 {
+		return entries, nil
+	}
+
+	groups := make([]string, 0, len(members))
+	for group := range members {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		entries = append(entries, h.groupEntry(group, members[group]))
+	}
+	return entries, nil
+}
+
+// Search returns all user and group entries below the search base. Filters, the search scope and the
+// selection of attributes are applied by the ldap server.
+func (h ldapHandler) Search(boundDN string, req ldap.SearchRequest, conn net.Conn) (result ldap.ServerSearchResult, err error) {
+	if !h.maySearch(boundDN) {
+		wdl.Printf("ldap: search by '%s' denied", boundDN)
+		result.ResultCode = ldap.LDAPResultInsufficientAccessRights
+		return result, errors.New("search is not allowed")
+	}
+
+	base, err := parseDN(req.BaseDN)
+	if err != nil {
+		result.ResultCode = ldap.LDAPResultInvalidDNSyntax
+		return result, err
+	}
+	entries, err := h.entries()
+	if err != nil {
+		result.ResultCode = ldap.LDAPResultOperationsError
+		return result, err
+	}
+	for _, entry := range entries {
+		// the DNs of the entries have been generated by us, parsing them can't fail
+		if dn, _ := parseDN(entry.DN); dn.Equal(base) || dn.IsDescendantOf(base) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	result.ResultCode = ldap.LDAPResultSuccess
+	return result, nil
+}
+
+// ldapRouter dispatches the requests to the handler of the default store or of a tenant. The
+// ldap server only knows how to route requests by comparing strings, which fails for DNs that
+// differ in case or spacing, so all requests are passed to the router which parses the DNs.
+type ldapRouter struct {
+	fallback *ldapHandler
+	tenants  []*ldapHandler
+}
+
+// route returns the handler responsible for dn. This is the tenant with the longest base-dn
+// that dn is equal to or located below. Names which aren't DNs, invalid DNs and DNs outside
+// of the base-dn of all tenants are handled by the default store.
+func (r ldapRouter) route(dn string) *ldapHandler {
+	if !strings.Contains(dn, "=") {
+		return r.fallback
+	}
+	parsed, err := parseDN(dn)
+	if err != nil {
+		return r.fallback
+	}
+	h := r.fallback
+	for _, th := range r.tenants {
+		if (parsed.Equal(th.baseDN) || parsed.IsDescendantOf(th.baseDN)) && (h == r.fallback || len(th.baseDN) > len(h.baseDN)) {
+			h = th
+		}
+	}
+	return h
+}
+
+func (r ldapRouter) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.route(bindDN).Bind(bindDN, bindSimplePw, conn)
+}
+
+// Search is routed by the search base. Users bound to the directory of another tenant may not
+// search it.
+func (r ldapRouter) Search(boundDN string, req ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	h := r.route(req.BaseDN)
+	if boundDN != "" && r.route(boundDN) != h {
+		wdl.Printf("ldap: search by '%s' below '%s' denied, it belongs to another directory", boundDN, req.BaseDN)
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, errors.New("search is not allowed")
+	}
+	return h.Search(boundDN, req, conn)
+}
+
+// Modify is routed by the DN of the entry to modify. Users bound to the directory of another
+// tenant may not modify it.
+func (r ldapRouter) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	h := r.route(req.Dn)
+	if boundDN != "" && r.route(boundDN) != h {
+		wdl.Printf("ldap: modify of '%s' by '%s' denied, it belongs to another directory", req.Dn, boundDN)
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	return h.Modify(boundDN, req, conn)
+}
+
+// newLDAPServer creates an ldap server for the default store and all tenants which have an ldap
+// configuration.
+func newLDAPServer(store *Store, config *ldapDirectoryConfig) (*ldap.Server, error) {
+	binds := newLDAPBinds()
+	h, err := newLDAPHandler(store, config, false)
+	if err != nil {
+		return nil, err
+	}
+	h.binds = binds
+	router := ldapRouter{fallback: &h}
+	for _, t := range store.Tenants() {
+		if t.config.LDAP == nil {
+			continue
+		}
+		th, err := newLDAPHandler(store.ForTenant(t), t.config.LDAP, true)
+		if err != nil {
+			return nil, fmt.Errorf("tenant '%s': %v", t.name, err)
+		}
+		for _, other := range router.tenants {
+			if other.baseDN.Equal(th.baseDN) {
+				return nil, fmt.Errorf("tenant '%s': base-dn '%s' is already in use", t.name, th.baseDN)
+			}
+		}
+		th.binds = binds
+		router.tenants = append(router.tenants, &th)
+	}
+
 	server := ldap.NewServer()
-	server.BindFunc("", ldapHandler{store: store})
+	server.EnforceLDAP = true
+	server.BindFunc("", router)
+	server.SearchFunc("", router)
+	server.ModifyFunc("", router)
+	server.CloseFunc("", binds)
+	return server, nil
+}
+
+func runLDAPsListener(listener *net.TCPListener, config *ldapsConfig, store *Store) error {
+	server, err := newLDAPServer(store.WithAppPasswords(true, "ldaps").WithListener("ldaps:"+listener.Addr().String()), &config.Directory)
+	if err != nil {
+		return err
+	}
 
 	tlsConfig, err := config.TLS.ToGoTLSConfig()
 	if err != nil {
@@ -74,8 +480,10 @@ func runLDAPsAddr(addr string, config *ldapsConfig, store *Store) error {
 }
 
 func runLDAPListener(listener *net.TCPListener, config *ldapConfig, store *Store) (err error) {
-	server := ldap.NewServer()
-	server.BindFunc("", ldapHandler{store: store})
+	server, err := newLDAPServer(store.WithAppPasswords(true, "ldap").WithListener("ldap:"+listener.Addr().String()), &config.Directory)
+	if err != nil {
+		return err
+	}
 	if config.TLS != nil {
 		if server.TLSConfig, err = config.TLS.ToGoTLSConfig(); err != nil {
 			return err
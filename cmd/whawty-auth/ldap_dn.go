@@ -0,0 +1,333 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type ldapAttributeValue struct {
+	Type  string
+	Value string
+}
+
+func (av ldapAttributeValue) equal(other ldapAttributeValue) bool {
+	return strings.EqualFold(av.Type, other.Type) && strings.EqualFold(av.Value, other.Value)
+}
+
+func (av ldapAttributeValue) String() string {
+	return av.Type + "=" + escapeDNValue(av.Value)
+}
+
+// ldapRDN is a relative distinguished name. Multi-valued RDNs have more than one element.
+type ldapRDN []ldapAttributeValue
+
+func (rdn ldapRDN) sorted() ldapRDN {
+	s := append(ldapRDN{}, rdn...)
+	sort.Slice(s, func(i, j int) bool {
+		if ti, tj := strings.ToLower(s[i].Type), strings.ToLower(s[j].Type); ti != tj {
+			return ti < tj
+		}
+		return strings.ToLower(s[i].Value) < strings.ToLower(s[j].Value)
+	})
+	return s
+}
+
+func (rdn ldapRDN) equal(other ldapRDN) bool {
+	if len(rdn) != len(other) {
+		return false
+	}
+	a, b := rdn.sorted(), other.sorted()
+	for i := range a {
+		if !a[i].equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rdn ldapRDN) String() string {
+	avs := make([]string, len(rdn))
+	for i, av := range rdn {
+		avs[i] = av.String()
+	}
+	return strings.Join(avs, "+")
+}
+
+// ldapDN is a distinguished name as described in RFC 4514. The first element is the
+// most specific RDN. The root DN is an empty list.
+type ldapDN []ldapRDN
+
+// Equal compares two DNs. Attribute types and values are compared case-insensitively.
+func (dn ldapDN) Equal(other ldapDN) bool {
+	if len(dn) != len(other) {
+		return false
+	}
+	for i := range dn {
+		if !dn[i].equal(other[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDescendantOf checks whether dn is located anywhere below base.
+func (dn ldapDN) IsDescendantOf(base ldapDN) bool {
+	if len(dn) <= len(base) {
+		return false
+	}
+	return dn[len(dn)-len(base):].Equal(base)
+}
+
+// Parent returns the DN without the first RDN.
+func (dn ldapDN) Parent() ldapDN {
+	if len(dn) == 0 {
+		return nil
+	}
+	return dn[1:]
+}
+
+func (dn ldapDN) String() string {
+	rdns := make([]string, len(dn))
+	for i, rdn := range dn {
+		rdns[i] = rdn.String()
+	}
+	return strings.Join(rdns, ",")
+}
+
+// escapeDNValue escapes value so that it may be used as attribute value in a DN.
+func escapeDNValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`"+,;<>\`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isValidAttributeType(t string) bool {
+	if t == "" {
+		return false
+	}
+	if t[0] >= '0' && t[0] <= '9' { // numericoid
+		for _, part := range strings.Split(t, ".") {
+			if part == "" || strings.Trim(part, "0123456789") != "" || (len(part) > 1 && part[0] == '0') {
+				return false
+			}
+		}
+		return true
+	}
+	for i, c := range t { // keystring
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseDNValue parses an attribute value up to the next unescaped ',' or '+'. It returns the
+// unescaped value and the remainder of str starting with the separator.
+func parseDNValue(str string) (string, string, error) {
+	str = strings.TrimLeft(str, " ")
+	if strings.HasPrefix(str, "#") {
+		return "", "", errors.New("hex encoded attribute values are not supported")
+	}
+
+	var value []byte
+	trimmed := 0 // length of the value without unescaped trailing spaces
+	i := 0
+loop:
+	for ; i < len(str); i++ {
+		c := str[i]
+		switch c {
+		case ',', '+':
+			break loop
+		case '"', ';', '<', '>':
+			return "", "", fmt.Errorf("character '%c' must be escaped", c)
+		case '\\':
+			i++
+			if i >= len(str) {
+				return "", "", errors.New("DN ends with an incomplete escape sequence")
+			}
+			if strings.IndexByte(` "#+,;<=>\`, str[i]) >= 0 {
+				value = append(value, str[i])
+			} else {
+				if i+1 >= len(str) {
+					return "", "", errors.New("DN ends with an incomplete escape sequence")
+				}
+				b, err := hex.DecodeString(str[i : i+2])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid escape sequence '\\%s'", str[i:i+2])
+				}
+				value = append(value, b[0])
+				i++
+			}
+			trimmed = len(value)
+		default:
+			value = append(value, c)
+			if c != ' ' {
+				trimmed = len(value)
+			}
+		}
+	}
+	value = value[:trimmed]
+	if !utf8.Valid(value) {
+		return "", "", errors.New("attribute value is not valid UTF-8")
+	}
+	return string(value), str[i:], nil
+}
+
+// parseDN parses the string representation of a distinguished name according to RFC 4514.
+func parseDN(str string) (dn ldapDN, err error) {
+	if strings.TrimSpace(str) == "" {
+		return ldapDN{}, nil
+	}
+
+	rdn := ldapRDN{}
+	for {
+		t, rest, found := strings.Cut(str, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid DN: '%s' is missing an attribute value", str)
+		}
+		av := ldapAttributeValue{Type: strings.TrimSpace(t)}
+		if !isValidAttributeType(av.Type) {
+			return nil, fmt.Errorf("invalid DN: '%s' is not a valid attribute type", av.Type)
+		}
+		if av.Value, str, err = parseDNValue(rest); err != nil {
+			return nil, fmt.Errorf("invalid DN: %v", err)
+		}
+		rdn = append(rdn, av)
+
+		if str == "" {
+			return append(dn, rdn), nil
+		}
+		if str[0] == ',' {
+			dn = append(dn, rdn)
+			rdn = ldapRDN{}
+		}
+		str = str[1:]
+	}
+}
+
+// ldapBindPattern describes which names are accepted for simple binds. A pattern containing
+// a '=' is a DN whose first RDN has the value '%s', for example 'uid=%s,ou=users,dc=example,dc=org'.
+// All other patterns are matched as strings where '%s' stands for the username and a trailing
+// '*' matches anything, e.g. '%s@example.org', '%s@*' or just '%s'.
+type ldapBindPattern struct {
+	rdnType   string
+	parent    ldapDN
+	prefix    string
+	suffix    string
+	anySuffix bool
+}
+
+func newLDAPBindPattern(pattern string) (p ldapBindPattern, err error) {
+	if strings.Count(pattern, "%s") != 1 {
+		return p, fmt.Errorf("ldap: bind pattern '%s' must contain '%%s' exactly once", pattern)
+	}
+	if !strings.Contains(pattern, "=") {
+		p.prefix, p.suffix, _ = strings.Cut(pattern, "%s")
+		p.suffix, p.anySuffix = strings.CutSuffix(p.suffix, "*")
+		if p.anySuffix && p.suffix == "" {
+			return p, fmt.Errorf("ldap: bind pattern '%s' needs a separator between '%%s' and '*'", pattern)
+		}
+		if strings.Contains(p.prefix+p.suffix, "*") {
+			return p, fmt.Errorf("ldap: bind pattern '%s' may only contain '*' at the end", pattern)
+		}
+		return p, nil
+	}
+
+	dn, err := parseDN(pattern)
+	if err != nil {
+		return p, fmt.Errorf("ldap: bind pattern '%s': %v", pattern, err)
+	}
+	if len(dn[0]) != 1 || dn[0][0].Value != "%s" {
+		return p, fmt.Errorf("ldap: the first RDN of bind pattern '%s' must be '<attribute>=%%s'", pattern)
+	}
+	p.rdnType = dn[0][0].Type
+	p.parent = dn.Parent()
+	return p, nil
+}
+
+func (p ldapBindPattern) isDN() bool {
+	return p.rdnType != ""
+}
+
+// matchDN returns the username if dn matches the pattern.
+func (p ldapBindPattern) matchDN(dn ldapDN) (string, bool) {
+	if !p.isDN() || len(dn) == 0 || len(dn[0]) != 1 {
+		return "", false
+	}
+	if !strings.EqualFold(dn[0][0].Type, p.rdnType) || !dn.Parent().Equal(p.parent) {
+		return "", false
+	}
+	return dn[0][0].Value, dn[0][0].Value != ""
+}
+
+// matchName returns the username if name matches the pattern.
+func (p ldapBindPattern) matchName(name string) (string, bool) {
+	if p.isDN() || len(name) < len(p.prefix) || !strings.EqualFold(name[:len(p.prefix)], p.prefix) {
+		return "", false
+	}
+	name = name[len(p.prefix):]
+
+	var username string
+	if p.anySuffix {
+		idx := strings.Index(strings.ToLower(name), strings.ToLower(p.suffix))
+		if idx < 0 || p.suffix == "" {
+			return "", false
+		}
+		username = name[:idx]
+	} else {
+		if len(name) < len(p.suffix) || !strings.EqualFold(name[len(name)-len(p.suffix):], p.suffix) {
+			return "", false
+		}
+		username = name[:len(name)-len(p.suffix)]
+	}
+	return username, username != ""
+}
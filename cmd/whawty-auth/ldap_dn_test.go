@@ -0,0 +1,263 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	dns := []struct {
+		str string
+		dn  ldapDN
+	}{
+		{"", ldapDN{}},
+		{"  ", ldapDN{}},
+		{"dc=org", ldapDN{{{"dc", "org"}}}},
+		{"uid=alice,ou=users,dc=example,dc=org", ldapDN{{{"uid", "alice"}}, {{"ou", "users"}}, {{"dc", "example"}}, {{"dc", "org"}}}},
+		// whitespace around types and values is ignored
+		{" uid = alice , dc = org ", ldapDN{{{"uid", "alice"}}, {{"dc", "org"}}}},
+		{"cn=Alice Smith,dc=org", ldapDN{{{"cn", "Alice Smith"}}, {{"dc", "org"}}}},
+		// multi-valued RDNs
+		{"cn=alice+uid=1000,dc=org", ldapDN{{{"cn", "alice"}, {"uid", "1000"}}, {{"dc", "org"}}}},
+		{"cn=alice + uid=1000", ldapDN{{{"cn", "alice"}, {"uid", "1000"}}}},
+		// escaped special characters
+		{`cn=Smith\, Alice,dc=org`, ldapDN{{{"cn", "Smith, Alice"}}, {{"dc", "org"}}}},
+		{`cn=a\+b\;c\<d\>e\"f\\g\=h`, ldapDN{{{"cn", `a+b;c<d>e"f\g=h`}}}},
+		{`cn=\#hash`, ldapDN{{{"cn", "#hash"}}}},
+		{`cn=\ space\ `, ldapDN{{{"cn", " space "}}}},
+		// hex pairs
+		{`cn=a\2Cb`, ldapDN{{{"cn", "a,b"}}}},
+		{`cn=a\2cb`, ldapDN{{{"cn", "a,b"}}}},
+		{`cn=J\C3\BCrgen`, ldapDN{{{"cn", "Jürgen"}}}},
+		{`cn=\00`, ldapDN{{{"cn", "\x00"}}}},
+		// attribute types
+		{"CN=alice", ldapDN{{{"CN", "alice"}}}},
+		{"2.5.4.3=alice", ldapDN{{{"2.5.4.3", "alice"}}}},
+		{"x-attr1=alice", ldapDN{{{"x-attr1", "alice"}}}},
+		{"cn=", ldapDN{{{"cn", ""}}}},
+	}
+	for _, d := range dns {
+		dn, err := parseDN(d.str)
+		if err != nil {
+			t.Fatalf("parsing '%s' returned an unexpected error: %v", d.str, err)
+		}
+		if !reflect.DeepEqual(dn, d.dn) {
+			t.Fatalf("parsing '%s' returned %#v instead of %#v", d.str, dn, d.dn)
+		}
+	}
+}
+
+func TestParseDNInvalid(t *testing.T) {
+	dns := []string{
+		"alice",
+		"=alice",
+		"cn",
+		"cn=alice,",
+		"cn=alice,,dc=org",
+		"cn=alice+",
+		"cn=alice,dc",
+		"1cn=alice",
+		"-cn=alice",
+		"c_n=alice",
+		"01.2=alice",
+		"1..2=alice",
+		"cn=#04024869",
+		`cn=a"b`,
+		"cn=a;b",
+		"cn=a<b",
+		"cn=a>b",
+		`cn=alice\`,
+		`cn=alice\4`,
+		`cn=alice\zz`,
+		`cn=alice\ff`,
+		`cn=\C3`,
+	}
+	for _, str := range dns {
+		if dn, err := parseDN(str); err == nil {
+			t.Fatalf("parsing '%s' should fail but returned %#v", str, dn)
+		}
+	}
+}
+
+func TestDNString(t *testing.T) {
+	dns := []struct {
+		dn  ldapDN
+		str string
+	}{
+		{ldapDN{}, ""},
+		{ldapDN{{{"uid", "alice"}}, {{"dc", "org"}}}, "uid=alice,dc=org"},
+		{ldapDN{{{"cn", "alice"}, {"uid", "1000"}}}, "cn=alice+uid=1000"},
+		{ldapDN{{{"cn", `Smith, "A" <a>;b+c\d`}}}, `cn=Smith\, \"A\" \<a\>\;b\+c\\d`},
+		{ldapDN{{{"cn", " #a "}}}, `cn=\ #a\ `},
+		{ldapDN{{{"cn", "a\x00"}}}, `cn=a\00`},
+	}
+	for _, d := range dns {
+		if str := d.dn.String(); str != d.str {
+			t.Fatalf("%#v should be '%s' but is '%s'", d.dn, d.str, str)
+		}
+		if dn, err := parseDN(d.str); err != nil {
+			t.Fatalf("parsing '%s' returned an unexpected error: %v", d.str, err)
+		} else if !dn.Equal(d.dn) {
+			t.Fatalf("'%s' should parse to %#v but is %#v", d.str, d.dn, dn)
+		}
+	}
+}
+
+func TestDNEqual(t *testing.T) {
+	equal := [][2]string{
+		{"uid=alice,dc=org", "uid=alice,dc=org"},
+		{"UID=Alice,DC=ORG", "uid=alice,dc=org"},
+		{"uid = alice , dc = org", "uid=alice,dc=org"},
+		{"cn=alice+uid=1000,dc=org", "uid=1000+CN=Alice,dc=org"},
+		{`cn=a\2cb`, `cn=a\,b`},
+		{"", ""},
+	}
+	for _, e := range equal {
+		a, err := parseDN(e[0])
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		b, err := parseDN(e[1])
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if !a.Equal(b) || !b.Equal(a) {
+			t.Fatalf("'%s' and '%s' should be equal", e[0], e[1])
+		}
+	}
+
+	different := [][2]string{
+		{"uid=alice,dc=org", "uid=bob,dc=org"},
+		{"uid=alice,dc=org", "cn=alice,dc=org"},
+		{"uid=alice,dc=org", "uid=alice,dc=example,dc=org"},
+		{"cn=alice+uid=1000,dc=org", "cn=alice,dc=org"},
+		{"dc=example,dc=org", "dc=org,dc=example"},
+		{"dc=org", ""},
+	}
+	for _, d := range different {
+		a, err := parseDN(d[0])
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		b, err := parseDN(d[1])
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if a.Equal(b) || b.Equal(a) {
+			t.Fatalf("'%s' and '%s' shouldn't be equal", d[0], d[1])
+		}
+	}
+}
+
+func TestDNIsDescendantOf(t *testing.T) {
+	base, err := parseDN("ou=Users,dc=example,dc=org")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dns := []struct {
+		str        string
+		descendant bool
+	}{
+		{"uid=alice,ou=users,dc=example,dc=org", true},
+		{"uid=alice,ou=staff,ou=users,DC=Example,dc=org", true},
+		{"ou=users,dc=example,dc=org", false},
+		{"dc=example,dc=org", false},
+		{"uid=alice,ou=groups,dc=example,dc=org", false},
+		{"uid=alice,ou=users,dc=example,dc=com", false},
+		{"", false},
+	}
+	for _, d := range dns {
+		dn, err := parseDN(d.str)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if dn.IsDescendantOf(base) != d.descendant {
+			t.Fatalf("IsDescendantOf of '%s' should be %t", d.str, d.descendant)
+		}
+	}
+	if dn, _ := parseDN("dc=org"); !dn.IsDescendantOf(ldapDN{}) {
+		t.Fatal("every non-root DN should be a descendant of the root DN")
+	}
+}
+
+func TestLDAPBindPattern(t *testing.T) {
+	patterns := []struct {
+		pattern  string
+		name     string
+		username string
+		ok       bool
+	}{
+		{"uid=%s,ou=users,dc=example,dc=org", "uid=alice,ou=users,dc=example,dc=org", "alice", true},
+		{"uid=%s,ou=users,dc=example,dc=org", "UID=alice, OU=Users, DC=Example, DC=org", "alice", true},
+		{"uid=%s,ou=users,dc=example,dc=org", `uid=alice\2Cbob,ou=users,dc=example,dc=org`, "alice,bob", true},
+		{"uid=%s,ou=users,dc=example,dc=org", "cn=alice,ou=users,dc=example,dc=org", "", false},
+		{"uid=%s,ou=users,dc=example,dc=org", "uid=alice,ou=staff,dc=example,dc=org", "", false},
+		{"uid=%s,ou=users,dc=example,dc=org", "uid=alice,ou=x,ou=users,dc=example,dc=org", "", false},
+		{"uid=%s,ou=users,dc=example,dc=org", "uid=alice+cn=x,ou=users,dc=example,dc=org", "", false},
+		{"uid=%s,ou=users,dc=example,dc=org", "uid=,ou=users,dc=example,dc=org", "", false},
+		{"uid=%s,ou=users,dc=example,dc=org", "alice", "", false},
+		{"%s", "alice", "alice", true},
+		{"%s", "", "", false},
+		{"%s@example.org", "alice@example.org", "alice", true},
+		{"%s@example.org", "alice@EXAMPLE.org", "alice", true},
+		{"%s@example.org", "alice@example.com", "", false},
+		{"%s@example.org", "@example.org", "", false},
+		{"%s@*", "alice@example.org", "alice", true},
+		{"%s@*", "alice", "", false},
+		{"EXAMPLE\\%s", "example\\alice", "alice", true},
+		{"EXAMPLE\\%s", "alice", "", false},
+	}
+	for _, p := range patterns {
+		pattern, err := newLDAPBindPattern(p.pattern)
+		if err != nil {
+			t.Fatalf("pattern '%s' returned an unexpected error: %v", p.pattern, err)
+		}
+		var username string
+		var ok bool
+		if dn, err := parseDN(p.name); err == nil && pattern.isDN() {
+			username, ok = pattern.matchDN(dn)
+		} else {
+			username, ok = pattern.matchName(p.name)
+		}
+		if ok != p.ok || username != p.username {
+			t.Fatalf("pattern '%s' with '%s' should return ('%s', %t) but returned ('%s', %t)",
+				p.pattern, p.name, p.username, p.ok, username, ok)
+		}
+	}
+
+	for _, pattern := range []string{"", "alice", "%s%s", "%s*", "*%s", "%s@*.org", "cn=alice,uid=%s", "uid=%s+cn=x,dc=org", "uid=%s,dc"} {
+		if _, err := newLDAPBindPattern(pattern); err == nil {
+			t.Fatalf("pattern '%s' should be invalid", pattern)
+		}
+	}
+}
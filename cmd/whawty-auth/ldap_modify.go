@@ -0,0 +1,137 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/glauth/ldap"
+)
+
+const ldapAttrUserPassword = "userpassword"
+
+type ldapPasswordChange struct {
+	oldPassword string
+	newPassword string
+}
+
+// parsePasswordChange extracts the password change out of a modify request. Only the
+// userPassword attribute may be modified and the values are the plain-text passwords. Users
+// change their password by deleting the old and adding the new value, replacing the value is
+// reserved for admins as the old password is not needed for it.
+func parsePasswordChange(req ldap.ModifyRequest) (change ldapPasswordChange, ok bool) {
+	value := func(attrs []ldap.PartialAttribute) (string, bool) {
+		if len(attrs) == 0 {
+			return "", true
+		}
+		if len(attrs) != 1 || strings.ToLower(attrs[0].AttrType) != ldapAttrUserPassword || len(attrs[0].AttrVals) != 1 || attrs[0].AttrVals[0] == "" {
+			return "", false
+		}
+		return attrs[0].AttrVals[0], true
+	}
+
+	var oldOk, addOk, replaceOk bool
+	var added, replaced string
+	change.oldPassword, oldOk = value(req.DeleteAttributes)
+	added, addOk = value(req.AddAttributes)
+	replaced, replaceOk = value(req.ReplaceAttributes)
+	if !oldOk || !addOk || !replaceOk {
+		return change, false
+	}
+	switch {
+	case replaced != "" && change.oldPassword == "" && added == "":
+		change.newPassword = replaced
+	case replaced == "" && change.oldPassword != "" && added != "":
+		change.newPassword = added
+	default:
+		return change, false
+	}
+	return change, true
+}
+
+// Modify changes the password of the user addressed by the DN of req. The same rules as for the
+// update endpoint of the web-api apply: users may change their password by supplying the old
+// password, admins may change the password of any user. Admins which have bound using an app
+// password must supply the old password as well.
+func (h ldapHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	change, ok := parsePasswordChange(req)
+	if !ok {
+		wdl.Printf("ldap: refusing modify request for '%s', only changing the userPassword is supported", req.Dn)
+		return ldap.LDAPResultUnwillingToPerform, nil
+	}
+
+	var boundUser string
+	if boundDN != "" && !h.isServiceAccount(boundDN) {
+		boundUser, _ = h.bindUsername(boundDN)
+	}
+	username, ok := h.bindUsername(req.Dn)
+	if !ok {
+		wdl.Printf("ldap: modify: '%s' does not match any bind pattern", req.Dn)
+		return ldap.LDAPResultNoSuchObject, nil
+	}
+
+	if change.oldPassword != "" {
+		// changing the password always requires the password of the user, app passwords are not enough
+		if ok, _, _, err := h.store.WithAppPasswords(false).WithSource(auditSource(conn.RemoteAddr())).Authenticate(username, change.oldPassword); !ok {
+			if err != nil {
+				wdl.Printf("ldap: password change for '%s' failed: %v", username, err)
+			}
+			return ldap.LDAPResultInvalidCredentials, nil
+		}
+		wdl.Printf("ldap: update user '%s', using current(old) password", username)
+	} else {
+		list, err := h.store.List()
+		if err != nil {
+			wl.Printf("ldap: password change: failed to list users: %v", err)
+			return ldap.LDAPResultOperationsError, nil
+		}
+		if boundUser == "" || !list[boundUser].IsAdmin {
+			wdl.Printf("ldap: password change for '%s' by '%s' denied, only admins may change passwords without the old password", username, boundDN)
+			return ldap.LDAPResultInsufficientAccessRights, nil
+		}
+		if h.binds.usedAppPassword(conn) {
+			wdl.Printf("ldap: password change for '%s' by '%s' denied, admins which used an app password must supply the old password", username, boundDN)
+			return ldap.LDAPResultInsufficientAccessRights, nil
+		}
+		wdl.Printf("ldap: admin '%s' want's to update user '%s'", boundUser, username)
+	}
+
+	actor := username
+	if boundUser != "" {
+		actor = boundUser
+	}
+	if err := h.store.WithActor(actor).WithSource(auditSource(conn.RemoteAddr())).Update(username, change.newPassword); err != nil {
+		wdl.Printf("ldap: password change for '%s' failed: %v", username, err)
+		return ldap.LDAPResultConstraintViolation, nil
+	}
+	return ldap.LDAPResultSuccess, nil
+}
@@ -0,0 +1,296 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/glauth/ldap"
+)
+
+// newTestLDAPServer starts an ldap server for store and returns a function which connects to it.
+func newTestLDAPServer(t *testing.T, store *Store, config *ldapDirectoryConfig) func() *ldap.Conn {
+	server, err := newLDAPServer(store.WithAppPasswords(true, "ldap"), config)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+
+	return func() *ldap.Conn {
+		conn, err := ldap.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		t.Cleanup(conn.Close)
+		return conn
+	}
+}
+
+func ldapResultCode(err error) ldap.LDAPResultCode {
+	if err == nil {
+		return ldap.LDAPResultSuccess
+	}
+	var lerr *ldap.Error
+	if !errors.As(err, &lerr) {
+		return ldap.LDAPResultOther
+	}
+	return lerr.ResultCode
+}
+
+func newTestPasswordChange(dn, oldPassword, newPassword string) *ldap.ModifyRequest {
+	req := ldap.NewModifyRequest(dn)
+	if oldPassword != "" {
+		req.Delete("userPassword", []string{oldPassword})
+		req.Add("userPassword", []string{newPassword})
+	} else {
+		req.Replace("userPassword", []string{newPassword})
+	}
+	return req
+}
+
+func TestParsePasswordChange(t *testing.T) {
+	testVectors := []struct {
+		req    ldap.ModifyRequest
+		change ldapPasswordChange
+		ok     bool
+	}{
+		{*newTestPasswordChange("uid=user", "old", "new"), ldapPasswordChange{"old", "new"}, true},
+		{*newTestPasswordChange("uid=user", "", "new"), ldapPasswordChange{"", "new"}, true},
+		{ldap.ModifyRequest{ReplaceAttributes: []ldap.PartialAttribute{{AttrType: "UserPassword", AttrVals: []string{"new"}}}}, ldapPasswordChange{"", "new"}, true},
+		{ldap.ModifyRequest{}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{DeleteAttributes: []ldap.PartialAttribute{{AttrType: "userPassword", AttrVals: []string{"old"}}}}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{DeleteAttributes: []ldap.PartialAttribute{{AttrType: "userPassword"}}}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{AddAttributes: []ldap.PartialAttribute{{AttrType: "userPassword", AttrVals: []string{"new"}}}}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{ReplaceAttributes: []ldap.PartialAttribute{{AttrType: "userPassword", AttrVals: []string{"new", "other"}}}}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{ReplaceAttributes: []ldap.PartialAttribute{{AttrType: "mail", AttrVals: []string{"user@example.org"}}}}, ldapPasswordChange{}, false},
+		{ldap.ModifyRequest{
+			ReplaceAttributes: []ldap.PartialAttribute{{AttrType: "userPassword", AttrVals: []string{"new"}}},
+			AddAttributes:     []ldap.PartialAttribute{{AttrType: "mail", AttrVals: []string{"user@example.org"}}},
+		}, ldapPasswordChange{}, false},
+	}
+
+	for _, vector := range testVectors {
+		change, ok := parsePasswordChange(vector.req)
+		if ok != vector.ok {
+			t.Fatalf("parsing %+v: expected ok=%t, got %t", vector.req, vector.ok, ok)
+		}
+		if ok && change != vector.change {
+			t.Fatalf("parsing %+v: expected %+v, got %+v", vector.req, vector.change, change)
+		}
+	}
+}
+
+func TestLDAPModifyPassword(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	dial := newTestLDAPServer(t, s, &ldapDirectoryConfig{BaseDN: "dc=example,dc=org"})
+
+	conn := dial()
+	if err := conn.Bind("uid=user,dc=example,dc=org", "user-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if code := ldapResultCode(conn.Modify(newTestPasswordChange("uid=user,dc=example,dc=org", "wrong", "new-secret"))); code != ldap.LDAPResultInvalidCredentials {
+		t.Fatalf("changing the password with a wrong old password should fail, got result %d", code)
+	}
+	if code := ldapResultCode(conn.Modify(newTestPasswordChange("uid=user,dc=example,dc=org", "", "new-secret"))); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("users must not replace their password without the old one, got result %d", code)
+	}
+	if code := ldapResultCode(conn.Modify(newTestPasswordChange("uid=admin,dc=example,dc=org", "", "new-secret"))); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("users must not change the password of others, got result %d", code)
+	}
+	req := ldap.NewModifyRequest("uid=user,dc=example,dc=org")
+	req.Replace("mail", []string{"user@example.org"})
+	if code := ldapResultCode(conn.Modify(req)); code != ldap.LDAPResultUnwillingToPerform {
+		t.Fatalf("modifying other attributes should be refused, got result %d", code)
+	}
+	if code := ldapResultCode(conn.Modify(newTestPasswordChange("uid=nobody,ou=other", "", "new-secret"))); code != ldap.LDAPResultNoSuchObject {
+		t.Fatalf("changing the password of an entry outside of the base-dn should fail, got result %d", code)
+	}
+
+	if err := conn.Modify(newTestPasswordChange("uid=user,dc=example,dc=org", "user-secret", "new-secret")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, _, _, _ := s.Authenticate("user", "new-secret"); !ok {
+		t.Fatal("authentication with the new password should succeed")
+	}
+	if ok, _, _, _ := s.Authenticate("user", "user-secret"); ok {
+		t.Fatal("authentication with the old password should fail")
+	}
+}
+
+func TestLDAPModifyPasswordAdmin(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	dial := newTestLDAPServer(t, s, &ldapDirectoryConfig{})
+
+	conn := dial()
+	if err := conn.Bind("admin", "admin-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := conn.Modify(newTestPasswordChange("user", "", "new-secret")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, _, _, _ := s.Authenticate("user", "new-secret"); !ok {
+		t.Fatal("authentication with the password set by the admin should succeed")
+	}
+
+	appPassword, err := s.AddAppPassword("admin", "mail", nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	conn = dial()
+	if err := conn.Bind("admin", appPassword); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if code := ldapResultCode(conn.Modify(newTestPasswordChange("user", "", "other-secret"))); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("admins bound with an app password must supply the old password, got result %d", code)
+	}
+	if err := conn.Modify(newTestPasswordChange("user", "new-secret", "other-secret")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// binding again without the app password lifts the restriction
+	if err := conn.Bind("admin", "admin-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := conn.Modify(newTestPasswordChange("user", "", "new-secret")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	anonymous := dial()
+	if code := ldapResultCode(anonymous.Modify(newTestPasswordChange("user", "", "other-secret"))); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("anonymous password changes without the old password should fail, got result %d", code)
+	}
+}
+
+func ldapSearchDNs(conn *ldap.Conn, base string) ([]string, ldap.LDAPResultCode) {
+	result, err := conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	if err != nil {
+		return nil, ldapResultCode(err)
+	}
+	var dns []string
+	for _, entry := range result.Entries {
+		dns = append(dns, entry.DN)
+	}
+	sort.Strings(dns)
+	return dns, ldap.LDAPResultSuccess
+}
+
+func TestLDAPSearch(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	dial := newTestLDAPServer(t, s, &ldapDirectoryConfig{
+		BaseDN:   "ou=users,dc=example,dc=org",
+		GroupsDN: "ou=groups,dc=example,dc=org",
+		Search:   &ldapSearchConfig{Users: true},
+	})
+
+	anonymous := dial()
+	if _, code := ldapSearchDNs(anonymous, "ou=users,dc=example,dc=org"); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("anonymous searches should be denied, got result %d", code)
+	}
+
+	conn := dial()
+	if err := conn.Bind("uid=user,ou=users,dc=example,dc=org", "user-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	testVectors := []struct {
+		base string
+		dns  []string
+	}{
+		{"dc=example,dc=org", []string{"cn=admins,ou=groups,dc=example,dc=org", "uid=admin,ou=users,dc=example,dc=org", "uid=user,ou=users,dc=example,dc=org"}},
+		{"ou=users,dc=example,dc=org", []string{"uid=admin,ou=users,dc=example,dc=org", "uid=user,ou=users,dc=example,dc=org"}},
+		{"OU=Users, DC=Example, DC=Org", []string{"uid=admin,ou=users,dc=example,dc=org", "uid=user,ou=users,dc=example,dc=org"}},
+		{"ou=groups,dc=example,dc=org", []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+		{"uid=user,ou=users,dc=example,dc=org", []string{"uid=user,ou=users,dc=example,dc=org"}},
+		{"dc=example,dc=com", nil},
+		{"ou=users,dc=example", nil},
+	}
+	for _, vector := range testVectors {
+		dns, code := ldapSearchDNs(conn, vector.base)
+		if code != ldap.LDAPResultSuccess {
+			t.Fatalf("search below '%s' failed with result %d", vector.base, code)
+		}
+		if !reflect.DeepEqual(dns, vector.dns) {
+			t.Fatalf("search below '%s': expected %v, got %v", vector.base, vector.dns, dns)
+		}
+	}
+}
+
+func TestLDAPSearchTenants(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	example := &tenant{
+		name:   "example",
+		config: &tenantConfig{LDAP: &ldapDirectoryConfig{BaseDN: "dc=example,dc=org", Search: &ldapSearchConfig{Users: true}}},
+		store:  newTestStore(t).GetInterface(),
+	}
+	if err := example.store.Add("tenant-user", "tenant-secret", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// as plain strings the default base-dn ends with the base-dn of the tenant
+	tenants := &tenantList{tenants: []*tenant{example}}
+	dial := newTestLDAPServer(t, s.WithTenants(tenants), &ldapDirectoryConfig{BaseDN: "dc=sub-example,dc=org", Search: &ldapSearchConfig{Users: true}})
+
+	conn := dial()
+	if err := conn.Bind("uid=tenant-user, DC=Example, dc=org", "tenant-secret"); err != nil {
+		t.Fatal("binds with DNs which differ in case and spacing should be routed to the tenant:", err)
+	}
+	if dns, code := ldapSearchDNs(conn, "dc=example,DC=org"); code != ldap.LDAPResultSuccess {
+		t.Fatalf("search failed with result %d", code)
+	} else if !reflect.DeepEqual(dns, []string{"uid=admin,dc=example,dc=org", "uid=tenant-user,dc=example,dc=org", "uid=user,dc=example,dc=org"}) {
+		t.Fatalf("search returned unexpected entries: %v", dns)
+	}
+	if _, code := ldapSearchDNs(conn, "dc=sub-example,dc=org"); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("searching the directory of another tenant should be denied, got result %d", code)
+	}
+
+	conn = dial()
+	if err := conn.Bind("uid=user,dc=sub-example,dc=org", "user-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if dns, code := ldapSearchDNs(conn, "dc=sub-example,dc=org"); code != ldap.LDAPResultSuccess {
+		t.Fatalf("search failed with result %d", code)
+	} else if !reflect.DeepEqual(dns, []string{"uid=admin,dc=sub-example,dc=org", "uid=user,dc=sub-example,dc=org"}) {
+		t.Fatalf("search returned unexpected entries: %v", dns)
+	}
+	if _, code := ldapSearchDNs(conn, "dc=example,dc=org"); code != ldap.LDAPResultInsufficientAccessRights {
+		t.Fatalf("searching the directory of another tenant should be denied, got result %d", code)
+	}
+	if err := conn.Bind("uid=tenant-user,dc=sub-example,dc=org", "tenant-secret"); err == nil {
+		t.Fatal("users of a tenant must not be able to bind to the default directory")
+	}
+}
@@ -38,6 +38,7 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -98,8 +99,9 @@ func cmdInit(c *cli.Context) error {
 		password = pwd
 	}
 
-	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"),
-		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"))
+	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"), c.GlobalString("upgrade-config"),
+		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"), c.GlobalString("hooks-config"),
+		c.GlobalString("state-dir"), c.GlobalBool("read-only"), c.GlobalDuration("auth-cache-ttl"), c.GlobalInt("auth-cache-size"))
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("Error initializing whawty store: %s", err), 3)
 	}
@@ -110,21 +112,27 @@ func cmdInit(c *cli.Context) error {
 }
 
 func cmdCheck(c *cli.Context) error {
-	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"),
-		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"))
+	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"), c.GlobalString("upgrade-config"),
+		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"), c.GlobalString("hooks-config"),
+		c.GlobalString("state-dir"), c.GlobalBool("read-only"), c.GlobalDuration("auth-cache-ttl"), c.GlobalInt("auth-cache-size"))
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("Error opening whawty store: %s", err), 3)
 	}
 
-	if err := s.GetInterface().Check(); err != nil {
+	warnings, err := s.GetInterface().Check()
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("Error checking whawty store: %s", err), 3)
 	}
 	return cli.NewExitError("whawty store is ok!", 0)
 }
 
 func openAndCheck(c *cli.Context) (*store, error) {
-	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"),
-		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"))
+	s, err := NewStore(c.GlobalString("store"), c.GlobalString("do-upgrades"), c.GlobalString("upgrade-config"),
+		c.GlobalString("policy-type"), c.GlobalString("policy-condition"), c.GlobalString("hooks-dir"), c.GlobalString("hooks-config"),
+		c.GlobalString("state-dir"), c.GlobalBool("read-only"), c.GlobalDuration("auth-cache-ttl"), c.GlobalInt("auth-cache-size"))
 	if err != nil {
 		return nil, fmt.Errorf("Error opening whawty store: %s", err)
 	}
@@ -133,7 +141,11 @@ func openAndCheck(c *cli.Context) (*store, error) {
 		return s, nil
 	}
 
-	if err := s.GetInterface().Check(); err != nil {
+	warnings, err := s.GetInterface().Check()
+	for _, warning := range warnings {
+		wl.Printf("store: %s", warning)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("Error checking whawty store: %s", err)
 	}
 	return s, nil
@@ -246,7 +258,109 @@ func cmdSetAdmin(c *cli.Context) error {
 	}
 }
 
-func cmdListFull(s *Store) error {
+func cmdGroup(c *cli.Context, member bool) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	username := c.Args().First()
+	group := c.Args().Get(1)
+	if username == "" || group == "" {
+		cli.ShowCommandHelp(c, c.Command.Name) //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	if err := s.GetInterface().SetGroup(username, group, member); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error changing groups of user '%s': %s", username, err), 3)
+	}
+
+	if member {
+		return cli.NewExitError(fmt.Sprintf("user '%s' is now a member of group '%s'!", username, group), 0)
+	} else {
+		return cli.NewExitError(fmt.Sprintf("user '%s' is no longer a member of group '%s'!", username, group), 0)
+	}
+}
+
+func cmdAppPasswordAdd(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	username := c.Args().First()
+	name := c.Args().Get(1)
+	if username == "" || name == "" {
+		cli.ShowCommandHelp(c, c.Command.Name) //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	password, err := s.GetInterface().AddAppPassword(username, name, c.StringSlice("scope"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error adding app password '%s' for user '%s': %s", name, username, err), 3)
+	}
+	return cli.NewExitError(fmt.Sprintf("app password '%s' for user '%s': %s", name, username, password), 0)
+}
+
+func cmdAppPasswordRemove(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	username := c.Args().First()
+	name := c.Args().Get(1)
+	if username == "" || name == "" {
+		cli.ShowCommandHelp(c, c.Command.Name) //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	if err := s.GetInterface().RemoveAppPassword(username, name); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error removing app password '%s' of user '%s': %s", name, username, err), 3)
+	}
+	return cli.NewExitError(fmt.Sprintf("app password '%s' of user '%s' successfully removed!", name, username), 0)
+}
+
+func cmdAppPasswordList(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	username := c.Args().First()
+	if username == "" {
+		cli.ShowCommandHelp(c, c.Command.Name) //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	lst, err := s.GetInterface().AppPasswords(username)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error listing app passwords of user '%s': %s", username, err), 3)
+	}
+
+	var keys []string
+	for k := range lst {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	table := uitable.New()
+	table.MaxColWidth = 50
+	table.AddRow("NAME", "CREATED", "SCOPES")
+	for _, k := range keys {
+		scopes := strings.Join(lst[k].Scopes, ",")
+		if scopes == "" {
+			scopes = "*"
+		}
+		table.AddRow(k, lst[k].Created.String(), scopes)
+	}
+	fmt.Println(table)
+	return cli.NewExitError("", 0)
+}
+
+// cmdListFull shows all users. If inactive is not zero only users whose last login and password
+// change are longer ago are shown.
+func cmdListFull(s *Store, inactive time.Duration) error {
 	lst, err := s.ListFull()
 	if err != nil {
 		return fmt.Errorf("Error listing user: %s\n", err)
@@ -254,19 +368,26 @@ func cmdListFull(s *Store) error {
 
 	var keys []string
 	for k := range lst {
+		if inactive != 0 && time.Since(lastActivity(lst[k])) < inactive {
+			continue
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
 	table := uitable.New()
 	table.MaxColWidth = 80
-	table.AddRow("NAME", "TYPE", "LAST-CHANGED", "VALID", "SUPPORTED", "FORMAT", "PARAMETER-SET")
+	table.AddRow("NAME", "TYPE", "LAST-CHANGED", "LAST-LOGIN", "VALID", "SUPPORTED", "FORMAT", "PARAMETER-SET", "GROUPS")
 	for _, k := range keys {
 		t := "user"
 		if lst[k].IsAdmin {
 			t = "admin"
 		}
-		table.AddRow(k, t, lst[k].LastChanged.String(), lst[k].IsValid, lst[k].IsSupported, lst[k].FormatID, lst[k].ParamID)
+		lastLogin := "never"
+		if lst[k].LastLogin != nil {
+			lastLogin = lst[k].LastLogin.String()
+		}
+		table.AddRow(k, t, lst[k].LastChanged.String(), lastLogin, lst[k].IsValid, lst[k].IsSupported, lst[k].FormatID, lst[k].ParamID, strings.Join(lst[k].Groups, ","))
 	}
 	fmt.Println(table)
 	return nil
@@ -298,14 +419,35 @@ func cmdListSupported(s *Store) error {
 	return nil
 }
 
+// parseDays works like time.ParseDuration but also accepts a number of days, e.g. '90d'.
+func parseDays(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.ParseUint(days, 10, 16)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
 func cmdList(c *cli.Context) error {
 	s, err := openAndCheck(c)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 3)
 	}
 
-	if c.Bool("full") {
-		err = cmdListFull(s.GetInterface())
+	if c.String("inactive") != "" {
+		if c.GlobalString("state-dir") == "" && (c.GlobalString("audit-log") == "" || !c.GlobalBool("audit-authentications")) {
+			return cli.NewExitError("the last logins are only known if --state-dir or --audit-authentications is used", 1)
+		}
+		inactive, perr := parseDays(c.String("inactive"))
+		if perr != nil || inactive <= 0 {
+			return cli.NewExitError(fmt.Sprintf("invalid value for --inactive: '%s'", c.String("inactive")), 1)
+		}
+		err = cmdListFull(s.GetInterface(), inactive)
+	} else if c.Bool("full") {
+		err = cmdListFull(s.GetInterface(), 0)
 	} else {
 		err = cmdListSupported(s.GetInterface())
 	}
@@ -315,6 +457,293 @@ func cmdList(c *cli.Context) error {
 	return cli.NewExitError("", 0)
 }
 
+func formatAge(t time.Time) string {
+	return fmt.Sprintf("%dd", int(time.Since(t).Hours()/24))
+}
+
+type upgradeStatusKey struct {
+	formatID string
+	paramID  uint
+}
+
+type upgradeStatusEntry struct {
+	supported bool
+	users     uint
+	mustReset uint
+	oldest    time.Time
+	newest    time.Time
+}
+
+func cmdUpgradeStatus(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	lst, err := s.GetInterface().ListFull()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error listing user: %s", err), 3)
+	}
+
+	status := make(map[upgradeStatusKey]*upgradeStatusEntry)
+	var names []string
+	for name, user := range lst {
+		names = append(names, name)
+		key := upgradeStatusKey{user.FormatID, user.ParamID}
+		entry, exists := status[key]
+		if !exists {
+			entry = &upgradeStatusEntry{oldest: user.LastChanged, newest: user.LastChanged}
+			status[key] = entry
+		}
+		entry.supported = entry.supported || user.IsSupported
+		entry.users++
+		if user.MustReset {
+			entry.mustReset++
+		}
+		if user.LastChanged.Before(entry.oldest) {
+			entry.oldest = user.LastChanged
+		}
+		if user.LastChanged.After(entry.newest) {
+			entry.newest = user.LastChanged
+		}
+	}
+
+	var keys []upgradeStatusKey
+	for k := range status {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].formatID != keys[j].formatID {
+			return keys[i].formatID < keys[j].formatID
+		}
+		return keys[i].paramID < keys[j].paramID
+	})
+
+	table := uitable.New()
+	table.MaxColWidth = 50
+	table.AddRow("FORMAT", "PARAMETER-SET", "SUPPORTED", "USERS", "MUST-RESET", "OLDEST-CHANGE", "NEWEST-CHANGE")
+	for _, k := range keys {
+		e := status[k]
+		table.AddRow(k.formatID, k.paramID, e.supported, e.users, e.mustReset, formatAge(e.oldest), formatAge(e.newest))
+	}
+	fmt.Println(table)
+
+	if !c.Bool("users") {
+		return cli.NewExitError("", 0)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return lst[names[i]].LastChanged.Before(lst[names[j]].LastChanged)
+	})
+	table = uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("NAME", "FORMAT", "PARAMETER-SET", "MUST-RESET", "AGE")
+	for _, name := range names {
+		u := lst[name]
+		table.AddRow(name, u.FormatID, u.ParamID, u.MustReset, formatAge(u.LastChanged))
+	}
+	fmt.Println()
+	fmt.Println(table)
+	return cli.NewExitError("", 0)
+}
+
+func cmdExpireLegacy(c *cli.Context) error {
+	if !c.Args().Present() {
+		cli.ShowCommandHelp(c, "expire-legacy") //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+	legacy := make(map[uint]bool)
+	for _, arg := range c.Args() {
+		id, err := strconv.ParseUint(arg, 10, 0)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("invalid parameter-set '%s': %s", arg, err), 1)
+		}
+		legacy[uint(id)] = true
+	}
+
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	lst, err := s.GetInterface().ListFull()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error listing user: %s", err), 3)
+	}
+
+	var names []string
+	for name, user := range lst {
+		if user.IsValid && !user.MustReset && legacy[user.ParamID] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	table := uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("NAME", "PARAMETER-SET", "RESET-TOKEN")
+	failed := 0
+	for _, name := range names {
+		token := ""
+		if !c.Bool("dry-run") {
+			if token, err = s.GetInterface().Expire(name, c.Bool("reset-tokens")); err != nil {
+				fmt.Printf("Error expiring password of user '%s': %s\n", name, err)
+				failed++
+				continue
+			}
+		}
+		table.AddRow(name, lst[name].ParamID, token)
+	}
+	fmt.Println(table)
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("failed to expire %d of %d users", failed, len(names)), 3)
+	}
+	if c.Bool("dry-run") {
+		return cli.NewExitError(fmt.Sprintf("%d users would have been expired", len(names)), 0)
+	}
+	return cli.NewExitError(fmt.Sprintf("%d users successfully expired", len(names)), 0)
+}
+
+func cmdRewrap(c *cli.Context) error {
+	from, err := strconv.ParseUint(c.Args().First(), 10, 0)
+	if err != nil {
+		cli.ShowCommandHelp(c, "rewrap") //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+	to, err := strconv.ParseUint(c.Args().Get(1), 10, 0)
+	if err != nil {
+		cli.ShowCommandHelp(c, "rewrap") //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	lst, err := s.GetInterface().ListFull()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error listing user: %s", err), 3)
+	}
+
+	var names []string
+	for name, user := range lst {
+		if user.IsValid && user.ParamID == uint(from) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		if err := s.GetInterface().Rewrap(name, uint(to)); err != nil {
+			fmt.Printf("Error rewrapping password hash of user '%s': %s\n", name, err)
+			failed++
+			continue
+		}
+		wdl.Printf("rewrapped password hash of user '%s' from parameter-set %d to %d", name, from, to)
+	}
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("failed to rewrap %d of %d users", failed, len(names)), 3)
+	}
+	return cli.NewExitError(fmt.Sprintf("%d users successfully rewrapped from parameter-set %d to %d", len(names), from, to), 0)
+}
+
+func cmdReencrypt(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	lst, err := s.GetInterface().ListFull()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error listing user: %s", err), 3)
+	}
+
+	var names []string
+	for name, user := range lst {
+		if user.IsValid {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := 0
+	failed := 0
+	for _, name := range names {
+		ok, err := s.GetInterface().Reencrypt(name)
+		if err != nil {
+			fmt.Printf("Error re-encrypting password hash of user '%s': %s\n", name, err)
+			failed++
+			continue
+		}
+		if ok {
+			wdl.Printf("re-encrypted password hash of user '%s'", name)
+			changed++
+		}
+	}
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("failed to re-encrypt %d of %d users", failed, len(names)), 3)
+	}
+	return cli.NewExitError(fmt.Sprintf("%d users successfully re-encrypted", changed), 0)
+}
+
+func cmdAuditVerify(c *cli.Context) error {
+	if c.NArg() == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name) //nolint:errcheck
+		return cli.NewExitError("", 0)
+	}
+
+	prev := ""
+	for _, path := range c.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error opening audit log: %s", err), 3)
+		}
+		prev, err = verifyAuditLog(file, prev)
+		file.Close()
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %s", path, err), 3)
+		}
+	}
+	return cli.NewExitError("audit log is ok!", 0)
+}
+
+func cmdHooksTest(c *cli.Context) error {
+	s, err := openAndCheck(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+
+	status, err := s.GetInterface().TestHooks(c.String("event"), c.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error calling hooks: %s", err), 3)
+	}
+
+	failed := 0
+	for _, st := range status {
+		result := fmt.Sprintf("exit status %d", st.ExitStatus)
+		if st.Error != "" {
+			result = st.Error
+			failed++
+		}
+		fmt.Printf("%s: %s (%.3fs)\n", st.Name, result, st.Duration)
+		for _, line := range strings.Split(strings.TrimRight(st.Output, "\n"), "\n") {
+			if line != "" {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d hooks failed", failed, len(status)), 3)
+	}
+	return cli.NewExitError(fmt.Sprintf("%d hooks successfully called", len(status)), 0)
+}
+
 func cmdAuthenticate(c *cli.Context) error {
 	s, err := openAndCheck(c)
 	if err != nil {
@@ -340,7 +769,11 @@ func cmdAuthenticate(c *cli.Context) error {
 		password = string(pwd)
 	}
 
-	ok, isAdmin, _, err := s.GetInterface().Authenticate(username, password)
+	auth := s.GetInterface()
+	if c.Bool("app-passwords") || len(c.StringSlice("scope")) > 0 {
+		auth = auth.WithAppPasswords(true, c.StringSlice("scope")...)
+	}
+	ok, isAdmin, _, err := auth.Authenticate(username, password)
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("Error authenticating user '%s': %s", username, err), 3)
 	}
@@ -365,31 +798,79 @@ func cmdRun(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 3)
 	}
 
+	if err := s.GetInterface().StartWebhooks(); err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+	s.GetInterface().StartLoginState()
+
 	lc, err := readListenerConfig(c.String("listener"))
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
+	access, err := newAccessControl(lc.Access)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tenants, err := openTenants(c, lc.Tenants)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+	iface := s.GetInterface().WithActor("agent").WithAccessControl(access).WithTenants(tenants)
 
 	var wg sync.WaitGroup
+	if lc.Replica != nil {
+		replicaStatus = newReplicaState(lc.Replica.MaxLag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runReplica(lc.Replica, iface, replicaStatus); err != nil {
+				fmt.Printf("warning running replica failed: %s\n", err)
+			}
+		}()
+	}
+	if lc.Replication != nil {
+		for _, addr := range lc.Replication.Listen {
+			a := addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := runReplicationAddr(a, lc.Replication, iface); err != nil {
+					fmt.Printf("warning running replication listener failed: %s\n", err)
+				}
+			}()
+		}
+	}
 	if lc.SASLAuthd != nil {
 		for _, path := range lc.SASLAuthd.Listen {
 			p := path
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := runSaslAuthSocket(p, s.GetInterface()); err != nil {
+				if err := runSaslAuthSocket(p, iface.WithAuthCache(lc.SASLAuthd.AuthCache)); err != nil {
 					fmt.Printf("warning running auth-socket failed: %s\n", err)
 				}
 			}()
 		}
 	}
+	if lc.Dovecot != nil {
+		for _, path := range lc.Dovecot.Listen {
+			p := path
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := runDovecotAuthSocket(p, iface.WithAuthCache(lc.Dovecot.AuthCache)); err != nil {
+					fmt.Printf("warning running dovecot auth-socket failed: %s\n", err)
+				}
+			}()
+		}
+	}
 	if lc.HTTP != nil {
 		for _, addr := range lc.HTTP.Listen {
 			a := addr
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := runHTTPAddr(a, lc.HTTP, s.GetInterface()); err != nil {
+				if err := runHTTPAddr(a, lc.HTTP, iface.WithAuthCache(lc.HTTP.AuthCache)); err != nil {
 					fmt.Printf("warning running web-api failed: %s\n", err)
 				}
 			}()
@@ -401,7 +882,7 @@ func cmdRun(c *cli.Context) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := runHTTPsAddr(a, lc.HTTPs, s.GetInterface()); err != nil {
+				if err := runHTTPsAddr(a, lc.HTTPs, iface.WithAuthCache(lc.HTTPs.AuthCache)); err != nil {
 					fmt.Printf("warning running web-api failed: %s\n", err)
 				}
 			}()
@@ -413,7 +894,7 @@ func cmdRun(c *cli.Context) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := runLDAPAddr(a, lc.LDAP, s.GetInterface()); err != nil {
+				if err := runLDAPAddr(a, lc.LDAP, iface.WithAuthCache(lc.LDAP.AuthCache)); err != nil {
 					fmt.Printf("warning running web-api failed: %s\n", err)
 				}
 			}()
@@ -425,39 +906,89 @@ func cmdRun(c *cli.Context) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := runLDAPsAddr(a, lc.LDAPs, s.GetInterface()); err != nil {
+				if err := runLDAPsAddr(a, lc.LDAPs, iface.WithAuthCache(lc.LDAPs.AuthCache)); err != nil {
 					fmt.Printf("warning running web-api failed: %s\n", err)
 				}
 			}()
 		}
 	}
+	if lc.Radius != nil {
+		for _, addr := range lc.Radius.Listen {
+			a := addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := runRadiusAddr(a, lc.Radius, iface.WithAuthCache(lc.Radius.AuthCache)); err != nil {
+					fmt.Printf("warning running radius listener failed: %s\n", err)
+				}
+			}()
+		}
+	}
 	wg.Wait()
 
 	return cli.NewExitError("shutting down since all auth sockets have closed.", 0)
 }
 
+// activationSocketsWithNames works like activation.ListenersWithNames but also returns the
+// datagram sockets passed to us by systemd.
+func activationSocketsWithNames() (map[string][]net.Listener, map[string][]net.PacketConn) {
+	listeners := map[string][]net.Listener{}
+	packetConns := map[string][]net.PacketConn{}
+	for _, f := range activation.Files(true) {
+		if ln, err := net.FileListener(f); err == nil {
+			listeners[f.Name()] = append(listeners[f.Name()], ln)
+			f.Close()
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packetConns[f.Name()] = append(packetConns[f.Name()], pc)
+			f.Close()
+		}
+	}
+	return listeners, packetConns
+}
+
 func cmdRunSa(c *cli.Context) error {
 	s, err := openAndCheck(c)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 3)
 	}
 
+	if err := s.GetInterface().StartWebhooks(); err != nil {
+		return cli.NewExitError(err.Error(), 3)
+	}
+	s.GetInterface().StartLoginState()
+
 	lc, err := readListenerConfig(c.String("listener"))
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
-
-	listenerGroups, err := activation.ListenersWithNames()
+	access, err := newAccessControl(lc.Access)
 	if err != nil {
-		return cli.NewExitError(fmt.Sprintf("fetching socket listeners from systemd failed: %s", err), 2)
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tenants, err := openTenants(c, lc.Tenants)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 3)
 	}
+	iface := s.GetInterface().WithActor("agent").WithAccessControl(access).WithTenants(tenants)
+
+	listenerGroups, packetConnGroups := activationSocketsWithNames()
 
-	fmt.Printf("got %d listener-groups from systemd\n", len(listenerGroups))
-	if len(listenerGroups) == 0 {
+	fmt.Printf("got %d listener-groups from systemd\n", len(listenerGroups)+len(packetConnGroups))
+	if len(listenerGroups)+len(packetConnGroups) == 0 {
 		return cli.NewExitError("shutting down since there are no sockets to lissten on.", 2)
 	}
 
 	var wg sync.WaitGroup
+	if lc.Replica != nil {
+		replicaStatus = newReplicaState(lc.Replica.MaxLag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runReplica(lc.Replica, iface, replicaStatus); err != nil {
+				fmt.Printf("warning running replica failed: %s\n", err)
+			}
+		}()
+	}
 	for name, listeners := range listenerGroups {
 		switch name {
 		case "saslauthd":
@@ -473,11 +1004,30 @@ func cmdRunSa(c *cli.Context) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					if err := runSaslAuthSocketListener(ln, s.GetInterface()); err != nil {
+					if err := runSaslAuthSocketListener(ln, iface.WithAuthCache(lc.SASLAuthd.AuthCache)); err != nil {
 						fmt.Printf("warning running auth-socket failed: %s\n", err)
 					}
 				}()
 			}
+		case "dovecot":
+			if lc.Dovecot == nil {
+				fmt.Printf("ingoring unexpected socket for dovecot-compatible listener (no config found in listener-config)\n")
+				continue
+			}
+			for _, listener := range listeners {
+				ln, ok := listener.(*net.UnixListener)
+				if !ok {
+					fmt.Printf("ingoring invalid socket type %T for dovecot-compatible listener\n", listener)
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := runDovecotAuthSocketListener(ln, iface.WithAuthCache(lc.Dovecot.AuthCache)); err != nil {
+						fmt.Printf("warning running dovecot auth-socket failed: %s\n", err)
+					}
+				}()
+			}
 		case "http":
 			if lc.HTTP == nil {
 				fmt.Printf("ingoring unexpected socket for HTTP listener (no config found in listener-config)\n")
@@ -491,7 +1041,7 @@ func cmdRunSa(c *cli.Context) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					if err := runHTTPListener(ln, lc.HTTP, s.GetInterface()); err != nil {
+					if err := runHTTPListener(ln, lc.HTTP, iface.WithAuthCache(lc.HTTP.AuthCache)); err != nil {
 						fmt.Printf("warning running web-api failed: %s\n", err)
 					}
 				}()
@@ -509,7 +1059,7 @@ func cmdRunSa(c *cli.Context) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					if err := runHTTPsListener(ln, lc.HTTPs, s.GetInterface()); err != nil {
+					if err := runHTTPsListener(ln, lc.HTTPs, iface.WithAuthCache(lc.HTTPs.AuthCache)); err != nil {
 						fmt.Printf("warning running web-api failed: %s\n", err)
 					}
 				}()
@@ -527,7 +1077,7 @@ func cmdRunSa(c *cli.Context) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					if err := runLDAPListener(ln, lc.LDAP, s.GetInterface()); err != nil {
+					if err := runLDAPListener(ln, lc.LDAP, iface.WithAuthCache(lc.LDAP.AuthCache)); err != nil {
 						fmt.Printf("warning running web-api failed: %s\n", err)
 					}
 				}()
@@ -545,14 +1095,56 @@ func cmdRunSa(c *cli.Context) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					if err := runLDAPsListener(ln, lc.LDAPs, s.GetInterface()); err != nil {
+					if err := runLDAPsListener(ln, lc.LDAPs, iface.WithAuthCache(lc.LDAPs.AuthCache)); err != nil {
 						fmt.Printf("warning running web-api failed: %s\n", err)
 					}
 				}()
 			}
+		case "replication":
+			if lc.Replication == nil {
+				fmt.Printf("ingoring unexpected socket for replication listener (no config found in listener-config)\n")
+				continue
+			}
+			for _, listener := range listeners {
+				ln, ok := listener.(*net.TCPListener)
+				if !ok {
+					fmt.Printf("ingoring invalid socket type %T for replication listener\n", listener)
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := runReplicationListener(ln, lc.Replication, iface); err != nil {
+						fmt.Printf("warning running replication listener failed: %s\n", err)
+					}
+				}()
+			}
 		}
 
 	}
+	for name, conns := range packetConnGroups {
+		switch name {
+		case "radius":
+			if lc.Radius == nil {
+				fmt.Printf("ingoring unexpected socket for RADIUS listener (no config found in listener-config)\n")
+				continue
+			}
+			for _, conn := range conns {
+				uc, ok := conn.(*net.UDPConn)
+				if !ok {
+					fmt.Printf("ingoring invalid socket type %T for RADIUS listener\n", conn)
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := runRadiusConn(uc, lc.Radius, iface.WithAuthCache(lc.Radius.AuthCache)); err != nil {
+						fmt.Printf("warning running radius listener failed: %s\n", err)
+					}
+				}()
+			}
+		}
+	}
 	wg.Wait()
 
 	return cli.NewExitError("shutting down since all auth sockets have closed.", 0)
@@ -581,6 +1173,12 @@ func main() {
 			Usage:  "enable local or remote upgrades for password hashes",
 			EnvVar: "WHAWTY_AUTH_DO_UPGRADES",
 		},
+		cli.StringFlag{
+			Name:   "upgrade-config",
+			Value:  "",
+			Usage:  "path to the configuration file for remote upgrades",
+			EnvVar: "WHAWTY_AUTH_UPGRADE_CONFIG",
+		},
 		cli.StringFlag{
 			Name:   "policy-type",
 			Value:  "",
@@ -599,6 +1197,51 @@ func main() {
 			Usage:  "path to update hooks",
 			EnvVar: "WHAWTY_AUTH_HOOKS_DIR",
 		},
+		cli.StringFlag{
+			Name:   "hooks-config",
+			Value:  "",
+			Usage:  "path to the configuration file for the update hooks",
+			EnvVar: "WHAWTY_AUTH_HOOKS_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "state-dir",
+			Value:  "",
+			Usage:  "path to the directory to keep the last logins of all users in",
+			EnvVar: "WHAWTY_AUTH_STATE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			Value:  "",
+			Usage:  "path to the audit log",
+			EnvVar: "WHAWTY_AUTH_AUDIT_LOG",
+		},
+		cli.BoolFlag{
+			Name:   "audit-chain",
+			Usage:  "chain the records of the audit log using hashes",
+			EnvVar: "WHAWTY_AUTH_AUDIT_CHAIN",
+		},
+		cli.BoolFlag{
+			Name:   "audit-authentications",
+			Usage:  "also record all authentications in the audit log",
+			EnvVar: "WHAWTY_AUTH_AUDIT_AUTHENTICATIONS",
+		},
+		cli.BoolFlag{
+			Name:   "read-only",
+			Usage:  "reject all changes to the store, e.g. on replicas",
+			EnvVar: "WHAWTY_AUTH_READ_ONLY",
+		},
+		cli.DurationFlag{
+			Name:   "auth-cache-ttl",
+			Value:  0,
+			Usage:  "time to remember successful authentications for listeners with auth-cache enabled (0 disables the cache)",
+			EnvVar: "WHAWTY_AUTH_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "auth-cache-size",
+			Value:  1000,
+			Usage:  "maximum number of entries in the authentication cache",
+			EnvVar: "WHAWTY_AUTH_CACHE_SIZE",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -637,6 +1280,24 @@ func main() {
 			ArgsUsage: "<username> (true|false)",
 			Action:    cmdSetAdmin,
 		},
+		{
+			Name:  "group",
+			Usage: "manage group memberships of users",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add a user to a group",
+					ArgsUsage: "<username> <group>",
+					Action:    func(c *cli.Context) error { return cmdGroup(c, true) },
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a user from a group",
+					ArgsUsage: "<username> <group>",
+					Action:    func(c *cli.Context) error { return cmdGroup(c, false) },
+				},
+			},
+		},
 		{
 			Name:  "list",
 			Usage: "list all users",
@@ -645,14 +1306,128 @@ func main() {
 					Name:  "full",
 					Usage: "show full user list",
 				},
+				cli.StringFlag{
+					Name:  "inactive",
+					Usage: "only show users which haven't logged in for this long, e.g. '90d' (implies --full)",
+				},
 			},
 			Action: cmdList,
 		},
+		{
+			Name:  "app-password",
+			Usage: "manage app passwords of users",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "generate a new app password for a user",
+					ArgsUsage: "<username> <name>",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "scope",
+							Usage: "only accept the app password for this listener or service, may be given several times",
+						},
+					},
+					Action: cmdAppPasswordAdd,
+				},
+				{
+					Name:      "remove",
+					Usage:     "revoke an app password of a user",
+					ArgsUsage: "<username> <name>",
+					Action:    cmdAppPasswordRemove,
+				},
+				{
+					Name:      "list",
+					Usage:     "list the app passwords of a user",
+					ArgsUsage: "<username>",
+					Action:    cmdAppPasswordList,
+				},
+			},
+		},
+		{
+			Name:  "upgrade-status",
+			Usage: "show which parameter-sets are in use",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "users",
+					Usage: "also list all users sorted by the age of their password",
+				},
+			},
+			Action: cmdUpgradeStatus,
+		},
+		{
+			Name:      "expire-legacy",
+			Usage:     "mark all users on deprecated parameter-sets as must-reset",
+			ArgsUsage: "<parameter-set> [ <parameter-set> ... ]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reset-tokens",
+					Usage: "generate one-time password reset tokens for all expired users",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show which users would be expired",
+				},
+			},
+			Action: cmdExpireLegacy,
+		},
+		{
+			Name:      "rewrap",
+			Usage:     "rewrap all password hashes of a parameter-set using new HMAC keys",
+			ArgsUsage: "<from-parameter-set> <to-parameter-set>",
+			Action:    cmdRewrap,
+		},
+		{
+			Name:      "reencrypt",
+			Usage:     "re-encrypt all password hashes using the default encryption key",
+			ArgsUsage: "",
+			Action:    cmdReencrypt,
+		},
+		{
+			Name:  "audit",
+			Usage: "inspect the audit log",
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "check the hash chain of the audit log",
+					ArgsUsage: "<file> [ <file> ... ]",
+					Action:    cmdAuditVerify,
+				},
+			},
+		},
+		{
+			Name:  "hooks",
+			Usage: "manage the update hooks",
+			Subcommands: []cli.Command{
+				{
+					Name:      "test",
+					Usage:     "call all hooks with a synthetic event and wait for them to finish",
+					ArgsUsage: "[ <username> ]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "event",
+							Value: hookEventTest,
+							Usage: "type of the event to send",
+						},
+					},
+					Action: cmdHooksTest,
+				},
+			},
+		},
 		{
 			Name:      "authenticate",
 			Usage:     "check if username/password are valid",
 			ArgsUsage: "<username> [ <password> ]",
-			Action:    cmdAuthenticate,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "app-passwords",
+					Usage: "also accept app passwords",
+				},
+				cli.StringSliceFlag{
+					Name:  "scope",
+					Usage: "scope to check app passwords for, may be given several times (implies --app-passwords)",
+				},
+			},
+			Action: cmdAuthenticate,
 		},
 		{
 			Name:  "run",
@@ -682,6 +1457,15 @@ func main() {
 		},
 	}
 
+	app.Before = func(c *cli.Context) (err error) {
+		if path := c.GlobalString("audit-log"); path != "" {
+			if auditLog, err = newAuditLogger(path, c.GlobalBool("audit-chain"), c.GlobalBool("audit-authentications"), cliActor()); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error opening audit log: %s", err), 1)
+			}
+		}
+		return nil
+	}
+
 	wdl.Printf("calling app.Run()")
 	app.Run(os.Args) //nolint:errcheck
 }
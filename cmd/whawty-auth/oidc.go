@@ -0,0 +1,573 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCodeLifetime         = 60 * time.Second
+	oidcDefaultTokenLifetime = time.Hour
+	oidcMaxCodes             = 10000
+	oidcCSRFCookie           = "whawty-oidc-csrf"
+)
+
+var oidcLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>whawty.auth - Login</title>
+    <link rel="stylesheet" href="../admin/bootstrap/css/bootstrap.min.css">
+  </head>
+  <body>
+    <div class="container" style="max-width: 25em; margin-top: 5em;">
+      <h4 class="mb-3">Login to {{.Client}}</h4>
+      {{- if .Error}}
+      <div class="alert alert-danger">{{.Error}}</div>
+      {{- end}}
+      <form method="post" action="authorize">
+        {{- range .Params}}
+        <input type="hidden" name="{{.Name}}" value="{{.Value}}">
+        {{- end}}
+        <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+        <input class="form-control mb-2" type="text" name="username" placeholder="Username" value="{{.Username}}" autocomplete="username" required autofocus>
+        <input class="form-control mb-3" type="password" name="password" placeholder="Password" autocomplete="current-password" required>
+        <button class="btn btn-primary w-100" type="submit">Login</button>
+      </form>
+    </div>
+  </body>
+</html>
+`))
+
+// oidcAuthParams are the parameters of an authorization request which are passed on by the
+// login form.
+var oidcAuthParams = []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+type oidcCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	isAdmin     bool
+	expires     time.Time
+}
+
+type oidcIDTokenClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Audience          string `json:"aud"`
+	Expires           int64  `json:"exp"`
+	IssuedAt          int64  `json:"iat"`
+	Nonce             string `json:"nonce,omitempty"`
+	PreferredUsername string `json:"preferred_username"`
+	Admin             bool   `json:"admin"`
+}
+
+type oidcAccessTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	ClientID string `json:"client_id"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	Admin    bool   `json:"admin"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+type oidcUserinfoResponse struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Admin             bool   `json:"admin"`
+}
+
+type oidcErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type oidcProvider struct {
+	store         *Store
+	sessions      *webSessionFactory
+	issuer        string
+	csrfPath      string
+	key           *oidcKey
+	tokenLifetime time.Duration
+	clients       map[string]*oidcClientConfig
+
+	mutex sync.Mutex
+	codes map[string]*oidcCode
+}
+
+func newOIDCProvider(store *Store, sessions *webSessionFactory, config *oidcConfig) (p *oidcProvider, err error) {
+	p = &oidcProvider{store: store, sessions: sessions, tokenLifetime: config.TokenLifetime}
+	p.clients = make(map[string]*oidcClientConfig)
+	p.codes = make(map[string]*oidcCode)
+
+	issuer, err := url.Parse(config.Issuer)
+	if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" || issuer.RawQuery != "" || issuer.Fragment != "" {
+		return nil, fmt.Errorf("oidc: issuer '%s' is not a valid http(s) URL", config.Issuer)
+	}
+	p.issuer = strings.TrimSuffix(config.Issuer, "/")
+	// the path as seen by the user agent, this includes the path of the issuer
+	p.csrfPath = strings.TrimSuffix(issuer.Path, "/") + "/oidc/"
+	if p.tokenLifetime <= 0 {
+		p.tokenLifetime = oidcDefaultTokenLifetime
+	}
+	if config.SigningKey == "" {
+		return nil, errors.New("oidc: no signing key configured")
+	}
+	if p.key, err = loadOIDCKey(config.SigningKey); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Clients {
+		client := &config.Clients[i]
+		if client.ID == "" {
+			return nil, errors.New("oidc: client without id")
+		}
+		if _, exists := p.clients[client.ID]; exists {
+			return nil, fmt.Errorf("oidc: client '%s' is configured more than once", client.ID)
+		}
+		if len(client.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("oidc: client '%s' has no redirect URIs", client.ID)
+		}
+		for _, uri := range client.RedirectURIs {
+			if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+				return nil, fmt.Errorf("oidc: redirect URI '%s' of client '%s' is invalid", uri, client.ID)
+			}
+		}
+		p.clients[client.ID] = client
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) register(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/oidc/jwks", p.handleJWKS)
+	mux.HandleFunc("/oidc/authorize", p.handleAuthorize)
+	mux.HandleFunc("/oidc/token", p.handleToken)
+	mux.HandleFunc("/oidc/userinfo", p.handleUserinfo)
+}
+
+func (p *oidcProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	sendWebResponse(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                         p.issuer,
+		"authorization_endpoint":                         p.issuer + "/oidc/authorize",
+		"token_endpoint":                                 p.issuer + "/oidc/token",
+		"userinfo_endpoint":                              p.issuer + "/oidc/userinfo",
+		"jwks_uri":                                       p.issuer + "/oidc/jwks",
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{p.key.alg},
+		"scopes_supported":                               []string{"openid", "profile"},
+		"claims_supported":                               []string{"iss", "sub", "aud", "exp", "iat", "nonce", "preferred_username", "admin"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+func (p *oidcProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	sendWebResponse(w, http.StatusOK, p.key.JWKS())
+}
+
+func (p *oidcProvider) newCode(code *oidcCode) (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	code.expires = time.Now().Add(oidcCodeLifetime)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for id, c := range p.codes {
+		if now.After(c.expires) {
+			delete(p.codes, id)
+		}
+	}
+	if len(p.codes) >= oidcMaxCodes {
+		return "", errors.New("too many pending authorization codes")
+	}
+	p.codes[b64url(id)] = code
+	return b64url(id), nil
+}
+
+// takeCode returns the code with the given id. Codes may only be used once.
+func (p *oidcProvider) takeCode(id string) *oidcCode {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	code, exists := p.codes[id]
+	if !exists {
+		return nil
+	}
+	delete(p.codes, id)
+	if time.Now().After(code.expires) {
+		return nil
+	}
+	return code
+}
+
+// redirect sends the user agent back to the client using params as query parameters.
+func (p *oidcProvider) redirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if state := r.Form.Get("state"); state != "" {
+		query.Set("state", state)
+	}
+	query.Set("iss", p.issuer)
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (p *oidcProvider) redirectError(w http.ResponseWriter, r *http.Request, redirectURI, code, description string) {
+	p.redirect(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// showLogin renders the login form. Every form gets a new CSRF token which is also stored in
+// a cookie, logins are only accepted if both match.
+func (p *oidcProvider) showLogin(w http.ResponseWriter, r *http.Request, status int, username, errorStr string) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		wl.Printf("oidc: failed to create CSRF token: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type param struct{ Name, Value string }
+	data := struct {
+		Client    string
+		Username  string
+		Error     string
+		Params    []param
+		CSRFToken string
+	}{Client: r.Form.Get("client_id"), Username: username, Error: errorStr, CSRFToken: b64url(token)}
+	for _, name := range oidcAuthParams {
+		if value := r.Form.Get(name); value != "" {
+			data.Params = append(data.Params, param{name, value})
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCSRFCookie,
+		Value:    data.CSRFToken,
+		Path:     p.csrfPath,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	oidcLoginTemplate.Execute(w, data) //nolint:errcheck
+}
+
+func (p *oidcProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// errors concerning the client or the redirect URI must not be sent to the redirect URI
+	client, exists := p.clients[r.Form.Get("client_id")]
+	if !exists {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	valid := false
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			valid = true
+		}
+	}
+	if !valid {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		p.redirectError(w, r, redirectURI, "unsupported_response_type", "only the authorization code flow is supported")
+		return
+	}
+	scopes := strings.Fields(r.Form.Get("scope"))
+	hasOpenID := false
+	for _, scope := range scopes {
+		if scope == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		p.redirectError(w, r, redirectURI, "invalid_scope", "the scope openid is required")
+		return
+	}
+	if r.Form.Get("code_challenge") == "" || r.Form.Get("code_challenge_method") != "S256" {
+		p.redirectError(w, r, redirectURI, "invalid_request", "PKCE using S256 is required")
+		return
+	}
+
+	var username string
+	var isAdmin bool
+	if r.Method == http.MethodPost {
+		username = r.PostForm.Get("username")
+		if !checkOIDCCSRFToken(r) {
+			wdl.Printf("oidc: rejecting login of '%s' with invalid CSRF token", username)
+			p.showLogin(w, r, http.StatusForbidden, username, "The login form has expired, please try again.")
+			return
+		}
+		ok, admin, _, err := p.store.WithSource(r.RemoteAddr).Authenticate(username, r.PostForm.Get("password"))
+		if err == errAccessDenied {
+			p.redirectError(w, r, redirectURI, "access_denied", "the user may not use this service")
+			return
+		}
+		if err != nil || !ok {
+			p.showLogin(w, r, http.StatusUnauthorized, username, webAuthFailedError("oidc login", username, err))
+			return
+		}
+		isAdmin = admin
+		if status, _, session := p.sessions.Generate(username, isAdmin); status == http.StatusOK {
+			p.sessions.SetCookie(w, r, session)
+		}
+	} else {
+		prompt := r.Form.Get("prompt")
+		cookie, found := p.sessions.Cookie(r)
+		if found && prompt != "login" {
+			var status int
+			if status, _, username, isAdmin = p.sessions.Check(cookie); status != http.StatusOK {
+				username = ""
+			}
+		}
+		if username == "" {
+			if prompt == "none" {
+				p.redirectError(w, r, redirectURI, "login_required", "the user is not logged in")
+				return
+			}
+			p.showLogin(w, r, http.StatusOK, "", "")
+			return
+		}
+		// sessions are also created by logins to the web interface which don't check the access rules
+		if allowed, err := p.store.CheckAccess(username, isAdmin); err != nil || !allowed {
+			if err != nil {
+				wl.Printf("oidc: failed to check permissions of '%s': %v", username, err)
+			}
+			p.redirectError(w, r, redirectURI, "access_denied", "the user may not use this service")
+			return
+		}
+	}
+
+	code, err := p.newCode(&oidcCode{
+		clientID:    client.ID,
+		redirectURI: redirectURI,
+		challenge:   r.Form.Get("code_challenge"),
+		nonce:       r.Form.Get("nonce"),
+		username:    username,
+		isAdmin:     isAdmin,
+	})
+	if err != nil {
+		wl.Printf("oidc: failed to create authorization code: %v", err)
+		p.redirectError(w, r, redirectURI, "temporarily_unavailable", "")
+		return
+	}
+	wdl.Printf("oidc: issued authorization code for '%s' to client '%s'", username, client.ID)
+	p.redirect(w, r, redirectURI, url.Values{"code": {code}})
+}
+
+// checkOIDCCSRFToken checks whether the CSRF token of the login form matches the cookie.
+func checkOIDCCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(oidcCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) == 1
+}
+
+func sendOIDCError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendWebResponse(w, status, oidcErrorResponse{code, description})
+}
+
+// tokenClient authenticates the client of a token request, see RFC 6749 section 2.3.1.
+func (p *oidcProvider) tokenClient(r *http.Request) *oidcClientConfig {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, exists := p.clients[id]
+	if !exists {
+		return nil
+	}
+	if client.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return nil
+	}
+	return client
+}
+
+func (p *oidcProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	client := p.tokenClient(r)
+	if client == nil {
+		sendOIDCError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		sendOIDCError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := p.takeCode(r.PostForm.Get("code"))
+	if code == nil || code.clientID != client.ID || code.redirectURI != r.PostForm.Get("redirect_uri") {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(b64url(challenge[:])), []byte(code.challenge)) != 1 {
+		sendOIDCError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(p.tokenLifetime)
+	idToken, err := p.key.Sign("JWT", oidcIDTokenClaims{
+		Issuer:            p.issuer,
+		Subject:           code.username,
+		Audience:          client.ID,
+		Expires:           expires.Unix(),
+		IssuedAt:          now.Unix(),
+		Nonce:             code.nonce,
+		PreferredUsername: code.username,
+		Admin:             code.isAdmin,
+	})
+	if err != nil {
+		wl.Printf("oidc: failed to sign ID token: %v", err)
+		sendOIDCError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	accessToken, err := p.key.Sign("at+jwt", oidcAccessTokenClaims{
+		Issuer:   p.issuer,
+		Subject:  code.username,
+		Audience: p.issuer + "/oidc/userinfo",
+		ClientID: client.ID,
+		Expires:  expires.Unix(),
+		IssuedAt: now.Unix(),
+		Admin:    code.isAdmin,
+	})
+	if err != nil {
+		wl.Printf("oidc: failed to sign access token: %v", err)
+		sendOIDCError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	wdl.Printf("oidc: issued tokens for '%s' to client '%s'", code.username, client.ID)
+	w.Header().Set("Cache-Control", "no-store")
+	sendWebResponse(w, http.StatusOK, oidcTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.tokenLifetime / time.Second),
+		IDToken:     idToken,
+	})
+}
+
+func (p *oidcProvider) handleUserinfo(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	var claims oidcAccessTokenClaims
+	err := errors.New("no bearer token")
+	if strings.EqualFold(scheme, "Bearer") {
+		if err = p.key.Verify(token, "at+jwt", &claims); err == nil {
+			if claims.Issuer != p.issuer || time.Now().Unix() >= claims.Expires {
+				err = errors.New("token is expired or from a different issuer")
+			}
+		}
+	}
+	if err != nil {
+		wdl.Printf("oidc: userinfo request with invalid token: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sendWebResponse(w, http.StatusOK, oidcUserinfoResponse{
+		Subject:           claims.Subject,
+		PreferredUsername: claims.Subject,
+		Admin:             claims.Admin,
+	})
+}
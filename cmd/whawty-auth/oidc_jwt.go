@@ -0,0 +1,211 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// oidcKey is the key used to sign ID and access tokens. RSA keys use RS256, ECDSA keys on
+// the curve P-256 use ES256.
+type oidcKey struct {
+	signer crypto.Signer
+	alg    string
+	kid    string
+	jwk    map[string]string
+}
+
+func b64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func loadOIDCKey(path string) (*oidcKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("oidc: '%s' does not contain a PEM encoded key", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("oidc: unsupported PEM block type '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oidc: failed to parse signing key: %v", err)
+	}
+	return newOIDCKey(key)
+}
+
+func newOIDCKey(key interface{}) (*oidcKey, error) {
+	k := &oidcKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("oidc: RSA signing keys must have at least 2048 bits")
+		}
+		k.signer, k.alg = key, "RS256"
+		k.jwk = map[string]string{
+			"kty": "RSA",
+			"e":   b64url(big.NewInt(int64(key.E)).Bytes()),
+			"n":   b64url(key.N.Bytes()),
+		}
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("oidc: only ECDSA signing keys on the curve P-256 are supported")
+		}
+		k.signer, k.alg = key, "ES256"
+		k.jwk = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   b64url(key.X.FillBytes(make([]byte, 32))),
+			"y":   b64url(key.Y.FillBytes(make([]byte, 32))),
+		}
+	default:
+		return nil, fmt.Errorf("oidc: unsupported signing key type %T", key)
+	}
+
+	// the key id is the JWK thumbprint as defined in RFC 7638, encoding/json sorts the keys
+	thumbprint, err := json.Marshal(k.jwk)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	k.kid = b64url(sum[:])
+	return k, nil
+}
+
+// JWKS returns the JSON Web Key Set containing the public key.
+func (k *oidcKey) JWKS() interface{} {
+	jwk := map[string]string{"use": "sig", "alg": k.alg, "kid": k.kid}
+	for name, value := range k.jwk {
+		jwk[name] = value
+	}
+	return map[string]interface{}{"keys": []interface{}{jwk}}
+}
+
+// Sign returns a signed JWT containing claims.
+func (k *oidcKey) Sign(typ string, claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": typ})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64url(header) + "." + b64url(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64url(signature), nil
+}
+
+// Verify checks the signature of a JWT signed by Sign and decodes its claims. The type of
+// the token must match typ.
+func (k *oidcKey) Verify(token, typ string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	var header map[string]string
+	if err = json.Unmarshal(headerData, &header); err != nil {
+		return err
+	}
+	if header["alg"] != k.alg || header["kid"] != k.kid || header["typ"] != typ {
+		return errors.New("unexpected token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return err
+		}
+	case *ecdsa.PrivateKey:
+		if len(signature) != 64 {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, claims)
+}
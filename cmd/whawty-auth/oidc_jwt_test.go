@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+	Admin   bool   `json:"admin"`
+}
+
+func newTestOIDCKeys(t *testing.T) []*oidcKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var keys []*oidcKey
+	for _, key := range []interface{}{rsaKey, ecKey} {
+		k, err := newOIDCKey(key)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestOIDCKeyInvalid(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := newOIDCKey(rsaKey); err == nil {
+		t.Fatal("RSA keys with less than 2048 bits should be rejected")
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := newOIDCKey(ecKey); err == nil {
+		t.Fatal("ECDSA keys on curves other than P-256 should be rejected")
+	}
+	if _, err := newOIDCKey("key"); err == nil {
+		t.Fatal("unsupported key types should be rejected")
+	}
+}
+
+func TestOIDCKeySignVerify(t *testing.T) {
+	for _, k := range newTestOIDCKeys(t) {
+		token, err := k.Sign("JWT", testClaims{Subject: "alice", Admin: true})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		var claims testClaims
+		if err := k.Verify(token, "JWT", &claims); err != nil {
+			t.Fatalf("%s: verifying token failed: %v", k.alg, err)
+		}
+		if claims.Subject != "alice" || !claims.Admin {
+			t.Fatalf("%s: unexpected claims: %+v", k.alg, claims)
+		}
+		if err := k.Verify(token, "at+jwt", &claims); err == nil {
+			t.Fatalf("%s: verifying a token of a different type should fail", k.alg)
+		}
+
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(testClaims{Subject: "mallory", Admin: true})
+		if err := k.Verify(parts[0]+"."+b64url(forged)+"."+parts[2], "JWT", &claims); err == nil {
+			t.Fatalf("%s: verifying a token with modified claims should fail", k.alg)
+		}
+		if err := k.Verify(parts[0]+"."+parts[1], "JWT", &claims); err == nil {
+			t.Fatalf("%s: verifying a token without signature should fail", k.alg)
+		}
+	}
+
+	keys := newTestOIDCKeys(t)
+	other, err := newOIDCKey(keys[0].signer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	token, err := keys[1].Sign("JWT", testClaims{Subject: "alice"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := other.Verify(token, "JWT", &testClaims{}); err == nil {
+		t.Fatal("verifying a token signed by a different key should fail")
+	}
+}
+
+// TestOIDCKeyJWKS checks the tokens against the published keys, just like a relying party would.
+func TestOIDCKeyJWKS(t *testing.T) {
+	for _, k := range newTestOIDCKeys(t) {
+		jwks := k.JWKS().(map[string]interface{})["keys"].([]interface{})
+		if len(jwks) != 1 {
+			t.Fatalf("%s: JWKS should contain exactly one key", k.alg)
+		}
+		jwk := jwks[0].(map[string]string)
+		if jwk["kid"] != k.kid || jwk["alg"] != k.alg || jwk["use"] != "sig" {
+			t.Fatalf("%s: unexpected JWK: %v", k.alg, jwk)
+		}
+
+		token, err := k.Sign("JWT", testClaims{Subject: "alice"})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		parts := strings.Split(token, ".")
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		if !strings.Contains(string(header), `"kid":"`+k.kid+`"`) {
+			t.Fatalf("%s: token header doesn't contain the key id: %s", k.alg, header)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		param := func(name string) *big.Int {
+			data, err := base64.RawURLEncoding.DecodeString(jwk[name])
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			return new(big.Int).SetBytes(data)
+		}
+
+		switch jwk["kty"] {
+		case "RSA":
+			pub := &rsa.PublicKey{N: param("n"), E: int(param("e").Int64())}
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+				t.Fatalf("%s: signature doesn't match the JWK: %v", k.alg, err)
+			}
+		case "EC":
+			if len(signature) != 64 {
+				t.Fatalf("%s: unexpected signature length %d", k.alg, len(signature))
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: param("x"), Y: param("y")}
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if !ecdsa.Verify(pub, digest[:], r, s) {
+				t.Fatalf("%s: signature doesn't match the JWK", k.alg)
+			}
+		default:
+			t.Fatalf("%s: unexpected key type '%s'", k.alg, jwk["kty"])
+		}
+	}
+}
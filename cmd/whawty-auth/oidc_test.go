@@ -0,0 +1,343 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testOIDCIssuer   = "https://auth.example.com"
+	testOIDCRedirect = "https://app.example.com/callback"
+	testOIDCVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func newTestOIDCProvider(t *testing.T) *oidcProvider {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	p := &oidcProvider{issuer: testOIDCIssuer, csrfPath: "/oidc/", tokenLifetime: time.Hour}
+	if p.key, err = newOIDCKey(ecKey); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if p.sessions, err = NewWebSessionFactory(0, webSessionCookie); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	p.clients = map[string]*oidcClientConfig{
+		"app": {ID: "app", Secret: "app-secret", RedirectURIs: []string{testOIDCRedirect}},
+	}
+	p.codes = make(map[string]*oidcCode)
+	return p
+}
+
+func testOIDCChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64url(sum[:])
+}
+
+func (p *oidcProvider) testCode(t *testing.T) string {
+	code, err := p.newCode(&oidcCode{
+		clientID:    "app",
+		redirectURI: testOIDCRedirect,
+		challenge:   testOIDCChallenge(testOIDCVerifier),
+		nonce:       "nonce",
+		username:    "alice",
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return code
+}
+
+func (p *oidcProvider) testTokenRequest(code, verifier string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testOIDCRedirect},
+		"code_verifier": {verifier},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("app", "app-secret")
+	w := httptest.NewRecorder()
+	p.handleToken(w, r)
+	return w
+}
+
+func TestOIDCTokenPKCE(t *testing.T) {
+	p := newTestOIDCProvider(t)
+
+	// the example of RFC 7636 appendix B
+	if challenge := testOIDCChallenge(testOIDCVerifier); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("unexpected S256 code challenge: %s", challenge)
+	}
+
+	for _, verifier := range []string{"", "wrong-verifier", testOIDCChallenge(testOIDCVerifier)} {
+		if w := p.testTokenRequest(p.testCode(t), verifier); w.Code != http.StatusBadRequest {
+			t.Fatalf("token request with code_verifier '%s' should fail, got status %d", verifier, w.Code)
+		}
+	}
+
+	w := p.testTokenRequest(p.testCode(t), testOIDCVerifier)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token request failed with status %d: %s", w.Code, w.Body.String())
+	}
+	var response oidcTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var claims oidcIDTokenClaims
+	if err := p.key.Verify(response.IDToken, "JWT", &claims); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if claims.Issuer != testOIDCIssuer || claims.Subject != "alice" || claims.Audience != "app" || claims.Nonce != "nonce" {
+		t.Fatalf("unexpected ID token claims: %+v", claims)
+	}
+}
+
+func TestOIDCCodeSingleUse(t *testing.T) {
+	p := newTestOIDCProvider(t)
+
+	code := p.testCode(t)
+	if w := p.testTokenRequest(code, testOIDCVerifier); w.Code != http.StatusOK {
+		t.Fatalf("token request failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if w := p.testTokenRequest(code, testOIDCVerifier); w.Code != http.StatusBadRequest {
+		t.Fatalf("using a code twice should fail, got status %d", w.Code)
+	}
+
+	// failed attempts use up the code as well
+	code = p.testCode(t)
+	if w := p.testTokenRequest(code, "wrong-verifier"); w.Code != http.StatusBadRequest {
+		t.Fatalf("token request with wrong code_verifier should fail, got status %d", w.Code)
+	}
+	if w := p.testTokenRequest(code, testOIDCVerifier); w.Code != http.StatusBadRequest {
+		t.Fatalf("using a code after a failed attempt should fail, got status %d", w.Code)
+	}
+
+	if w := p.testTokenRequest("unknown", testOIDCVerifier); w.Code != http.StatusBadRequest {
+		t.Fatalf("using an unknown code should fail, got status %d", w.Code)
+	}
+}
+
+func TestOIDCCodeExpiry(t *testing.T) {
+	p := newTestOIDCProvider(t)
+
+	code := p.testCode(t)
+	expires := p.codes[code].expires
+	if lifetime := time.Until(expires); lifetime <= 0 || lifetime > oidcCodeLifetime {
+		t.Fatalf("unexpected code lifetime %v", lifetime)
+	}
+	p.codes[code].expires = time.Now().Add(-time.Second)
+	if w := p.testTokenRequest(code, testOIDCVerifier); w.Code != http.StatusBadRequest {
+		t.Fatalf("using an expired code should fail, got status %d", w.Code)
+	}
+
+	// expired codes are removed when new codes are issued
+	expired := p.testCode(t)
+	p.codes[expired].expires = time.Now().Add(-time.Second)
+	p.testCode(t)
+	if _, exists := p.codes[expired]; exists {
+		t.Fatal("expired codes should be removed")
+	}
+}
+
+var testOIDCCSRFField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func TestOIDCLoginCSRF(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	params := url.Values{
+		"client_id":             {"app"},
+		"redirect_uri":          {testOIDCRedirect},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {testOIDCChallenge(testOIDCVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	login := func() (token string, cookie *http.Cookie) {
+		w := httptest.NewRecorder()
+		p.handleAuthorize(w, httptest.NewRequest(http.MethodGet, "/oidc/authorize?"+params.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("showing the login form failed with status %d", w.Code)
+		}
+		match := testOIDCCSRFField.FindStringSubmatch(w.Body.String())
+		if match == nil {
+			t.Fatal("the login form doesn't contain a CSRF token")
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == oidcCSRFCookie {
+				cookie = c
+			}
+		}
+		if cookie == nil || cookie.Value != match[1] || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+			t.Fatalf("unexpected CSRF cookie: %v", cookie)
+		}
+		return match[1], cookie
+	}
+	token1, cookie1 := login()
+	token2, cookie2 := login()
+	if token1 == token2 {
+		t.Fatal("every login form should get a new CSRF token")
+	}
+
+	// the store is not set, so these requests must be rejected before the password is checked
+	for _, test := range []struct {
+		token  string
+		cookie *http.Cookie
+	}{
+		{"", nil},
+		{token1, nil},
+		{"", cookie1},
+		{token1, cookie2},
+		{token2, cookie1},
+	} {
+		form := url.Values{"username": {"alice"}, "password": {"secret"}}
+		for name, values := range params {
+			form[name] = values
+		}
+		if test.token != "" {
+			form.Set("csrf_token", test.token)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/oidc/authorize", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		w := httptest.NewRecorder()
+		p.handleAuthorize(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("login with CSRF token '%s' and cookie %v should be rejected, got status %d", test.token, test.cookie, w.Code)
+		}
+		if !testOIDCCSRFField.MatchString(w.Body.String()) {
+			t.Fatal("the login form should be shown again")
+		}
+	}
+}
+
+func TestOIDCAccessRules(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "oidc.key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ac, err := newAccessControl([]accessRuleConfig{{Service: "oidc", Admin: true}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	mux, err := newWebMux(newTestStore(t).GetInterface().WithAccessControl(ac), webSessionCookie, 0, false, "", &oidcConfig{
+		Issuer:     testOIDCIssuer,
+		SigningKey: keyFile,
+		Clients:    []oidcClientConfig{{ID: "app", Secret: "app-secret", RedirectURIs: []string{testOIDCRedirect}}},
+	}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	params := url.Values{
+		"client_id":             {"app"},
+		"redirect_uri":          {testOIDCRedirect},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {testOIDCChallenge(testOIDCVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	// redirected returns the parameters of the redirect to the client
+	redirected := func(w *httptest.ResponseRecorder) url.Values {
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected a redirect to the client, got status %d", w.Code)
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return location.Query()
+	}
+	login := func(username, password string) url.Values {
+		w := testWebRequest(mux, http.MethodGet, "/oidc/authorize?"+params.Encode(), "", nil)
+		match := testOIDCCSRFField.FindStringSubmatch(w.Body.String())
+		if match == nil {
+			t.Fatal("the login form doesn't contain a CSRF token")
+		}
+		form := url.Values{"username": {username}, "password": {password}, "csrf_token": {match[1]}}
+		for name, values := range params {
+			form[name] = values
+		}
+		header := http.Header{
+			"Content-Type": {"application/x-www-form-urlencoded"},
+			"Cookie":       {oidcCSRFCookie + "=" + match[1]},
+		}
+		return redirected(testWebRequest(mux, http.MethodPost, "/oidc/authorize", form.Encode(), header))
+	}
+	silentLogin := func(session string) url.Values {
+		header := http.Header{"Cookie": {webSessionCookie + "=" + session}}
+		return redirected(testWebRequest(mux, http.MethodGet, "/oidc/authorize?prompt=none&"+params.Encode(), "", header))
+	}
+
+	if query := login("user", "user-secret"); query.Get("error") != "access_denied" || query.Has("code") {
+		t.Fatalf("the login of a user denied by the access rules should fail, got %v", query)
+	}
+	if query := login("admin", "admin-secret"); query.Get("code") == "" {
+		t.Fatalf("the login of an admin should succeed, got %v", query)
+	}
+
+	// logins to the web interface are not subject to the access rules, sessions created by them
+	// must not be usable to get around the rules
+	if query := silentLogin(testWebSession(t, mux, "user", "user-secret")); query.Get("error") != "access_denied" || query.Has("code") {
+		t.Fatalf("silent login of a user denied by the access rules should fail, got %v", query)
+	}
+	if query := silentLogin(testWebSession(t, mux, "admin", "admin-secret")); query.Get("code") == "" {
+		t.Fatalf("silent login of an admin should succeed, got %v", query)
+	}
+}
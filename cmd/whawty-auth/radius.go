@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+type radiusClient struct {
+	network                     *net.IPNet
+	secret                      []byte
+	requireMessageAuthenticator bool
+}
+
+type radiusHandler struct {
+	store   *Store
+	clients []radiusClient
+}
+
+func newRadiusHandler(store *Store, config *radiusConfig) (*radiusHandler, error) {
+	h := &radiusHandler{store: store.WithAppPasswords(true, "radius").WithService("radius", "")}
+	if len(config.Clients) == 0 {
+		return nil, errors.New("radius: no clients configured")
+	}
+	for _, c := range config.Clients {
+		client := radiusClient{secret: []byte(c.Secret), requireMessageAuthenticator: c.RequireMessageAuthenticator}
+		if len(client.secret) == 0 {
+			return nil, fmt.Errorf("radius: client '%s' has no secret", c.Address)
+		}
+		if strings.Contains(c.Address, "/") {
+			_, network, err := net.ParseCIDR(c.Address)
+			if err != nil {
+				return nil, fmt.Errorf("radius: invalid client address: %v", err)
+			}
+			client.network = network
+		} else {
+			ip := net.ParseIP(c.Address)
+			if ip == nil {
+				return nil, fmt.Errorf("radius: invalid client address '%s'", c.Address)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			client.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		h.clients = append(h.clients, client)
+	}
+	return h, nil
+}
+
+// client returns the first client whose address matches addr.
+func (h *radiusHandler) client(addr net.Addr) *radiusClient {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	for i := range h.clients {
+		if h.clients[i].network.Contains(udpAddr.IP) {
+			return &h.clients[i]
+		}
+	}
+	return nil
+}
+
+func (h *radiusHandler) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	client := h.client(remoteAddr)
+	if client == nil {
+		return nil, fmt.Errorf("unknown client '%s'", remoteAddr)
+	}
+	return client.secret, nil
+}
+
+// checkMessageAuthenticator verifies the Message-Authenticator attribute of p, see RFC 3579
+// section 3.2. It reports whether the attribute is present at all and whether it is valid.
+func checkMessageAuthenticator(p *radius.Packet) (present, valid bool) {
+	var avp *radius.AVP
+	for _, a := range p.Attributes {
+		if a.Type != rfc2869.MessageAuthenticator_Type {
+			continue
+		}
+		if avp != nil {
+			return true, false
+		}
+		avp = a
+	}
+	if avp == nil {
+		return false, false
+	}
+	if len(avp.Attribute) != md5.Size {
+		return true, false
+	}
+
+	received := avp.Attribute
+	avp.Attribute = make(radius.Attribute, md5.Size)
+	b, err := p.MarshalBinary()
+	avp.Attribute = received
+	if err != nil {
+		return true, false
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	return true, hmac.Equal(mac.Sum(nil), received)
+}
+
+// withMessageAuthenticator returns a copy of the response p which has a Message-Authenticator
+// as its first attribute. Sending it with every response protects clients against forged
+// responses (CVE-2024-3596).
+func withMessageAuthenticator(p *radius.Packet) (*radius.Packet, error) {
+	response := *p
+	ma := &radius.AVP{Type: rfc2869.MessageAuthenticator_Type, Attribute: make(radius.Attribute, md5.Size)}
+	response.Attributes = append(radius.Attributes{ma}, p.Attributes...)
+
+	// the authenticator of a response is still the request authenticator at this point
+	b, err := response.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(md5.New, response.Secret)
+	mac.Write(b)
+	copy(ma.Attribute, mac.Sum(nil))
+	return &response, nil
+}
+
+func (h *radiusHandler) respond(w radius.ResponseWriter, r *radius.Request, p *radius.Packet) {
+	response, err := withMessageAuthenticator(p)
+	if err == nil {
+		err = w.Write(response)
+	}
+	if err != nil {
+		wl.Printf("radius: failed to send response to '%s': %v", r.RemoteAddr, err)
+	}
+}
+
+func (h *radiusHandler) authenticate(source net.Addr, login, password string) bool {
+	store, username := h.store.ForLogin(login, "")
+	ok, _, _, err := store.WithSource(auditSource(source)).Authenticate(username, password)
+	if err != nil {
+		wdl.Printf("radius: authentication failed for '%s': %v", login, err)
+	}
+	return ok
+}
+
+func (h *radiusHandler) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		wdl.Printf("radius: ignoring %v from '%s'", r.Code, r.RemoteAddr)
+		return
+	}
+	client := h.client(r.RemoteAddr)
+	if client == nil {
+		return
+	}
+
+	eapMessage := rfc2869.EAPMessage_Get(r.Packet)
+	present, valid := checkMessageAuthenticator(r.Packet)
+	if present && !valid {
+		wdl.Printf("radius: dropping request from '%s' with invalid Message-Authenticator", r.RemoteAddr)
+		return
+	}
+	if !present && (client.requireMessageAuthenticator || eapMessage != nil) {
+		wdl.Printf("radius: dropping request from '%s' without Message-Authenticator", r.RemoteAddr)
+		return
+	}
+
+	if eapMessage != nil {
+		wdl.Printf("radius: rejecting EAP request from '%s' (EAP is not supported)", r.RemoteAddr)
+		h.respond(w, r, r.Response(radius.CodeAccessReject))
+		return
+	}
+
+	username := rfc2865.UserName_GetString(r.Packet)
+	password, err := rfc2865.UserPassword_LookupString(r.Packet)
+	if err != nil {
+		wdl.Printf("radius: rejecting request from '%s' for '%s': no usable User-Password", r.RemoteAddr, username)
+		h.respond(w, r, r.Response(radius.CodeAccessReject))
+		return
+	}
+	if !h.authenticate(r.RemoteAddr, username, password) {
+		h.respond(w, r, r.Response(radius.CodeAccessReject))
+		return
+	}
+	h.respond(w, r, r.Response(radius.CodeAccessAccept))
+}
+
+func newRadiusServer(store *Store, config *radiusConfig) (*radius.PacketServer, error) {
+	h, err := newRadiusHandler(store, config)
+	if err != nil {
+		return nil, err
+	}
+	return &radius.PacketServer{Handler: h, SecretSource: h, ErrorLog: wdl}, nil
+}
+
+func runRadiusConn(conn *net.UDPConn, config *radiusConfig, store *Store) error {
+	server, err := newRadiusServer(store.WithListener("radius:"+conn.LocalAddr().String()), config)
+	if err != nil {
+		return err
+	}
+	wl.Printf("radius: listening on '%s'", conn.LocalAddr())
+	return server.Serve(conn)
+}
+
+func runRadiusAddr(addr string, config *radiusConfig, store *Store) error {
+	if addr == "" {
+		addr = ":1812"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return runRadiusConn(conn.(*net.UDPConn), config, store)
+}
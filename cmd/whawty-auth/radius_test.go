@@ -0,0 +1,202 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+var testRadiusSecret = []byte("radius-secret")
+
+// newTestRadiusServer starts a radius server for store which accepts requests from localhost.
+func newTestRadiusServer(t *testing.T, store *Store, requireMessageAuthenticator bool) string {
+	config := &radiusConfig{Clients: []radiusClientConfig{{Address: "127.0.0.1", Secret: string(testRadiusSecret), RequireMessageAuthenticator: requireMessageAuthenticator}}}
+	server, err := newRadiusServer(store, config)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return conn.LocalAddr().String()
+}
+
+func newTestRadiusRequest(t *testing.T, username, password string) *radius.Packet {
+	p := radius.New(radius.CodeAccessRequest, testRadiusSecret)
+	if err := rfc2865.UserName_SetString(p, username); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := rfc2865.UserPassword_SetString(p, password); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return p
+}
+
+// addTestMessageAuthenticator adds a Message-Authenticator to the request p. If valid is false
+// the value will be wrong.
+func addTestMessageAuthenticator(t *testing.T, p *radius.Packet, valid bool) {
+	ma := make(radius.Attribute, md5.Size)
+	p.Add(rfc2869.MessageAuthenticator_Type, ma)
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	copy(ma, mac.Sum(nil))
+	if !valid {
+		ma[0] ^= 0xff
+	}
+}
+
+// exchangeTestRadius sends p to the server at addr. The client verifies the response
+// authenticator. Dropped requests result in a nil response.
+func exchangeTestRadius(t *testing.T, addr string, p *radius.Packet) *radius.Packet {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	response, err := (&radius.Client{MaxPacketErrors: 1}).Exchange(ctx, p, addr)
+	if err == context.DeadlineExceeded {
+		return nil
+	}
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the Message-Authenticator of a response is calculated using the request authenticator
+	if len(response.Attributes) == 0 || response.Attributes[0].Type != rfc2869.MessageAuthenticator_Type {
+		t.Fatalf("the first attribute of the response should be the Message-Authenticator: %v", response.Attributes)
+	}
+	signed := *response
+	signed.Authenticator = p.Authenticator
+	if present, valid := checkMessageAuthenticator(&signed); !present || !valid {
+		t.Fatal("the response contains an invalid Message-Authenticator")
+	}
+	return response
+}
+
+func TestRadiusPAP(t *testing.T) {
+	addr := newTestRadiusServer(t, newTestStore(t).GetInterface(), false)
+
+	testVectors := []struct {
+		username string
+		password string
+		code     radius.Code
+	}{
+		{"user", "user-secret", radius.CodeAccessAccept},
+		{"user", "wrong", radius.CodeAccessReject},
+		{"nobody", "user-secret", radius.CodeAccessReject},
+	}
+	for _, vector := range testVectors {
+		for _, withMessageAuthenticator := range []bool{false, true} {
+			request := newTestRadiusRequest(t, vector.username, vector.password)
+			if withMessageAuthenticator {
+				addTestMessageAuthenticator(t, request, true)
+			}
+			response := exchangeTestRadius(t, addr, request)
+			if response == nil {
+				t.Fatalf("request for '%s' has been dropped", vector.username)
+			}
+			if response.Code != vector.code {
+				t.Fatalf("request for '%s' with password '%s': expected %v, got %v", vector.username, vector.password, vector.code, response.Code)
+			}
+		}
+	}
+}
+
+func TestRadiusLongPassword(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	password := "a password which is longer than sixteen bytes and needs more blocks"
+	if err := s.Add("long", password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	addr := newTestRadiusServer(t, s, false)
+	if response := exchangeTestRadius(t, addr, newTestRadiusRequest(t, "long", password)); response == nil || response.Code != radius.CodeAccessAccept {
+		t.Fatalf("authentication with a long password should succeed, got %v", response)
+	}
+}
+
+func TestRadiusMessageAuthenticator(t *testing.T) {
+	s := newTestStore(t).GetInterface()
+	addr := newTestRadiusServer(t, s, false)
+
+	request := newTestRadiusRequest(t, "user", "user-secret")
+	addTestMessageAuthenticator(t, request, false)
+	if response := exchangeTestRadius(t, addr, request); response != nil {
+		t.Fatalf("requests with an invalid Message-Authenticator should be dropped, got %v", response.Code)
+	}
+
+	// requests containing an EAP message need a Message-Authenticator and are rejected
+	request = newTestRadiusRequest(t, "user", "user-secret")
+	rfc2869.EAPMessage_Set(request, []byte{2, 1, 0, 9, 1, 'u', 's', 'e', 'r'})
+	if response := exchangeTestRadius(t, addr, request); response != nil {
+		t.Fatalf("EAP requests without Message-Authenticator should be dropped, got %v", response.Code)
+	}
+	addTestMessageAuthenticator(t, request, true)
+	if response := exchangeTestRadius(t, addr, request); response == nil || response.Code != radius.CodeAccessReject {
+		t.Fatalf("EAP requests should be rejected, got %v", response)
+	}
+
+	addr = newTestRadiusServer(t, s, true)
+	if response := exchangeTestRadius(t, addr, newTestRadiusRequest(t, "user", "user-secret")); response != nil {
+		t.Fatalf("requests without Message-Authenticator should be dropped if it is required, got %v", response.Code)
+	}
+	request = newTestRadiusRequest(t, "user", "user-secret")
+	addTestMessageAuthenticator(t, request, true)
+	if response := exchangeTestRadius(t, addr, request); response == nil || response.Code != radius.CodeAccessAccept {
+		t.Fatalf("requests with a valid Message-Authenticator should be accepted, got %v", response)
+	}
+}
+
+func TestRadiusResponseSecret(t *testing.T) {
+	addr := newTestRadiusServer(t, newTestStore(t).GetInterface(), false)
+
+	// the server answers using its own secret, which the client can't verify
+	request := radius.New(radius.CodeAccessRequest, []byte("wrong-secret"))
+	rfc2865.UserName_SetString(request, "user")
+	rfc2865.UserPassword_SetString(request, "user-secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if response, err := (&radius.Client{MaxPacketErrors: 1}).Exchange(ctx, request, addr); err == nil {
+		t.Fatalf("the response to a request using the wrong secret shouldn't be authentic, got %v", response.Code)
+	}
+}
@@ -0,0 +1,328 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	lib "github.com/whawty/auth/store"
+)
+
+// The master sends a snapshot of all users to every replica which connects, followed by an update
+// or remove message for every change. Pings are sent regularly so replicas can detect dead
+// connections and compute the replication lag. The snapshot contains the ping interval of the
+// master, replicas consider the connection dead if nothing arrives for three intervals. Messages
+// are JSON objects, one per line.
+const (
+	replicationSnapshot = "snapshot"
+	replicationUpdate   = "update"
+	replicationRemove   = "remove"
+	replicationPing     = "ping"
+
+	replicationDefaultPingInterval = 10 * time.Second
+	replicationDefaultTimeout      = 30 * time.Second
+	replicationDefaultBuffer       = 100
+)
+
+var (
+	replicationReplicas    = expvar.NewInt("replication_replicas")
+	replicationConnected   = expvar.NewInt("replication_connected")
+	replicationLag         = expvar.NewFloat("replication_lag_seconds")
+	replicationLastMessage = expvar.NewInt("replication_last_message")
+	replicationResyncs     = expvar.NewInt("replication_resyncs")
+)
+
+type replicationMessage struct {
+	Type         string         `json:"type"`
+	Time         time.Time      `json:"time"`
+	Users        []lib.UserFile `json:"users,omitempty"`
+	Username     string         `json:"username,omitempty"`
+	PingInterval time.Duration  `json:"ping_interval,omitempty"`
+}
+
+// replicationTimeout returns timeout or, if it is not set, the default.
+func replicationTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return replicationDefaultTimeout
+	}
+	return timeout
+}
+
+// replicaState tracks the connection of a replica to its master. It is used by the health check.
+type replicaState struct {
+	mutex       sync.Mutex
+	maxLag      time.Duration
+	connected   bool
+	lastMessage time.Time
+	lag         time.Duration
+}
+
+// replicaStatus is nil unless the agent runs as replica.
+var replicaStatus *replicaState
+
+func newReplicaState(maxLag time.Duration) *replicaState {
+	if maxLag <= 0 {
+		maxLag = time.Minute
+	}
+	return &replicaState{maxLag: maxLag}
+}
+
+func (r *replicaState) received(sent time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.connected = true
+	r.lastMessage = time.Now()
+	if r.lag = r.lastMessage.Sub(sent); r.lag < 0 {
+		r.lag = 0
+	}
+	replicationConnected.Set(1)
+	replicationLag.Set(r.lag.Seconds())
+	replicationLastMessage.Set(r.lastMessage.Unix())
+}
+
+func (r *replicaState) disconnected() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.connected = false
+	replicationConnected.Set(0)
+}
+
+func (r *replicaState) status() (connected bool, lastMessage time.Time, lag time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.connected, r.lastMessage, r.lag
+}
+
+// check returns an error if the replica is not connected or lags behind for more than max-lag.
+func (r *replicaState) check() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.connected {
+		return errors.New("replication: not connected to master")
+	}
+	if since := time.Since(r.lastMessage); since > r.maxLag {
+		return fmt.Errorf("replication: no message from master since %v", since.Round(time.Second))
+	}
+	if r.lag > r.maxLag {
+		return fmt.Errorf("replication: lag of %v exceeds max-lag", r.lag.Round(time.Second))
+	}
+	return nil
+}
+
+// *********************************************************
+// Master
+
+func handleReplica(conn *tls.Conn, config *replicationConfig, store *Store) {
+	defer conn.Close()
+
+	timeout := replicationTimeout(config.Timeout)
+	pingInterval := config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = replicationDefaultPingInterval
+	}
+	buffer := config.Buffer
+	if buffer <= 0 {
+		buffer = replicationDefaultBuffer
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck
+	if err := conn.Handshake(); err != nil {
+		wl.Printf("replication: TLS handshake with '%s' failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+	events := make(chan replicationMessage, buffer)
+	snapshot, err := store.Subscribe(events)
+	if err != nil {
+		wl.Printf("replication: failed to create snapshot for replica '%s': %v", name, err)
+		return
+	}
+	defer store.Unsubscribe(events)
+	replicationReplicas.Add(1)
+	defer replicationReplicas.Add(-1)
+	wl.Printf("replication: replica '%s' connected from '%s'", name, conn.RemoteAddr())
+
+	encoder := json.NewEncoder(conn)
+	send := func(msg replicationMessage) error {
+		conn.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck
+		return encoder.Encode(msg)
+	}
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	snapshot.PingInterval = pingInterval
+	err = send(snapshot)
+	for err == nil {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				wl.Printf("replication: replica '%s' can't keep up, disconnecting", name)
+				return
+			}
+			err = send(msg)
+		case <-ping.C:
+			err = send(replicationMessage{Type: replicationPing, Time: time.Now()})
+		}
+	}
+	wl.Printf("replication: connection to replica '%s' failed: %v", name, err)
+}
+
+func runReplicationListener(listener *net.TCPListener, config *replicationConfig, store *Store) error {
+	if config.TLS == nil {
+		return errors.New("replication: tls is not configured")
+	}
+	tlsConfig, err := config.TLS.ToGoTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig.ClientCAs == nil {
+		return errors.New("replication: ca-certificates are needed to verify the replicas")
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	wl.Printf("replication: listening on '%s'", listener.Addr())
+	ln := tls.NewListener(tcpKeepAliveListener{listener}, tlsConfig)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleReplica(conn.(*tls.Conn), config, store)
+	}
+}
+
+func runReplicationAddr(addr string, config *replicationConfig, store *Store) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return runReplicationListener(listener.(*net.TCPListener), config, store)
+}
+
+// *********************************************************
+// Replica
+
+// replicateFrom connects to the master and applies all changes it receives until the connection
+// fails. synced is true if the initial snapshot has been applied.
+func replicateFrom(config *replicaConfig, tlsConfig *tls.Config, store *Store, state *replicaState) (synced bool, err error) {
+	timeout := replicationTimeout(config.Timeout)
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 3 * time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", config.Master, tlsConfig)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// until the snapshot tells us the ping interval of the master the timeout is used
+	readTimeout := timeout
+	decoder := json.NewDecoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout)) //nolint:errcheck
+		var msg replicationMessage
+		if err = decoder.Decode(&msg); err != nil {
+			return
+		}
+		if !synced && msg.Type != replicationSnapshot {
+			return false, fmt.Errorf("expected snapshot but got '%s' message", msg.Type)
+		}
+
+		switch msg.Type {
+		case replicationSnapshot:
+			if msg.PingInterval > 0 {
+				readTimeout = 3 * msg.PingInterval
+			}
+			if err = store.Replicate(true, msg.Users, nil); err == nil {
+				if !synced {
+					wl.Printf("replication: synchronized %d users from master '%s'", len(msg.Users), config.Master)
+				}
+				synced = true
+				replicationResyncs.Add(1)
+			}
+		case replicationUpdate:
+			err = store.Replicate(false, msg.Users, nil)
+		case replicationRemove:
+			err = store.Replicate(false, nil, []string{msg.Username})
+		case replicationPing:
+		default:
+			wdl.Printf("replication: ignoring unknown message type '%s'", msg.Type)
+		}
+		if err != nil {
+			return synced, fmt.Errorf("applying %s failed: %v", msg.Type, err)
+		}
+		state.received(msg.Time)
+	}
+}
+
+func runReplica(config *replicaConfig, store *Store, state *replicaState) error {
+	if config.Master == "" {
+		return errors.New("replication: the address of the master is missing")
+	}
+	if config.TLS == nil {
+		return errors.New("replication: tls is not configured")
+	}
+	tlsConfig, err := config.TLS.ToGoTLSConfig()
+	if err != nil {
+		return err
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return errors.New("replication: the replica needs a client certificate")
+	}
+
+	wl.Printf("replication: replicating from master '%s'", config.Master)
+	store = store.WithActor("replication").WithSource(config.Master)
+	backoff := time.Second
+	for {
+		synced, err := replicateFrom(config, tlsConfig, store, state)
+		state.disconnected()
+		if synced {
+			backoff = time.Second
+		}
+		wl.Printf("replication: connection to master '%s' failed: %v, reconnecting in %v", config.Master, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
@@ -31,6 +31,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"os"
 
@@ -40,17 +41,18 @@ import (
 func callback(login, password, service, realm, path string, store *Store) (ok bool, msg string, err error) {
 	wdl.Printf("auth request on '%s': [user=%s] [service=%s] [realm=%s]", path, login, service, realm)
 
-	ok, _, _, err = store.Authenticate(login, password)
-	if err != nil {
-		return false, "", err
+	store, username := store.ForLogin(login, realm)
+	ok, _, _, err = store.WithAppPasswords(true, "saslauthd", service).WithService(service, realm).WithListener("saslauthd:"+path).Authenticate(username, password)
+	if err == errAccessDenied {
+		return false, fmt.Sprintf("access to service '%s' denied", service), nil
 	}
-	if ok {
-		msg = "successfully authenticated"
-	} else {
-		msg = "wrong credentials"
+	if err != nil || !ok {
+		if err != nil {
+			wdl.Printf("auth request on '%s' failed for '%s': %v", path, login, err)
+		}
+		return false, authFailedMessage, nil
 	}
-
-	return ok, msg, nil
+	return true, "successfully authenticated", nil
 }
 
 func runSaslAuthSocket(path string, store *Store) error {
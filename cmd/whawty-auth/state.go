@@ -0,0 +1,269 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	lib "github.com/whawty/auth/store"
+)
+
+// loginStateFlushInterval is the time between writes of the login state by the agent.
+const loginStateFlushInterval = time.Minute // TODO: hardcoded value
+
+// loginStateUnknownListener is used for logins through interfaces which have no listener.
+const loginStateUnknownListener = "unknown"
+
+// loginState keeps track of the last successful and failed logins of all users per listener.
+// The state is kept in a file in the state-dir and not in the base directory of the store so
+// logins don't change the hash files. Logins are recorded in memory and only the agent writes
+// them to disk, at most once every loginStateFlushInterval and when it is terminated.
+type loginState struct {
+	file  string
+	mutex sync.Mutex
+	users map[string]map[string]*lib.UserLogins
+	dirty bool
+}
+
+// loginStates are all login states started by the agent, they are written to disk once the agent
+// gets terminated.
+var (
+	loginStatesMutex sync.Mutex
+	loginStates      []*loginState
+	loginStatesOnce  sync.Once
+)
+
+// newLoginState loads the login state of the store at storeDir from stateDir. It returns nil if
+// stateDir is empty.
+func newLoginState(stateDir, storeDir string) (*loginState, error) {
+	if stateDir == "" {
+		return nil, nil
+	}
+	if info, err := os.Stat(stateDir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("state-dir '%s' is not a directory", stateDir)
+	}
+
+	// several stores may use the same state-dir
+	digest := sha256.Sum256([]byte(storeDir))
+	st := &loginState{users: make(map[string]map[string]*lib.UserLogins)}
+	st.file = filepath.Join(stateDir, fmt.Sprintf("logins-%s.json", hex.EncodeToString(digest[:8])))
+	data, err := os.ReadFile(st.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &st.users); err != nil {
+		return nil, fmt.Errorf("error reading login state '%s': %v", st.file, err)
+	}
+	return st, nil
+}
+
+// record remembers a login of username using listener.
+func (st *loginState) record(username, listener string, ok bool) {
+	if st == nil {
+		return
+	}
+	if listener == "" {
+		listener = loginStateUnknownListener
+	}
+	now := time.Now()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	listeners, exists := st.users[username]
+	if !exists {
+		listeners = make(map[string]*lib.UserLogins)
+		st.users[username] = listeners
+	}
+	logins, exists := listeners[listener]
+	if !exists {
+		logins = &lib.UserLogins{}
+		listeners[listener] = logins
+	}
+	if ok {
+		logins.LastLogin = &now
+	} else {
+		logins.LastFailedLogin = &now
+	}
+	st.dirty = true
+}
+
+// remove forgets the logins of username.
+func (st *loginState) remove(username string) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, exists := st.users[username]; exists {
+		delete(st.users, username)
+		st.dirty = true
+	}
+}
+
+// prune forgets the logins of all users which are not in list.
+func (st *loginState) prune(list lib.UserListFull) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for username := range st.users {
+		if _, exists := list[username]; !exists {
+			delete(st.users, username)
+			st.dirty = true
+		}
+	}
+}
+
+// flush writes the login state to disk if it has changed.
+func (st *loginState) flush() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if !st.dirty {
+		return
+	}
+	data, err := json.Marshal(st.users)
+	if err == nil {
+		tmp := st.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, st.file)
+		}
+	}
+	if err != nil {
+		wl.Printf("state: error writing login state: %v", err)
+		return
+	}
+	st.dirty = false
+	wdl.Printf("state: wrote login state of %d users to '%s'", len(st.users), st.file)
+}
+
+// sync removes the users which no longer exist in the store and writes the login state to disk.
+// Users may also be removed by the commands while the agent is running, so the list of users is
+// always read from the store.
+func (st *loginState) sync(list func() (lib.UserListFull, error)) {
+	users, err := list()
+	if err != nil {
+		wl.Printf("state: error listing users: %v", err)
+	} else {
+		st.prune(users)
+	}
+	st.flush()
+}
+
+// start writes the login state to disk periodically and when the agent is terminated. list is
+// used to find the users which have been removed from the store.
+func (st *loginState) start(list func() (lib.UserListFull, error)) {
+	if st == nil {
+		return
+	}
+	loginStatesMutex.Lock()
+	loginStates = append(loginStates, st)
+	loginStatesMutex.Unlock()
+	loginStatesOnce.Do(func() { go flushLoginStatesOnExit() })
+
+	go func() {
+		for range time.Tick(loginStateFlushInterval) {
+			st.sync(list)
+		}
+	}()
+}
+
+// flushLoginStates writes all login states started by the agent to disk.
+func flushLoginStates() {
+	loginStatesMutex.Lock()
+	defer loginStatesMutex.Unlock()
+	for _, st := range loginStates {
+		st.flush()
+	}
+}
+
+// flushLoginStatesOnExit waits for the agent to be terminated, writes all login states to disk and
+// exits.
+func flushLoginStatesOnExit() {
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-terminate
+	wl.Printf("state: got signal '%v', writing login state", sig)
+	flushLoginStates()
+	os.Exit(0)
+}
+
+// lastLogins adds the logins of all users in list. Times already set in list are only replaced
+// by more recent ones.
+func (st *loginState) lastLogins(list lib.UserListFull) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for username, listeners := range st.users {
+		user, exists := list[username]
+		if !exists {
+			continue
+		}
+		user.Listeners = make(map[string]lib.UserLogins)
+		for listener, logins := range listeners {
+			user.Listeners[listener] = *logins
+			mergeLogins(&user.UserLogins, *logins)
+		}
+		list[username] = user
+	}
+}
+
+// mergeLogins sets the times in dst to the ones in src if they are more recent.
+func mergeLogins(dst *lib.UserLogins, src lib.UserLogins) {
+	if src.LastLogin != nil && (dst.LastLogin == nil || src.LastLogin.After(*dst.LastLogin)) {
+		dst.LastLogin = src.LastLogin
+	}
+	if src.LastFailedLogin != nil && (dst.LastFailedLogin == nil || src.LastFailedLogin.After(*dst.LastFailedLogin)) {
+		dst.LastFailedLogin = src.LastFailedLogin
+	}
+}
+
+// lastActivity returns the time of the last successful login or the last password change of
+// user, whichever is more recent.
+func lastActivity(user lib.UserFull) time.Time {
+	if user.LastLogin != nil && user.LastLogin.After(user.LastChanged) {
+		return *user.LastLogin
+	}
+	return user.LastChanged
+}
@@ -0,0 +1,327 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/whawty/auth/store"
+)
+
+func newTestLoginState(t *testing.T, stateDir string) *loginState {
+	st, err := newLoginState(stateDir, "/path/to/store")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return st
+}
+
+// newTestStoreWithState creates a test store, see newTestStore, which keeps track of the logins
+// in a temporary state-dir.
+func newTestStoreWithState(t *testing.T) *store {
+	s := newTestStore(t)
+	var err error
+	if s.logins, err = newLoginState(t.TempDir(), s.dir.BaseDir); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return s
+}
+
+func TestLoginStateRecord(t *testing.T) {
+	stateDir := t.TempDir()
+	st := newTestLoginState(t, stateDir)
+	before := time.Now()
+	st.record("alice", "ldap", true)
+	st.record("alice", "", false)
+	st.record("bob", "ldap", false)
+
+	alice := st.users["alice"]
+	if len(alice) != 2 || alice["ldap"].LastLogin == nil || alice["ldap"].LastFailedLogin != nil || alice["ldap"].LastLogin.Before(before) {
+		t.Fatalf("unexpected logins of alice: %+v", alice)
+	}
+	if logins := alice[loginStateUnknownListener]; logins == nil || logins.LastLogin != nil || logins.LastFailedLogin == nil {
+		t.Fatal("logins without a listener should be recorded for the unknown listener")
+	}
+	if !st.dirty {
+		t.Fatal("the state should be dirty after recording logins")
+	}
+
+	st.flush()
+	info, err := os.Stat(st.file)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if info.Mode().Perm() != 0600 || filepath.Dir(st.file) != stateDir || st.dirty {
+		t.Fatalf("unexpected state file '%s' (%v)", st.file, info.Mode())
+	}
+
+	st2 := newTestLoginState(t, stateDir)
+	if len(st2.users) != 2 || !st2.users["alice"]["ldap"].LastLogin.Equal(*alice["ldap"].LastLogin) || st2.users["bob"]["ldap"].LastFailedLogin == nil {
+		t.Fatalf("the state should be loaded from the state-dir: %+v", st2.users)
+	}
+	if other, err := newLoginState(stateDir, "/path/to/other-store"); err != nil || len(other.users) != 0 {
+		t.Fatal("every store should use its own state")
+	}
+
+	if err := os.WriteFile(st.file, []byte("invalid"), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := newLoginState(stateDir, "/path/to/store"); err == nil {
+		t.Fatal("a corrupted state should be an error")
+	}
+	if _, err := newLoginState(st.file, "/path/to/store"); err == nil {
+		t.Fatal("a state-dir which is not a directory should be an error")
+	}
+	if st, err := newLoginState("", "/path/to/store"); err != nil || st != nil {
+		t.Fatal("the state should be disabled without a state-dir")
+	}
+	var disabled *loginState
+	disabled.record("alice", "ldap", true)
+	disabled.remove("alice")
+	disabled.lastLogins(lib.UserListFull{})
+}
+
+func TestMergeLogins(t *testing.T) {
+	t0 := time.Now()
+	t1 := t0.Add(time.Second)
+
+	dst := lib.UserLogins{}
+	mergeLogins(&dst, lib.UserLogins{LastLogin: &t0})
+	if dst.LastLogin != &t0 || dst.LastFailedLogin != nil {
+		t.Fatalf("missing times should be set: %+v", dst)
+	}
+	mergeLogins(&dst, lib.UserLogins{LastLogin: &t1, LastFailedLogin: &t0})
+	if dst.LastLogin != &t1 || dst.LastFailedLogin != &t0 {
+		t.Fatalf("more recent times should replace older ones: %+v", dst)
+	}
+	mergeLogins(&dst, lib.UserLogins{LastLogin: &t0, LastFailedLogin: &t1})
+	if dst.LastLogin != &t1 || dst.LastFailedLogin != &t1 {
+		t.Fatalf("older times must not replace more recent ones: %+v", dst)
+	}
+	mergeLogins(&dst, lib.UserLogins{})
+	if dst.LastLogin != &t1 || dst.LastFailedLogin != &t1 {
+		t.Fatalf("missing times must not replace existing ones: %+v", dst)
+	}
+}
+
+func TestLoginStateLastLogins(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour)
+	t1 := time.Now()
+	st := newTestLoginState(t, t.TempDir())
+	st.users = map[string]map[string]*lib.UserLogins{
+		"alice": {
+			"ldap":   {LastLogin: &t0, LastFailedLogin: &t1},
+			"web-ui": {LastLogin: &t1},
+		},
+		"bob":     {"ldap": {LastFailedLogin: &t0}},
+		"removed": {"ldap": {LastLogin: &t1}},
+	}
+
+	list := lib.UserListFull{
+		"alice": {},
+		"bob":   {UserLogins: lib.UserLogins{LastFailedLogin: &t1}}, // e.g. from the audit log
+		"carol": {},
+	}
+	st.lastLogins(list)
+
+	alice := list["alice"]
+	if alice.LastLogin != &t1 || alice.LastFailedLogin != &t1 || len(alice.Listeners) != 2 || alice.Listeners["ldap"].LastLogin != &t0 {
+		t.Fatalf("the most recent logins of all listeners should be used: %+v", alice)
+	}
+	if bob := list["bob"]; bob.LastLogin != nil || bob.LastFailedLogin != &t1 {
+		t.Fatalf("more recent times already in the list should be kept: %+v", bob)
+	}
+	if carol := list["carol"]; carol.LastLogin != nil || carol.Listeners != nil {
+		t.Fatalf("users without logins should not be changed: %+v", carol)
+	}
+	if _, exists := list["removed"]; exists || len(list) != 3 {
+		t.Fatal("users which are not in the store must not be added to the list")
+	}
+}
+
+func TestLoginStatePrune(t *testing.T) {
+	st := newTestLoginState(t, t.TempDir())
+	st.record("alice", "ldap", true)
+	st.record("bob", "ldap", true)
+	st.record("carol", "ldap", true)
+	st.flush()
+
+	st.remove("alice")
+	st.remove("unknown")
+	if _, exists := st.users["alice"]; exists || !st.dirty {
+		t.Fatal("removed users should be forgotten")
+	}
+
+	st.sync(func() (lib.UserListFull, error) { return nil, errors.New("listing failed") })
+	if len(st.users) != 2 || st.dirty {
+		t.Fatal("the state should be written even if the users can't be listed")
+	}
+
+	st.sync(func() (lib.UserListFull, error) { return lib.UserListFull{"bob": {}}, nil })
+	if st2 := newTestLoginState(t, filepath.Dir(st.file)); len(st2.users) != 1 || st2.users["bob"] == nil {
+		t.Fatalf("users which no longer exist should be removed from the state file: %+v", st2.users)
+	}
+}
+
+func TestLoginStateStore(t *testing.T) {
+	s := newTestStoreWithState(t)
+	iface := s.GetInterface()
+
+	if ok, _, _, err := iface.WithListener("ldap").Authenticate("admin", "admin-secret"); !ok || err != nil {
+		t.Fatal("authentication failed:", err)
+	}
+	iface.WithListener("web-ui").Authenticate("user", "wrong")    //nolint:errcheck
+	iface.WithListener("web-ui").Authenticate("unknown", "wrong") //nolint:errcheck
+
+	list, err := iface.ListFull()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if admin := list["admin"]; admin.LastLogin == nil || admin.Listeners["ldap"].LastLogin == nil {
+		t.Fatalf("the login of admin should be listed: %+v", admin)
+	}
+	if user := list["user"]; user.LastLogin != nil || user.LastFailedLogin == nil || user.Listeners["web-ui"].LastFailedLogin == nil {
+		t.Fatalf("the failed login of user should be listed: %+v", user)
+	}
+	if _, exists := s.logins.users["unknown"]; exists {
+		t.Fatal("logins of unknown users must not be recorded")
+	}
+
+	if err := iface.Remove("user"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s.logins.sync(iface.ListFull)
+	if st, _ := newLoginState(filepath.Dir(s.logins.file), s.dir.BaseDir); len(st.users) != 1 || st.users["admin"] == nil {
+		t.Fatalf("the state file should only contain existing users: %+v", st.users)
+	}
+}
+
+func TestFlushLoginStates(t *testing.T) {
+	st := newTestLoginState(t, t.TempDir())
+	// this is what start does, except for catching the signals
+	loginStatesMutex.Lock()
+	loginStates = append(loginStates, st)
+	loginStatesMutex.Unlock()
+	defer func() {
+		loginStatesMutex.Lock()
+		loginStates = nil
+		loginStatesMutex.Unlock()
+	}()
+
+	st.record("alice", "ldap", true)
+	flushLoginStates()
+	if _, err := os.Stat(st.file); err != nil || st.dirty {
+		t.Fatal("started login states should be written when the agent is terminated:", err)
+	}
+}
+
+// setTestLastChanged changes the time of the last password change of username.
+func setTestLastChanged(t *testing.T, s *store, username string, lastChanged time.Time) {
+	files, err := filepath.Glob(filepath.Join(s.dir.BaseDir, username+".*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("can't find hash file of '%s': %v", username, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	parts := strings.SplitN(string(data), ":", 3)
+	parts[1] = strconv.FormatInt(lastChanged.Unix(), 10)
+	if err := os.WriteFile(files[0], []byte(strings.Join(parts, ":")), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+// captureStdout returns everything f writes to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var out strings.Builder
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			out.WriteString(scanner.Text() + "\n")
+		}
+		done <- out.String()
+	}()
+	f()
+	os.Stdout = stdout
+	w.Close()
+	return <-done
+}
+
+func TestListInactive(t *testing.T) {
+	s := newTestStoreWithState(t)
+	iface := s.GetInterface()
+	if err := iface.Add("old", "old-secret", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	yearAgo := time.Now().AddDate(-1, 0, 0)
+	setTestLastChanged(t, s, "user", yearAgo)
+	setTestLastChanged(t, s, "old", yearAgo)
+	if ok, _, _, err := iface.WithListener("ldap").Authenticate("old", "old-secret"); !ok || err != nil {
+		t.Fatal("authentication failed:", err)
+	}
+
+	for _, test := range []struct {
+		inactive time.Duration
+		expected []string
+	}{
+		{0, []string{"admin", "old", "user"}},
+		{30 * 24 * time.Hour, []string{"user"}},
+		{2 * 365 * 24 * time.Hour, nil},
+	} {
+		var err error
+		out := captureStdout(t, func() { err = cmdListFull(iface, test.inactive) })
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+			names = append(names, strings.Fields(line)[0])
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Fatalf("inactive %v: expected %v, got %v", test.inactive, test.expected, names)
+		}
+	}
+}
@@ -32,18 +32,40 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"net/http"
-	"net/url"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	lib "github.com/whawty/auth/store"
 )
 
+// authFailedMessage is sent to clients of network frontends if the authentication fails.
+// The actual reason only goes to the debug log since it might reveal whether a user exists.
+const authFailedMessage = "authentication failed"
+
+// The hooks get notified about users which failed to log in too often.
+const (
+	loginFailureThreshold = 5                // TODO: hardcoded value
+	loginFailureWindow    = 10 * time.Minute // TODO: hardcoded value
+)
+
+type loginFailures struct {
+	count uint
+	since time.Time
+}
+
+// errReadOnly is returned by all operations which would modify a read-only store.
+var errReadOnly = errors.New("the store is read-only, changes must be made on the master")
+
+// errHashMismatch is returned by rehash if the hash file of the user has changed in the meantime.
+var errHashMismatch = errors.New("the password hash does not match the current one")
+
 type initResult struct {
 	err error
 }
@@ -55,7 +77,8 @@ type initRequest struct {
 }
 
 type checkResult struct {
-	err error
+	warnings []string
+	err      error
 }
 
 type checkRequest struct {
@@ -89,9 +112,52 @@ type updateResult struct {
 type updateRequest struct {
 	username string
 	password string
+	hash     string // digest of the hash file which has been upgradeable, only set for upgrades
 	response chan<- updateResult
 }
 
+type expireResult struct {
+	token string
+	err   error
+}
+
+type expireRequest struct {
+	username  string
+	withToken bool
+	response  chan<- expireResult
+}
+
+type resetResult struct {
+	err error
+}
+
+type resetRequest struct {
+	username string
+	token    string
+	password string
+	response chan<- resetResult
+}
+
+type rewrapResult struct {
+	err error
+}
+
+type rewrapRequest struct {
+	username string
+	paramID  uint
+	response chan<- rewrapResult
+}
+
+type reencryptResult struct {
+	changed bool
+	err     error
+}
+
+type reencryptRequest struct {
+	username string
+	response chan<- reencryptResult
+}
+
 type setAdminResult struct {
 	err error
 }
@@ -102,6 +168,17 @@ type setAdminRequest struct {
 	response chan<- setAdminResult
 }
 
+type setGroupResult struct {
+	err error
+}
+
+type setGroupRequest struct {
+	username string
+	group    string
+	member   bool
+	response chan<- setGroupResult
+}
+
 type listResult struct {
 	list lib.UserList
 	err  error
@@ -120,35 +197,141 @@ type listFullRequest struct {
 	response chan<- listFullResult
 }
 
+type auxDataResult struct {
+	aux lib.AuxData
+	err error
+}
+
+type auxDataRequest struct {
+	username string
+	response chan<- auxDataResult
+}
+
+type appPasswordsResult struct {
+	list lib.AppPasswordList
+	err  error
+}
+
+type appPasswordsRequest struct {
+	username string
+	response chan<- appPasswordsResult
+}
+
+type addAppPasswordResult struct {
+	password string
+	err      error
+}
+
+type addAppPasswordRequest struct {
+	username string
+	name     string
+	scopes   []string
+	response chan<- addAppPasswordResult
+}
+
+type removeAppPasswordResult struct {
+	err error
+}
+
+type removeAppPasswordRequest struct {
+	username string
+	name     string
+	response chan<- removeAppPasswordResult
+}
+
 type authenticateResult struct {
 	ok          bool
 	isAdmin     bool
 	upgradeable bool
+	known       bool
 	lastChanged time.Time
+	appPassword string
 	err         error
 }
 
 type authenticateRequest struct {
+	username     string
+	password     string
+	useCache     bool
+	appPasswords bool
+	scopes       []string
+	response     chan<- authenticateResult
+}
+
+type rehashResult struct {
+	upgraded bool
+	err      error
+}
+
+type rehashRequest struct {
 	username string
 	password string
-	response chan<- authenticateResult
+	hash     string
+	response chan<- rehashResult
+}
+
+type subscribeResult struct {
+	snapshot replicationMessage
+	err      error
+}
+
+type subscribeRequest struct {
+	events   chan replicationMessage
+	response chan<- subscribeResult
+}
+
+type unsubscribeResult struct {
+}
+
+type unsubscribeRequest struct {
+	events   chan replicationMessage
+	response chan<- unsubscribeResult
+}
+
+type replicateResult struct {
+	err error
+}
+
+type replicateRequest struct {
+	full     bool
+	files    []lib.UserFile
+	removed  []string
+	response chan<- replicateResult
 }
 
 type store struct {
-	configfile       string
-	dir              *lib.Dir
-	policy           PolicyChecker
-	hooks            *HooksCaller
-	initChan         chan initRequest
-	checkChan        chan checkRequest
-	addChan          chan addRequest
-	removeChan       chan removeRequest
-	updateChan       chan updateRequest
-	setAdminChan     chan setAdminRequest
-	listChan         chan listRequest
-	listFullChan     chan listFullRequest
-	authenticateChan chan authenticateRequest
-	upgradeChan      chan updateRequest
+	configfile            string
+	dir                   *lib.Dir
+	policy                PolicyChecker
+	hooks                 *HooksCaller
+	logins                *loginState
+	authCache             *authCache
+	readOnly              bool
+	loginFailures         map[string]*loginFailures
+	replicas              map[chan replicationMessage]bool
+	initChan              chan initRequest
+	checkChan             chan checkRequest
+	addChan               chan addRequest
+	removeChan            chan removeRequest
+	updateChan            chan updateRequest
+	expireChan            chan expireRequest
+	resetChan             chan resetRequest
+	rewrapChan            chan rewrapRequest
+	reencryptChan         chan reencryptRequest
+	setAdminChan          chan setAdminRequest
+	setGroupChan          chan setGroupRequest
+	listChan              chan listRequest
+	listFullChan          chan listFullRequest
+	auxDataChan           chan auxDataRequest
+	appPasswordsChan      chan appPasswordsRequest
+	addAppPasswordChan    chan addAppPasswordRequest
+	removeAppPasswordChan chan removeAppPasswordRequest
+	authenticateChan      chan authenticateRequest
+	rehashChan            chan rehashRequest
+	subscribeChan         chan subscribeRequest
+	unsubscribeChan       chan unsubscribeRequest
+	replicateChan         chan replicateRequest
+	upgradeChan           chan updateRequest
 }
 
 func (s *store) reload() {
@@ -158,17 +341,76 @@ func (s *store) reload() {
 		wl.Printf("store: reload failed: %v, keeping current configuration", err)
 		return
 	}
-	if err := newdir.Check(); err != nil {
+	warnings, err := newdir.Check()
+	if err != nil {
 		wl.Printf("store: reload failed: %v, keeping current configuration", err)
 		return
 	}
+	for _, warning := range warnings {
+		wl.Printf("store: %s", warning)
+	}
 
+	if newdir.ReadOnly != s.dir.ReadOnly {
+		wl.Printf("store: changing read-only requires a restart, ignoring it")
+	}
 	s.dir = newdir
+	s.authCache.flush()
 	s.hooks.NewStore <- s.dir.BaseDir
 	wl.Printf("store: successfully reloaded")
+	if len(s.replicas) > 0 {
+		// the store might have been changed by someone else, resynchronize all replicas
+		if snapshot, err := s.snapshot(); err == nil {
+			s.publish(snapshot)
+		}
+	}
+}
+
+// changed must be called after username has been modified by event. It triggers the hooks and
+// sends the new hash file of the user to all replicas.
+func (s *store) changed(event, username string) {
+	s.hooks.Notify <- newHookEvent(event, username)
+	if len(s.replicas) == 0 {
+		return
+	}
+
+	file, err := s.dir.ReadUserFile(username)
+	if err != nil {
+		wl.Printf("replication: failed to read hash file of '%s': %v", username, err)
+		return
+	}
+	if file == nil {
+		s.publish(replicationMessage{Type: replicationRemove, Time: time.Now(), Username: username})
+		return
+	}
+	s.publish(replicationMessage{Type: replicationUpdate, Time: time.Now(), Users: []lib.UserFile{*file}})
+}
+
+// publish sends msg to all replicas. Replicas which can't keep up are dropped, they will do
+// a full resynchronization once they reconnect.
+func (s *store) publish(msg replicationMessage) {
+	for events := range s.replicas {
+		select {
+		case events <- msg:
+		default:
+			close(events)
+			delete(s.replicas, events)
+		}
+	}
+}
+
+func (s *store) snapshot() (msg replicationMessage, err error) {
+	msg = replicationMessage{Type: replicationSnapshot, Time: time.Now()}
+	if msg.Users, err = s.dir.ReadUserFiles(); err != nil {
+		wl.Printf("replication: failed to read hash files: %v", err)
+	}
+	return
 }
 
 func (s *store) init(username, password string) (result initResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
 	if ok, err := s.policy.Check(password, username); !ok || err != nil {
 		if err != nil {
 			result.err = err
@@ -182,11 +424,15 @@ func (s *store) init(username, password string) (result initResult) {
 }
 
 func (s *store) check() (result checkResult) {
-	result.err = s.dir.Check()
+	result.warnings, result.err = s.dir.Check()
 	return
 }
 
 func (s *store) add(username, password string, isAdmin bool) (result addResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
 	if ok, err := s.policy.Check(password, username); !ok || err != nil {
 		if err != nil {
 			result.err = err
@@ -195,20 +441,41 @@ func (s *store) add(username, password string, isAdmin bool) (result addResult)
 		}
 		return
 	}
+	s.authCache.invalidate(username)
 	result.err = s.dir.AddUser(username, password, isAdmin)
 	if result.err == nil {
-		s.hooks.Notify <- true
+		s.changed(hookEventAdd, username)
 	}
 	return
 }
 
 func (s *store) remove(username string) (result removeResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	s.authCache.invalidate(username)
 	s.dir.RemoveUser(username)
-	s.hooks.Notify <- true
+	s.logins.remove(username)
+	s.changed(hookEventRemove, username)
 	return
 }
 
 func (s *store) update(username, password string) (result updateResult) {
+	return s.updatePassword(hookEventUpdate, username, password)
+}
+
+// upgrade is used for local upgrades of password hashes, it only differs from update by the
+// event which is sent to the hooks.
+func (s *store) upgrade(username, password string) (result updateResult) {
+	return s.updatePassword(hookEventUpgrade, username, password)
+}
+
+func (s *store) updatePassword(event, username, password string) (result updateResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
 	if ok, err := s.policy.Check(password, username); !ok || err != nil {
 		if err != nil {
 			result.err = err
@@ -217,17 +484,95 @@ func (s *store) update(username, password string) (result updateResult) {
 		}
 		return
 	}
+	s.authCache.invalidate(username)
 	result.err = s.dir.UpdateUser(username, password)
 	if result.err == nil {
-		s.hooks.Notify <- true
+		s.changed(event, username)
+	}
+	return
+}
+
+func (s *store) expire(username string, withToken bool) (result expireResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	s.authCache.invalidate(username)
+	result.token, result.err = s.dir.ExpireUser(username, withToken)
+	if result.err == nil {
+		s.changed(hookEventExpire, username)
+	}
+	return
+}
+
+func (s *store) reset(username, token, password string) (result resetResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	if ok, err := s.policy.Check(password, username); !ok || err != nil {
+		if err != nil {
+			result.err = err
+		} else {
+			result.err = errors.New("password policy checked failed")
+		}
+		return
+	}
+	s.authCache.invalidate(username)
+	result.err = s.dir.ResetUser(username, token, password)
+	if result.err == nil {
+		s.changed(hookEventReset, username)
+	}
+	return
+}
+
+func (s *store) rewrap(username string, paramID uint) (result rewrapResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	s.authCache.invalidate(username)
+	result.err = s.dir.RewrapUser(username, paramID)
+	if result.err == nil {
+		s.changed(hookEventRewrap, username)
+	}
+	return
+}
+
+func (s *store) reencrypt(username string) (result reencryptResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	s.authCache.invalidate(username)
+	result.changed, result.err = s.dir.ReencryptUser(username)
+	if result.changed {
+		s.changed(hookEventReencrypt, username)
 	}
 	return
 }
 
 func (s *store) setAdmin(username string, isAdmin bool) (result setAdminResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	s.authCache.invalidate(username)
 	result.err = s.dir.SetAdmin(username, isAdmin)
 	if result.err == nil {
-		s.hooks.Notify <- true
+		s.changed(hookEventSetAdmin, username)
+	}
+	return
+}
+
+func (s *store) setGroup(username, group string, member bool) (result setGroupResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	result.err = s.dir.SetGroup(username, group, member)
+	if result.err == nil {
+		s.changed(hookEventSetGroup, username)
 	}
 	return
 }
@@ -242,10 +587,203 @@ func (s *store) listFull() (result listFullResult) {
 	return
 }
 
-func (s *store) authenticate(username, password string) (result authenticateResult) {
-	result.ok, result.isAdmin, result.upgradeable, result.lastChanged, result.err = s.dir.Authenticate(username, password)
+func (s *store) auxData(username string) (result auxDataResult) {
+	result.aux, result.err = s.dir.GetAuxData(username)
+	return
+}
+
+func (s *store) appPasswords(username string) (result appPasswordsResult) {
+	result.list, result.err = s.dir.AppPasswords(username)
+	return
+}
+
+func (s *store) addAppPassword(username, name string, scopes []string) (result addAppPasswordResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	result.password, result.err = s.dir.AddAppPassword(username, name, scopes)
+	if result.err == nil {
+		s.changed(hookEventAddAppPassword, username)
+	}
+	return
+}
+
+func (s *store) removeAppPassword(username, name string) (result removeAppPasswordResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	result.err = s.dir.RemoveAppPassword(username, name)
+	if result.err == nil {
+		s.changed(hookEventRemoveAppPassword, username)
+	}
+	return
+}
+
+func (s *store) authenticate(username, password string, useCache, appPasswords bool, scopes []string) (result authenticateResult) {
+	var file os.FileInfo
+	if useCache && s.authCache != nil {
+		// the file info must be fetched before authenticating, otherwise a concurrent change
+		// of the hash file could end up being treated as valid for the old password.
+		var err error
+		if file, err = s.dir.Stat(username); err != nil {
+			s.authCache.invalidate(username)
+			file = nil
+		} else if entry, ok := s.authCache.lookup(username, password, file); ok {
+			result.ok = true
+			result.known = true
+			result.isAdmin = entry.isAdmin
+			result.lastChanged = entry.lastChanged
+			return
+		}
+	}
+
+	if !appPasswords {
+		result.ok, result.isAdmin, result.upgradeable, result.lastChanged, result.err = s.dir.Authenticate(username, password)
+	} else {
+		result.ok, result.isAdmin, result.upgradeable, result.lastChanged, result.appPassword, result.err = s.dir.AuthenticateWithAppPasswords(username, password, scopes)
+	}
+	result.known = s.trackLoginFailures(username, result.ok)
+	if result.appPassword != "" {
+		// app passwords might be restricted to some scopes and must therefore not end up in the cache
+		wdl.Printf("store: '%s' used app password '%s'", username, result.appPassword)
+		return
+	}
+	if result.ok && result.err == nil && file != nil {
+		s.authCache.add(username, password, file, result.isAdmin, result.lastChanged)
+	}
 	if result.ok && result.upgradeable && s.upgradeChan != nil {
-		s.upgradeChan <- updateRequest{username: username, password: password}
+		upgrade := updateRequest{username: username, password: password}
+		if file, err := s.dir.ReadUserFile(username); err == nil && file != nil {
+			upgrade.hash = userFileDigest(file)
+		}
+		s.upgradeChan <- upgrade
+	}
+	return
+}
+
+// trackLoginFailures counts the failed logins of existing users. The hooks are notified once a
+// user reaches loginFailureThreshold failures within loginFailureWindow. It returns whether
+// username exists.
+func (s *store) trackLoginFailures(username string, ok bool) bool {
+	if ok {
+		delete(s.loginFailures, username)
+		return true
+	}
+	if _, err := s.dir.Stat(username); err != nil {
+		return false // unknown users must not fill up the map
+	}
+	failures := s.loginFailures[username]
+	if failures == nil || time.Since(failures.since) > loginFailureWindow {
+		failures = &loginFailures{since: time.Now()}
+		s.loginFailures[username] = failures
+	}
+	failures.count++
+	if failures.count == loginFailureThreshold {
+		wl.Printf("store: %d failed logins for '%s' since %s", failures.count, username, failures.since.Format(time.RFC3339))
+		s.hooks.Notify <- newHookEvent(hookEventLoginFailure, username)
+	}
+	return true
+}
+
+// userFileDigest identifies the contents of the hash file of a user. Remote upgrades use it to
+// make sure that the master only upgrades the hash which has been upgradeable on the replica.
+func userFileDigest(file *lib.UserFile) string {
+	digest := sha256.Sum256(file.Content)
+	return hex.EncodeToString(digest[:])
+}
+
+// rehash hashes password again using the default parameter-set if hash matches the digest of the
+// current hash file of username and password is valid. Hashes which are not upgradeable are
+// left alone.
+func (s *store) rehash(username, password, hash string) (result rehashResult) {
+	if s.readOnly {
+		result.err = errReadOnly
+		return
+	}
+	file, err := s.dir.ReadUserFile(username)
+	if err != nil {
+		result.err = err
+		return
+	}
+	if file == nil || userFileDigest(file) != hash {
+		result.err = errHashMismatch
+		return
+	}
+	ok, _, upgradeable, _, err := s.dir.Authenticate(username, password)
+	if err != nil {
+		result.err = err
+		return
+	}
+	if !ok {
+		result.err = errors.New(authFailedMessage)
+		return
+	}
+	if !upgradeable {
+		return
+	}
+
+	s.authCache.invalidate(username)
+	if result.err = s.dir.UpdateUser(username, password); result.err == nil {
+		result.upgraded = true
+		s.changed(hookEventUpgrade, username)
+	}
+	return
+}
+
+func (s *store) subscribe(events chan replicationMessage) (result subscribeResult) {
+	if result.snapshot, result.err = s.snapshot(); result.err == nil {
+		s.replicas[events] = true
+	}
+	return
+}
+
+func (s *store) unsubscribe(events chan replicationMessage) (result unsubscribeResult) {
+	delete(s.replicas, events)
+	return
+}
+
+// replicate applies the changes received from the master. If full is set files contains all
+// users of the master and all other users are removed. Files which are already up-to-date
+// are left alone.
+func (s *store) replicate(full bool, files []lib.UserFile, removed []string) (result replicateResult) {
+	current := make(map[string]lib.UserFile)
+	if full {
+		existing, err := s.dir.ReadUserFiles()
+		if err != nil {
+			result.err = err
+			return
+		}
+		keep := make(map[string]bool)
+		for _, file := range files {
+			keep[file.Username] = true
+		}
+		for _, file := range existing {
+			current[file.Username] = file
+			if !keep[file.Username] {
+				removed = append(removed, file.Username)
+			}
+		}
+	}
+
+	for _, file := range files {
+		if old, exists := current[file.Username]; exists && old.IsAdmin == file.IsAdmin && bytes.Equal(old.Content, file.Content) {
+			continue
+		}
+		s.authCache.invalidate(file.Username)
+		if result.err = s.dir.WriteUserFile(file); result.err != nil {
+			return
+		}
+		wdl.Printf("replication: updated '%s'", file.Username)
+		s.changed(hookEventReplicate, file.Username)
+	}
+	for _, username := range removed {
+		s.authCache.invalidate(username)
+		s.dir.RemoveUser(username)
+		s.logins.remove(username)
+		wdl.Printf("replication: removed '%s'", username)
+		s.changed(hookEventRemove, username)
 	}
 	return
 }
@@ -271,92 +809,244 @@ func (s *store) dispatchRequests() {
 				req.response <- s.update(req.username, req.password)
 			} else {
 				wdl.Printf("upgrade(local): upgrading '%s'", req.username)
-				if resp := s.update(req.username, req.password); resp.err != nil {
+				resp := s.upgrade(req.username, req.password)
+				if resp.err != nil {
 					wl.Printf("upgrade(local): failed for '%s': %v", req.username, resp.err)
 				} else {
 					wdl.Printf("upgrade(local): successfully upgraded '%s'", req.username)
 				}
+				result, msg := auditResult(resp.err)
+				auditLog.record(auditRecord{Store: s.dir.BaseDir, Actor: "upgrade", Action: hookEventUpgrade, Target: req.username, Result: result, Error: msg})
 			}
+		case req := <-s.expireChan:
+			req.response <- s.expire(req.username, req.withToken)
+		case req := <-s.resetChan:
+			req.response <- s.reset(req.username, req.token, req.password)
+		case req := <-s.rewrapChan:
+			req.response <- s.rewrap(req.username, req.paramID)
+		case req := <-s.reencryptChan:
+			req.response <- s.reencrypt(req.username)
 		case req := <-s.setAdminChan:
 			req.response <- s.setAdmin(req.username, req.isAdmin)
+		case req := <-s.setGroupChan:
+			req.response <- s.setGroup(req.username, req.group, req.member)
 		case req := <-s.listChan:
 			req.response <- s.list()
 		case req := <-s.listFullChan:
 			req.response <- s.listFull()
+		case req := <-s.auxDataChan:
+			req.response <- s.auxData(req.username)
+		case req := <-s.appPasswordsChan:
+			req.response <- s.appPasswords(req.username)
+		case req := <-s.addAppPasswordChan:
+			req.response <- s.addAppPassword(req.username, req.name, req.scopes)
+		case req := <-s.removeAppPasswordChan:
+			req.response <- s.removeAppPassword(req.username, req.name)
 		case req := <-s.authenticateChan:
-			req.response <- s.authenticate(req.username, req.password)
+			req.response <- s.authenticate(req.username, req.password, req.useCache, req.appPasswords, req.scopes)
+		case req := <-s.rehashChan:
+			req.response <- s.rehash(req.username, req.password, req.hash)
+		case req := <-s.subscribeChan:
+			req.response <- s.subscribe(req.events)
+		case req := <-s.unsubscribeChan:
+			req.response <- s.unsubscribe(req.events)
+		case req := <-s.replicateChan:
+			req.response <- s.replicate(req.full, req.files, req.removed)
 		}
 	}
 }
 
-func remoteHTTPUpgrade(update updateRequest, remote string) {
-	reqdata, err := json.Marshal(webUpdateRequest{Username: update.username, OldPassword: update.password})
-	if err != nil {
-		wl.Printf("upgrade(remote): error while encoding update request: %v", err)
-		return
-	}
-	req, _ := http.NewRequest("POST", remote, bytes.NewReader(reqdata))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		wl.Printf("upgrade(remote): error sending update request: %v", err)
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		wl.Printf("upgrade(remote): failed for '%s' with status: %s", update.username, resp.Status)
-	} else {
-		wdl.Printf("upgrade(remote): successfully upgraded '%s'", update.username)
-	}
+// *********************************************************
+// Public Interface
+
+type Store struct {
+	initChan              chan<- initRequest
+	checkChan             chan<- checkRequest
+	addChan               chan<- addRequest
+	removeChan            chan<- removeRequest
+	updateChan            chan<- updateRequest
+	expireChan            chan<- expireRequest
+	resetChan             chan<- resetRequest
+	rewrapChan            chan<- rewrapRequest
+	reencryptChan         chan<- reencryptRequest
+	setAdminChan          chan<- setAdminRequest
+	setGroupChan          chan<- setGroupRequest
+	listChan              chan<- listRequest
+	listFullChan          chan<- listFullRequest
+	auxDataChan           chan<- auxDataRequest
+	appPasswordsChan      chan<- appPasswordsRequest
+	addAppPasswordChan    chan<- addAppPasswordRequest
+	removeAppPasswordChan chan<- removeAppPasswordRequest
+	authenticateChan      chan<- authenticateRequest
+	rehashChan            chan<- rehashRequest
+	subscribeChan         chan<- subscribeRequest
+	unsubscribeChan       chan<- unsubscribeRequest
+	replicateChan         chan<- replicateRequest
+	hooks                 *HooksCaller
+	logins                *loginState
+	baseDir               string
+	readOnly              bool
+	useAuthCache          bool
+	useAppPasswords       bool
+	scopes                []string
+	access                *accessControl
+	service               string
+	realm                 string
+	caller                auditInfo
+	tenants               *tenantList
 }
 
-func remoteHTTPUpgrader(upgradeChan <-chan updateRequest, remote string) {
-	sem := make(chan bool, 10) // TODO: hardcoded value
-	for update := range upgradeChan {
-		select {
-		case sem <- true:
-			wdl.Printf("upgrade(remote): upgrading '%s' via %s", update.username, remote)
-			go func(update updateRequest, remote string) {
-				defer func() { <-sem }()
-				remoteHTTPUpgrade(update, remote)
-			}(update, remote)
-		default:
-			wdl.Printf("upgrade(remote): ignoring upgrade request for '%s' due to rate-limiting", update.username)
-		}
-	}
+// WithAuthCache returns a copy of the interface which uses the authentication cache
+// if enabled is true and the cache has been configured.
+func (s *Store) WithAuthCache(enabled bool) *Store {
+	ch := *s
+	ch.useAuthCache = enabled
+	return &ch
 }
 
-func runRemoteUpgrader(remote string) (upgradeChan chan updateRequest, err error) {
-	var r *url.URL
-	if r, err = url.Parse(remote); err != nil {
-		return
+// WithAppPasswords returns a copy of the interface which also accepts app passwords if enabled
+// is true. App passwords which are restricted to some scopes are only accepted if at least one
+// of scopes matches.
+func (s *Store) WithAppPasswords(enabled bool, scopes ...string) *Store {
+	ch := *s
+	ch.useAppPasswords = enabled
+	ch.scopes = scopes
+	return &ch
+}
+
+// WithAccessControl returns a copy of the interface which checks the access rules of access
+// after successful authentications, see CheckAccess. Passing nil disables the checks.
+func (s *Store) WithAccessControl(access *accessControl) *Store {
+	ch := *s
+	ch.access = access
+	return &ch
+}
+
+// WithService returns a copy of the interface which checks the access rules for service and
+// realm. Authenticate returns errAccessDenied if the rules don't allow the user to use them.
+func (s *Store) WithService(service, realm string) *Store {
+	ch := *s
+	ch.service = service
+	ch.realm = realm
+	return &ch
+}
+
+// WithActor returns a copy of the interface which records actor as the one who made the changes
+// in the audit log.
+func (s *Store) WithActor(actor string) *Store {
+	ch := *s
+	ch.caller.actor = actor
+	return &ch
+}
+
+// WithListener returns a copy of the interface which records listener in the audit log.
+func (s *Store) WithListener(listener string) *Store {
+	ch := *s
+	ch.caller.listener = listener
+	return &ch
+}
+
+// WithSource returns a copy of the interface which records source as the address of the peer in
+// the audit log.
+func (s *Store) WithSource(source string) *Store {
+	ch := *s
+	ch.caller.source = source
+	return &ch
+}
+
+// WithTenants returns a copy of the interface which knows about the stores of tenants. Listeners
+// use ForLogin or ForTenant to route requests to them.
+func (s *Store) WithTenants(tenants *tenantList) *Store {
+	ch := *s
+	ch.tenants = tenants
+	return &ch
+}
+
+// ReadOnly returns true if the store rejects all changes.
+func (s *Store) ReadOnly() bool {
+	return s.readOnly
+}
+
+// HooksStatus returns the status of all hooks which have been called so far.
+func (s *Store) HooksStatus() []hookStatus {
+	return s.hooks.Status()
+}
+
+// StartWebhooks starts delivering events to the configured webhook endpoints.
+func (s *Store) StartWebhooks() error {
+	return s.hooks.StartWebhooks()
+}
+
+// StartLoginState starts writing the logins of all users to the state-dir.
+func (s *Store) StartLoginState() {
+	s.logins.start(s.ListFull)
+}
+
+// WebhooksStatus returns the delivery state of all webhook endpoints.
+func (s *Store) WebhooksStatus() []webhookStatus {
+	return s.hooks.WebhooksStatus()
+}
+
+// TestHooks calls all hooks with a synthetic event and waits for them to finish.
+func (s *Store) TestHooks(event, username string) ([]hookStatus, error) {
+	return s.hooks.Test(newHookEvent(event, username))
+}
+
+// Tenants returns all tenants known to the interface.
+func (s *Store) Tenants() []*tenant {
+	if s.tenants == nil {
+		return nil
 	}
-	switch r.Scheme {
-	case "http":
-		wl.Printf("upgrade(remote): Warning using unsecure url for remote updates: %s", remote)
-		fallthrough
-	case "https":
-		upgradeChan = make(chan updateRequest, 10)
-		go remoteHTTPUpgrader(upgradeChan, remote)
-	default:
-		err = errors.New("unsupported hash-upgrade mode, must be either empty, 'local' or a http(s) url to the master")
+	return s.tenants.tenants
+}
+
+// ForTenant returns an interface to the store of t which uses the same settings as s. The access
+// rules of t replace the ones of s if t has any.
+func (s *Store) ForTenant(t *tenant) *Store {
+	ch := *t.store
+	ch.useAuthCache = s.useAuthCache
+	ch.useAppPasswords = s.useAppPasswords
+	ch.scopes = s.scopes
+	ch.access = s.access
+	if t.access != nil {
+		ch.access = t.access
 	}
-	return
+	ch.service = s.service
+	ch.realm = s.realm
+	ch.caller = s.caller
+	return &ch
 }
 
-// *********************************************************
-// Public Interface
+// audit records the result of action in the audit log.
+func (s *Store) audit(action, target, details string, err error) {
+	result, msg := auditResult(err)
+	auditLog.record(auditRecord{Store: s.baseDir, Actor: s.caller.actor, Action: action, Target: target, Details: details,
+		Listener: s.caller.listener, Source: s.caller.source, Result: result, Error: msg})
+}
 
-type Store struct {
-	initChan         chan<- initRequest
-	checkChan        chan<- checkRequest
-	addChan          chan<- addRequest
-	removeChan       chan<- removeRequest
-	updateChan       chan<- updateRequest
-	setAdminChan     chan<- setAdminRequest
-	listChan         chan<- listRequest
-	listFullChan     chan<- listFullRequest
-	authenticateChan chan<- authenticateRequest
+// ForLogin returns the interface of the store responsible for login and realm together with the
+// username to use for it. If realm is empty and login has the form user@domain the domain is used
+// as realm. If a tenant serves the realm and login ends with @realm this suffix is removed from
+// the username, no matter whether the realm has been passed or taken from login.
+func (s *Store) ForLogin(login, realm string) (*Store, string) {
+	if s.tenants == nil {
+		return s, login
+	}
+	username := login
+	if idx := strings.LastIndexByte(login, '@'); idx >= 0 {
+		if realm == "" {
+			realm = login[idx+1:]
+		}
+		if strings.EqualFold(login[idx+1:], realm) {
+			username = login[:idx]
+		}
+	}
+	t := s.tenants.byRealm(realm)
+	if t == nil {
+		return s, login
+	}
+	wdl.Printf("store: using tenant '%s' for '%s' (realm '%s')", t.name, login, realm)
+	return s.ForTenant(t), username
 }
 
 func (s *Store) Init(username, password string) error {
@@ -368,17 +1058,18 @@ func (s *Store) Init(username, password string) error {
 	s.initChan <- req
 
 	res := <-resCh
+	s.audit(auditActionInit, username, "", res.err)
 	return res.err
 }
 
-func (s *Store) Check() error {
+func (s *Store) Check() ([]string, error) {
 	resCh := make(chan checkResult)
 	req := checkRequest{}
 	req.response = resCh
 	s.checkChan <- req
 
 	res := <-resCh
-	return res.err
+	return res.warnings, res.err
 }
 
 func (s *Store) Add(username, password string, isAdmin bool) error {
@@ -391,6 +1082,7 @@ func (s *Store) Add(username, password string, isAdmin bool) error {
 	s.addChan <- req
 
 	res := <-resCh
+	s.audit(hookEventAdd, username, fmt.Sprintf("admin=%t", isAdmin), res.err)
 	return res.err
 }
 
@@ -402,6 +1094,7 @@ func (s *Store) Remove(username string) error {
 	s.removeChan <- req
 
 	res := <-resCh
+	s.audit(hookEventRemove, username, "", res.err)
 	return res.err
 }
 
@@ -414,9 +1107,64 @@ func (s *Store) Update(username, password string) error {
 	s.updateChan <- req
 
 	res := <-resCh
+	s.audit(hookEventUpdate, username, "", res.err)
+	return res.err
+}
+
+func (s *Store) Expire(username string, withToken bool) (string, error) {
+	resCh := make(chan expireResult)
+	req := expireRequest{}
+	req.username = username
+	req.withToken = withToken
+	req.response = resCh
+	s.expireChan <- req
+
+	res := <-resCh
+	s.audit(hookEventExpire, username, fmt.Sprintf("token=%t", withToken), res.err)
+	return res.token, res.err
+}
+
+func (s *Store) Reset(username, token, password string) error {
+	resCh := make(chan resetResult)
+	req := resetRequest{}
+	req.username = username
+	req.token = token
+	req.password = password
+	req.response = resCh
+	s.resetChan <- req
+
+	res := <-resCh
+	s.audit(hookEventReset, username, "", res.err)
+	return res.err
+}
+
+func (s *Store) Rewrap(username string, paramID uint) error {
+	resCh := make(chan rewrapResult)
+	req := rewrapRequest{}
+	req.username = username
+	req.paramID = paramID
+	req.response = resCh
+	s.rewrapChan <- req
+
+	res := <-resCh
+	s.audit(hookEventRewrap, username, fmt.Sprintf("parameter-set=%d", paramID), res.err)
 	return res.err
 }
 
+func (s *Store) Reencrypt(username string) (bool, error) {
+	resCh := make(chan reencryptResult)
+	req := reencryptRequest{}
+	req.username = username
+	req.response = resCh
+	s.reencryptChan <- req
+
+	res := <-resCh
+	if res.changed || res.err != nil {
+		s.audit(hookEventReencrypt, username, "", res.err)
+	}
+	return res.changed, res.err
+}
+
 func (s *Store) SetAdmin(username string, isAdmin bool) error {
 	resCh := make(chan setAdminResult)
 	req := setAdminRequest{}
@@ -426,6 +1174,21 @@ func (s *Store) SetAdmin(username string, isAdmin bool) error {
 	s.setAdminChan <- req
 
 	res := <-resCh
+	s.audit(hookEventSetAdmin, username, fmt.Sprintf("admin=%t", isAdmin), res.err)
+	return res.err
+}
+
+func (s *Store) SetGroup(username, group string, member bool) error {
+	resCh := make(chan setGroupResult)
+	req := setGroupRequest{}
+	req.username = username
+	req.group = group
+	req.member = member
+	req.response = resCh
+	s.setGroupChan <- req
+
+	res := <-resCh
+	s.audit(hookEventSetGroup, username, fmt.Sprintf("group=%s member=%t", group, member), res.err)
 	return res.err
 }
 
@@ -446,19 +1209,218 @@ func (s *Store) ListFull() (lib.UserListFull, error) {
 	s.listFullChan <- req
 
 	res := <-resCh
+	if res.err == nil {
+		auditLog.lastLogins(s.baseDir, res.list)
+		s.logins.lastLogins(res.list)
+	}
 	return res.list, res.err
 }
 
+// AuditLog returns up to limit records of the audit log concerning this store, newest first.
+// Only records which match username, actor and action and are between since and until are
+// returned, empty values match all records. See auditLogger.query for the cursor.
+func (s *Store) AuditLog(username, actor, action string, since, until time.Time, cursor string, limit int) ([]auditRecord, string, error) {
+	if auditLog == nil {
+		return nil, "", errors.New("the audit log is not enabled")
+	}
+	filter := auditFilter{store: s.baseDir, target: username, actor: actor, action: action, since: since, until: until}
+	return auditLog.query(filter, cursor, limit)
+}
+
+func (s *Store) GetAuxData(username string) (lib.AuxData, error) {
+	resCh := make(chan auxDataResult)
+	req := auxDataRequest{}
+	req.username = username
+	req.response = resCh
+	s.auxDataChan <- req
+
+	res := <-resCh
+	return res.aux, res.err
+}
+
+func (s *Store) AppPasswords(username string) (lib.AppPasswordList, error) {
+	resCh := make(chan appPasswordsResult)
+	req := appPasswordsRequest{}
+	req.username = username
+	req.response = resCh
+	s.appPasswordsChan <- req
+
+	res := <-resCh
+	return res.list, res.err
+}
+
+func (s *Store) AddAppPassword(username, name string, scopes []string) (string, error) {
+	resCh := make(chan addAppPasswordResult)
+	req := addAppPasswordRequest{}
+	req.username = username
+	req.name = name
+	req.scopes = scopes
+	req.response = resCh
+	s.addAppPasswordChan <- req
+
+	res := <-resCh
+	s.audit(hookEventAddAppPassword, username, fmt.Sprintf("name=%s scopes=%s", name, strings.Join(scopes, ",")), res.err)
+	return res.password, res.err
+}
+
+func (s *Store) RemoveAppPassword(username, name string) error {
+	resCh := make(chan removeAppPasswordResult)
+	req := removeAppPasswordRequest{}
+	req.username = username
+	req.name = name
+	req.response = resCh
+	s.removeAppPasswordChan <- req
+
+	res := <-resCh
+	s.audit(hookEventRemoveAppPassword, username, "name="+name, res.err)
+	return res.err
+}
+
 func (s *Store) Authenticate(username, password string) (bool, bool, time.Time, error) {
+	res := s.authenticate(username, password)
+	return res.ok, res.isAdmin, res.lastChanged, res.err
+}
+
+// AuthenticateWithAppPasswords works like Authenticate but also returns the name of the app
+// password which has been used, this is empty if the password of the user matched.
+func (s *Store) AuthenticateWithAppPasswords(username, password string) (bool, bool, time.Time, string, error) {
+	res := s.authenticate(username, password)
+	return res.ok, res.isAdmin, res.lastChanged, res.appPassword, res.err
+}
+
+func (s *Store) authenticate(username, password string) authenticateResult {
 	resCh := make(chan authenticateResult)
 	req := authenticateRequest{}
 	req.username = username
 	req.password = password
+	req.useCache = s.useAuthCache
+	req.appPasswords = s.useAppPasswords
+	req.scopes = s.scopes
 	req.response = resCh
 	s.authenticateChan <- req
 
 	res := <-resCh
-	return res.ok, res.isAdmin, res.lastChanged, res.err
+	if res.ok && res.err == nil {
+		if allowed, err := s.CheckAccess(username, res.isAdmin); !allowed {
+			if err != nil {
+				wl.Printf("store: checking access of '%s' to service '%s' failed: %v", username, s.service, err)
+			}
+			res.ok, res.err = false, errAccessDenied
+		}
+	}
+	s.auditAuthentication(username, res.ok, res.err)
+	if res.known {
+		s.logins.record(username, s.caller.listener, res.ok)
+	}
+	return res
+}
+
+// auditAuthentication records an authentication in the audit log if this has been enabled.
+func (s *Store) auditAuthentication(username string, ok bool, err error) {
+	if auditLog == nil || !auditLog.authentications {
+		return
+	}
+	record := auditRecord{Store: s.baseDir, Actor: username, Action: auditActionAuthenticate, Target: username,
+		Listener: s.caller.listener, Source: s.caller.source, Result: auditResultOK}
+	if s.service != "" {
+		record.Details = "service=" + s.service
+	}
+	if !ok {
+		record.Result = auditResultFailed
+		if err == errAccessDenied {
+			record.Result = auditResultDenied
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+	}
+	auditLog.record(record)
+}
+
+// CheckAccess checks whether the access rules allow username to use the service and realm set
+// using WithService. If there are no access rules access is granted. An empty service is checked
+// like any other, so rules like service '*' apply to it as well.
+func (s *Store) CheckAccess(username string, isAdmin bool) (bool, error) {
+	if s.access == nil {
+		return true, nil
+	}
+	allowed, err := s.access.allows(isAdmin, s.service, s.realm, func() ([]string, error) {
+		aux, err := s.GetAuxData(username)
+		if err != nil {
+			return nil, err
+		}
+		return aux.Groups(), nil
+	})
+	if err == nil && !allowed {
+		wdl.Printf("store: access of '%s' to service '%s' (realm '%s') denied", username, s.service, s.realm)
+	}
+	return allowed, err
+}
+
+// Rehash upgrades the password hash of username if hash matches the current hash file, see
+// store.rehash. It returns whether the hash has been changed.
+func (s *Store) Rehash(username, password, hash string) (bool, error) {
+	resCh := make(chan rehashResult)
+	req := rehashRequest{}
+	req.username = username
+	req.password = password
+	req.hash = hash
+	req.response = resCh
+	s.rehashChan <- req
+
+	res := <-resCh
+	if res.upgraded || res.err != nil {
+		s.audit(hookEventUpgrade, username, "", res.err)
+	}
+	return res.upgraded, res.err
+}
+
+// Subscribe registers events to receive all changes of the store. It returns a snapshot of all
+// users which is consistent with the changes sent to events. events gets closed if the receiver
+// can't keep up.
+func (s *Store) Subscribe(events chan replicationMessage) (replicationMessage, error) {
+	resCh := make(chan subscribeResult)
+	req := subscribeRequest{}
+	req.events = events
+	req.response = resCh
+	s.subscribeChan <- req
+
+	res := <-resCh
+	return res.snapshot, res.err
+}
+
+func (s *Store) Unsubscribe(events chan replicationMessage) {
+	resCh := make(chan unsubscribeResult)
+	req := unsubscribeRequest{}
+	req.events = events
+	req.response = resCh
+	s.unsubscribeChan <- req
+
+	<-resCh
+}
+
+// Replicate applies changes received from the master, see store.replicate.
+func (s *Store) Replicate(full bool, files []lib.UserFile, removed []string) error {
+	resCh := make(chan replicateResult)
+	req := replicateRequest{}
+	req.full = full
+	req.files = files
+	req.removed = removed
+	req.response = resCh
+	s.replicateChan <- req
+
+	res := <-resCh
+	switch {
+	case full:
+		s.audit(hookEventReplicate, "", fmt.Sprintf("full=true users=%d", len(files)), res.err)
+	case len(files) == 1 && len(removed) == 0:
+		s.audit(hookEventReplicate, files[0].Username, fmt.Sprintf("admin=%t", files[0].IsAdmin), res.err)
+	case len(files) == 0 && len(removed) == 1:
+		s.audit(hookEventReplicate, removed[0], "removed=true", res.err)
+	default:
+		s.audit(hookEventReplicate, "", fmt.Sprintf("users=%d removed=%d", len(files), len(removed)), res.err)
+	}
+	return res.err
 }
 
 func (s *store) GetInterface() *Store {
@@ -468,23 +1430,51 @@ func (s *store) GetInterface() *Store {
 	ch.addChan = s.addChan
 	ch.removeChan = s.removeChan
 	ch.updateChan = s.updateChan
+	ch.expireChan = s.expireChan
+	ch.resetChan = s.resetChan
+	ch.rewrapChan = s.rewrapChan
+	ch.reencryptChan = s.reencryptChan
 	ch.setAdminChan = s.setAdminChan
+	ch.setGroupChan = s.setGroupChan
 	ch.listChan = s.listChan
 	ch.listFullChan = s.listFullChan
+	ch.auxDataChan = s.auxDataChan
+	ch.appPasswordsChan = s.appPasswordsChan
+	ch.addAppPasswordChan = s.addAppPasswordChan
+	ch.removeAppPasswordChan = s.removeAppPasswordChan
 	ch.authenticateChan = s.authenticateChan
+	ch.rehashChan = s.rehashChan
+	ch.subscribeChan = s.subscribeChan
+	ch.unsubscribeChan = s.unsubscribeChan
+	ch.replicateChan = s.replicateChan
+	ch.hooks = s.hooks
+	ch.logins = s.logins
+	ch.baseDir = s.dir.BaseDir
+	ch.readOnly = s.readOnly
 	return ch
 }
 
-func NewStore(configfile, doUpgrades, policyType, policyCondition, hooksDir string) (s *store, err error) {
+func NewStore(configfile, doUpgrades, upgradeConfig, policyType, policyCondition, hooksDir, hooksConfigFile, stateDir string, readOnly bool, authCacheTTL time.Duration, authCacheSize int) (s *store, err error) {
 	s = &store{}
 	if s.dir, err = lib.NewDirFromConfig(configfile); err != nil {
 		return
 	}
 	s.configfile = configfile
+	s.readOnly = readOnly || s.dir.ReadOnly
 	if s.policy, err = NewPasswordPolicy(policyType, policyCondition); err != nil {
 		return
 	}
-	if s.hooks, err = NewHooksCaller(hooksDir, s.dir.BaseDir); err != nil {
+	var hc *hooksConfig
+	if hc, err = readHooksConfig(hooksConfigFile); err != nil {
+		return
+	}
+	if s.hooks, err = NewHooksCaller(hooksDir, s.dir.BaseDir, hc); err != nil {
+		return
+	}
+	if s.logins, err = newLoginState(stateDir, s.dir.BaseDir); err != nil {
+		return
+	}
+	if s.authCache, err = newAuthCache(authCacheTTL, authCacheSize); err != nil {
 		return
 	}
 
@@ -493,18 +1483,41 @@ func NewStore(configfile, doUpgrades, policyType, policyCondition, hooksDir stri
 	s.addChan = make(chan addRequest, 10)
 	s.removeChan = make(chan removeRequest, 10)
 	s.updateChan = make(chan updateRequest, 10)
+	s.expireChan = make(chan expireRequest, 10)
+	s.resetChan = make(chan resetRequest, 10)
+	s.rewrapChan = make(chan rewrapRequest, 10)
+	s.reencryptChan = make(chan reencryptRequest, 10)
 	s.setAdminChan = make(chan setAdminRequest, 10)
+	s.setGroupChan = make(chan setGroupRequest, 10)
 	s.listChan = make(chan listRequest, 10)
 	s.listFullChan = make(chan listFullRequest, 10)
+	s.auxDataChan = make(chan auxDataRequest, 10)
+	s.appPasswordsChan = make(chan appPasswordsRequest, 10)
+	s.addAppPasswordChan = make(chan addAppPasswordRequest, 10)
+	s.removeAppPasswordChan = make(chan removeAppPasswordRequest, 10)
 	s.authenticateChan = make(chan authenticateRequest, 10)
+	s.rehashChan = make(chan rehashRequest, 10)
+	s.subscribeChan = make(chan subscribeRequest, 10)
+	s.unsubscribeChan = make(chan unsubscribeRequest, 10)
+	s.replicateChan = make(chan replicateRequest, 10)
+	s.replicas = make(map[chan replicationMessage]bool)
+	s.loginFailures = make(map[string]*loginFailures)
 
 	switch doUpgrades {
 	case "":
 		s.upgradeChan = nil
 	case "local":
+		if s.readOnly {
+			err = errors.New("local upgrades are not possible for read-only stores")
+			return
+		}
 		s.upgradeChan = s.updateChan
 	default:
-		if s.upgradeChan, err = runRemoteUpgrader(doUpgrades); err != nil {
+		var config *remoteUpgradeConfig
+		if config, err = readRemoteUpgradeConfig(upgradeConfig); err != nil {
+			return
+		}
+		if s.upgradeChan, err = runRemoteUpgrader(doUpgrades, config, s.dir.BaseDir); err != nil {
 			return
 		}
 	}
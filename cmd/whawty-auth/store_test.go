@@ -0,0 +1,75 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testStoreConfig = `basedir: "%s"
+default: 1
+params:
+  - id: 1
+    argon2id:
+      time: 1
+      memory: 1024
+      threads: 1
+      length: 32
+`
+
+// newTestStore creates a store in a temporary directory which contains the admin 'admin' and
+// the user 'user'. Their passwords are 'admin-secret' and 'user-secret'.
+func newTestStore(t *testing.T) *store {
+	dir := t.TempDir()
+	baseDir := filepath.Join(dir, "store")
+	if err := os.Mkdir(baseDir, 0700); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	configfile := filepath.Join(dir, "store.yml")
+	if err := os.WriteFile(configfile, []byte(fmt.Sprintf(testStoreConfig, baseDir)), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	s, err := NewStore(configfile, "", "", "", "", "", "", "", false, 0, 0)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := s.GetInterface().Init("admin", "admin-secret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := s.GetInterface().Add("user", "user-secret", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var tenantNameRe = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]*$")
+
+// tenant is an additional store served by the agent. Every tenant has its own store agent and
+// therefore its own hooks, password policy and authentication cache.
+type tenant struct {
+	name   string
+	config *tenantConfig
+	store  *Store
+	access *accessControl
+}
+
+// tenantList holds all tenants of the listener configuration and maps realms to them.
+type tenantList struct {
+	tenants []*tenant
+	realms  map[string]*tenant
+}
+
+func openTenant(c *cli.Context, config *tenantConfig) (*tenant, error) {
+	t := &tenant{name: config.Name, config: config}
+	if config.Store == "" {
+		return nil, fmt.Errorf("tenant '%s': store config is missing", t.name)
+	}
+	hooksConfig := config.HooksConfig
+	if hooksConfig == "" {
+		hooksConfig = c.GlobalString("hooks-config")
+	}
+	stateDir := config.StateDir
+	if stateDir == "" {
+		stateDir = c.GlobalString("state-dir")
+	}
+	s, err := NewStore(config.Store, config.DoUpgrades, c.GlobalString("upgrade-config"), config.PolicyType, config.PolicyCondition, config.HooksDir,
+		hooksConfig, stateDir, config.ReadOnly, c.GlobalDuration("auth-cache-ttl"), c.GlobalInt("auth-cache-size"))
+	if err != nil {
+		return nil, fmt.Errorf("tenant '%s': Error opening whawty store: %s", t.name, err)
+	}
+	t.store = s.GetInterface()
+	if err := t.store.StartWebhooks(); err != nil {
+		return nil, fmt.Errorf("tenant '%s': %v", t.name, err)
+	}
+	t.store.StartLoginState()
+	if c.GlobalBool("do-check") {
+		warnings, err := t.store.Check()
+		for _, warning := range warnings {
+			wl.Printf("tenant '%s': %s", t.name, warning)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tenant '%s': Error checking whawty store: %s", t.name, err)
+		}
+	}
+	if t.access, err = newAccessControl(config.Access); err != nil {
+		return nil, fmt.Errorf("tenant '%s': %v", t.name, err)
+	}
+	return t, nil
+}
+
+// openTenants opens the stores of all tenants. It returns nil if there are no tenants.
+func openTenants(c *cli.Context, configs []tenantConfig) (*tenantList, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	l := &tenantList{realms: make(map[string]*tenant)}
+	names := make(map[string]bool)
+	realms := make(map[string]string)
+	hosts := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for i := range configs {
+		config := &configs[i]
+		if !tenantNameRe.MatchString(config.Name) {
+			return nil, fmt.Errorf("tenant name '%s' is invalid", config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("tenant '%s' is defined more than once", config.Name)
+		}
+		names[config.Name] = true
+		for _, realm := range config.Realms {
+			realm = strings.ToLower(realm)
+			if realm == "" {
+				return nil, fmt.Errorf("tenant '%s': empty realm", config.Name)
+			}
+			if other, exists := realms[realm]; exists {
+				return nil, fmt.Errorf("tenant '%s': realm '%s' is already used by tenant '%s'", config.Name, realm, other)
+			}
+			realms[realm] = config.Name
+		}
+		for _, host := range config.Hosts {
+			host = strings.ToLower(host)
+			if hosts[host] {
+				return nil, fmt.Errorf("tenant '%s': host '%s' is used more than once", config.Name, host)
+			}
+			hosts[host] = true
+		}
+		if prefix := config.PathPrefix; prefix != "" {
+			if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+				return nil, fmt.Errorf("tenant '%s': path-prefix must start but not end with a '/'", config.Name)
+			}
+			if prefixes[prefix] {
+				return nil, fmt.Errorf("tenant '%s': path-prefix '%s' is used more than once", config.Name, prefix)
+			}
+			prefixes[prefix] = true
+		}
+
+		t, err := openTenant(c, config)
+		if err != nil {
+			return nil, err
+		}
+		for _, realm := range config.Realms {
+			l.realms[strings.ToLower(realm)] = t
+		}
+		l.tenants = append(l.tenants, t)
+	}
+	return l, nil
+}
+
+// byRealm returns the tenant serving realm or nil if realm belongs to the default store.
+func (l *tenantList) byRealm(realm string) *tenant {
+	if l == nil {
+		return nil
+	}
+	return l.realms[strings.ToLower(realm)]
+}
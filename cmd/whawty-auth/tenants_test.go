@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func TestForLogin(t *testing.T) {
+	example := &tenant{name: "example", store: &Store{baseDir: "example"}}
+	tenants := &tenantList{tenants: []*tenant{example}, realms: map[string]*tenant{"example.org": example}}
+	s := (&Store{baseDir: "default"}).WithTenants(tenants)
+
+	testvectors := []struct {
+		login    string
+		realm    string
+		store    string
+		username string
+	}{
+		// realm taken from the login
+		{"alice@example.org", "", "example", "alice"},
+		{"alice@Example.ORG", "", "example", "alice"},
+		{"alice@host@example.org", "", "example", "alice@host"},
+		{"alice@example.com", "", "default", "alice@example.com"},
+		{"alice", "", "default", "alice"},
+		{"alice@", "", "default", "alice@"},
+		// explicit realm
+		{"alice@example.org", "example.org", "example", "alice"},
+		{"alice@example.org", "EXAMPLE.org", "example", "alice"},
+		{"alice", "example.org", "example", "alice"},
+		{"alice@example.com", "example.org", "example", "alice@example.com"},
+		{"alice@example.org", "example.com", "default", "alice@example.org"},
+		{"alice", "example.com", "default", "alice"},
+	}
+	for _, v := range testvectors {
+		store, username := s.ForLogin(v.login, v.realm)
+		if store.baseDir != v.store || username != v.username {
+			t.Fatalf("login '%s', realm '%s': got store '%s' and username '%s', expected '%s' and '%s'",
+				v.login, v.realm, store.baseDir, username, v.store, v.username)
+		}
+	}
+
+	// both routes must end up with the same username
+	viaLogin, username1 := s.ForLogin("alice@example.org", "")
+	viaRealm, username2 := s.ForLogin("alice@example.org", "example.org")
+	if viaLogin.baseDir != viaRealm.baseDir || username1 != username2 {
+		t.Fatalf("realm from login and explicit realm differ: '%s'@'%s' and '%s'@'%s'", username1, viaLogin.baseDir, username2, viaRealm.baseDir)
+	}
+
+	// without tenants the login is used as it is
+	if store, username := (&Store{baseDir: "default"}).ForLogin("alice@example.org", "example.org"); store.baseDir != "default" || username != "alice@example.org" {
+		t.Fatalf("without tenants got store '%s' and username '%s'", store.baseDir, username)
+	}
+}
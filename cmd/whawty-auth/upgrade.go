@@ -0,0 +1,347 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Upgrades are sent to the master by a pool of workers. Requests which failed due to network
+// problems or server errors are retried with an exponential backoff until they are older than
+// max-age. If queue-dir is set pending upgrades are written there so they survive restarts of
+// the agent. Since they contain the password of the user the file is encrypted using queue-key.
+const (
+	remoteUpgradeMinBackoff = time.Second     // TODO: hardcoded value
+	remoteUpgradeMaxBackoff = 5 * time.Minute // TODO: hardcoded value
+
+	remoteUpgradeQueueAD = "whawty-auth upgrade queue"
+)
+
+var (
+	remoteUpgradesPending   = expvar.NewInt("remote_upgrades_pending")
+	remoteUpgradesSucceeded = expvar.NewInt("remote_upgrades_succeeded")
+	remoteUpgradesRetried   = expvar.NewInt("remote_upgrades_retried")
+	remoteUpgradesDropped   = expvar.NewInt("remote_upgrades_dropped")
+)
+
+type remoteUpgrade struct {
+	request  updateRequest
+	queued   time.Time
+	attempts int
+}
+
+// remoteUpgradeEntry is the representation of a pending upgrade in the queue file.
+type remoteUpgradeEntry struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	Hash     string    `json:"hash"`
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts"`
+}
+
+type remoteUpgradeResult struct {
+	username string
+	err      error
+	retry    bool
+}
+
+type remoteUpgrader struct {
+	remote  string
+	config  *remoteUpgradeConfig
+	client  *http.Client
+	file    string
+	aead    cipher.AEAD
+	pending map[string]*remoteUpgrade
+	ready   []string
+	running int
+	done    chan remoteUpgradeResult
+	retry   chan string
+}
+
+func newRemoteUpgrader(remote string, config *remoteUpgradeConfig, storeDir string) (u *remoteUpgrader, err error) {
+	u = &remoteUpgrader{remote: remote, config: config}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TLS != nil {
+		if transport.TLSClientConfig, err = config.TLS.ToGoTLSConfig(); err != nil {
+			return
+		}
+	}
+	u.client = &http.Client{Transport: transport, Timeout: config.Timeout}
+	u.pending = make(map[string]*remoteUpgrade)
+	u.done = make(chan remoteUpgradeResult)
+	u.retry = make(chan string)
+
+	if config.QueueDir != "" {
+		var d os.FileInfo
+		if d, err = os.Stat(config.QueueDir); err != nil {
+			return
+		}
+		if !d.IsDir() {
+			return nil, errors.New("upgrade(remote): queue-dir is not a directory")
+		}
+		if u.aead, err = newRemoteUpgradeQueueAEAD(config.QueueKey); err != nil {
+			return
+		}
+		// several stores may use the same configuration
+		digest := sha256.Sum256([]byte(storeDir))
+		u.file = filepath.Join(config.QueueDir, fmt.Sprintf("upgrades-%s.queue", hex.EncodeToString(digest[:8])))
+		if err = u.load(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func newRemoteUpgradeQueueAEAD(queueKey string) (cipher.AEAD, error) {
+	if queueKey == "" {
+		return nil, errors.New("upgrade(remote): queue-dir needs a queue-key to encrypt the pending upgrades")
+	}
+	key, err := base64.StdEncoding.DecodeString(queueKey)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade(remote): can't decode queue-key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("upgrade(remote): queue-key must be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (u *remoteUpgrader) load() error {
+	data, err := os.ReadFile(u.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(data) < u.aead.NonceSize() {
+		return errors.New("upgrade(remote): error reading queue: file is too short")
+	}
+	plain, err := u.aead.Open(nil, data[:u.aead.NonceSize()], data[u.aead.NonceSize():], []byte(remoteUpgradeQueueAD))
+	if err != nil {
+		return fmt.Errorf("upgrade(remote): error reading queue: %v", err)
+	}
+	var entries []remoteUpgradeEntry
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return fmt.Errorf("upgrade(remote): error reading queue: %v", err)
+	}
+	for _, e := range entries {
+		u.pending[e.Username] = &remoteUpgrade{
+			request:  updateRequest{username: e.Username, password: e.Password, hash: e.Hash},
+			queued:   e.Queued,
+			attempts: e.Attempts,
+		}
+		u.ready = append(u.ready, e.Username)
+	}
+	remoteUpgradesPending.Add(int64(len(entries)))
+	if len(entries) > 0 {
+		wl.Printf("upgrade(remote): %d upgrades are still pending", len(entries))
+	}
+	return nil
+}
+
+// save writes all pending upgrades to the queue-dir, oldest first.
+func (u *remoteUpgrader) save() {
+	if u.file == "" {
+		return
+	}
+	entries := make([]remoteUpgradeEntry, 0, len(u.pending))
+	for _, upgrade := range u.pending {
+		entries = append(entries, remoteUpgradeEntry{
+			Username: upgrade.request.username,
+			Password: upgrade.request.password,
+			Hash:     upgrade.request.hash,
+			Queued:   upgrade.queued,
+			Attempts: upgrade.attempts,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Queued.Before(entries[j].Queued) })
+
+	plain, err := json.Marshal(entries)
+	if err == nil {
+		nonce := make([]byte, u.aead.NonceSize())
+		if _, err = rand.Read(nonce); err == nil {
+			data := u.aead.Seal(nonce, nonce, plain, []byte(remoteUpgradeQueueAD))
+			tmp := u.file + ".tmp"
+			if err = os.WriteFile(tmp, data, 0600); err == nil {
+				err = os.Rename(tmp, u.file)
+			}
+		}
+	}
+	if err != nil {
+		wl.Printf("upgrade(remote): error writing queue: %v", err)
+	}
+}
+
+func (u *remoteUpgrader) send(upgrade updateRequest) (result remoteUpgradeResult) {
+	result.username = upgrade.username
+	reqdata, err := json.Marshal(webUpgradeRequest{Username: upgrade.username, Password: upgrade.password, Hash: upgrade.hash})
+	if err != nil {
+		result.err = fmt.Errorf("error while encoding upgrade request: %v", err)
+		return
+	}
+	req, err := http.NewRequest("POST", u.remote, bytes.NewReader(reqdata))
+	if err != nil {
+		result.err = err
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.config.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+u.config.Secret)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		result.err = fmt.Errorf("error sending upgrade request: %v", err)
+		result.retry = true
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return
+	}
+	respdata := &webUpgradeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(respdata); err != nil || respdata.Error == "" {
+		result.err = fmt.Errorf("master responded with status: %s", resp.Status)
+	} else {
+		result.err = fmt.Errorf("master responded with status: %s (%s)", resp.Status, respdata.Error)
+	}
+	// client errors won't go away by trying again
+	result.retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return
+}
+
+func (u *remoteUpgrader) enqueue(upgrade updateRequest) {
+	if _, exists := u.pending[upgrade.username]; exists {
+		wdl.Printf("upgrade(remote): upgrade for '%s' is already pending", upgrade.username)
+		return
+	}
+	if len(u.pending) >= u.config.QueueSize {
+		wl.Printf("upgrade(remote): dropping upgrade for '%s', too many upgrades are pending", upgrade.username)
+		remoteUpgradesDropped.Add(1)
+		return
+	}
+	u.pending[upgrade.username] = &remoteUpgrade{request: upgrade, queued: time.Now()}
+	u.ready = append(u.ready, upgrade.username)
+	remoteUpgradesPending.Add(1)
+	u.save()
+}
+
+func (u *remoteUpgrader) finished(result remoteUpgradeResult) {
+	upgrade := u.pending[result.username]
+	if result.err != nil && result.retry && time.Since(upgrade.queued) < u.config.MaxAge {
+		backoff := remoteUpgradeMinBackoff << upgrade.attempts
+		if backoff > remoteUpgradeMaxBackoff || backoff <= 0 {
+			backoff = remoteUpgradeMaxBackoff
+		}
+		upgrade.attempts++
+		wl.Printf("upgrade(remote): upgrading '%s' failed: %v, retrying in %v", result.username, result.err, backoff)
+		remoteUpgradesRetried.Add(1)
+		u.save()
+		time.AfterFunc(backoff, func() { u.retry <- result.username })
+		return
+	}
+
+	delete(u.pending, result.username)
+	remoteUpgradesPending.Add(-1)
+	u.save()
+	if result.err != nil {
+		wl.Printf("upgrade(remote): giving up upgrading '%s': %v", result.username, result.err)
+		remoteUpgradesDropped.Add(1)
+		return
+	}
+	wdl.Printf("upgrade(remote): successfully upgraded '%s'", result.username)
+	remoteUpgradesSucceeded.Add(1)
+}
+
+func (u *remoteUpgrader) run(upgradeChan <-chan updateRequest) {
+	for {
+		for u.running < u.config.Concurrency && len(u.ready) > 0 {
+			upgrade := u.pending[u.ready[0]].request
+			u.ready = u.ready[1:]
+			u.running++
+			wdl.Printf("upgrade(remote): upgrading '%s' via %s", upgrade.username, u.remote)
+			go func() { u.done <- u.send(upgrade) }()
+		}
+
+		select {
+		case upgrade := <-upgradeChan:
+			u.enqueue(upgrade)
+		case result := <-u.done:
+			u.running--
+			u.finished(result)
+		case username := <-u.retry:
+			u.ready = append(u.ready, username)
+		}
+	}
+}
+
+func runRemoteUpgrader(remote string, config *remoteUpgradeConfig, storeDir string) (upgradeChan chan updateRequest, err error) {
+	var r *url.URL
+	if r, err = url.Parse(remote); err != nil {
+		return
+	}
+	switch r.Scheme {
+	case "http":
+		wl.Printf("upgrade(remote): Warning using unsecure url for remote updates: %s", remote)
+		fallthrough
+	case "https":
+		var u *remoteUpgrader
+		if u, err = newRemoteUpgrader(remote, config, storeDir); err != nil {
+			return
+		}
+		upgradeChan = make(chan updateRequest, 10)
+		go u.run(upgradeChan)
+	default:
+		err = errors.New("unsupported hash-upgrade mode, must be either empty, 'local' or a http(s) url to the master")
+	}
+	return
+}
@@ -0,0 +1,252 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUpgradeMaster is a master which answers upgrade requests with the queued status codes and
+// 200 once all of them have been used.
+type testUpgradeMaster struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []webUpgradeRequest
+}
+
+func (m *testUpgradeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer upgrade-secret" {
+		sendWebResponse(w, http.StatusUnauthorized, webUpgradeResponse{Error: "invalid secret"})
+		return
+	}
+	var req webUpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendWebResponse(w, http.StatusBadRequest, webUpgradeResponse{Error: err.Error()})
+		return
+	}
+	m.requests = append(m.requests, req)
+	status := http.StatusOK
+	if len(m.statuses) > 0 {
+		status, m.statuses = m.statuses[0], m.statuses[1:]
+	}
+	sendWebResponse(w, status, webUpgradeResponse{})
+}
+
+func newTestRemoteUpgrader(t *testing.T, remote string, config remoteUpgradeConfig) *remoteUpgrader {
+	if config.Concurrency == 0 {
+		config.Concurrency = 1
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 10
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = time.Hour
+	}
+	config.Timeout = time.Second
+	config.Secret = "upgrade-secret"
+	u, err := newRemoteUpgrader(remote, &config, "store")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return u
+}
+
+var errTestUpgrade = errors.New("upgrade failed")
+
+func newTestQueueKey(t *testing.T) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestRemoteUpgraderSend(t *testing.T) {
+	master := &testUpgradeMaster{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusConflict}}
+	server := httptest.NewServer(master)
+	defer server.Close()
+	u := newTestRemoteUpgrader(t, server.URL, remoteUpgradeConfig{})
+
+	upgrade := updateRequest{username: "user", password: "user-secret", hash: "digest"}
+	for _, expected := range []struct {
+		err   bool
+		retry bool
+	}{{true, true}, {true, true}, {true, false}, {false, false}} {
+		result := u.send(upgrade)
+		if (result.err != nil) != expected.err || result.retry != expected.retry {
+			t.Fatalf("expected err=%t and retry=%t, got %v and %t", expected.err, expected.retry, result.err, result.retry)
+		}
+	}
+	if len(master.requests) != 4 || master.requests[0] != (webUpgradeRequest{Username: "user", Password: "user-secret", Hash: "digest"}) {
+		t.Fatalf("master got unexpected requests: %+v", master.requests)
+	}
+
+	u.config.Secret = "wrong"
+	if result := u.send(upgrade); result.err == nil || result.retry {
+		t.Fatalf("requests rejected by the master should not be retried, got %v and %t", result.err, result.retry)
+	}
+
+	server.Close()
+	if result := u.send(upgrade); result.err == nil || !result.retry {
+		t.Fatalf("requests failing due to network problems should be retried, got %v and %t", result.err, result.retry)
+	}
+}
+
+func TestRemoteUpgraderQueue(t *testing.T) {
+	u := newTestRemoteUpgrader(t, "https://master.example.com/api/upgrade", remoteUpgradeConfig{QueueSize: 2})
+
+	u.enqueue(updateRequest{username: "alice", password: "secret1"})
+	u.enqueue(updateRequest{username: "alice", password: "secret2"})
+	u.enqueue(updateRequest{username: "bob", password: "secret3"})
+	u.enqueue(updateRequest{username: "carol", password: "secret4"})
+	if len(u.pending) != 2 || len(u.ready) != 2 || u.pending["alice"].request.password != "secret1" || u.pending["carol"] != nil {
+		t.Fatalf("duplicate upgrades and upgrades exceeding the queue size should be dropped: %v", u.ready)
+	}
+
+	u.ready = nil
+	u.finished(remoteUpgradeResult{username: "alice", err: errTestUpgrade, retry: true})
+	if upgrade := u.pending["alice"]; upgrade == nil || upgrade.attempts != 1 {
+		t.Fatal("failed upgrades should be retried")
+	}
+	select {
+	case username := <-u.retry:
+		if username != "alice" {
+			t.Fatalf("unexpected retry of '%s'", username)
+		}
+	case <-time.After(2 * remoteUpgradeMinBackoff):
+		t.Fatal("the upgrade hasn't been retried")
+	}
+
+	u.finished(remoteUpgradeResult{username: "alice", err: errTestUpgrade, retry: false})
+	if u.pending["alice"] != nil {
+		t.Fatal("upgrades which can't succeed should be dropped")
+	}
+
+	u.pending["bob"].queued = time.Now().Add(-2 * u.config.MaxAge)
+	u.finished(remoteUpgradeResult{username: "bob", err: errTestUpgrade, retry: true})
+	if u.pending["bob"] != nil {
+		t.Fatal("upgrades older than max-age should be dropped")
+	}
+
+	u.enqueue(updateRequest{username: "carol", password: "secret4"})
+	u.finished(remoteUpgradeResult{username: "carol"})
+	if len(u.pending) != 0 {
+		t.Fatal("successful upgrades should be removed from the queue")
+	}
+}
+
+func TestRemoteUpgraderRun(t *testing.T) {
+	master := &testUpgradeMaster{statuses: []int{http.StatusBadGateway}}
+	server := httptest.NewServer(master)
+	defer server.Close()
+	u := newTestRemoteUpgrader(t, server.URL, remoteUpgradeConfig{})
+
+	upgrades := make(chan updateRequest)
+	go u.run(upgrades)
+	upgrades <- updateRequest{username: "user", password: "user-secret"}
+
+	deadline := time.Now().Add(5 * remoteUpgradeMinBackoff)
+	for {
+		master.mutex.Lock()
+		n := len(master.requests)
+		master.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the upgrade should be retried once, the master got %d requests", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteUpgraderPersist(t *testing.T) {
+	config := remoteUpgradeConfig{QueueDir: t.TempDir(), QueueKey: newTestQueueKey(t)}
+	u := newTestRemoteUpgrader(t, "https://master.example.com/api/upgrade", config)
+	u.enqueue(updateRequest{username: "alice", password: "secret1", hash: "digest1"})
+	u.enqueue(updateRequest{username: "bob", password: "secret2", hash: "digest2"})
+	u.finished(remoteUpgradeResult{username: "alice", err: errTestUpgrade, retry: true})
+
+	data, err := os.ReadFile(u.file)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if bytes.Contains(data, []byte("secret1")) || bytes.Contains(data, []byte("alice")) {
+		t.Fatal("the queue must be stored encrypted")
+	}
+
+	u2 := newTestRemoteUpgrader(t, u.remote, config)
+	if len(u2.ready) != 2 || u2.ready[0] != "alice" || u2.ready[1] != "bob" {
+		t.Fatalf("all pending upgrades should be ready after loading the queue, oldest first: %v", u2.ready)
+	}
+	alice := u2.pending["alice"]
+	if alice == nil || alice.request != (updateRequest{username: "alice", password: "secret1", hash: "digest1"}) || alice.attempts != 1 || !alice.queued.Equal(u.pending["alice"].queued) {
+		t.Fatalf("upgrade restored from the queue differs: %+v", alice)
+	}
+
+	u2.finished(remoteUpgradeResult{username: "alice"})
+	u2.finished(remoteUpgradeResult{username: "bob"})
+	if u3 := newTestRemoteUpgrader(t, u.remote, config); len(u3.pending) != 0 {
+		t.Fatalf("finished upgrades should be removed from the queue file: %v", u3.ready)
+	}
+
+	// the queue is only readable using the same key
+	u.save()
+	config.QueueKey = newTestQueueKey(t)
+	if _, err := newRemoteUpgrader(u.remote, &config, "store"); err == nil {
+		t.Fatal("loading the queue using another key should fail")
+	}
+
+	for _, key := range []string{"", "invalid", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		config.QueueKey = key
+		if _, err := newRemoteUpgrader(u.remote, &config, "other-store"); err == nil {
+			t.Fatalf("queue-key '%s' should be rejected", key)
+		}
+	}
+	config.QueueDir = filepath.Join(config.QueueDir, "missing")
+	config.QueueKey = newTestQueueKey(t)
+	if _, err := newRemoteUpgrader(u.remote, &config, "store"); err == nil {
+		t.Fatal("a missing queue-dir should be an error")
+	}
+}
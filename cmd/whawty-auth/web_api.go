@@ -31,17 +31,37 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	storeLib "github.com/whawty/auth/store"
 	"github.com/whawty/auth/ui"
 )
 
+// webAuthFailedError returns the error string for a failed authentication. The reason
+// only gets logged unless the password was correct but has expired.
+func webAuthFailedError(op, username string, err error) string {
+	if err == storeLib.ErrPasswordExpired {
+		return err.Error()
+	}
+	if err != nil {
+		wdl.Printf("web-api: %s failed for '%s': %v", op, username, err)
+	}
+	return authFailedMessage
+}
+
 func handleWebBasicAuth(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -50,11 +70,18 @@ func handleWebBasicAuth(store *Store, sessions *webSessionFactory, w http.Respon
 		return
 	}
 
+	if service := r.URL.Query().Get("service"); service != "" {
+		store = store.WithService(service, "")
+	}
 	ok, _, _, err := store.Authenticate(username, password)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	if err == errAccessDenied {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
-	} else if !ok {
+	}
+	if err != nil || !ok {
+		if err != nil {
+			wdl.Printf("web-api: basic-auth failed for '%s': %v", username, err)
+		}
 		http.Error(w, "Authentication Failed", http.StatusUnauthorized)
 		return
 	}
@@ -64,6 +91,112 @@ func handleWebBasicAuth(store *Store, sessions *webSessionFactory, w http.Respon
 	fmt.Fprintln(w, "success")
 }
 
+// forwardAuthCredentials returns the user of the request. Credentials are taken from the
+// Authorization header, either using basic authentication or a session as bearer token, or
+// from the session cookie. The access rules are not checked here since they must also be
+// applied to sessions.
+func forwardAuthCredentials(store *Store, sessions *webSessionFactory, r *http.Request) (username string, isAdmin, ok bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		ok, isAdmin, _, err := store.WithAccessControl(nil).Authenticate(username, password)
+		if err != nil || !ok {
+			if err != nil {
+				wdl.Printf("web-api: forward-auth failed for '%s': %v", username, err)
+			}
+			return "", false, false
+		}
+		return username, isAdmin, true
+	}
+
+	var session string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, found := strings.Cut(auth, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return "", false, false
+		}
+		session = token
+	} else if cookie, found := sessions.Cookie(r); found {
+		session = cookie
+	} else {
+		return "", false, false
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(session)
+	if status != http.StatusOK {
+		wdl.Printf("web-api: forward-auth got invalid session: %s", errorStr)
+		return "", false, false
+	}
+	return username, isAdmin, true
+}
+
+// forwardAuthAllowed checks the requirements passed as query parameters: 'admin' requires
+// the user to be an admin and 'group', which may be given several times, requires the user
+// to be a member of at least one of the groups.
+func forwardAuthAllowed(store *Store, username string, isAdmin bool, query url.Values) (bool, error) {
+	if query.Has("admin") {
+		requireAdmin, err := strconv.ParseBool(query.Get("admin"))
+		if err != nil {
+			return false, fmt.Errorf("invalid value for parameter admin: %v", err)
+		}
+		if requireAdmin && !isAdmin {
+			return false, nil
+		}
+	}
+
+	required := query["group"]
+	if len(required) == 0 {
+		return true, nil
+	}
+	aux, err := store.GetAuxData(username)
+	if err != nil {
+		return false, err
+	}
+	groups := aux.Groups()
+	if isAdmin {
+		groups = append(groups, storeLib.AdminGroup)
+	}
+	for _, group := range required {
+		for _, g := range groups {
+			if g == group {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func handleWebForwardAuth(store *Store, sessions *webSessionFactory, realm string, w http.ResponseWriter, r *http.Request) {
+	if service := r.URL.Query().Get("service"); service != "" {
+		store = store.WithService(service, "")
+	}
+	username, isAdmin, ok := forwardAuthCredentials(store, sessions, r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	allowed, err := store.CheckAccess(username, isAdmin)
+	if err == nil && allowed {
+		allowed, err = forwardAuthAllowed(store, username, isAdmin, r.URL.Query())
+	}
+	if err != nil {
+		wl.Printf("web-api: forward-auth failed to check permissions of '%s': %v", username, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !allowed {
+		wdl.Printf("web-api: forward-auth denied access for '%s'", username)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("X-Whawty-User", username)
+	w.Header().Set("X-Whawty-Admin", strconv.FormatBool(isAdmin))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "success")
+}
+
 type webAuthenticateRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -74,6 +207,7 @@ type webAuthenticateResponse struct {
 	Username    string    `json:"username"`
 	IsAdmin     bool      `json:"admin"`
 	LastChanged time.Time `json:"lastchanged"`
+	ReadOnly    bool      `json:"readonly,omitempty"`
 	Error       string    `json:"error,omitempty"`
 }
 
@@ -98,10 +232,7 @@ func handleWebAuthenticate(store *Store, sessions *webSessionFactory, w http.Res
 
 	ok, isAdmin, lastChanged, err := store.Authenticate(reqdata.Username, reqdata.Password)
 	if err != nil || !ok {
-		respdata.Error = "authentication failed"
-		if err != nil {
-			respdata.Error = err.Error()
-		}
+		respdata.Error = webAuthFailedError("authenticate", reqdata.Username, err)
 		sendWebResponse(w, http.StatusUnauthorized, respdata)
 		return
 	}
@@ -109,8 +240,12 @@ func handleWebAuthenticate(store *Store, sessions *webSessionFactory, w http.Res
 	respdata.Username = reqdata.Username
 	respdata.IsAdmin = isAdmin
 	respdata.LastChanged = lastChanged
+	respdata.ReadOnly = store.ReadOnly()
 	var status int
 	status, respdata.Error, respdata.Session = sessions.Generate(reqdata.Username, isAdmin)
+	if status == http.StatusOK {
+		sessions.SetCookie(w, r, respdata.Session)
+	}
 	sendWebResponse(w, status, respdata)
 }
 
@@ -161,7 +296,7 @@ func handleWebAdd(store *Store, sessions *webSessionFactory, w http.ResponseWrit
 
 	wdl.Printf("admin '%s' want's to add user '%s' and admin status: %t", username, reqdata.Username, reqdata.IsAdmin)
 
-	if err := store.Add(reqdata.Username, reqdata.Password, reqdata.IsAdmin); err != nil {
+	if err := store.WithActor(username).Add(reqdata.Username, reqdata.Password, reqdata.IsAdmin); err != nil {
 		respdata.Error = err.Error()
 		sendWebResponse(w, http.StatusBadRequest, respdata)
 		return
@@ -215,7 +350,7 @@ func handleWebRemove(store *Store, sessions *webSessionFactory, w http.ResponseW
 
 	wdl.Printf("admin '%s' want's to remove user '%s'", username, reqdata.Username)
 
-	if err := store.Remove(reqdata.Username); err != nil {
+	if err := store.WithActor(username).Remove(reqdata.Username); err != nil {
 		respdata.Error = err.Error()
 		sendWebResponse(w, http.StatusBadRequest, respdata)
 		return
@@ -255,6 +390,7 @@ func handleWebUpdate(store *Store, sessions *webSessionFactory, w http.ResponseW
 		return
 	}
 
+	actor := reqdata.Username
 	if reqdata.Session != "" && reqdata.OldPassword == "" {
 		if reqdata.NewPassword == "" {
 			respdata.Error = "empty newpassword is not allowed when using session based authentication"
@@ -275,13 +411,11 @@ func handleWebUpdate(store *Store, sessions *webSessionFactory, w http.ResponseW
 			return
 		}
 		wdl.Printf("user '%s' want's to update user '%s', using a valid session", username, reqdata.Username)
+		actor = username
 	} else if reqdata.Session == "" && reqdata.OldPassword != "" {
 		ok, _, _, err := store.Authenticate(reqdata.Username, reqdata.OldPassword)
 		if err != nil || !ok {
-			respdata.Error = "authentication failed"
-			if err != nil {
-				respdata.Error = err.Error()
-			}
+			respdata.Error = webAuthFailedError("update", reqdata.Username, err)
 			sendWebResponse(w, http.StatusUnauthorized, respdata)
 			return
 		}
@@ -298,7 +432,7 @@ func handleWebUpdate(store *Store, sessions *webSessionFactory, w http.ResponseW
 		return
 	}
 
-	if err := store.Update(reqdata.Username, reqdata.NewPassword); err != nil {
+	if err := store.WithActor(actor).Update(reqdata.Username, reqdata.NewPassword); err != nil {
 		respdata.Error = err.Error()
 		sendWebResponse(w, http.StatusBadRequest, respdata)
 		return
@@ -307,6 +441,122 @@ func handleWebUpdate(store *Store, sessions *webSessionFactory, w http.ResponseW
 	sendWebResponse(w, http.StatusOK, respdata)
 }
 
+type webUpgradeRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Hash     string `json:"hash"`
+}
+
+type webUpgradeResponse struct {
+	Username string `json:"username"`
+	Upgraded bool   `json:"upgraded"`
+	Error    string `json:"error,omitempty"`
+}
+
+// webUpgradeAuthorized checks whether the request has been sent by a replica. If both a secret
+// and client certificates are configured both are required.
+func webUpgradeAuthorized(config *webUpgradesConfig, r *http.Request) bool {
+	if config.ClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if config.Secret != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(config.Secret)) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+func handleWebUpgrade(store *Store, config *webUpgradesConfig, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got UPGRADE request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webUpgradeRequest{}
+	respdata := &webUpgradeResponse{}
+
+	if !webUpgradeAuthorized(config, r) {
+		wl.Printf("web-api: rejecting unauthorized upgrade request from %s", r.RemoteAddr)
+		respdata.Error = "replica is not authorized to request upgrades"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Username == "" || reqdata.Password == "" || reqdata.Hash == "" {
+		respdata.Error = "empty username, password or hash is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	respdata.Username = reqdata.Username
+	upgraded, err := store.WithActor("replica").Rehash(reqdata.Username, reqdata.Password, reqdata.Hash)
+	switch {
+	case err == errHashMismatch:
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusConflict, respdata)
+	case err == errReadOnly:
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusForbidden, respdata)
+	case err != nil:
+		respdata.Error = webAuthFailedError("upgrade", reqdata.Username, err)
+		sendWebResponse(w, http.StatusUnauthorized, respdata)
+	default:
+		if upgraded {
+			wdl.Printf("web-api: upgraded password hash of '%s' for replica %s", reqdata.Username, r.RemoteAddr)
+		}
+		respdata.Upgraded = upgraded
+		sendWebResponse(w, http.StatusOK, respdata)
+	}
+}
+
+type webResetRequest struct {
+	Username    string `json:"username"`
+	Token       string `json:"token"`
+	NewPassword string `json:"newpassword"`
+}
+
+type webResetResponse struct {
+	Username string `json:"username"`
+	Error    string `json:"error,omitempty"`
+}
+
+func handleWebReset(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got RESET request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webResetRequest{}
+	respdata := &webResetResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Username == "" || reqdata.Token == "" || reqdata.NewPassword == "" {
+		respdata.Error = "empty username, token or newpassword is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	wdl.Printf("reset password of user '%s', using a reset token", reqdata.Username)
+
+	if err := store.WithActor(reqdata.Username).Reset(reqdata.Username, reqdata.Token, reqdata.NewPassword); err != nil {
+		// unknown users and invalid tokens must not be distinguishable
+		respdata.Error = webAuthFailedError("reset", reqdata.Username, err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	respdata.Username = reqdata.Username
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
 type webSetAdminRequest struct {
 	Session  string `json:"session"`
 	Username string `json:"username"`
@@ -353,7 +603,7 @@ func handleWebSetAdmin(store *Store, sessions *webSessionFactory, w http.Respons
 
 	wdl.Printf("admin '%s' want's to set admin status of user '%s' to %t", username, reqdata.Username, reqdata.IsAdmin)
 
-	if err := store.SetAdmin(reqdata.Username, reqdata.IsAdmin); err != nil {
+	if err := store.WithActor(username).SetAdmin(reqdata.Username, reqdata.IsAdmin); err != nil {
 		respdata.Error = err.Error()
 		sendWebResponse(w, http.StatusBadRequest, respdata)
 		return
@@ -363,6 +613,235 @@ func handleWebSetAdmin(store *Store, sessions *webSessionFactory, w http.Respons
 	sendWebResponse(w, http.StatusOK, respdata)
 }
 
+type webSetGroupRequest struct {
+	Session  string `json:"session"`
+	Username string `json:"username"`
+	Group    string `json:"group"`
+	Member   bool   `json:"member"`
+}
+
+type webSetGroupResponse struct {
+	Username string `json:"username"`
+	Group    string `json:"group"`
+	Member   bool   `json:"member"`
+	Error    string `json:"error,omitempty"`
+}
+
+func handleWebSetGroup(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got SET_GROUP request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webSetGroupRequest{}
+	respdata := &webSetGroupResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" || reqdata.Username == "" || reqdata.Group == "" {
+		respdata.Error = "empty session, username or group is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin {
+		respdata.Error = "only admins are allowed to change the groups of users"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("admin '%s' want's to set membership of user '%s' in group '%s' to %t", username, reqdata.Username, reqdata.Group, reqdata.Member)
+
+	if err := store.WithActor(username).SetGroup(reqdata.Username, reqdata.Group, reqdata.Member); err != nil {
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	respdata.Username = reqdata.Username
+	respdata.Group = reqdata.Group
+	respdata.Member = reqdata.Member
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webListAppPasswordsRequest struct {
+	Session  string `json:"session"`
+	Username string `json:"username"`
+}
+
+type webListAppPasswordsResponse struct {
+	Username string                   `json:"username"`
+	List     storeLib.AppPasswordList `json:"list"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+func handleWebListAppPasswords(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got LIST_APP_PASSWORDS request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webListAppPasswordsRequest{}
+	respdata := &webListAppPasswordsResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" || reqdata.Username == "" {
+		respdata.Error = "empty session or username is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin && username != reqdata.Username {
+		respdata.Error = "only admins are allowed to list the app passwords of any user"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("user '%s' want's to list the app passwords of user '%s'", username, reqdata.Username)
+
+	var err error
+	if respdata.List, err = store.AppPasswords(reqdata.Username); err != nil {
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	respdata.Username = reqdata.Username
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webAddAppPasswordRequest struct {
+	Session  string   `json:"session"`
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+type webAddAppPasswordResponse struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func handleWebAddAppPassword(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got ADD_APP_PASSWORD request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webAddAppPasswordRequest{}
+	respdata := &webAddAppPasswordResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" || reqdata.Username == "" || reqdata.Name == "" {
+		respdata.Error = "empty session, username or name is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin && username != reqdata.Username {
+		respdata.Error = "only admins are allowed to add app passwords for any user"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("user '%s' want's to add app password '%s' for user '%s' with scopes %v", username, reqdata.Name, reqdata.Username, reqdata.Scopes)
+
+	var err error
+	if respdata.Password, err = store.WithActor(username).AddAppPassword(reqdata.Username, reqdata.Name, reqdata.Scopes); err != nil {
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	respdata.Username = reqdata.Username
+	respdata.Name = reqdata.Name
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webRemoveAppPasswordRequest struct {
+	Session  string `json:"session"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type webRemoveAppPasswordResponse struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Error    string `json:"error,omitempty"`
+}
+
+func handleWebRemoveAppPassword(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got REMOVE_APP_PASSWORD request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webRemoveAppPasswordRequest{}
+	respdata := &webRemoveAppPasswordResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" || reqdata.Username == "" || reqdata.Name == "" {
+		respdata.Error = "empty session, username or name is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin && username != reqdata.Username {
+		respdata.Error = "only admins are allowed to remove app passwords of any user"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("user '%s' want's to remove app password '%s' of user '%s'", username, reqdata.Name, reqdata.Username)
+
+	if err := store.WithActor(username).RemoveAppPassword(reqdata.Username, reqdata.Name); err != nil {
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	respdata.Username = reqdata.Username
+	respdata.Name = reqdata.Name
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
 type webListRequest struct {
 	Session string `json:"session"`
 }
@@ -467,6 +946,193 @@ func handleWebListFull(store *Store, sessions *webSessionFactory, w http.Respons
 	sendWebResponse(w, http.StatusOK, respdata)
 }
 
+type webHooksStatusRequest struct {
+	Session string `json:"session"`
+}
+
+type webHooksStatusResponse struct {
+	Hooks []hookStatus `json:"hooks"`
+	Error string       `json:"error,omitempty"`
+}
+
+func handleWebHooksStatus(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got HOOKS_STATUS request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webHooksStatusRequest{}
+	respdata := &webHooksStatusResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" {
+		respdata.Error = "empty session is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin {
+		respdata.Error = "only admins are allowed to see the status of the hooks"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("admin '%s' want's to see the status of the hooks", username)
+
+	respdata.Hooks = store.HooksStatus()
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webAuditRequest struct {
+	Session  string    `json:"session"`
+	Username string    `json:"username"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Cursor   string    `json:"cursor"`
+	Limit    int       `json:"limit"`
+}
+
+type webAuditResponse struct {
+	Records []auditRecord `json:"records"`
+	Next    string        `json:"next,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func handleWebAudit(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got AUDIT request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webAuditRequest{}
+	respdata := &webAuditResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" {
+		respdata.Error = "empty session is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin {
+		respdata.Error = "only admins are allowed to see the audit log"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("admin '%s' want's to see the audit log", username)
+
+	var err error
+	if respdata.Records, respdata.Next, err = store.AuditLog(reqdata.Username, reqdata.Actor, reqdata.Action,
+		reqdata.Since, reqdata.Until, reqdata.Cursor, reqdata.Limit); err != nil {
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webWebhooksStatusRequest struct {
+	Session string `json:"session"`
+}
+
+type webWebhooksStatusResponse struct {
+	Webhooks []webhookStatus `json:"webhooks"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func handleWebWebhooksStatus(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	wdl.Printf("web-api: got WEBHOOKS_STATUS request from %s", r.RemoteAddr)
+
+	decoder := json.NewDecoder(r.Body)
+	reqdata := &webWebhooksStatusRequest{}
+	respdata := &webWebhooksStatusResponse{}
+
+	if err := decoder.Decode(reqdata); err != nil {
+		respdata.Error = fmt.Sprintf("Error parsing JSON response: %s", err)
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	if reqdata.Session == "" {
+		respdata.Error = "empty session is not allowed"
+		sendWebResponse(w, http.StatusBadRequest, respdata)
+		return
+	}
+
+	status, errorStr, username, isAdmin := sessions.Check(reqdata.Session)
+	if status != http.StatusOK {
+		respdata.Error = errorStr
+		sendWebResponse(w, status, respdata)
+		return
+	}
+
+	if !isAdmin {
+		respdata.Error = "only admins are allowed to see the status of the webhooks"
+		sendWebResponse(w, http.StatusForbidden, respdata)
+		return
+	}
+
+	wdl.Printf("admin '%s' want's to see the status of the webhooks", username)
+
+	respdata.Webhooks = store.WebhooksStatus()
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
+type webReplicationStatus struct {
+	Connected   bool      `json:"connected"`
+	LastMessage time.Time `json:"lastmessage"`
+	Lag         float64   `json:"lag"`
+}
+
+type webHealthResponse struct {
+	Status      string                `json:"status"`
+	Replication *webReplicationStatus `json:"replication,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+// handleWebHealth is meant for monitoring and load balancers. Replicas report an error if they
+// are not connected to their master or lag behind.
+func handleWebHealth(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+	respdata := &webHealthResponse{Status: "ok"}
+	if replicaStatus != nil {
+		status := &webReplicationStatus{}
+		var lag time.Duration
+		status.Connected, status.LastMessage, lag = replicaStatus.status()
+		status.Lag = lag.Seconds()
+		respdata.Replication = status
+	}
+	if err := replicaStatus.check(); err != nil {
+		respdata.Status = "error"
+		respdata.Error = err.Error()
+		sendWebResponse(w, http.StatusServiceUnavailable, respdata)
+		return
+	}
+	sendWebResponse(w, http.StatusOK, respdata)
+}
+
 func sendWebResponse(w http.ResponseWriter, status int, respdata interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -474,6 +1140,23 @@ func sendWebResponse(w http.ResponseWriter, status int, respdata interface{}) {
 	encoder.Encode(respdata) //nolint:errcheck
 }
 
+type webErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// webModifyHandler wraps the handlers of requests which would change the store. On read-only
+// stores they are rejected right away.
+func webModifyHandler(h func(*Store, *webSessionFactory, http.ResponseWriter, *http.Request)) func(*Store, *webSessionFactory, http.ResponseWriter, *http.Request) {
+	return func(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+		if store.ReadOnly() {
+			wdl.Printf("web-api: rejecting request for '%s' from %s, the store is read-only", r.URL.Path, r.RemoteAddr)
+			sendWebResponse(w, http.StatusForbidden, webErrorResponse{Error: errReadOnly.Error()})
+			return
+		}
+		h(store, sessions, w, r)
+	}
+}
+
 type webHandler struct {
 	store    *Store
 	sessions *webSessionFactory
@@ -481,7 +1164,7 @@ type webHandler struct {
 }
 
 func (h webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.H(h.store, h.sessions, w, r)
+	h.H(h.store.WithSource(r.RemoteAddr), h.sessions, w, r)
 }
 
 // This is from golang http package - why is this not exported?
@@ -499,21 +1182,63 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-func newWebHandler(store *Store) (mux *http.ServeMux, err error) {
+func newWebMux(store *Store, cookie string, sessionLifetime time.Duration, metrics bool, forwardAuthRealm string, oidc *oidcConfig, upgrades *webUpgradesConfig) (mux *http.ServeMux, err error) {
 	var sessions *webSessionFactory
-	if sessions, err = NewWebSessionFactory(600 * time.Second); err != nil { // TODO: hardcoded value
+	if sessions, err = NewWebSessionFactory(sessionLifetime, cookie); err != nil {
 		return
 	}
 
+	if forwardAuthRealm == "" {
+		forwardAuthRealm = "restricted"
+	}
+
 	mux = http.NewServeMux()
+	// only basic-auth and forward-auth may use the authentication cache and app passwords and are subject to the access
+	// rules, logins to the web interface always check the password of the user
 	mux.Handle("/basic-auth", webHandler{store, sessions, handleWebBasicAuth})
+	mux.Handle("/forward-auth", webHandler{store, sessions, func(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+		handleWebForwardAuth(store, sessions, forwardAuthRealm, w, r)
+	}})
+	// logins using OpenID Connect are subject to the access rules for the service 'oidc'
+	oidcStore := store.WithAuthCache(false).WithAppPasswords(false).WithService("oidc", "")
+	store = store.WithAuthCache(false).WithAppPasswords(false).WithAccessControl(nil)
 	mux.Handle("/api/authenticate", webHandler{store, sessions, handleWebAuthenticate})
-	mux.Handle("/api/add", webHandler{store, sessions, handleWebAdd})
-	mux.Handle("/api/remove", webHandler{store, sessions, handleWebRemove})
-	mux.Handle("/api/update", webHandler{store, sessions, handleWebUpdate})
-	mux.Handle("/api/set-admin", webHandler{store, sessions, handleWebSetAdmin})
+	mux.Handle("/api/add", webHandler{store, sessions, webModifyHandler(handleWebAdd)})
+	mux.Handle("/api/remove", webHandler{store, sessions, webModifyHandler(handleWebRemove)})
+	mux.Handle("/api/update", webHandler{store, sessions, webModifyHandler(handleWebUpdate)})
+	mux.Handle("/api/reset", webHandler{store, sessions, webModifyHandler(handleWebReset)})
+	mux.Handle("/api/set-admin", webHandler{store, sessions, webModifyHandler(handleWebSetAdmin)})
+	mux.Handle("/api/set-group", webHandler{store, sessions, webModifyHandler(handleWebSetGroup)})
 	mux.Handle("/api/list", webHandler{store, sessions, handleWebList})
 	mux.Handle("/api/list-full", webHandler{store, sessions, handleWebListFull})
+	mux.Handle("/api/hooks/status", webHandler{store, sessions, handleWebHooksStatus})
+	mux.Handle("/api/webhooks/status", webHandler{store, sessions, handleWebWebhooksStatus})
+	mux.Handle("/api/audit", webHandler{store, sessions, handleWebAudit})
+	mux.Handle("/api/list-app-passwords", webHandler{store, sessions, handleWebListAppPasswords})
+	mux.Handle("/api/add-app-password", webHandler{store, sessions, webModifyHandler(handleWebAddAppPassword)})
+	mux.Handle("/api/remove-app-password", webHandler{store, sessions, webModifyHandler(handleWebRemoveAppPassword)})
+	if upgrades != nil {
+		if upgrades.Secret == "" && !upgrades.ClientCert {
+			err = errors.New("web-api: upgrades need at least one of secret or client-cert")
+			return
+		}
+		mux.Handle("/api/upgrade", webHandler{store, sessions, func(store *Store, sessions *webSessionFactory, w http.ResponseWriter, r *http.Request) {
+			handleWebUpgrade(store, upgrades, w, r)
+		}})
+	}
+
+	if oidc != nil {
+		var provider *oidcProvider
+		if provider, err = newOIDCProvider(oidcStore, sessions, oidc); err != nil {
+			return
+		}
+		provider.register(mux)
+	}
+
+	mux.Handle("/health", webHandler{store, sessions, handleWebHealth})
+	if metrics {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
 
 	mux.Handle("/admin/", http.StripPrefix("/admin/", http.FileServer(http.FS(ui.Assets))))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -526,14 +1251,81 @@ func newWebHandler(store *Store) (mux *http.ServeMux, err error) {
 	return
 }
 
+type webTenantPrefix struct {
+	prefix  string
+	handler http.Handler
+}
+
+// webTenantRouter passes requests to the web handlers of tenants based on the host or the path
+// prefix of the request. All other requests are handled by the web handler of the default store.
+type webTenantRouter struct {
+	fallback http.Handler
+	hosts    map[string]http.Handler
+	prefixes []webTenantPrefix
+}
+
+func (t webTenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if handler, exists := t.hosts[strings.ToLower(host)]; exists {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	for _, p := range t.prefixes {
+		if r.URL.Path == p.prefix || r.URL.Path == p.prefix+"/" {
+			http.Redirect(w, r, p.prefix+"/admin/", http.StatusTemporaryRedirect)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, p.prefix+"/") {
+			p.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	t.fallback.ServeHTTP(w, r)
+}
+
+func newWebHandler(store *Store, sessionLifetime time.Duration, metrics bool, forwardAuthRealm string, oidc *oidcConfig, upgrades *webUpgradesConfig) (http.Handler, error) {
+	mux, err := newWebMux(store, webSessionCookie, sessionLifetime, metrics, forwardAuthRealm, oidc, upgrades)
+	if err != nil || len(store.Tenants()) == 0 {
+		return mux, err
+	}
+
+	router := webTenantRouter{fallback: mux, hosts: make(map[string]http.Handler)}
+	for _, t := range store.Tenants() {
+		if len(t.config.Hosts) == 0 && t.config.PathPrefix == "" {
+			continue
+		}
+		// the OpenID Connect provider and the metrics are only available for the default store
+		handler, err := newWebMux(store.ForTenant(t), webSessionCookie+"-"+t.name, sessionLifetime, false, forwardAuthRealm, nil, upgrades)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range t.config.Hosts {
+			router.hosts[strings.ToLower(host)] = handler
+		}
+		if t.config.PathPrefix != "" {
+			router.prefixes = append(router.prefixes, webTenantPrefix{t.config.PathPrefix, http.StripPrefix(t.config.PathPrefix, handler)})
+		}
+	}
+	// nested prefixes: the longest one wins
+	sort.Slice(router.prefixes, func(i, j int) bool { return len(router.prefixes[i].prefix) > len(router.prefixes[j].prefix) })
+	return router, nil
+}
+
 func runHTTPsListener(listener *net.TCPListener, config *httpsConfig, store *Store) (err error) {
 	server := &http.Server{ReadTimeout: 60 * time.Second, WriteTimeout: 60 * time.Second}
-	if server.Handler, err = newWebHandler(store); err != nil {
+	store = store.WithListener("https:" + listener.Addr().String())
+	if server.Handler, err = newWebHandler(store.WithAppPasswords(true, "https").WithService("https", ""), config.SessionLifetime, config.Metrics, config.ForwardAuthRealm, config.OIDC, config.Upgrades); err != nil {
 		return
 	}
 	if server.TLSConfig, err = config.TLS.ToGoTLSConfig(); err != nil {
 		return
 	}
+	if config.Upgrades != nil && config.Upgrades.ClientCert && server.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven {
+		return errors.New("web-api: upgrades using client-cert need 'client-auth' to be at least 'verify-client-cert-if-given'")
+	}
 	wl.Printf("web-api: listening on '%s' using TLS", listener.Addr())
 	return server.ServeTLS(tcpKeepAliveListener{listener}, "", "")
 }
@@ -551,7 +1343,11 @@ func runHTTPsAddr(addr string, config *httpsConfig, store *Store) error {
 
 func runHTTPListener(listener *net.TCPListener, config *httpConfig, store *Store) (err error) {
 	server := &http.Server{ReadTimeout: 60 * time.Second, WriteTimeout: 60 * time.Second}
-	if server.Handler, err = newWebHandler(store); err != nil {
+	if config.Upgrades != nil && config.Upgrades.ClientCert {
+		return errors.New("web-api: upgrades using client-cert are only possible for https listeners")
+	}
+	store = store.WithListener("http:" + listener.Addr().String())
+	if server.Handler, err = newWebHandler(store.WithAppPasswords(true, "http").WithService("http", ""), config.SessionLifetime, config.Metrics, config.ForwardAuthRealm, config.OIDC, config.Upgrades); err != nil {
 		return
 	}
 	wl.Printf("web-api: listening on '%s'", listener.Addr())
@@ -0,0 +1,262 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestWebMux(t *testing.T, store *Store) *http.ServeMux {
+	mux, err := newWebMux(store, webSessionCookie, 0, false, "", nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return mux
+}
+
+func testWebRequest(mux *http.ServeMux, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// testWebSession logs in using the web-api and returns the session.
+func testWebSession(t *testing.T, mux *http.ServeMux, username, password string) string {
+	body, _ := json.Marshal(webAuthenticateRequest{Username: username, Password: password})
+	w := testWebRequest(mux, "POST", "/api/authenticate", string(body), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login of '%s' failed: %d %s", username, w.Code, w.Body)
+	}
+	var response webAuthenticateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return response.Session
+}
+
+func basicAuthHeader(username, password string) http.Header {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(username, password)
+	return r.Header
+}
+
+func TestWebForwardAuthCredentials(t *testing.T) {
+	mux := newTestWebMux(t, newTestStore(t).GetInterface())
+	session := testWebSession(t, mux, "user", "user-secret")
+
+	testVectors := []struct {
+		name   string
+		header http.Header
+		user   string
+	}{
+		{"no credentials", nil, ""},
+		{"basic-auth", basicAuthHeader("user", "user-secret"), "user"},
+		{"basic-auth with wrong password", basicAuthHeader("user", "wrong"), ""},
+		{"bearer session", http.Header{"Authorization": {"Bearer " + session}}, "user"},
+		{"bearer session, lower case scheme", http.Header{"Authorization": {"bearer " + session}}, "user"},
+		{"invalid bearer session", http.Header{"Authorization": {"Bearer invalid"}}, ""},
+		{"unknown scheme", http.Header{"Authorization": {"Token " + session}}, ""},
+		{"session cookie", http.Header{"Cookie": {webSessionCookie + "=" + session}}, "user"},
+		{"invalid session cookie", http.Header{"Cookie": {webSessionCookie + "=invalid"}}, ""},
+		{"authorization header takes precedence", http.Header{"Authorization": {"Bearer invalid"}, "Cookie": {webSessionCookie + "=" + session}}, ""},
+	}
+	for _, vector := range testVectors {
+		w := testWebRequest(mux, "GET", "/forward-auth", "", vector.header)
+		if vector.user == "" {
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("%s: expected status %d, got %d", vector.name, http.StatusUnauthorized, w.Code)
+			}
+			if w.Header().Get("WWW-Authenticate") != `Basic realm="restricted", charset="UTF-8"` {
+				t.Fatalf("%s: unexpected WWW-Authenticate header '%s'", vector.name, w.Header().Get("WWW-Authenticate"))
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", vector.name, http.StatusOK, w.Code)
+		}
+		if user := w.Header().Get("X-Whawty-User"); user != vector.user {
+			t.Fatalf("%s: expected user '%s', got '%s'", vector.name, vector.user, user)
+		}
+		if admin := w.Header().Get("X-Whawty-Admin"); admin != "false" {
+			t.Fatalf("%s: expected X-Whawty-Admin 'false', got '%s'", vector.name, admin)
+		}
+	}
+}
+
+func TestWebForwardAuthAccess(t *testing.T) {
+	ac, err := newAccessControl([]accessRuleConfig{{Service: "git", Groups: []string{"dev"}}, {Service: "mail", Deny: true}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := newTestStore(t).GetInterface()
+	mux := newTestWebMux(t, s.WithAccessControl(ac))
+	userSession := testWebSession(t, mux, "user", "user-secret")
+	adminSession := testWebSession(t, mux, "admin", "admin-secret")
+
+	testVectors := []struct {
+		query   string
+		user    int
+		admin   int
+		devUser int
+	}{
+		{"", http.StatusOK, http.StatusOK, http.StatusOK},
+		{"?service=git", http.StatusForbidden, http.StatusForbidden, http.StatusOK},
+		{"?service=mail", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"?admin=true", http.StatusForbidden, http.StatusOK, http.StatusForbidden},
+		{"?admin=false", http.StatusOK, http.StatusOK, http.StatusOK},
+		{"?admin=invalid", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"?group=dev", http.StatusForbidden, http.StatusForbidden, http.StatusOK},
+		{"?group=ops&group=admins", http.StatusForbidden, http.StatusOK, http.StatusForbidden},
+		{"?service=git&admin=true", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"?service=other&group=dev", http.StatusForbidden, http.StatusForbidden, http.StatusOK},
+	}
+	check := func(name string, header http.Header, query string, expected int) {
+		if w := testWebRequest(mux, "GET", "/forward-auth"+query, "", header); w.Code != expected {
+			t.Fatalf("%s, query '%s': expected status %d, got %d", name, query, expected, w.Code)
+		}
+	}
+	for _, vector := range testVectors {
+		check("user using basic-auth", basicAuthHeader("user", "user-secret"), vector.query, vector.user)
+		check("user using a session", http.Header{"Authorization": {"Bearer " + userSession}}, vector.query, vector.user)
+		check("admin using basic-auth", basicAuthHeader("admin", "admin-secret"), vector.query, vector.admin)
+		check("admin using a session", http.Header{"Cookie": {webSessionCookie + "=" + adminSession}}, vector.query, vector.admin)
+	}
+
+	if err := s.SetGroup("user", "dev", true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, vector := range testVectors {
+		check("member of dev using basic-auth", basicAuthHeader("user", "user-secret"), vector.query, vector.devUser)
+		check("member of dev using a session", http.Header{"Authorization": {"Bearer " + userSession}}, vector.query, vector.devUser)
+	}
+}
+
+// testWebAudit queries the audit log using the web-api.
+func testWebAudit(t *testing.T, mux *http.ServeMux, request webAuditRequest) (int, webAuditResponse) {
+	body, _ := json.Marshal(request)
+	w := testWebRequest(mux, "POST", "/api/audit", string(body), nil)
+	var response webAuditResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return w.Code, response
+}
+
+func TestWebAudit(t *testing.T) {
+	auditLog = newTestAuditLogger(t, false)
+	defer func() { auditLog = nil }()
+
+	s := newTestStore(t).GetInterface()
+	mux := newTestWebMux(t, s)
+	admin := testWebSession(t, mux, "admin", "admin-secret")
+	user := testWebSession(t, mux, "user", "user-secret")
+	auditLog.testRecord(t, "admin", hookEventAdd, "other") // another store
+
+	if code, response := testWebAudit(t, mux, webAuditRequest{Session: user}); code != http.StatusForbidden || response.Records != nil {
+		t.Fatalf("only admins should be allowed to see the audit log, got %d: %+v", code, response)
+	}
+	forged := "A" + admin[1:]
+	if admin[0] == 'A' {
+		forged = "B" + admin[1:]
+	}
+	if code, _ := testWebAudit(t, mux, webAuditRequest{Session: forged}); code != http.StatusUnauthorized {
+		t.Fatalf("forged sessions should be rejected, got %d", code)
+	}
+	if code, _ := testWebAudit(t, mux, webAuditRequest{}); code != http.StatusBadRequest {
+		t.Fatalf("empty sessions should be rejected, got %d", code)
+	}
+
+	code, all := testWebAudit(t, mux, webAuditRequest{Session: admin})
+	if code != http.StatusOK || all.Next != "" {
+		t.Fatalf("unexpected response %d: %+v", code, all)
+	}
+	// init, add and the authentications of admin and user, newest first
+	if len(all.Records) != 4 || all.Records[0].Action != auditActionAuthenticate || all.Records[3].Action != auditActionInit {
+		t.Fatalf("only the records of the store should be returned: %+v", all.Records)
+	}
+
+	for _, filter := range []struct {
+		request  webAuditRequest
+		expected int
+	}{
+		{webAuditRequest{Username: "user"}, 2},
+		{webAuditRequest{Username: "user", Action: hookEventAdd}, 1},
+		{webAuditRequest{Actor: "user"}, 1},
+		{webAuditRequest{Action: auditActionAuthenticate}, 2},
+		{webAuditRequest{Username: "other"}, 0},
+		{webAuditRequest{Since: all.Records[1].Time}, 2},
+		{webAuditRequest{Until: all.Records[2].Time}, 2},
+	} {
+		filter.request.Session = admin
+		code, response := testWebAudit(t, mux, filter.request)
+		if code != http.StatusOK || len(response.Records) != filter.expected {
+			t.Fatalf("filter %+v: expected %d records, got %d: %+v", filter.request, filter.expected, code, response)
+		}
+	}
+
+	var paged []auditRecord
+	request := webAuditRequest{Session: admin, Limit: 3}
+	for pages := 1; ; pages++ {
+		code, response := testWebAudit(t, mux, request)
+		if code != http.StatusOK || len(response.Records) > 3 || pages > 2 {
+			t.Fatalf("unexpected page %d: %d %+v", pages, code, response)
+		}
+		paged = append(paged, response.Records...)
+		if response.Next == "" {
+			break
+		}
+		request.Cursor = response.Next
+	}
+	if len(paged) != len(all.Records) {
+		t.Fatalf("the pages should contain all records: %+v", paged)
+	}
+	for i := range paged {
+		if paged[i] != all.Records[i] {
+			t.Fatalf("record %d differs: %+v != %+v", i, paged[i], all.Records[i])
+		}
+	}
+
+	if code, _ := testWebAudit(t, mux, webAuditRequest{Session: admin, Cursor: "invalid"}); code != http.StatusBadRequest {
+		t.Fatalf("invalid cursors should be rejected, got %d", code)
+	}
+	auditLog = nil
+	if code, response := testWebAudit(t, mux, webAuditRequest{Session: admin}); code != http.StatusBadRequest || response.Error == "" {
+		t.Fatalf("querying a disabled audit log should fail, got %d: %+v", code, response)
+	}
+}
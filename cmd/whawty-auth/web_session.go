@@ -42,14 +42,24 @@ import (
 	"time"
 )
 
+const (
+	webSessionCookie          = "whawty-session"
+	webDefaultSessionLifetime = 600 * time.Second
+)
+
 type webSessionFactory struct {
 	aesgcm   cipher.AEAD
 	lifetime time.Duration
+	cookie   string
 }
 
-func NewWebSessionFactory(lifetime time.Duration) (w *webSessionFactory, err error) {
+func NewWebSessionFactory(lifetime time.Duration, cookie string) (w *webSessionFactory, err error) {
 	w = &webSessionFactory{}
 	w.lifetime = lifetime
+	if w.lifetime <= 0 {
+		w.lifetime = webDefaultSessionLifetime
+	}
+	w.cookie = cookie
 
 	key := make([]byte, 16) // -> AES-128
 	var keylen int
@@ -188,3 +198,25 @@ func (w *webSessionFactory) Check(session string) (status int, errorStr string,
 
 	return w.splitCheckToken(token)
 }
+
+// Cookie returns the session cookie of the request if there is one.
+func (w *webSessionFactory) Cookie(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(w.cookie)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// SetCookie stores session in the session cookie which is used by forward-auth.
+func (w *webSessionFactory) SetCookie(rw http.ResponseWriter, r *http.Request, session string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     w.cookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(w.lifetime / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
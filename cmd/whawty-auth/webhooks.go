@@ -0,0 +1,361 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks are delivered to every endpoint one at a time in the order the events happened. A
+// delivery which failed due to network problems or server errors is retried with an exponential
+// backoff until it is older than max-age, later events wait until then. Pending deliveries are
+// written to the queue-dir, if configured, so they survive restarts of the agent. Since an event
+// might be delivered more than once receivers should use the event id to detect duplicates.
+const (
+	webhookMinBackoff = time.Second     // TODO: hardcoded value
+	webhookMaxBackoff = 5 * time.Minute // TODO: hardcoded value
+)
+
+var (
+	webhooksPending   = expvar.NewMap("webhooks_pending")
+	webhooksDelivered = expvar.NewMap("webhooks_delivered")
+	webhooksRetried   = expvar.NewMap("webhooks_retried")
+	webhooksDropped   = expvar.NewMap("webhooks_dropped")
+)
+
+// webhookEvent is the body of every webhook request.
+type webhookEvent struct {
+	ID       string    `json:"id"`
+	Store    string    `json:"store"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newWebhookEvent(store string, event hookEvent) (webhookEvent, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return webhookEvent{}, err
+	}
+	return webhookEvent{ID: hex.EncodeToString(id), Store: store, Type: event.Type, Username: event.Username, Time: event.Time}, nil
+}
+
+// webhookSignature returns the value of the X-Whawty-Signature header: the HMAC-SHA256 of the
+// timestamp, a dot and the body.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".") //nolint:errcheck
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookDelivery struct {
+	Event    webhookEvent `json:"event"`
+	Queued   time.Time    `json:"queued"`
+	Attempts int          `json:"attempts"`
+}
+
+// webhookStatus holds the delivery state of a webhook endpoint.
+type webhookStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Pending     int       `json:"pending"`
+	Oldest      time.Time `json:"oldest"`
+	Delivered   uint64    `json:"delivered"`
+	Retried     uint64    `json:"retried"`
+	Dropped     uint64    `json:"dropped"`
+	LastAttempt time.Time `json:"lastattempt"`
+	LastSuccess time.Time `json:"lastsuccess"`
+	LastError   string    `json:"lasterror,omitempty"`
+}
+
+type webhookResult struct {
+	err   error
+	retry bool
+}
+
+type webhookSender struct {
+	config *webhookConfig
+	events map[string]bool
+	client *http.Client
+	file   string
+	Notify chan webhookEvent
+	done   chan webhookResult
+	retry  chan struct{}
+	mutex  sync.Mutex
+	queue  []*webhookDelivery
+	status webhookStatus
+}
+
+func newWebhookSender(config *webhookConfig, queueDir, storeDir string) (w *webhookSender, err error) {
+	w = &webhookSender{config: config}
+	w.events = make(map[string]bool)
+	for _, event := range config.Events {
+		w.events[event] = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TLS != nil {
+		if transport.TLSClientConfig, err = config.TLS.ToGoTLSConfig(); err != nil {
+			return
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: config.Timeout}
+	w.Notify = make(chan webhookEvent, 32)
+	w.done = make(chan webhookResult)
+	w.retry = make(chan struct{})
+	w.status = webhookStatus{Name: config.Name, URL: config.URL}
+
+	if queueDir != "" {
+		// several stores may use the same configuration
+		digest := sha256.Sum256([]byte(storeDir))
+		w.file = filepath.Join(queueDir, fmt.Sprintf("%s-%s.json", config.Name, hex.EncodeToString(digest[:8])))
+		if err = w.load(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *webhookSender) load() error {
+	data, err := os.ReadFile(w.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, &w.queue); err != nil {
+		return fmt.Errorf("webhook '%s': error reading queue: %v", w.config.Name, err)
+	}
+	webhooksPending.Add(w.config.Name, int64(len(w.queue)))
+	if len(w.queue) > 0 {
+		wl.Printf("webhook '%s': %d deliveries are still pending", w.config.Name, len(w.queue))
+	}
+	return nil
+}
+
+// save writes the queue to the queue-dir. It must be called with the mutex held.
+func (w *webhookSender) save() {
+	if w.file == "" {
+		return
+	}
+	data, err := json.Marshal(w.queue)
+	if err == nil {
+		tmp := w.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, w.file)
+		}
+	}
+	if err != nil {
+		wl.Printf("webhook '%s': error writing queue: %v", w.config.Name, err)
+	}
+}
+
+func (w *webhookSender) send(event webhookEvent) (result webhookResult) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		result.err = fmt.Errorf("error while encoding event: %v", err)
+		return
+	}
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		result.err = err
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Whawty-Event", event.Type)
+	req.Header.Set("X-Whawty-Event-Id", event.ID)
+	req.Header.Set("X-Whawty-Timestamp", timestamp)
+	req.Header.Set("X-Whawty-Signature", webhookSignature(w.config.Secret, timestamp, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		result.err = fmt.Errorf("error sending event: %v", err)
+		result.retry = true
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) //nolint:errcheck
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return
+	}
+	result.err = fmt.Errorf("endpoint responded with status: %s", resp.Status)
+	// client errors won't go away by trying again
+	result.retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return
+}
+
+func (w *webhookSender) enqueue(event webhookEvent) {
+	if !w.events[event.Type] {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.queue) >= w.config.QueueSize {
+		wl.Printf("webhook '%s': dropping event '%s', too many deliveries are pending", w.config.Name, event.ID)
+		webhooksDropped.Add(w.config.Name, 1)
+		w.status.Dropped++
+		return
+	}
+	w.queue = append(w.queue, &webhookDelivery{Event: event, Queued: time.Now()})
+	webhooksPending.Add(w.config.Name, 1)
+	w.save()
+}
+
+// finished handles the result of the delivery of the first event in the queue and returns
+// whether the delivery needs to be retried.
+func (w *webhookSender) finished(result webhookResult) (backoff time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delivery := w.queue[0]
+	w.status.LastAttempt = time.Now()
+	if result.err != nil {
+		w.status.LastError = result.err.Error()
+		if result.retry && time.Since(delivery.Queued) < w.config.MaxAge {
+			backoff = webhookMinBackoff << delivery.Attempts
+			if backoff > webhookMaxBackoff || backoff <= 0 {
+				backoff = webhookMaxBackoff
+			}
+			delivery.Attempts++
+			wl.Printf("webhook '%s': delivering event '%s' failed: %v, retrying in %v", w.config.Name, delivery.Event.ID, result.err, backoff)
+			webhooksRetried.Add(w.config.Name, 1)
+			w.status.Retried++
+			w.save()
+			return
+		}
+		wl.Printf("webhook '%s': giving up delivering event '%s': %v", w.config.Name, delivery.Event.ID, result.err)
+		webhooksDropped.Add(w.config.Name, 1)
+		w.status.Dropped++
+	} else {
+		wdl.Printf("webhook '%s': successfully delivered event '%s'", w.config.Name, delivery.Event.ID)
+		webhooksDelivered.Add(w.config.Name, 1)
+		w.status.Delivered++
+		w.status.LastSuccess = w.status.LastAttempt
+	}
+
+	w.queue[0] = nil
+	w.queue = w.queue[1:]
+	webhooksPending.Add(w.config.Name, -1)
+	w.save()
+	return
+}
+
+// Status returns the delivery state of the endpoint.
+func (w *webhookSender) Status() webhookStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	status := w.status
+	status.Pending = len(w.queue)
+	if len(w.queue) > 0 {
+		status.Oldest = w.queue[0].Queued
+	}
+	return status
+}
+
+func (w *webhookSender) next() (event webhookEvent, ok bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.queue) == 0 {
+		return
+	}
+	return w.queue[0].Event, true
+}
+
+func (w *webhookSender) run() {
+	busy := false
+	for {
+		if !busy {
+			if event, ok := w.next(); ok {
+				busy = true
+				wdl.Printf("webhook '%s': delivering event '%s' (%s)", w.config.Name, event.ID, event.Type)
+				go func() { w.done <- w.send(event) }()
+			}
+		}
+
+		select {
+		case event := <-w.Notify:
+			w.enqueue(event)
+		case result := <-w.done:
+			if backoff := w.finished(result); backoff > 0 {
+				time.AfterFunc(backoff, func() { w.retry <- struct{}{} })
+				continue
+			}
+			busy = false
+		case <-w.retry:
+			busy = false
+		}
+	}
+}
+
+func runWebhookSenders(config *webhooksConfig, storeDir string) (senders []*webhookSender, err error) {
+	if config == nil {
+		return
+	}
+	if config.QueueDir != "" {
+		var d os.FileInfo
+		if d, err = os.Stat(config.QueueDir); err != nil {
+			return
+		}
+		if !d.IsDir() {
+			return nil, errors.New("webhooks: queue-dir is not a directory")
+		}
+	}
+	for i := range config.Endpoints {
+		var w *webhookSender
+		if w, err = newWebhookSender(&config.Endpoints[i], config.QueueDir, storeDir); err != nil {
+			return
+		}
+		senders = append(senders, w)
+	}
+	for _, w := range senders {
+		go w.run()
+	}
+	return
+}
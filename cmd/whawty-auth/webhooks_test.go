@@ -0,0 +1,281 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookEndpoint answers deliveries with the queued status codes and 200 once all of them
+// have been used. Only deliveries with a valid signature are recorded.
+type testWebhookEndpoint struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	statuses []int
+	events   []webhookEvent
+}
+
+func (e *testWebhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		e.t.Error("unexpected error:", err)
+		return
+	}
+	signature := webhookSignature("webhook-secret", r.Header.Get("X-Whawty-Timestamp"), body)
+	if r.Header.Get("X-Whawty-Signature") != signature {
+		e.t.Errorf("invalid signature '%s', expected '%s'", r.Header.Get("X-Whawty-Signature"), signature)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		e.t.Error("unexpected error:", err)
+		return
+	}
+	if r.Header.Get("X-Whawty-Event") != event.Type || r.Header.Get("X-Whawty-Event-Id") != event.ID {
+		e.t.Errorf("event headers don't match the body: %v", r.Header)
+	}
+	e.events = append(e.events, event)
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// received returns the ids of all deliveries.
+func (e *testWebhookEndpoint) received() (ids []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, event := range e.events {
+		ids = append(ids, event.ID)
+	}
+	return
+}
+
+var errTestWebhook = errors.New("delivery failed")
+
+func newTestWebhookSender(t *testing.T, url, queueDir string) *webhookSender {
+	return newTestWebhookSenderForStore(t, url, queueDir, "/path/to/store")
+}
+
+func newTestWebhookSenderForStore(t *testing.T, url, queueDir, storeDir string) *webhookSender {
+	config := &webhookConfig{
+		Name:      "test",
+		URL:       url,
+		Secret:    "webhook-secret",
+		Events:    []string{hookEventAdd, hookEventRemove},
+		Timeout:   time.Second,
+		MaxAge:    time.Hour,
+		QueueSize: 10,
+	}
+	w, err := newWebhookSender(config, queueDir, storeDir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return w
+}
+
+func newTestWebhookEvent(t *testing.T, event, username string) webhookEvent {
+	e, err := newWebhookEvent("/path/to/store", newHookEvent(event, username))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return e
+}
+
+// waitForWebhooks waits until the endpoint received n deliveries and the queue of the sender is
+// empty.
+func waitForWebhooks(t *testing.T, endpoint *testWebhookEndpoint, w *webhookSender, n int) {
+	deadline := time.Now().Add(5 * webhookMinBackoff)
+	for len(endpoint.received()) < n || w.Status().Pending > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d deliveries, got %d with %d pending", n, len(endpoint.received()), w.Status().Pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"add"}`)
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if signature := webhookSignature("webhook-secret", "1700000000", body); signature != expected {
+		t.Fatalf("expected signature '%s', got '%s'", expected, signature)
+	}
+	if webhookSignature("webhook-secret", "1700000001", body) == expected {
+		t.Fatal("the signature must depend on the timestamp")
+	}
+	if webhookSignature("other-secret", "1700000000", body) == expected {
+		t.Fatal("the signature must depend on the secret")
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	endpoint := &testWebhookEndpoint{t: t, statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNotFound}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	w := newTestWebhookSender(t, server.URL, "")
+
+	event := newTestWebhookEvent(t, hookEventAdd, "alice")
+	for _, expected := range []struct {
+		err   bool
+		retry bool
+	}{{true, true}, {true, true}, {true, false}, {false, false}} {
+		result := w.send(event)
+		if (result.err != nil) != expected.err || result.retry != expected.retry {
+			t.Fatalf("expected err=%t and retry=%t, got %v and %t", expected.err, expected.retry, result.err, result.retry)
+		}
+	}
+	if received := endpoint.received(); len(received) != 4 || received[0] != event.ID {
+		t.Fatalf("unexpected deliveries: %v", received)
+	}
+
+	server.Close()
+	if result := w.send(event); result.err == nil || !result.retry {
+		t.Fatalf("deliveries failing due to network problems should be retried, got %v and %t", result.err, result.retry)
+	}
+}
+
+func TestWebhookRun(t *testing.T) {
+	endpoint := &testWebhookEndpoint{t: t, statuses: []int{http.StatusInternalServerError, http.StatusOK, http.StatusBadRequest}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	w := newTestWebhookSender(t, server.URL, "")
+	go w.run()
+
+	first := newTestWebhookEvent(t, hookEventAdd, "alice")
+	ignored := newTestWebhookEvent(t, hookEventUpdate, "alice")
+	second := newTestWebhookEvent(t, hookEventRemove, "bob")
+	w.Notify <- first
+	w.Notify <- ignored
+	w.Notify <- second
+
+	waitForWebhooks(t, endpoint, w, 3)
+	received := endpoint.received()
+	if len(received) != 3 || received[0] != first.ID || received[1] != first.ID || received[2] != second.ID {
+		t.Fatalf("the failed delivery should be retried before later events are delivered: %v", received)
+	}
+	status := w.Status()
+	if status.Delivered != 1 || status.Retried != 1 || status.Dropped != 1 || status.LastError == "" || status.LastSuccess.IsZero() {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	queueDir := t.TempDir()
+	w := newTestWebhookSender(t, "http://127.0.0.1:1/", queueDir)
+	w.config.QueueSize = 2
+
+	first := newTestWebhookEvent(t, hookEventAdd, "alice")
+	second := newTestWebhookEvent(t, hookEventRemove, "bob")
+	w.enqueue(first)
+	w.enqueue(second)
+	w.enqueue(newTestWebhookEvent(t, hookEventAdd, "carol"))
+	if status := w.Status(); status.Pending != 2 || status.Dropped != 1 || !status.Oldest.Equal(w.queue[0].Queued) {
+		t.Fatalf("events exceeding the queue size should be dropped: %+v", status)
+	}
+	if backoff := w.finished(webhookResult{err: errTestWebhook, retry: true}); backoff != webhookMinBackoff {
+		t.Fatalf("expected a backoff of %v, got %v", webhookMinBackoff, backoff)
+	}
+
+	info, err := os.Stat(w.file)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if info.Mode().Perm() != 0600 || filepath.Dir(w.file) != queueDir {
+		t.Fatalf("unexpected queue file '%s' (%v)", w.file, info.Mode())
+	}
+
+	endpoint := &testWebhookEndpoint{t: t}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	w2 := newTestWebhookSender(t, server.URL, queueDir)
+	if len(w2.queue) != 2 || w2.queue[0].Event.ID != first.ID || w2.queue[0].Attempts != 1 || w2.queue[1].Event.ID != second.ID {
+		t.Fatal("the pending deliveries should be loaded from the queue-dir")
+	}
+	if other := newTestWebhookSenderForStore(t, server.URL, queueDir, "/path/to/other-store"); len(other.queue) != 0 {
+		t.Fatal("every store should use its own queue")
+	}
+
+	go w2.run()
+	waitForWebhooks(t, endpoint, w2, 2)
+	if received := endpoint.received(); len(received) != 2 || received[0] != first.ID || received[1] != second.ID {
+		t.Fatalf("unexpected deliveries: %v", received)
+	}
+	if w3 := newTestWebhookSender(t, server.URL, queueDir); len(w3.queue) != 0 {
+		t.Fatal("delivered events should be removed from the queue-dir")
+	}
+
+	if err := os.WriteFile(w.file, []byte("invalid"), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := newWebhookSender(w.config, queueDir, "/path/to/store"); err == nil {
+		t.Fatal("a corrupted queue should be an error")
+	}
+	if _, err := runWebhookSenders(&webhooksConfig{QueueDir: w.file}, "/path/to/store"); err == nil {
+		t.Fatal("a queue-dir which is not a directory should be an error")
+	}
+}
+
+func TestWebhookMaxAge(t *testing.T) {
+	w := newTestWebhookSender(t, "http://127.0.0.1:1/", "")
+	w.enqueue(newTestWebhookEvent(t, hookEventAdd, "alice"))
+	w.queue[0].Queued = time.Now().Add(-2 * w.config.MaxAge)
+	if backoff := w.finished(webhookResult{err: errTestWebhook, retry: true}); backoff != 0 || len(w.queue) != 0 {
+		t.Fatal("deliveries older than max-age should be dropped")
+	}
+
+	for i := 0; i < 20; i++ {
+		w.enqueue(newTestWebhookEvent(t, hookEventAdd, "alice"))
+		w.queue[0].Attempts = i
+		if backoff := w.finished(webhookResult{err: errTestWebhook, retry: true}); backoff <= 0 || backoff > webhookMaxBackoff {
+			t.Fatalf("the backoff after %d attempts is out of range: %v", i, backoff)
+		}
+		w.queue = nil
+	}
+}
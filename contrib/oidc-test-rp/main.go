@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+// oidc-test-rp is a minimal OpenID Connect relying party which can be used to test the OIDC
+// provider of whawty-auth. It does not verify the signature of the ID token, use it for
+// testing only.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type discovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+var (
+	issuer       = flag.String("issuer", "http://127.0.0.1:8080", "issuer of the OIDC provider")
+	clientID     = flag.String("client-id", "test-rp", "client id")
+	clientSecret = flag.String("client-secret", "", "client secret, leave empty for public clients")
+	listen       = flag.String("listen", "127.0.0.1:9999", "address to listen on")
+
+	mutex     sync.Mutex
+	verifiers = make(map[string]string)
+)
+
+func random() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func getJSON(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func main() {
+	flag.Parse()
+
+	req, _ := http.NewRequest(http.MethodGet, strings.TrimSuffix(*issuer, "/")+"/.well-known/openid-configuration", nil)
+	var provider discovery
+	if err := getJSON(req, &provider); err != nil {
+		log.Fatalf("fetching discovery document failed: %v", err)
+	}
+	redirectURI := "http://" + *listen + "/callback"
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		state, verifier := random(), random()
+		mutex.Lock()
+		verifiers[state] = verifier
+		mutex.Unlock()
+
+		challenge := sha256.Sum256([]byte(verifier))
+		params := url.Values{
+			"client_id":             {*clientID},
+			"redirect_uri":          {redirectURI},
+			"response_type":         {"code"},
+			"scope":                 {"openid profile"},
+			"state":                 {state},
+			"nonce":                 {random()},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		http.Redirect(w, r, provider.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+	})
+
+	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			http.Error(w, fmt.Sprintf("authorization failed: %s: %s", e, query.Get("error_description")), http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		verifier, ok := verifiers[query.Get("state")]
+		delete(verifiers, query.Get("state"))
+		mutex.Unlock()
+		if !ok {
+			http.Error(w, "unknown state", http.StatusBadRequest)
+			return
+		}
+
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {query.Get("code")},
+			"redirect_uri":  {redirectURI},
+			"client_id":     {*clientID},
+			"code_verifier": {verifier},
+		}
+		if *clientSecret != "" {
+			form.Set("client_secret", *clientSecret)
+		}
+		req, _ := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var token tokenResponse
+		if err := getJSON(req, &token); err != nil || token.Error != "" {
+			http.Error(w, fmt.Sprintf("token request failed: %v %s %s", err, token.Error, token.Description), http.StatusBadGateway)
+			return
+		}
+
+		var claims json.RawMessage
+		if parts := strings.Split(token.IDToken, "."); len(parts) == 3 {
+			claims, _ = base64.RawURLEncoding.DecodeString(parts[1])
+		}
+		req, _ = http.NewRequest(http.MethodGet, provider.UserinfoEndpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		var userinfo json.RawMessage
+		if err := getJSON(req, &userinfo); err != nil {
+			http.Error(w, fmt.Sprintf("userinfo request failed: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "ID token claims (not verified): %s\n\nuserinfo: %s\n", claims, userinfo)
+	})
+
+	log.Printf("open http://%s/ to start the login, redirect URI is %s", *listen, redirectURI)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,302 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+// Package dovecot implements the server side of the authentication protocol which is spoken
+// between the Dovecot auth process and its clients. Besides Dovecot itself this protocol is
+// supported by other software like Postfix or Exim.
+// See: https://doc.dovecot.org/developer_manual/design/auth_protocol/
+package dovecot
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	versionMajor = 1
+	versionMinor = 2
+
+	mechPlain = "PLAIN"
+	mechLogin = "LOGIN"
+)
+
+// AuthCB is the function signature of callbacks as used by the server to
+// handle authentication requests.
+type AuthCB func(login, password, service string) (ok bool, msg string, err error)
+
+// Server holds all information needed to run the server. Use NewServer to
+// create the struct.
+type Server struct {
+	cb       AuthCB
+	ln       net.Listener
+	cookie   string
+	lastCUID uint32
+}
+
+func newServer(ln net.Listener, cb AuthCB) (*Server, error) {
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	return &Server{cb: cb, ln: ln, cookie: hex.EncodeToString(cookie)}, nil
+}
+
+// NewServer creates a server struct and starts listening on the unix socket
+// as specified by socketpath. cb is the callback function which will get
+// called for any authentication request.
+func NewServer(socketpath string, cb AuthCB) (*Server, error) {
+	ln, err := net.Listen("unix", socketpath)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(ln, cb)
+}
+
+// NewServerFromListener creates a server struct using a UnixListener specified
+// by ln. cb is the callback function which will get called for any authentication
+// request.
+func NewServerFromListener(ln *net.UnixListener, cb AuthCB) (*Server, error) {
+	return newServer(ln, cb)
+}
+
+type authRequest struct {
+	mech    string
+	service string
+	login   string
+}
+
+type connection struct {
+	server   *Server
+	writer   io.Writer
+	version  bool
+	requests map[string]*authRequest
+}
+
+func (c *connection) send(cmd string, params ...string) error {
+	_, err := io.WriteString(c.writer, EncodeLine(cmd, params...))
+	return err
+}
+
+func (c *connection) handshake(cuid uint32) error {
+	lines := []string{
+		EncodeLine("VERSION", strconv.Itoa(versionMajor), strconv.Itoa(versionMinor)),
+		EncodeLine("MECH", mechPlain, "plaintext"),
+		EncodeLine("MECH", mechLogin, "plaintext"),
+		EncodeLine("SPID", strconv.Itoa(os.Getpid())),
+		EncodeLine("CUID", strconv.FormatUint(uint64(cuid), 10)),
+		EncodeLine("COOKIE", c.server.cookie),
+		EncodeLine("DONE"),
+	}
+	_, err := io.WriteString(c.writer, strings.Join(lines, ""))
+	return err
+}
+
+func (c *connection) fail(id string, login string, reason string, temporary bool) error {
+	params := []string{id}
+	if login != "" {
+		params = append(params, "user="+login)
+	}
+	if temporary {
+		params = append(params, "temp")
+	}
+	if reason != "" {
+		params = append(params, "reason="+reason)
+	}
+	return c.send("FAIL", params...)
+}
+
+// finish runs the callback for the request and sends the result to the client.
+func (c *connection) finish(id string, req *authRequest, password string) error {
+	delete(c.requests, id)
+	ok, msg, err := c.server.cb(req.login, password, req.service)
+	if err != nil {
+		return c.fail(id, req.login, err.Error(), true)
+	}
+	if !ok {
+		return c.fail(id, req.login, msg, false)
+	}
+	return c.send("OK", id, "user="+req.login)
+}
+
+// step processes the next response of the client for the request.
+func (c *connection) step(id string, req *authRequest, data []byte) error {
+	switch req.mech {
+	case mechPlain:
+		login, password, err := decodePlain(data)
+		if err != nil {
+			delete(c.requests, id)
+			return c.fail(id, "", err.Error(), false)
+		}
+		req.login = login
+		return c.finish(id, req, password)
+	case mechLogin:
+		if req.login == "" {
+			if req.login = string(data); req.login == "" {
+				delete(c.requests, id)
+				return c.fail(id, "", "empty username", false)
+			}
+			return c.send("CONT", id, base64.StdEncoding.EncodeToString([]byte("Password:")))
+		}
+		return c.finish(id, req, string(data))
+	}
+	return fmt.Errorf("unsupported mechanism '%s'", req.mech)
+}
+
+func (c *connection) handleAuth(params []string) error {
+	if len(params) < 2 {
+		return errors.New("AUTH: missing parameters")
+	}
+	id, mech := params[0], strings.ToUpper(params[1])
+	if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+		return fmt.Errorf("AUTH: invalid id '%s'", id)
+	}
+	if _, exists := c.requests[id]; exists {
+		return fmt.Errorf("AUTH: id '%s' is already in use", id)
+	}
+	if mech != mechPlain && mech != mechLogin {
+		return c.fail(id, "", "unsupported mechanism", false)
+	}
+
+	req := &authRequest{mech: mech}
+	var resp []byte
+	hasResp := false
+	for _, param := range params[2:] {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "service":
+			req.service = value
+		case "resp":
+			var err error
+			if resp, err = base64.StdEncoding.DecodeString(value); err != nil {
+				return c.fail(id, "", "invalid base64 data", false)
+			}
+			hasResp = true
+		}
+	}
+
+	c.requests[id] = req
+	if hasResp {
+		return c.step(id, req, resp)
+	}
+	if mech == mechLogin {
+		return c.send("CONT", id, base64.StdEncoding.EncodeToString([]byte("Username:")))
+	}
+	return c.send("CONT", id, "")
+}
+
+func (c *connection) handleCont(params []string) error {
+	if len(params) < 1 {
+		return errors.New("CONT: missing parameters")
+	}
+	id := params[0]
+	req, exists := c.requests[id]
+	if !exists {
+		return fmt.Errorf("CONT: unknown id '%s'", id)
+	}
+	var data []byte
+	if len(params) > 1 {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(params[1]); err != nil {
+			delete(c.requests, id)
+			return c.fail(id, "", "invalid base64 data", false)
+		}
+	}
+	return c.step(id, req, data)
+}
+
+func (c *connection) handleLine(line string) error {
+	cmd, params := DecodeLine(line)
+	if !c.version {
+		if cmd != "VERSION" || len(params) < 2 {
+			return errors.New("client did not send its version")
+		}
+		if params[0] != strconv.Itoa(versionMajor) {
+			return fmt.Errorf("unsupported protocol version %s.%s", params[0], params[1])
+		}
+		c.version = true
+		return nil
+	}
+
+	switch cmd {
+	case "CPID":
+		return nil
+	case "AUTH":
+		return c.handleAuth(params)
+	case "CONT":
+		return c.handleCont(params)
+	}
+	return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	c := &connection{server: s, writer: conn, requests: make(map[string]*authRequest)}
+	if err := c.handshake(atomic.AddUint32(&s.lastCUID, 1)); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MaxLineLength)
+	for scanner.Scan() {
+		if err := c.handleLine(scanner.Text()); err != nil {
+			return
+		}
+	}
+}
+
+// Run actually runs the server. In calls Accept() on the server socket and
+// runs go-routines for new connections.
+func (s *Server) Run() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			operr, ok := err.(*net.OpError)
+			if !ok {
+				return err
+			}
+			if operr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.handleConnection(conn)
+	}
+}
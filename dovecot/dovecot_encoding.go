@@ -0,0 +1,91 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package dovecot
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+const (
+	// MaxLineLength is the maximum length of a line sent by the client.
+	MaxLineLength = 16384
+)
+
+var (
+	tabEscaper   = strings.NewReplacer("\x01", "\x011", "\t", "\x01t", "\r", "\x01r", "\n", "\x01n")
+	tabUnescaper = strings.NewReplacer("\x011", "\x01", "\x01t", "\t", "\x01r", "\r", "\x01n", "\n")
+)
+
+// EscapeTab escapes s so it can be used as a parameter of the dovecot auth protocol.
+func EscapeTab(s string) string {
+	return tabEscaper.Replace(s)
+}
+
+// UnescapeTab reverts EscapeTab.
+func UnescapeTab(s string) string {
+	return tabUnescaper.Replace(s)
+}
+
+// EncodeLine returns the protocol line consisting of the command and its parameters.
+func EncodeLine(cmd string, params ...string) string {
+	parts := []string{cmd}
+	for _, p := range params {
+		parts = append(parts, EscapeTab(p))
+	}
+	return strings.Join(parts, "\t") + "\n"
+}
+
+// DecodeLine splits a protocol line into the command and its unescaped parameters.
+func DecodeLine(line string) (cmd string, params []string) {
+	parts := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	for _, p := range parts[1:] {
+		params = append(params, UnescapeTab(p))
+	}
+	return parts[0], params
+}
+
+// decodePlain parses the response of the client for the PLAIN mechanism, see RFC 4616.
+func decodePlain(data []byte) (login, password string, err error) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return "", "", errors.New("invalid PLAIN response")
+	}
+	authzid, authcid := string(parts[0]), string(parts[1])
+	if authzid != "" && authzid != authcid {
+		return "", "", errors.New("authorization identity is not supported")
+	}
+	if authcid == "" {
+		return "", "", errors.New("empty authentication identity")
+	}
+	return authcid, string(parts[2]), nil
+}
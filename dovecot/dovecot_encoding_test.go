@@ -0,0 +1,111 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package dovecot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEscapeTab(t *testing.T) {
+	testVectors := []struct {
+		raw     string
+		escaped string
+	}{
+		{"", ""},
+		{"foo", "foo"},
+		{"foo\tbar", "foo\x01tbar"},
+		{"\r\n", "\x01r\x01n"},
+		{"\x01t", "\x011t"},
+		{"a\x01\tb", "a\x011\x01tb"},
+	}
+
+	for _, vector := range testVectors {
+		if escaped := EscapeTab(vector.raw); escaped != vector.escaped {
+			t.Fatalf("escaping %q returned %q, expected %q", vector.raw, escaped, vector.escaped)
+		}
+		if raw := UnescapeTab(vector.escaped); raw != vector.raw {
+			t.Fatalf("unescaping %q returned %q, expected %q", vector.escaped, raw, vector.raw)
+		}
+	}
+}
+
+func TestEncodeDecodeLine(t *testing.T) {
+	line := EncodeLine("FAIL", "1", "user=foo", "reason=bad\tthings")
+	if line != "FAIL\t1\tuser=foo\treason=bad\x01tthings\n" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	cmd, params := DecodeLine(line)
+	if cmd != "FAIL" {
+		t.Fatalf("unexpected command %q", cmd)
+	}
+	if !reflect.DeepEqual(params, []string{"1", "user=foo", "reason=bad\tthings"}) {
+		t.Fatalf("unexpected parameters %q", params)
+	}
+
+	cmd, params = DecodeLine("DONE\r\n")
+	if cmd != "DONE" || len(params) != 0 {
+		t.Fatalf("unexpected result for line without parameters: %q %q", cmd, params)
+	}
+}
+
+func TestDecodePlain(t *testing.T) {
+	testVectors := []struct {
+		data     string
+		login    string
+		password string
+		valid    bool
+	}{
+		{"\x00foo\x00bar", "foo", "bar", true},
+		{"foo\x00foo\x00bar", "foo", "bar", true},
+		{"\x00foo\x00", "foo", "", true},
+		{"admin\x00foo\x00bar", "", "", false},
+		{"\x00\x00bar", "", "", false},
+		{"foo\x00bar", "", "", false},
+		{"\x00foo\x00bar\x00", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, vector := range testVectors {
+		login, password, err := decodePlain([]byte(vector.data))
+		if vector.valid {
+			if err != nil {
+				t.Fatalf("decoding %q failed: %v", vector.data, err)
+			}
+			if login != vector.login || password != vector.password {
+				t.Fatalf("decoding %q returned (%q, %q)", vector.data, login, password)
+			}
+		} else if err == nil {
+			t.Fatalf("decoding %q should give an error", vector.data)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package dovecot
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testBaseDir string = "test-dovecot"
+
+	testUsername string = "foo"
+	testPassword string = "bar"
+	testService  string = "smtp"
+
+	errorService string = "error"
+)
+
+func callback(login, password, service string) (ok bool, msg string, err error) {
+	if service == errorService {
+		return true, "success", errors.New("it is an error to use the error service")
+	}
+	if service != testService {
+		return false, "wrong service", nil
+	}
+	if login != testUsername || password != testPassword {
+		return false, "invalid credentials", nil
+	}
+	return true, "success", nil
+}
+
+func TestCreateServer(t *testing.T) {
+	if _, err := NewServer(filepath.Join(testBaseDir, "new.sock"), callback); err == nil {
+		t.Fatalf("initializing a server socket inside non-existing directory should give an error")
+	}
+
+	if err := os.Mkdir(testBaseDir, 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(testBaseDir)
+
+	if _, err := NewServer(filepath.Join(testBaseDir, "new.sock"), callback); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	ln, err := net.Listen("unix", filepath.Join(testBaseDir, "existing.sock"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err := NewServerFromListener(ln.(*net.UnixListener), callback); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func newTestClient(t *testing.T, path string) *testClient {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	c := &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+
+	var mechs []string
+	for {
+		cmd, params := c.receive()
+		if cmd == "DONE" {
+			break
+		}
+		switch cmd {
+		case "VERSION":
+			if len(params) != 2 || params[0] != "1" {
+				t.Fatalf("unexpected version %q", params)
+			}
+		case "MECH":
+			mechs = append(mechs, params[0])
+		}
+	}
+	if strings.Join(mechs, ",") != "PLAIN,LOGIN" {
+		t.Fatalf("unexpected mechanisms %q", mechs)
+	}
+
+	c.send("VERSION", "1", "2")
+	c.send("CPID", "1234")
+	return c
+}
+
+func (c *testClient) send(cmd string, params ...string) {
+	if _, err := c.conn.Write([]byte(EncodeLine(cmd, params...))); err != nil {
+		c.t.Fatal("unexpected error:", err)
+	}
+}
+
+func (c *testClient) receive() (string, []string) {
+	if !c.scanner.Scan() {
+		c.t.Fatal("connection closed unexpectedly:", c.scanner.Err())
+	}
+	return DecodeLine(c.scanner.Text())
+}
+
+func (c *testClient) expect(cmd string, params ...string) {
+	rcmd, rparams := c.receive()
+	if rcmd != cmd || strings.Join(rparams, "\t") != strings.Join(params, "\t") {
+		c.t.Fatalf("expected %q %q, got %q %q", cmd, params, rcmd, rparams)
+	}
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func runTestServer(t *testing.T) string {
+	if err := os.Mkdir(testBaseDir, 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	path := filepath.Join(testBaseDir, "sock")
+	s, err := NewServer(path, callback)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	go s.Run() //nolint:errcheck
+	return path
+}
+
+func TestAuthPlain(t *testing.T) {
+	path := runTestServer(t)
+	defer os.RemoveAll(testBaseDir)
+
+	c := newTestClient(t, path)
+	defer c.conn.Close()
+
+	c.send("AUTH", "1", "PLAIN", "service="+testService, "resp="+b64("\x00"+testUsername+"\x00"+testPassword))
+	c.expect("OK", "1", "user="+testUsername)
+
+	c.send("AUTH", "2", "PLAIN", "service="+testService, "resp="+b64("\x00"+testUsername+"\x00wrong"))
+	c.expect("FAIL", "2", "user="+testUsername, "reason=invalid credentials")
+
+	c.send("AUTH", "3", "PLAIN", "service="+testService)
+	c.expect("CONT", "3", "")
+	c.send("CONT", "3", b64(testUsername+"\x00"+testUsername+"\x00"+testPassword))
+	c.expect("OK", "3", "user="+testUsername)
+
+	c.send("AUTH", "4", "PLAIN", "service=imap", "resp="+b64("\x00"+testUsername+"\x00"+testPassword))
+	c.expect("FAIL", "4", "user="+testUsername, "reason=wrong service")
+
+	c.send("AUTH", "5", "PLAIN", "service="+errorService, "resp="+b64("\x00"+testUsername+"\x00"+testPassword))
+	c.expect("FAIL", "5", "user="+testUsername, "temp", "reason=it is an error to use the error service")
+
+	c.send("AUTH", "6", "PLAIN", "service="+testService, "resp="+b64("other\x00"+testUsername+"\x00"+testPassword))
+	c.expect("FAIL", "6", "reason=authorization identity is not supported")
+
+	c.send("AUTH", "7", "PLAIN", "service="+testService, "resp=!invalid!")
+	c.expect("FAIL", "7", "reason=invalid base64 data")
+
+	c.send("AUTH", "8", "CRAM-MD5", "service="+testService)
+	c.expect("FAIL", "8", "reason=unsupported mechanism")
+}
+
+func TestAuthLogin(t *testing.T) {
+	path := runTestServer(t)
+	defer os.RemoveAll(testBaseDir)
+
+	c := newTestClient(t, path)
+	defer c.conn.Close()
+
+	c.send("AUTH", "1", "LOGIN", "service="+testService)
+	c.expect("CONT", "1", b64("Username:"))
+	c.send("CONT", "1", b64(testUsername))
+	c.expect("CONT", "1", b64("Password:"))
+	c.send("CONT", "1", b64(testPassword))
+	c.expect("OK", "1", "user="+testUsername)
+
+	c.send("AUTH", "2", "LOGIN", "service="+testService, "resp="+b64(testUsername))
+	c.expect("CONT", "2", b64("Password:"))
+	c.send("CONT", "2", b64("wrong"))
+	c.expect("FAIL", "2", "user="+testUsername, "reason=invalid credentials")
+
+	c.send("AUTH", "3", "LOGIN", "service="+testService)
+	c.expect("CONT", "3", b64("Username:"))
+	c.send("CONT", "3", "")
+	c.expect("FAIL", "3", "reason=empty username")
+}
+
+func TestProtocolErrors(t *testing.T) {
+	path := runTestServer(t)
+	defer os.RemoveAll(testBaseDir)
+
+	testVectors := []struct {
+		name  string
+		lines []string
+	}{
+		{"missing version", []string{"AUTH\t1\tPLAIN\tservice=smtp\n"}},
+		{"wrong version", []string{"VERSION\t2\t0\n"}},
+		{"unknown command", []string{"VERSION\t1\t2\n", "FOO\n"}},
+		{"invalid id", []string{"VERSION\t1\t2\n", "AUTH\tx\tPLAIN\n"}},
+		{"unknown CONT id", []string{"VERSION\t1\t2\n", "CONT\t1\tAA==\n"}},
+		{"reused id", []string{"VERSION\t1\t2\n", "AUTH\t1\tPLAIN\n", "AUTH\t1\tPLAIN\n"}},
+	}
+
+	for _, vector := range testVectors {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := conn.Write([]byte(strings.Join(vector.lines, ""))); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if cmd, _ := DecodeLine(scanner.Text()); cmd == "OK" || cmd == "FAIL" {
+				t.Fatalf("%s: unexpected response %q", vector.name, scanner.Text())
+			}
+		}
+		conn.Close()
+	}
+}
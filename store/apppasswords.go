@@ -0,0 +1,230 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const auxAppPasswordPrefix string = "apppassword."
+
+var appPasswordNameRe = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]*$")
+
+// IsValidAppPasswordName checks whether name may be used as the name of an app password.
+// Scopes of app passwords must follow the same rules.
+func IsValidAppPasswordName(name string) bool {
+	return appPasswordNameRe.MatchString(name)
+}
+
+// AppPassword holds the information about an app password of a user. The password itself
+// is only known right after it has been generated.
+type AppPassword struct {
+	Created time.Time `json:"created"`
+	Scopes  []string  `json:"scopes,omitempty"`
+	hash    []byte
+}
+
+// AppPasswordList is the return value of AppPasswords(). The key of the map is the name of
+// the app password.
+type AppPasswordList map[string]AppPassword
+
+// allows returns whether the app password may be used for any of the given scopes. App
+// passwords without scopes may be used everywhere.
+func (p AppPassword) allows(scopes []string) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		for _, s := range p.Scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p AppPassword) marshal() []byte {
+	return []byte(fmt.Sprintf("%d:%s:%s", p.Created.Unix(), strings.Join(p.Scopes, ","), hex.EncodeToString(p.hash)))
+}
+
+func unmarshalAppPassword(data []byte) (p AppPassword, err error) {
+	parts := strings.SplitN(string(data), ":", 3)
+	if len(parts) != 3 {
+		return p, fmt.Errorf("whawty.auth.store: app password is invalid")
+	}
+	created, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return p, fmt.Errorf("whawty.auth.store: app password is invalid, %v", err)
+	}
+	p.Created = time.Unix(created, 0)
+	if parts[1] != "" {
+		p.Scopes = strings.Split(parts[1], ",")
+	}
+	if p.hash, err = hex.DecodeString(parts[2]); err != nil || len(p.hash) != sha256.Size {
+		return p, fmt.Errorf("whawty.auth.store: app password hash is invalid")
+	}
+	return p, nil
+}
+
+// AppPasswords returns the app passwords stored in the aux data. Invalid entries are ignored.
+func (a AuxData) AppPasswords() AppPasswordList {
+	list := make(AppPasswordList)
+	for id, data := range a {
+		name, found := strings.CutPrefix(id, auxAppPasswordPrefix)
+		if !found {
+			continue
+		}
+		p, err := unmarshalAppPassword(data)
+		if err != nil {
+			wl.Printf("ignoring app password '%s': %v", name, err)
+			continue
+		}
+		list[name] = p
+	}
+	return list
+}
+
+// AppPasswords returns the app passwords of the user.
+func (u *UserHash) AppPasswords() (AppPasswordList, error) {
+	aux, err := u.GetAuxData()
+	if err != nil {
+		return nil, err
+	}
+	return aux.AppPasswords(), nil
+}
+
+// AddAppPassword generates a new app password called name for the user. If scopes is not
+// empty the app password is only accepted by AuthenticateWithAppPasswords if at least one of
+// the scopes is requested. It is an error if an app password with this name already exists.
+func (u *UserHash) AddAppPassword(name string, scopes []string) (password string, err error) {
+	if !IsValidAppPasswordName(name) {
+		return "", fmt.Errorf("whawty.auth.store: app password name '%s' is invalid", name)
+	}
+	p := AppPassword{Created: time.Now()}
+	for _, scope := range scopes {
+		if !IsValidAppPasswordName(scope) {
+			return "", fmt.Errorf("whawty.auth.store: app password scope '%s' is invalid", scope)
+		}
+		p.Scopes = append(p.Scopes, scope)
+	}
+	sort.Strings(p.Scopes)
+
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return "", err
+	} else if !exists {
+		return "", fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	password = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	h := sha256.Sum256([]byte(password))
+	p.hash = h[:]
+
+	err = u.rewriteFile(isAdmin, false, func(hashLine string, aux AuxData) (string, error) {
+		if _, exists := aux[auxAppPasswordPrefix+name]; exists {
+			return "", fmt.Errorf("whawty.auth.store: app password '%s' already exists", name)
+		}
+		aux[auxAppPasswordPrefix+name] = p.marshal()
+		return hashLine, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// RemoveAppPassword revokes the app password called name.
+func (u *UserHash) RemoveAppPassword(name string) error {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	return u.rewriteFile(isAdmin, false, func(hashLine string, aux AuxData) (string, error) {
+		if _, exists := aux[auxAppPasswordPrefix+name]; !exists {
+			return "", fmt.Errorf("whawty.auth.store: app password '%s' does not exist", name)
+		}
+		delete(aux, auxAppPasswordPrefix+name)
+		return hashLine, nil
+	})
+}
+
+// AuthenticateWithAppPasswords works like Authenticate but also accepts the app passwords of the
+// user. App passwords with scopes are only accepted if at least one of them is contained in scopes.
+// appPassword is the name of the app password which has been used, it is empty if the password
+// of the user was correct. App passwords are never upgradeable and are rejected as well if the
+// password of the user has expired.
+func (u *UserHash) AuthenticateWithAppPasswords(password string, scopes []string) (isAuthenticated, isAdmin, upgradeable bool, lastchange time.Time, appPassword string, err error) {
+	var checked bool
+	isAuthenticated, isAdmin, upgradeable, lastchange, checked, err = u.authenticate(password)
+	if !checked {
+		u.store.dummyCheck(password)
+	}
+	// the hashers also return an error if the password is wrong
+	if !checked || isAuthenticated || err == ErrPasswordExpired {
+		return
+	}
+
+	aux, auxErr := readAuxData(u.getFilename(isAdmin))
+	if auxErr != nil {
+		return false, isAdmin, false, lastchange, "", auxErr
+	}
+	h := sha256.Sum256([]byte(password))
+	for name, p := range aux.AppPasswords() {
+		if subtle.ConstantTimeCompare(h[:], p.hash) == 1 && p.allows(scopes) {
+			appPassword = name
+		}
+	}
+	if appPassword == "" {
+		return
+	}
+	if _, expired := aux[auxMustReset]; expired {
+		return false, isAdmin, false, lastchange, appPassword, ErrPasswordExpired
+	}
+	return true, isAdmin, false, lastchange, appPassword, nil
+}
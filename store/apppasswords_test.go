@@ -0,0 +1,166 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppPasswords(t *testing.T) {
+	username := "test-app-passwords"
+	password := "secret"
+
+	u := NewUserHash(testStoreUserHash, username)
+	if _, err := u.AddAppPassword("phone", nil); err == nil {
+		t.Fatal("adding an app password for a non-existent user should fail")
+	}
+
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	phone, err := u.AddAppPassword("phone", nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := u.AddAppPassword("phone", nil); err == nil {
+		t.Fatal("adding an app password a second time should fail")
+	}
+	mail, err := u.AddAppPassword("mail", []string{"smtp", "imap"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if phone == "" || mail == "" || phone == mail {
+		t.Fatalf("app passwords should be unique and not empty: '%s', '%s'", phone, mail)
+	}
+
+	list, err := u.AppPasswords()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected list of app passwords: %v", list)
+	}
+	if len(list["phone"].Scopes) != 0 || !reflect.DeepEqual(list["mail"].Scopes, []string{"imap", "smtp"}) {
+		t.Fatalf("unexpected scopes: %v", list)
+	}
+
+	if ok, _, _, _, _ := u.Authenticate(phone); ok {
+		t.Fatal("Authenticate shouldn't accept app passwords")
+	}
+	tests := []struct {
+		password string
+		scopes   []string
+		ok       bool
+		name     string
+	}{
+		{password, nil, true, ""},
+		{phone, nil, true, "phone"},
+		{phone, []string{"ldap"}, true, "phone"},
+		{mail, nil, false, ""},
+		{mail, []string{"ldap"}, false, ""},
+		{mail, []string{"saslauthd", "imap"}, true, "mail"},
+		{"invalid", []string{"imap"}, false, ""},
+	}
+	for _, test := range tests {
+		ok, _, upgradeable, _, name, err := u.AuthenticateWithAppPasswords(test.password, test.scopes)
+		if test.ok && err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if ok != test.ok || name != test.name {
+			t.Fatalf("authenticating with scopes %v returned %t/'%s', expected %t/'%s'", test.scopes, ok, name, test.ok, test.name)
+		}
+		if name != "" && upgradeable {
+			t.Fatal("app passwords should never be upgradeable")
+		}
+	}
+
+	if err := u.Update("moresecret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, _, _, _, _, err := u.AuthenticateWithAppPasswords(phone, nil); err != nil || !ok {
+		t.Fatal("app passwords should survive password updates:", err)
+	}
+
+	if _, err := u.Expire(false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, _, _, _, _, err := u.AuthenticateWithAppPasswords(phone, nil); ok || err != ErrPasswordExpired {
+		t.Fatalf("app passwords of expired users should fail with ErrPasswordExpired: %v", err)
+	}
+	if err := u.Update(password); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if err := u.RemoveAppPassword("phone"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.RemoveAppPassword("phone"); err == nil {
+		t.Fatal("removing an app password a second time should fail")
+	}
+	if ok, _, _, _, _, _ := u.AuthenticateWithAppPasswords(phone, nil); ok {
+		t.Fatal("revoked app passwords shouldn't be accepted")
+	}
+	if ok, _, _, _, _, _ := u.AuthenticateWithAppPasswords(mail, []string{"smtp"}); !ok {
+		t.Fatal("revoking an app password shouldn't affect other app passwords")
+	}
+}
+
+func TestAppPasswordsInvalid(t *testing.T) {
+	username := "test-app-passwords-invalid"
+	password := "secret"
+
+	u := NewUserHash(testStoreUserHash, username)
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	for _, name := range []string{"", "a,b", "-dash", "with space", "colon:"} {
+		if _, err := u.AddAppPassword(name, nil); err == nil {
+			t.Fatalf("adding app password '%s' should fail", name)
+		}
+		if _, err := u.AddAppPassword("valid", []string{name}); err == nil {
+			t.Fatalf("adding app password with scope '%s' should fail", name)
+		}
+	}
+
+	if err := u.SetAuxData(auxAppPasswordPrefix+"broken", []byte("not an app password")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if list, err := u.AppPasswords(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if len(list) != 0 {
+		t.Fatalf("invalid app passwords should be ignored: %v", list)
+	}
+}
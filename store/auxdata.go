@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	auxMustReset  string = "mustreset"
+	auxResetToken string = "resettoken"
+)
+
+// AuxData holds the auxiliary data of a user hash file. The key of the map is the
+// identifier and the value is the decoded data.
+type AuxData map[string][]byte
+
+func isAuxIdentifierValid(id string) bool {
+	return id != "" && !strings.ContainsAny(id, ": \t\r\n")
+}
+
+// parseAuxLine parses a single line of auxiliary data.
+func parseAuxLine(line string) (string, []byte, error) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || !isAuxIdentifierValid(parts[0]) {
+		return "", nil, fmt.Errorf("whawty.auth.store: aux data is invalid")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return "", nil, fmt.Errorf("whawty.auth.store: decoding aux data '%s' failed (%v)", parts[0], err)
+	}
+	return parts[0], data, nil
+}
+
+// parseAuxDataLines parses the auxiliary data from r. Lines which can't be parsed, or whose
+// identifier has already been used, are returned verbatim instead of failing. They are ignored
+// when reading and kept when rewriting hash files so that aux data this agent doesn't
+// understand is never lost and never breaks logins. It expects that the first line of the file
+// (the password hash) has already been consumed.
+func parseAuxDataLines(r *bufio.Reader) (AuxData, []string, error) {
+	aux := make(AuxData)
+	var foreign []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			id, data, perr := parseAuxLine(line)
+			if _, exists := aux[id]; perr != nil || exists {
+				foreign = append(foreign, line)
+			} else {
+				aux[id] = data
+			}
+		}
+		if err == io.EOF {
+			return aux, foreign, nil
+		}
+	}
+}
+
+// readAuxData returns the auxiliary data of the user hash file.
+func readAuxData(filename string) (AuxData, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	// Skip the first line
+	if _, err := reader.ReadString('\n'); err != nil {
+		if err == io.EOF {
+			return make(AuxData), nil
+		}
+		return nil, err
+	}
+	aux, _, err := parseAuxDataLines(reader)
+	return aux, err
+}
+
+// changedIDs returns the identifiers whose data differs between a and b.
+func (a AuxData) changedIDs(b AuxData) map[string]bool {
+	changed := make(map[string]bool)
+	for id, data := range a {
+		if other, exists := b[id]; !exists || !bytes.Equal(data, other) {
+			changed[id] = true
+		}
+	}
+	for id := range b {
+		if _, exists := a[id]; !exists {
+			changed[id] = true
+		}
+	}
+	return changed
+}
+
+// writeForeignAuxLines writes the lines returned by parseAuxDataLines unless their identifier
+// is in replaced.
+func writeForeignAuxLines(w io.Writer, foreign []string, replaced map[string]bool) error {
+	for _, line := range foreign {
+		if id, _, found := strings.Cut(line, ":"); found && replaced[id] {
+			continue
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a AuxData) writeTo(w io.Writer) error {
+	ids := make([]string, 0, len(a))
+	for id := range a {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", id, base64.StdEncoding.EncodeToString(a[id])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAuxData returns the auxiliary data of the user.
+func (u *UserHash) GetAuxData() (AuxData, error) {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+	return readAuxData(u.getFilename(isAdmin))
+}
+
+// SetAuxData sets the auxiliary data with identifier id. If data is nil the entry gets removed.
+func (u *UserHash) SetAuxData(id string, data []byte) error {
+	if !isAuxIdentifierValid(id) {
+		return fmt.Errorf("whawty.auth.store: aux data identifier '%s' is invalid", id)
+	}
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	return u.rewriteFile(isAdmin, false, func(hashLine string, aux AuxData) (string, error) {
+		if data == nil {
+			delete(aux, id)
+		} else {
+			aux[id] = data
+		}
+		return hashLine, nil
+	})
+}
@@ -31,6 +31,7 @@
 package store
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 
@@ -43,10 +44,22 @@ type cfgParams struct {
 	Argon2ID   *Argon2IDParams   `yaml:"argon2id"`
 }
 
+type cfgEncryptionKey struct {
+	ID        string `yaml:"id"`
+	KeyBase64 string `yaml:"key"`
+}
+
+type cfgEncryption struct {
+	Default string             `yaml:"default"`
+	Keys    []cfgEncryptionKey `yaml:"keys"`
+}
+
 type config struct {
-	BaseDir string      `yaml:"basedir"`
-	Default uint        `yaml:"default"`
-	Params  []cfgParams `yaml:"params"`
+	BaseDir    string         `yaml:"basedir"`
+	Default    uint           `yaml:"default"`
+	Params     []cfgParams    `yaml:"params"`
+	Encryption *cfgEncryption `yaml:"encryption"`
+	ReadOnly   bool           `yaml:"read-only"`
 }
 
 func readConfig(configfile string) (*config, error) {
@@ -76,6 +89,7 @@ func (d *Dir) fromConfig(configfile string) error {
 	}
 	d.BaseDir = c.BaseDir
 	d.Default = c.Default
+	d.ReadOnly = c.ReadOnly
 
 	for _, params := range c.Params {
 		if params.ID == 0 {
@@ -113,5 +127,22 @@ func (d *Dir) fromConfig(configfile string) error {
 	}
 	d.Default = c.Default
 
+	if c.Encryption != nil {
+		d.Envelope = NewEnvelope()
+		for _, key := range c.Encryption.Keys {
+			k, err := base64.StdEncoding.DecodeString(key.KeyBase64)
+			if err != nil {
+				return fmt.Errorf("Error: can't decode encryption key '%s': %s", key.ID, err)
+			}
+			if err = d.Envelope.AddKey(key.ID, k); err != nil {
+				return err
+			}
+		}
+		if c.Encryption.Default != "" && !d.Envelope.HasKey(c.Encryption.Default) {
+			return fmt.Errorf("Error: invalid default encryption key '%s'", c.Encryption.Default)
+		}
+		d.Envelope.Default = c.Encryption.Default
+	}
+
 	return nil
 }
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const envelopePrefix = "$aesgcm$"
+
+var keyIDRe = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]*$")
+
+// Envelope encrypts the format specific part of password hashes using AES-GCM.
+// Multiple keys may exist at the same time, new hashes are encrypted using the
+// default key. If Default is empty new hashes won't be encrypted.
+type Envelope struct {
+	Default string
+	keys    map[string]cipher.AEAD
+}
+
+// NewEnvelope creates a new Envelope with no keys.
+func NewEnvelope() *Envelope {
+	return &Envelope{keys: make(map[string]cipher.AEAD)}
+}
+
+// AddKey adds a new AES-256 key with the given id.
+func (e *Envelope) AddKey(id string, key []byte) error {
+	if !keyIDRe.MatchString(id) {
+		return fmt.Errorf("Error: encryption key id '%s' is invalid", id)
+	}
+	if _, exists := e.keys[id]; exists {
+		return fmt.Errorf("Error: encryption key id '%s' is not unique", id)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("Error: encryption key '%s' has invalid length %d != 32", id, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if e.keys[id], err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	return nil
+}
+
+// HasKey returns whether a key with the given id exists.
+func (e *Envelope) HasKey(id string) bool {
+	if e == nil {
+		return false
+	}
+	_, exists := e.keys[id]
+	return exists
+}
+
+func envelopeAdditionalData(user, formatID string, lastchange int64, paramID uint) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d:%d", user, formatID, lastchange, paramID))
+}
+
+// envelopeKeyID returns the id of the key used to encrypt hashStr or an empty string if
+// hashStr is not encrypted.
+func envelopeKeyID(hashStr string) (string, error) {
+	if !strings.HasPrefix(hashStr, envelopePrefix) {
+		return "", nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(hashStr, envelopePrefix), "$", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("whawty.auth.store: encrypted hash string has invalid format")
+	}
+	return parts[0], nil
+}
+
+// encryptionKeyID returns the id of the key which was used to encrypt the user hash file
+// or an empty string if the file is not encrypted.
+func encryptionKeyID(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	data, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	parts := strings.SplitN(data, ":", 4)
+	if len(parts) != 4 {
+		return "", nil
+	}
+	return envelopeKeyID(parts[3])
+}
+
+// hashLine returns the first line of a user hash file. If there is a default key the format
+// specific part gets encrypted.
+func (e *Envelope) hashLine(user, formatID string, lastchange int64, paramID uint, hashStr string) (string, error) {
+	if e != nil && e.Default != "" {
+		aead, exists := e.keys[e.Default]
+		if !exists {
+			return "", fmt.Errorf("whawty.auth.store: encryption key '%s' is unknown", e.Default)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		ciphertext := aead.Seal(nonce, nonce, []byte(hashStr), envelopeAdditionalData(user, formatID, lastchange, paramID))
+		hashStr = envelopePrefix + e.Default + "$" + base64.URLEncoding.EncodeToString(ciphertext)
+	}
+	return fmt.Sprintf("%s:%d:%d:%s", formatID, lastchange, paramID, hashStr), nil
+}
+
+// open decrypts hashStr if it is encrypted. Otherwise hashStr is returned unchanged.
+func (e *Envelope) open(filename, formatID string, lastchange int64, paramID uint, hashStr string) (string, error) {
+	keyID, err := envelopeKeyID(hashStr)
+	if err != nil || keyID == "" {
+		return hashStr, err
+	}
+	if !e.HasKey(keyID) {
+		return "", fmt.Errorf("whawty.auth.store: hash file is encrypted with unknown key '%s'", keyID)
+	}
+	aead := e.keys[keyID]
+
+	ciphertext, err := base64.URLEncoding.DecodeString(strings.TrimSpace(hashStr[len(envelopePrefix)+len(keyID)+1:]))
+	if err != nil {
+		return "", fmt.Errorf("whawty.auth.store: decoding encrypted hash string failed (%v)", err)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return "", fmt.Errorf("whawty.auth.store: encrypted hash string is too short")
+	}
+
+	user := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], envelopeAdditionalData(user, formatID, lastchange, paramID))
+	if err != nil {
+		return "", fmt.Errorf("whawty.auth.store: decrypting hash string failed (%v)", err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,224 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestEnvelope(t *testing.T, ids ...string) *Envelope {
+	e := NewEnvelope()
+	for _, id := range ids {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if err := e.AddKey(id, key); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	return e
+}
+
+func TestEnvelopeAddKey(t *testing.T) {
+	e := NewEnvelope()
+	keys := []struct {
+		id    string
+		len   int
+		valid bool
+	}{
+		{"", 32, false},
+		{"$key", 32, false},
+		{"key:1", 32, false},
+		{"key1", 16, false},
+		{"key1", 32, true},
+		{"key1", 32, false}, // not unique
+		{"2024-01_a.b", 32, true},
+	}
+	for _, k := range keys {
+		err := e.AddKey(k.id, make([]byte, k.len))
+		if k.valid && err != nil {
+			t.Fatalf("AddKey returned an unexpected error for '%s': %v", k.id, err)
+		} else if !k.valid && err == nil {
+			t.Fatalf("AddKey didn't return an error for invalid key '%s'", k.id)
+		}
+	}
+}
+
+func TestEnvelopeAuthenticate(t *testing.T) {
+	username := "test-envelope"
+	password := "secret"
+
+	store := NewDir(testBaseDirUserHash)
+	store.Default = testStoreUserHash.Default
+	store.Params = testStoreUserHash.Params
+	store.Envelope = newTestEnvelope(t, "key1", "key2")
+	store.Envelope.Default = "key1"
+
+	u := NewUserHash(store, username)
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	if keyID, err := encryptionKeyID(u.getFilename(false)); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if keyID != "key1" {
+		t.Fatalf("hash should be encrypted using 'key1' but key is '%s'", keyID)
+	}
+	if isAuthOk, _, _, _, err := u.Authenticate(password); !isAuthOk {
+		t.Fatal("authentication should succeed:", err)
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate("wrong"); isAuthOk {
+		t.Fatal("authentication with wrong password shouldn't succeed")
+	}
+
+	store.Envelope.Default = "key2"
+	if changed, err := u.Reencrypt(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if !changed {
+		t.Fatal("re-encrypting with a new default key should change the hash file")
+	}
+	if changed, err := u.Reencrypt(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if changed {
+		t.Fatal("re-encrypting twice shouldn't change the hash file")
+	}
+	if keyID, _ := encryptionKeyID(u.getFilename(false)); keyID != "key2" {
+		t.Fatalf("hash should be encrypted using 'key2' but key is '%s'", keyID)
+	}
+	if isAuthOk, _, _, _, err := u.Authenticate(password); !isAuthOk {
+		t.Fatal("authentication should succeed after re-encryption:", err)
+	}
+
+	store.Envelope.Default = ""
+	if changed, err := u.Reencrypt(); err != nil || !changed {
+		t.Fatal("re-encrypting without default key should decrypt the hash:", err)
+	}
+	if keyID, _ := encryptionKeyID(u.getFilename(false)); keyID != "" {
+		t.Fatalf("hash shouldn't be encrypted but key is '%s'", keyID)
+	}
+	if isAuthOk, _, _, _, err := testStoreUserHash.Authenticate(username, password); !isAuthOk {
+		t.Fatal("authentication of decrypted hash without envelope should succeed:", err)
+	}
+}
+
+func TestEnvelopeUnknownKey(t *testing.T) {
+	username := "test-envelope-unknown"
+	password := "secret"
+
+	if err := os.Mkdir(testBaseDir, 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(testBaseDir)
+
+	store := NewDir(testBaseDir)
+	store.Default = testStoreUserHash.Default
+	store.Params = testStoreUserHash.Params
+	store.Envelope = newTestEnvelope(t, "key1")
+	store.Envelope.Default = "key1"
+
+	if err := store.Init(username, password); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if warnings, err := store.Check(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if len(warnings) != 0 {
+		t.Fatalf("check shouldn't return warnings: %v", warnings)
+	}
+
+	store.Envelope = newTestEnvelope(t, "key2")
+	if _, err := store.Check(); err == nil {
+		t.Fatal("check should fail if the only admin is encrypted with an unknown key")
+	}
+	if isAuthOk, _, _, _, err := store.Authenticate(username, password); isAuthOk || err == nil {
+		t.Fatal("authentication of hash encrypted with unknown key should fail")
+	}
+
+	store.Envelope = newTestEnvelope(t, "key1")
+	if isAuthOk, _, _, _, err := store.Authenticate(username, password); isAuthOk || err == nil {
+		t.Fatal("authentication of hash encrypted with wrong key should fail")
+	}
+
+	store.Envelope = nil
+	if _, err := store.Check(); err == nil {
+		t.Fatal("check should fail if the only admin is encrypted and there is no envelope")
+	}
+
+	// files encrypted with unknown keys are ignored like unsupported hash formats
+	store.Envelope = newTestEnvelope(t, "key2")
+	store.Envelope.Default = "key2"
+	if err := store.AddUser(username+"2", password, true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	warnings, err := store.Check()
+	if err != nil {
+		t.Fatal("check shouldn't fail because of files encrypted with unknown keys:", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], username+".admin") || !strings.Contains(warnings[0], "key1") {
+		t.Fatalf("check should report the file encrypted with the unknown key, got: %v", warnings)
+	}
+	if list, err := store.ListFull(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if user, exists := list[username]; !exists || user.IsSupported {
+		t.Fatalf("user encrypted with unknown key should be listed as unsupported: %v", list)
+	}
+}
+
+func TestEnvelopeBoundToUser(t *testing.T) {
+	username1 := "test-envelope-bound1"
+	username2 := "test-envelope-bound2"
+	password := "secret"
+
+	store := NewDir(testBaseDirUserHash)
+	store.Default = testStoreUserHash.Default
+	store.Params = testStoreUserHash.Params
+	store.Envelope = newTestEnvelope(t, "key1")
+	store.Envelope.Default = "key1"
+
+	u1 := NewUserHash(store, username1)
+	if err := u1.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u1.Remove()
+
+	u2 := NewUserHash(store, username2)
+	defer u2.Remove()
+	if err := os.Rename(u1.getFilename(false), u2.getFilename(false)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if isAuthOk, _, _, _, err := u2.Authenticate(password); isAuthOk || err == nil {
+		t.Fatal("encrypted hashes of one user shouldn't be valid for another user")
+	}
+}
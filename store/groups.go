@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	auxGroups string = "groups"
+
+	// AdminGroup is the name of the group which implicitly contains all admins. Users can't
+	// be added to this group explicitly, use SetAdmin instead.
+	AdminGroup string = "admins"
+)
+
+var groupNameRe = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]*$")
+
+// IsValidGroupName checks whether group may be used as a group name.
+func IsValidGroupName(group string) bool {
+	return groupNameRe.MatchString(group)
+}
+
+// Groups returns the sorted list of groups stored in the aux data. This does not include
+// the admin group.
+func (a AuxData) Groups() []string {
+	data, exists := a[auxGroups]
+	if !exists || len(data) == 0 {
+		return nil
+	}
+	groups := strings.Split(string(data), ",")
+	sort.Strings(groups)
+	return groups
+}
+
+func (a AuxData) setGroups(groups []string) {
+	if len(groups) == 0 {
+		delete(a, auxGroups)
+		return
+	}
+	sort.Strings(groups)
+	a[auxGroups] = []byte(strings.Join(groups, ","))
+}
+
+// Groups returns the groups of the user. If the user is an admin this includes AdminGroup.
+func (u *UserHash) Groups() ([]string, error) {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+	aux, err := readAuxData(u.getFilename(isAdmin))
+	if err != nil {
+		return nil, err
+	}
+	groups := aux.Groups()
+	if isAdmin {
+		groups = append(groups, AdminGroup)
+		sort.Strings(groups)
+	}
+	return groups, nil
+}
+
+// SetGroup adds the user to group or removes it from group.
+func (u *UserHash) SetGroup(group string, member bool) error {
+	if !IsValidGroupName(group) {
+		return fmt.Errorf("whawty.auth.store: group name '%s' is invalid", group)
+	}
+	if group == AdminGroup {
+		return fmt.Errorf("whawty.auth.store: membership of group '%s' is derived from the admin flag", AdminGroup)
+	}
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	return u.rewriteFile(isAdmin, false, func(hashLine string, aux AuxData) (string, error) {
+		var groups []string
+		for _, g := range aux.Groups() {
+			if g != group {
+				groups = append(groups, g)
+			}
+		}
+		if member {
+			groups = append(groups, group)
+		}
+		aux.setGroups(groups)
+		return hashLine, nil
+	})
+}
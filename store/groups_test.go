@@ -0,0 +1,109 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	username := "test-groups"
+	password := "secret"
+
+	u := NewUserHash(testStoreUserHash, username)
+	if err := u.SetGroup("staff", true); err == nil {
+		t.Fatal("adding a non-existent user to a group should fail")
+	}
+
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	if groups, err := u.Groups(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if len(groups) != 0 {
+		t.Fatalf("new user shouldn't be member of any group, got %v", groups)
+	}
+
+	for _, group := range []string{"staff", "devs", "staff"} {
+		if err := u.SetGroup(group, true); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if groups, err := u.Groups(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if !reflect.DeepEqual(groups, []string{"devs", "staff"}) {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+
+	if err := u.SetAdmin(true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if groups, err := u.Groups(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if !reflect.DeepEqual(groups, []string{AdminGroup, "devs", "staff"}) {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+
+	if err := u.SetGroup("staff", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.SetGroup("unknown", false); err != nil {
+		t.Fatal("removing the user from a group it is not a member of shouldn't fail:", err)
+	}
+	if ok, _, _, _, err := u.Authenticate(password); err != nil || !ok {
+		t.Fatal("changing groups shouldn't affect the password:", err)
+	}
+	if groups, err := u.Groups(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if !reflect.DeepEqual(groups, []string{AdminGroup, "devs"}) {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
+
+func TestGroupsInvalid(t *testing.T) {
+	username := "test-groups-invalid"
+	password := "secret"
+
+	u := NewUserHash(testStoreUserHash, username)
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	for _, group := range []string{"", AdminGroup, "a,b", "-dash", "with space", "colon:"} {
+		if err := u.SetGroup(group, true); err == nil {
+			t.Fatalf("adding user to group '%s' should fail", group)
+		}
+	}
+}
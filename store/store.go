@@ -66,10 +66,14 @@ func init() {
 }
 
 // Dir represents a directory containing a whawty.auth password hash store. Use NewDir to create it.
+// If Envelope is not nil password hashes will be encrypted. ReadOnly marks stores which are
+// maintained somewhere else, e.g. by a master, it is not enforced by Dir itself.
 type Dir struct {
-	BaseDir string
-	Default uint
-	Params  map[uint]Hasher
+	BaseDir  string
+	Default  uint
+	Params   map[uint]Hasher
+	Envelope *Envelope
+	ReadOnly bool
 }
 
 // NewDir creates a new whawty.auth store using BaseDir as base directory.
@@ -120,6 +124,39 @@ func (d *Dir) getTempFile() (tmp *os.File, err error) {
 	return os.CreateTemp(tmpDir, "")
 }
 
+// replaceFile atomically replaces filename with the contents written by write. The contents
+// go to a temporary file which is moved in place once it has been flushed to disk.
+func (d *Dir) replaceFile(filename string, write func(w io.Writer) error) error {
+	tmp, err := d.getTempFile()
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name()) // Ensure that the file gets removed in case of failure
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+
+	// Flush the file's contents to disk
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	// Atomically move the new file in place
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	// Flush the move to disk
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
 func isDirEmpty(dir *os.File) bool {
 	entries, _ := dir.ReadDir(2)
 	if len(entries) == 0 {
@@ -163,16 +200,18 @@ func (d *Dir) Init(admin, password string) error {
 	return d.AddUser(admin, password, true)
 }
 
-// Check tests if the directory is a valid whawty.auth base directory.
-func (d *Dir) Check() error {
+// Check tests if the directory is a valid whawty.auth base directory. Files
+// which are ignored by the store, like files for invalid usernames or files
+// encrypted with an unknown key, are not errors but are returned as warnings.
+func (d *Dir) Check() (warnings []string, err error) {
 	dir, err := openDir(d.BaseDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer dir.Close()
 	names, err := dir.Readdirnames(0)
 	if err != nil && err != io.EOF {
-		return err
+		return nil, err
 	}
 
 	result := errNoSupportedHash
@@ -184,20 +223,27 @@ func (d *Dir) Check() error {
 
 		valid, user, isAdmin, err := checkUserFile(name)
 		if err != nil {
-			return err
+			return warnings, err
 		}
 
 		if !valid {
-			wl.Printf("ignoring file for invalid username: '%s'", user)
+			warnings = append(warnings, fmt.Sprintf("ignoring file for invalid username: '%s'", user))
+		}
+
+		if keyID, err := encryptionKeyID(filepath.Join(dir.Name(), name)); err != nil {
+			return warnings, err
+		} else if keyID != "" && !d.Envelope.HasKey(keyID) {
+			// these files are treated like files with an unsupported hash format
+			warnings = append(warnings, fmt.Sprintf("ignoring '%s' which is encrypted with unknown key '%s'", name, keyID))
 		}
 
 		if isAdmin {
 			if exists, _ := fileExists(filepath.Join(dir.Name(), user) + userExt); exists {
-				return fmt.Errorf("both '%s' and '%s' exist", name, user+userExt)
+				return warnings, fmt.Errorf("both '%s' and '%s' exist", name, user+userExt)
 			}
 		} else {
 			if exists, _ := fileExists(filepath.Join(dir.Name(), user) + adminExt); exists {
-				return fmt.Errorf("both '%s' and '%s' exist", name, user+adminExt)
+				return warnings, fmt.Errorf("both '%s' and '%s' exist", name, user+adminExt)
 			}
 			continue
 		}
@@ -207,7 +253,7 @@ func (d *Dir) Check() error {
 		}
 	}
 
-	return result
+	return warnings, result
 }
 
 // AddUser adds user to the store. It is an error if the user already exists.
@@ -224,6 +270,29 @@ func (d *Dir) UpdateUser(user, password string) (err error) {
 	return NewUserHash(d, user).Update(password)
 }
 
+// ExpireUser marks the password of user as expired. If withToken is set a one-time
+// reset token is returned. It is an error if the user does not exist.
+func (d *Dir) ExpireUser(user string, withToken bool) (string, error) {
+	return NewUserHash(d, user).Expire(withToken)
+}
+
+// ResetUser changes the password of user using a reset token as returned by ExpireUser.
+func (d *Dir) ResetUser(user, token, password string) error {
+	return NewUserHash(d, user).Reset(token, password)
+}
+
+// RewrapUser converts the password hash of user to the parameter-set paramID
+// without knowing the password. It is an error if the user does not exist.
+func (d *Dir) RewrapUser(user string, paramID uint) error {
+	return NewUserHash(d, user).Rewrap(paramID)
+}
+
+// ReencryptUser rewrites the password hash of user using the current default
+// encryption key. It returns whether the hash file has been changed.
+func (d *Dir) ReencryptUser(user string) (bool, error) {
+	return NewUserHash(d, user).Reencrypt()
+}
+
 // SetAdmin changes the admin status of user. It is an error if the user does
 // not exist.
 func (d *Dir) SetAdmin(user string, adminState bool) (err error) {
@@ -306,6 +375,19 @@ type UserFull struct {
 	IsSupported bool      `json:"supported"`
 	FormatID    string    `json:"formatid"`
 	ParamID     uint      `json:"paramid"`
+	MustReset   bool      `json:"mustreset"`
+	Groups      []string  `json:"groups,omitempty"`
+
+	// UserLogins and Listeners are never set by the store itself. Applications which keep
+	// track of authentications may fill them in. Listeners holds the logins per listener.
+	UserLogins
+	Listeners map[string]UserLogins `json:"listeners,omitempty"`
+}
+
+// UserLogins holds the times of the last successful and failed login of a user.
+type UserLogins struct {
+	LastLogin       *time.Time `json:"lastlogin,omitempty"`
+	LastFailedLogin *time.Time `json:"lastfailedlogin,omitempty"`
 }
 
 // UserListFull is the return value of ListFull(). The key of the map is the username.
@@ -345,6 +427,10 @@ func (d *Dir) ListFull() (UserListFull, error) {
 				return list, err
 			}
 			user.IsSupported, user.FormatID, user.LastChanged, user.ParamID, _ = isFormatSupportedFull(filepath.Join(dir.Name(), name), d)
+			if aux, err := readAuxData(filepath.Join(dir.Name(), name)); err == nil {
+				_, user.MustReset = aux[auxMustReset]
+				user.Groups = aux.Groups()
+			}
 			list[username] = user
 		}
 
@@ -360,8 +446,49 @@ func (d *Dir) Exists(user string) (exists bool, isAdmin bool, err error) {
 	return NewUserHash(d, user).Exists()
 }
 
+// Groups returns the groups of user.
+func (d *Dir) Groups(user string) ([]string, error) {
+	return NewUserHash(d, user).Groups()
+}
+
+// SetGroup adds user to group or removes it from group.
+func (d *Dir) SetGroup(user, group string, member bool) error {
+	return NewUserHash(d, user).SetGroup(group, member)
+}
+
+// AppPasswords returns the app passwords of user.
+func (d *Dir) AppPasswords(user string) (AppPasswordList, error) {
+	return NewUserHash(d, user).AppPasswords()
+}
+
+// AddAppPassword generates a new app password called name for user, optionally restricted to scopes.
+func (d *Dir) AddAppPassword(user, name string, scopes []string) (string, error) {
+	return NewUserHash(d, user).AddAppPassword(name, scopes)
+}
+
+// RemoveAppPassword revokes the app password called name of user.
+func (d *Dir) RemoveAppPassword(user, name string) error {
+	return NewUserHash(d, user).RemoveAppPassword(name)
+}
+
+// GetAuxData returns the aux data of user.
+func (d *Dir) GetAuxData(user string) (AuxData, error) {
+	return NewUserHash(d, user).GetAuxData()
+}
+
+// Stat returns the file info of the hash file of user.
+func (d *Dir) Stat(user string) (os.FileInfo, error) {
+	return NewUserHash(d, user).Stat()
+}
+
 // Authenticate checks if user and password are a valid combination. It also returns
 // whether user is an admin, the password is upgradeable and when the password was last changed.
 func (d *Dir) Authenticate(user, password string) (isAuthenticated, isAdmin, upgradeable bool, lastchange time.Time, err error) {
 	return NewUserHash(d, user).Authenticate(password)
 }
+
+// AuthenticateWithAppPasswords works like Authenticate but also accepts app passwords of user which
+// are valid for at least one of scopes. It also returns the name of the app password which has been used.
+func (d *Dir) AuthenticateWithAppPasswords(user, password string, scopes []string) (isAuthenticated, isAdmin, upgradeable bool, lastchange time.Time, appPassword string, err error) {
+	return NewUserHash(d, user).AuthenticateWithAppPasswords(password, scopes)
+}
@@ -148,6 +148,56 @@ params:
       cost: 14
       p: 7
       r: 2`, true},
+		{`basedir: "/tmp"
+default: 17
+params:
+  - id: 17
+    scryptauth:
+      hmackey: "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="
+      cost: 12
+      rewrap:
+        - "e70t9ZiCR75KE4VoUHQM6wH05KORAfLV74bREA=="`, false}, // rewrap key is too short
+		{`basedir: "/tmp"
+default: 17
+params:
+  - id: 17
+    scryptauth:
+      hmackey: "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="
+      cost: 12
+      rewrap:
+        - "1rrhSZPW3v/BBpJOPQ/wd5XcRoZNEaDbHnfXEHOxoSc="`, true},
+		{`basedir: "/tmp"
+encryption:
+  default: "k1"`, false}, // default encryption key does not exist
+		{`basedir: "/tmp"
+encryption:
+  keys:
+    - id: "k1"
+      key: "e70t9ZiCR75KE4VoUHQM6wH05KORAfLV74bREA=="`, false}, // encryption key is too short
+		{`basedir: "/tmp"
+encryption:
+  keys:
+    - id: "k:1"
+      key: "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="`, false}, // invalid encryption key id
+		{`basedir: "/tmp"
+encryption:
+  keys:
+    - id: "k1"
+      key: "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="
+    - id: "k1"
+      key: "1rrhSZPW3v/BBpJOPQ/wd5XcRoZNEaDbHnfXEHOxoSc="`, false}, // encryption key id is not unique
+		{`basedir: "/tmp"
+encryption:
+  default: "k2"
+  keys:
+    - id: "k1"
+      key: "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="
+    - id: "k2"
+      key: "1rrhSZPW3v/BBpJOPQ/wd5XcRoZNEaDbHnfXEHOxoSc="`, true},
+		{`basedir: "/tmp"
+read-only: true`, true},
+		{`basedir: "/tmp"
+read-only: "maybe"`, false}, // read-only is not a boolean
 	}
 
 	file, err := os.CreateTemp("", "whawty-auth-config")
@@ -249,7 +299,7 @@ func TestInitDir(t *testing.T) {
 func TestCheckDir(t *testing.T) {
 	store := NewDir(testBaseDir)
 
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatalf("check should return an error for non-existing directory")
 	}
 
@@ -259,7 +309,7 @@ func TestCheckDir(t *testing.T) {
 		file.Close()
 	}
 
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatalf("check should return an error if path is not a directory")
 	}
 
@@ -271,7 +321,7 @@ func TestCheckDir(t *testing.T) {
 	}
 	defer os.RemoveAll(testBaseDir)
 
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatalf("check should return an error if directory is not accessible")
 	}
 
@@ -279,7 +329,7 @@ func TestCheckDir(t *testing.T) {
 		t.Fatal("unexpected error:", err)
 	}
 
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatalf("check should return an error for an empty directory")
 	}
 
@@ -292,7 +342,7 @@ func TestCheckDir(t *testing.T) {
 		t.Fatal("init should succeed on an empty directory:", err)
 	}
 
-	if err := store.Check(); err != nil {
+	if _, err := store.Check(); err != nil {
 		t.Fatal("check should succeed in a freshly-created base:", err)
 	}
 
@@ -300,14 +350,14 @@ func TestCheckDir(t *testing.T) {
 		t.Fatal("Unexpected error:", err)
 	}
 
-	if err := store.Check(); err != nil {
+	if _, err := store.Check(); err != nil {
 		t.Fatal("check should succeed without .tmp/:", err)
 	}
 
 	if err := store.AddUser("foo", "bar", false); err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	if err := store.Check(); err != nil {
+	if _, err := store.Check(); err != nil {
 		t.Fatal("check should succeed after adding regular user:", err)
 	}
 
@@ -317,7 +367,7 @@ func TestCheckDir(t *testing.T) {
 	} else {
 		file.Close()
 	}
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatal("check should fail if a file with no extension is found")
 	}
 	if err := os.Remove(filepath.Join(testBaseDir, "blub")); err != nil {
@@ -329,7 +379,7 @@ func TestCheckDir(t *testing.T) {
 	} else {
 		file.Close()
 	}
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatal("check should fail if a file with invalid extension is found")
 	}
 	if err := os.Remove(filepath.Join(testBaseDir, "blub.invalid")); err != nil {
@@ -341,7 +391,7 @@ func TestCheckDir(t *testing.T) {
 	} else {
 		file.Close()
 	}
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatal("check should fail if admin and user hash for the same user exist")
 	}
 	if err := os.Remove(filepath.Join(testBaseDir, "admin.user")); err != nil {
@@ -353,7 +403,7 @@ func TestCheckDir(t *testing.T) {
 	} else {
 		file.Close()
 	}
-	if err := store.Check(); err == nil {
+	if _, err := store.Check(); err == nil {
 		t.Fatal("check should fail if admin and user hash for the same user exist")
 	}
 	if err := os.Remove(filepath.Join(testBaseDir, "foo.admin")); err != nil {
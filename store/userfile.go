@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// UserFile holds the raw contents of the hash file of a user. It is used to copy users
+// between stores, e.g. for replication.
+type UserFile struct {
+	Username string `json:"username"`
+	IsAdmin  bool   `json:"admin"`
+	Content  []byte `json:"content"`
+}
+
+// ReadUserFile returns the hash file of user or nil if the user does not exist.
+func (d *Dir) ReadUserFile(user string) (*UserFile, error) {
+	if !userNameRe.MatchString(user) {
+		return nil, fmt.Errorf("username '%s' is invalid", user)
+	}
+
+	u := NewUserHash(d, user)
+	exists, isAdmin, err := u.Exists()
+	if err != nil || !exists {
+		return nil, err
+	}
+	content, err := os.ReadFile(u.getFilename(isAdmin))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &UserFile{Username: user, IsAdmin: isAdmin, Content: content}, nil
+}
+
+// ReadUserFiles returns the hash files of all users with a valid username sorted by username.
+// This includes users with unsupported hash formats.
+func (d *Dir) ReadUserFiles() ([]UserFile, error) {
+	dir, err := openDir(d.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []UserFile
+	for _, name := range names {
+		// Skip the '.tmp' directory
+		if name == tmpDir {
+			continue
+		}
+
+		valid, user, isAdmin, err := checkUserFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			wl.Printf("ignoring file for invalid username: '%s'", user)
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(d.BaseDir, name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, UserFile{Username: user, IsAdmin: isAdmin, Content: content})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Username < files[j].Username })
+	return files, nil
+}
+
+// WriteUserFile atomically replaces the hash file of a user with file. If the admin flag of
+// the user changes the old hash file is removed.
+func (d *Dir) WriteUserFile(file UserFile) error {
+	if !userNameRe.MatchString(file.Username) {
+		return fmt.Errorf("username '%s' is invalid", file.Username)
+	}
+
+	u := NewUserHash(d, file.Username)
+	err := d.replaceFile(u.getFilename(file.IsAdmin), func(w io.Writer) error {
+		_, err := w.Write(file.Content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(u.getFilename(!file.IsAdmin)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+//
+// Copyright (c) 2016 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.auth nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package store
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUserFiles(t *testing.T) {
+	username := "test-userfiles"
+	password := "secret"
+
+	if err := os.Mkdir(testBaseDir, 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(testBaseDir)
+
+	replica := NewDir(testBaseDir)
+	replica.Default = testStoreUserHash.Default
+	replica.Params = testStoreUserHash.Params
+
+	if file, err := testStoreUserHash.ReadUserFile(username); err != nil || file != nil {
+		t.Fatalf("reading the file of a non-existent user should return nil, got %v, %v", file, err)
+	}
+	if _, err := testStoreUserHash.ReadUserFile("../" + username); err == nil {
+		t.Fatal("reading the file of an invalid username should fail")
+	}
+	if err := replica.WriteUserFile(UserFile{Username: "../" + username}); err == nil {
+		t.Fatal("writing the file of an invalid username should fail")
+	}
+
+	u := NewUserHash(testStoreUserHash, username)
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+	if err := u.SetGroup("staff", true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	file, err := testStoreUserHash.ReadUserFile(username)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if file.Username != username || file.IsAdmin || len(file.Content) == 0 {
+		t.Fatalf("unexpected user file: %+v", file)
+	}
+	if err := replica.WriteUserFile(*file); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, isAdmin, _, _, err := replica.Authenticate(username, password); !ok || isAdmin || err != nil {
+		t.Fatalf("authentication on the copy failed: %v, %v, %v", ok, isAdmin, err)
+	}
+	if groups, err := replica.Groups(username); err != nil || len(groups) != 1 || groups[0] != "staff" {
+		t.Fatalf("unexpected groups of the copy: %v, %v", groups, err)
+	}
+
+	if err := u.SetAdmin(true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if file, err = testStoreUserHash.ReadUserFile(username); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !file.IsAdmin {
+		t.Fatal("user file should belong to an admin")
+	}
+	if err := replica.WriteUserFile(*file); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	files, err := replica.ReadUserFiles()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(files) != 1 || files[0].Username != username || !files[0].IsAdmin || string(files[0].Content) != string(file.Content) {
+		t.Fatalf("unexpected user files: %+v", files)
+	}
+}
@@ -32,6 +32,11 @@ package store
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -41,6 +46,10 @@ import (
 	"time"
 )
 
+// ErrPasswordExpired is returned by Authenticate if the password is correct but has been
+// marked as expired. The user must reset the password before logging in again.
+var ErrPasswordExpired = errors.New("whawty.auth.store: password has expired and must be reset")
+
 type Hasher interface {
 	GetFormatID() string
 	IsValid(hashStr string) (bool, error)
@@ -48,6 +57,12 @@ type Hasher interface {
 	Check(password, hashStr string) (bool, error)
 }
 
+// Rewrapper is implemented by hashers which are able to convert hashes of another
+// parameter-set without knowing the password.
+type Rewrapper interface {
+	Rewrap(from Hasher, hashStr string) (string, error)
+}
+
 // fileExists returns whether the given file or directory exists or not
 // this is from: stackoverflow.com/questions/10510691
 func fileExists(path string) (bool, error) {
@@ -62,8 +77,9 @@ func fileExists(path string) (bool, error) {
 }
 
 // readHashStr returns the contents of the user hash file separated into format id
-// string, change time parameter id and the whole hash string.
-func readHashStr(filename string) (string, time.Time, uint, string, error) {
+// string, change time parameter id and the whole hash string. Encrypted hash strings
+// get decrypted using the envelope of the store.
+func readHashStr(filename string, store *Dir) (string, time.Time, uint, string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return "", time.Unix(0, 0), 0, "", err
@@ -94,12 +110,17 @@ func readHashStr(filename string) (string, time.Time, uint, string, error) {
 	}
 	paramID := uint(tmpParamID)
 
-	return parts[0], lastchange, paramID, parts[3], nil
+	hashStr, err := store.Envelope.open(filename, parts[0], tmpTime, paramID, parts[3])
+	if err != nil {
+		return "", time.Unix(0, 0), 0, "", err
+	}
+
+	return parts[0], lastchange, paramID, hashStr, nil
 }
 
 func isFormatSupportedFull(filename string, store *Dir) (supported bool, formatID string, lastChange time.Time, paramID uint, err error) {
 	var hashStr string
-	if formatID, lastChange, paramID, hashStr, err = readHashStr(filename); err != nil {
+	if formatID, lastChange, paramID, hashStr, err = readHashStr(filename, store); err != nil {
 		return
 	}
 
@@ -150,18 +171,11 @@ func (u *UserHash) getFilename(isAdmin bool) string {
 	return filename + userExt
 }
 
-func (u *UserHash) writeHashStr(password string, isAdmin bool, mayCreate bool) error {
-	paramID := u.store.Default
-	hasher := u.store.Params[u.store.Default]
-	if hasher == nil {
-		return fmt.Errorf("whawty.auth.store: no default parameter-set")
-	}
-	hashStr, err := hasher.Generate(password)
-	if err != nil {
-		return err
-	}
-	formatID := hasher.GetFormatID()
-
+// rewriteFile atomically replaces the hash file of the user. modify is called with the
+// current hash line (empty if the file was just created) as well as the current aux data
+// and must return the new hash line. Changes to aux will be written to the new file. Aux data
+// lines which can't be parsed are carried over verbatim unless modify changes their identifier.
+func (u *UserHash) rewriteFile(isAdmin bool, mayCreate bool, modify func(hashLine string, aux AuxData) (string, error)) error {
 	// Set the flags based on whether we expect to create the file
 	// The file is opened read-only, since we write to a tmp file and atomically move it in place.
 	flags := os.O_RDONLY | os.O_EXCL
@@ -175,49 +189,62 @@ func (u *UserHash) writeHashStr(password string, isAdmin bool, mayCreate bool) e
 	}
 	defer file.Close()
 
-	tmp, err := u.store.getTempFile()
-	if err != nil {
-		return err
-	}
-	defer tmp.Close()
-	defer os.Remove(tmp.Name()) // Ensure that the file gets removed in case of failure
-
-	// Write the new password hash
-	if _, err := io.WriteString(tmp, fmt.Sprintf("%s:%d:%d:%s\n", formatID, time.Now().Unix(), paramID, hashStr)); err != nil {
-		// TODO: retry if write was short??
-		return err
-	}
-
 	// Create a reader for the original file
 	reader := bufio.NewReader(file)
 
-	// Skip the first line
-	if _, err := reader.ReadString('\n'); err != nil && err != io.EOF {
+	hashLine, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
 		return err
 	}
-
-	// Write the rest of the old file to the new one
-	if _, err := reader.WriteTo(tmp); err != nil {
+	aux, foreign, err := parseAuxDataLines(reader)
+	if err != nil {
 		return err
 	}
 
-	// Flush the file's contents to disk
-	if err := tmp.Sync(); err != nil {
+	original := make(AuxData, len(aux))
+	for id, data := range aux {
+		original[id] = data
+	}
+	if hashLine, err = modify(strings.TrimSuffix(hashLine, "\n"), aux); err != nil {
 		return err
 	}
 
-	// Atomically move the new file in place
-	if err := os.Rename(tmp.Name(), file.Name()); err != nil {
+	return u.store.replaceFile(file.Name(), func(w io.Writer) error {
+		// Write the password hash
+		if _, err := io.WriteString(w, hashLine+"\n"); err != nil {
+			// TODO: retry if write was short??
+			return err
+		}
+
+		// Write the aux data, lines we don't understand are kept as they are
+		if err := aux.writeTo(w); err != nil {
+			return err
+		}
+		return writeForeignAuxLines(w, foreign, original.changedIDs(aux))
+	})
+}
+
+func (u *UserHash) writeHashStr(password string, isAdmin bool, mayCreate bool) error {
+	paramID := u.store.Default
+	hasher := u.store.Params[u.store.Default]
+	if hasher == nil {
+		return fmt.Errorf("whawty.auth.store: no default parameter-set")
+	}
+	hashStr, err := hasher.Generate(password)
+	if err != nil {
 		return err
 	}
-
-	// Flush the move to disk
-	dir, err := os.Open(filepath.Dir(file.Name()))
+	hashLine, err := u.store.Envelope.hashLine(u.user, hasher.GetFormatID(), time.Now().Unix(), paramID, hashStr)
 	if err != nil {
 		return err
 	}
-	defer dir.Close()
-	return dir.Sync()
+
+	return u.rewriteFile(isAdmin, mayCreate, func(_ string, aux AuxData) (string, error) {
+		// a new password invalidates any pending password reset
+		delete(aux, auxMustReset)
+		delete(aux, auxResetToken)
+		return hashLine, nil
+	})
 }
 
 // Add creates the hash file. It is an error if the user already exists.
@@ -247,6 +274,151 @@ func (u *UserHash) Update(password string) error {
 	return u.writeHashStr(password, isAdmin, false)
 }
 
+// Expire marks the password of user as expired. Authenticate will fail until the password
+// gets changed. If withToken is set a one-time reset token is generated which can be used
+// to set a new password using Reset.
+func (u *UserHash) Expire(withToken bool) (token string, err error) {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return "", err
+	} else if !exists {
+		return "", fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	var tokenHash []byte
+	if withToken {
+		b := make([]byte, 15)
+		if _, err = rand.Read(b); err != nil {
+			return "", err
+		}
+		token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		h := sha256.Sum256([]byte(token))
+		tokenHash = h[:]
+	}
+
+	err = u.rewriteFile(isAdmin, false, func(hashLine string, aux AuxData) (string, error) {
+		aux[auxMustReset] = []byte(strconv.FormatInt(time.Now().Unix(), 10))
+		if tokenHash != nil {
+			aux[auxResetToken] = tokenHash
+		} else {
+			delete(aux, auxResetToken)
+		}
+		return hashLine, nil
+	})
+	return
+}
+
+// Reset sets a new password for user using a reset token generated by Expire. The token
+// is only valid once. Other than Update this also replaces hashes with unsupported formats
+// since the reset has been explicitly requested using Expire.
+func (u *UserHash) Reset(token, password string) error {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	aux, err := readAuxData(u.getFilename(isAdmin))
+	if err != nil {
+		return err
+	}
+	tokenHash, exists := aux[auxResetToken]
+	if !exists {
+		return fmt.Errorf("whawty.auth.store: there is no pending password reset for user '%s'", u.user)
+	}
+	h := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(h[:], tokenHash) != 1 {
+		return fmt.Errorf("whawty.auth.store: invalid password reset token")
+	}
+	return u.writeHashStr(password, isAdmin, false)
+}
+
+// Rewrap converts the password hash of user to the parameter-set paramID without knowing
+// the password. This is only possible if the hasher of paramID implements Rewrapper and
+// supports the current parameter-set of the user. The last-change time stays the same.
+func (u *UserHash) Rewrap(paramID uint) error {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	to := u.store.Params[paramID]
+	if to == nil {
+		return fmt.Errorf("whawty.auth.store: parameter-set %d is unknown", paramID)
+	}
+	rewrapper, ok := to.(Rewrapper)
+	if !ok {
+		return fmt.Errorf("whawty.auth.store: parameter-set %d does not support rewrapping", paramID)
+	}
+
+	formatID, lastchange, fromParamID, hashStr, err := readHashStr(u.getFilename(isAdmin), u.store)
+	if err != nil {
+		return err
+	}
+	from := u.store.Params[fromParamID]
+	if from == nil {
+		return fmt.Errorf("whawty.auth.store: parameter-set %d is unknown", fromParamID)
+	}
+	if from.GetFormatID() != formatID {
+		return fmt.Errorf("whawty.auth.store: hash file format ID '%s' does not fit parameter-set %d", formatID, fromParamID)
+	}
+	if newHashStr, err := rewrapper.Rewrap(from, strings.TrimSpace(hashStr)); err != nil {
+		return err
+	} else {
+		hashStr = newHashStr
+	}
+
+	hashLine, err := u.store.Envelope.hashLine(u.user, to.GetFormatID(), lastchange.Unix(), paramID, hashStr)
+	if err != nil {
+		return err
+	}
+
+	return u.rewriteFile(isAdmin, false, func(_ string, _ AuxData) (string, error) {
+		return hashLine, nil
+	})
+}
+
+// Reencrypt rewrites the password hash of user using the current default encryption key
+// of the store. If there is no default key the hash will be stored unencrypted. This
+// returns false if the hash was already using the default key.
+func (u *UserHash) Reencrypt() (bool, error) {
+	exists, isAdmin, err := u.Exists()
+	if err != nil {
+		return false, err
+	} else if !exists {
+		return false, fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+	}
+
+	keyID, err := encryptionKeyID(u.getFilename(isAdmin))
+	if err != nil {
+		return false, err
+	}
+	defaultKeyID := ""
+	if u.store.Envelope != nil {
+		defaultKeyID = u.store.Envelope.Default
+	}
+	if keyID == defaultKeyID {
+		return false, nil
+	}
+
+	formatID, lastchange, paramID, hashStr, err := readHashStr(u.getFilename(isAdmin), u.store)
+	if err != nil {
+		return false, err
+	}
+	hashLine, err := u.store.Envelope.hashLine(u.user, formatID, lastchange.Unix(), paramID, strings.TrimSpace(hashStr))
+	if err != nil {
+		return false, err
+	}
+
+	err = u.rewriteFile(isAdmin, false, func(_ string, _ AuxData) (string, error) {
+		return hashLine, nil
+	})
+	return err == nil, err
+}
+
 // SetAdmin changes the admin status of user.
 func (u *UserHash) SetAdmin(adminState bool) error {
 	exists, isAdmin, err := u.Exists()
@@ -294,31 +466,68 @@ func (u *UserHash) Exists() (exists bool, isAdmin bool, err error) {
 	return
 }
 
+// Stat returns the file info of the hash file of the user. Since the file gets replaced on every
+// change this can be used to detect whether the user has been modified.
+func (u *UserHash) Stat() (os.FileInfo, error) {
+	if fi, err := os.Stat(u.getFilename(true)); err == nil || !os.IsNotExist(err) {
+		return fi, err
+	}
+	return os.Stat(u.getFilename(false))
+}
+
 // Authenticate checks the user password. It also returns whether user is an admin, the password is upgradable
 // and when the password was last changed.
+// If the user does not exist or the hash file is not supported a password hash using the default parameter-set
+// is computed anyway. This way the time it takes to authenticate doesn't reveal whether a user exists.
 func (u *UserHash) Authenticate(password string) (isAuthenticated, isAdmin, upgradeable bool, lastchange time.Time, err error) {
+	var checked bool
+	if isAuthenticated, isAdmin, upgradeable, lastchange, checked, err = u.authenticate(password); !checked {
+		u.store.dummyCheck(password)
+	}
+	return
+}
+
+func (u *UserHash) authenticate(password string) (isAuthenticated, isAdmin, upgradeable bool, lastchange time.Time, checked bool, err error) {
 	var exists bool
 	if exists, isAdmin, err = u.Exists(); err != nil {
 		return
 	} else if !exists {
-		return false, false, false, time.Unix(0, 0), fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
+		return false, false, false, time.Unix(0, 0), false, fmt.Errorf("whawty.auth.store: user '%s' does not exist", u.user)
 	}
 
 	var formatID, hashStr string
 	var paramID uint
-	if formatID, lastchange, paramID, hashStr, err = readHashStr(u.getFilename(isAdmin)); err != nil {
+	if formatID, lastchange, paramID, hashStr, err = readHashStr(u.getFilename(isAdmin), u.store); err != nil {
 		return
 	}
 	upgradeable = (u.store.Default != paramID)
 
 	hasher := u.store.Params[paramID]
 	if hasher == nil {
-		return false, false, false, time.Unix(0, 0), fmt.Errorf("whawty.auth.store: parameter-set %d is unknown", paramID)
+		return false, false, false, time.Unix(0, 0), false, fmt.Errorf("whawty.auth.store: parameter-set %d is unknown", paramID)
 	}
 	if hasher.GetFormatID() != formatID {
-		return false, false, false, time.Unix(0, 0), fmt.Errorf("whawty.auth.store: hash file format ID '%s' does not fit parameter-set %d ", formatID, paramID)
+		return false, false, false, time.Unix(0, 0), false, fmt.Errorf("whawty.auth.store: hash file format ID '%s' does not fit parameter-set %d ", formatID, paramID)
 	}
 
-	isAuthenticated, err = hasher.Check(password, hashStr)
+	checked = true
+	if isAuthenticated, err = hasher.Check(password, hashStr); !isAuthenticated || err != nil {
+		return
+	}
+
+	var aux AuxData
+	if aux, err = readAuxData(u.getFilename(isAdmin)); err != nil {
+		return false, isAdmin, false, lastchange, checked, err
+	}
+	if _, expired := aux[auxMustReset]; expired {
+		return false, isAdmin, false, lastchange, checked, ErrPasswordExpired
+	}
 	return
 }
+
+// dummyCheck computes a password hash using the default parameter-set and throws it away.
+func (d *Dir) dummyCheck(password string) {
+	if hasher := d.Params[d.Default]; hasher != nil {
+		hasher.Generate(password) //nolint:errcheck
+	}
+}
@@ -31,6 +31,10 @@
 package store
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -39,23 +43,41 @@ import (
 )
 
 type ScryptAuthParams struct {
-	HmacKeyBase64 string `yaml:"hmackey"`
-	Cost          uint   `yaml:"cost"`
-	R             int    `yaml:"r"`
-	P             int    `yaml:"p"`
+	HmacKeyBase64    string   `yaml:"hmackey"`
+	Cost             uint     `yaml:"cost"`
+	R                int      `yaml:"r"`
+	P                int      `yaml:"p"`
+	RewrapKeysBase64 []string `yaml:"rewrap"`
 }
 
 type ScryptAuthHasher struct {
-	saCtx *scryptauth.Context
+	saCtx      *scryptauth.Context
+	rewrapKeys [][]byte
+}
+
+func decodeScryptAuthKey(keyBase64, name string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("Error: can't decode %s for scrypt-auth parameter-set: %s", name, err)
+	}
+	if len(k) != scryptauth.KeyLength {
+		return nil, fmt.Errorf("Error: %s for scrypt-auth parameter-set has invalid length %d != %d", name, scryptauth.KeyLength, len(k))
+	}
+	return k, nil
 }
 
 func NewScryptAuthHasher(params *ScryptAuthParams) (*ScryptAuthHasher, error) {
-	hk, err := base64.StdEncoding.DecodeString(params.HmacKeyBase64)
+	hk, err := decodeScryptAuthKey(params.HmacKeyBase64, "HMAC Key")
 	if err != nil {
-		return nil, fmt.Errorf("Error: can't decode HMAC Key for scrypt-auth parameter-set: %s", err)
+		return nil, err
 	}
-	if len(hk) != scryptauth.KeyLength {
-		return nil, fmt.Errorf("Error: HMAC Key for scrypt-auth parameter-set has invalid length %d != %d", scryptauth.KeyLength, len(hk))
+	var rewrapKeys [][]byte
+	for _, keyBase64 := range params.RewrapKeysBase64 {
+		rk, err := decodeScryptAuthKey(keyBase64, "rewrap HMAC Key")
+		if err != nil {
+			return nil, err
+		}
+		rewrapKeys = append(rewrapKeys, rk)
 	}
 
 	sactx, err := scryptauth.New(params.Cost, hk)
@@ -68,7 +90,18 @@ func NewScryptAuthHasher(params *ScryptAuthParams) (*ScryptAuthHasher, error) {
 	if params.P > 0 {
 		sactx.P = params.P
 	}
-	return &ScryptAuthHasher{saCtx: sactx}, nil
+	return &ScryptAuthHasher{saCtx: sactx, rewrapKeys: rewrapKeys}, nil
+}
+
+// rewrap applies hmac-sha256 using all the keys to hash. This way hashes can be
+// protected by a new key without knowing the password.
+func rewrap(hash []byte, keys [][]byte) []byte {
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(hash) //nolint:errcheck
+		hash = mac.Sum(nil)
+	}
+	return hash
 }
 
 func scryptAuthDecodeBase64(hashStr string) (salt, hash []byte, err error) {
@@ -90,6 +123,9 @@ func scryptAuthDecodeBase64(hashStr string) (salt, hash []byte, err error) {
 }
 
 func (h *ScryptAuthHasher) GetFormatID() string {
+	if len(h.rewrapKeys) > 0 {
+		return "hmac_sha256_scrypt_rewrap"
+	}
 	return "hmac_sha256_scrypt"
 }
 
@@ -110,6 +146,7 @@ func (h *ScryptAuthHasher) Generate(password string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	hash = rewrap(hash, h.rewrapKeys)
 
 	b64_salt := base64.URLEncoding.EncodeToString(salt)
 	b64_hash := base64.URLEncoding.EncodeToString(hash)
@@ -122,6 +159,49 @@ func (h *ScryptAuthHasher) Check(password, hashStr string) (isAuthenticated bool
 		return
 	}
 
-	isAuthenticated, err = h.saCtx.Check(hash, []byte(password), salt)
-	return
+	if len(h.rewrapKeys) == 0 {
+		isAuthenticated, err = h.saCtx.Check(hash, []byte(password), salt)
+		return
+	}
+
+	var cmp []byte
+	if cmp, err = h.saCtx.Hash([]byte(password), salt); err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare(rewrap(cmp, h.rewrapKeys), hash) != 1 {
+		return false, fmt.Errorf("Error: Hash verification failed")
+	}
+	return true, nil
+}
+
+// Rewrap converts hashStr which was generated using the parameter-set from to this
+// parameter-set. This only works if both parameter-sets use the same scrypt parameters
+// and HMAC key and the rewrap keys of from are a prefix of the rewrap keys of h.
+func (h *ScryptAuthHasher) Rewrap(from Hasher, hashStr string) (string, error) {
+	f, ok := from.(*ScryptAuthHasher)
+	if !ok {
+		return "", fmt.Errorf("whawty.auth.store: can't rewrap hashes of format '%s'", from.GetFormatID())
+	}
+	if f.saCtx.PwCost != h.saCtx.PwCost || f.saCtx.R != h.saCtx.R || f.saCtx.P != h.saCtx.P ||
+		!bytes.Equal(f.saCtx.HmacKey, h.saCtx.HmacKey) {
+		return "", fmt.Errorf("whawty.auth.store: parameter-sets use different scrypt parameters or HMAC keys")
+	}
+	if len(f.rewrapKeys) >= len(h.rewrapKeys) {
+		return "", fmt.Errorf("whawty.auth.store: parameter-set has no additional rewrap keys")
+	}
+	for i, key := range f.rewrapKeys {
+		if !bytes.Equal(key, h.rewrapKeys[i]) {
+			return "", fmt.Errorf("whawty.auth.store: rewrap keys of parameter-sets don't match")
+		}
+	}
+
+	hash, salt, err := scryptAuthDecodeBase64(hashStr)
+	if err != nil {
+		return "", err
+	}
+	hash = rewrap(hash, h.rewrapKeys[len(f.rewrapKeys):])
+
+	b64_salt := base64.URLEncoding.EncodeToString(salt)
+	b64_hash := base64.URLEncoding.EncodeToString(hash)
+	return fmt.Sprintf("%s:%s", b64_salt, b64_hash), nil
 }
@@ -33,6 +33,7 @@ package store
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -164,6 +165,46 @@ func TestExistsAdmin(t *testing.T) {
 	}
 }
 
+func TestStat(t *testing.T) {
+	username := "test-stat"
+	password := "secret"
+
+	u := NewUserHash(testStoreUserHash, username)
+
+	if _, err := u.Stat(); !os.IsNotExist(err) {
+		t.Fatal("stat of non-existent user should fail with not-exist error, got:", err)
+	}
+
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	before, err := u.Stat()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Update("newsecret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	after, err := u.Stat()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if os.SameFile(before, after) {
+		t.Fatal("updating the user should replace the hash file")
+	}
+
+	if err := u.SetAdmin(true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if fi, err := u.Stat(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if fi.Name() != username+adminExt {
+		t.Fatalf("stat should return the admin hash file, got '%s'", fi.Name())
+	}
+}
+
 func TestSetAdmin(t *testing.T) {
 	username := "test-set-admin"
 	password := "secret"
@@ -497,3 +538,387 @@ func TestUpdateToArgon2ID(t *testing.T) {
 		t.Fatal("authentication should succeed with new password")
 	}
 }
+
+func TestAuxData(t *testing.T) {
+	username := "test-aux-data"
+	password1 := "secret"
+	password2 := "moresecret"
+
+	u := NewUserHash(testStoreUserHash, username)
+
+	if err := u.SetAuxData("totp", []byte("hello")); err == nil {
+		t.Fatal("setting aux data of not existing user should be an error")
+	}
+
+	if err := u.Add(password1, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	if aux, err := u.GetAuxData(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if len(aux) != 0 {
+		t.Fatalf("aux data of new user should be empty: %v", aux)
+	}
+
+	for _, id := range []string{"", "to:tp", "to tp"} {
+		if err := u.SetAuxData(id, []byte("hello")); err == nil {
+			t.Fatalf("setting aux data with invalid identifier '%s' should be an error", id)
+		}
+	}
+
+	if err := u.SetAuxData("totp", []byte("hello")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.SetAuxData("u2f", []byte("world")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Update(password2); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate(password2); !isAuthOk {
+		t.Fatal("authentication should succeed")
+	}
+
+	if aux, err := u.GetAuxData(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if len(aux) != 2 || string(aux["totp"]) != "hello" || string(aux["u2f"]) != "world" {
+		t.Fatalf("aux data should survive password updates: %v", aux)
+	}
+
+	if err := u.SetAuxData("totp", nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if aux, err := u.GetAuxData(); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if _, exists := aux["totp"]; exists || len(aux) != 1 {
+		t.Fatalf("aux data entry should have been removed: %v", aux)
+	}
+}
+
+func TestAuxDataInvalid(t *testing.T) {
+	username := "test-aux-data-invalid"
+	auxStrings := []string{
+		"no identifier",
+		": aGVsbG8=",
+		"totp: $$no-base64$$",
+		"totp: aGVsbG8=\ntotp: d29ybGQ=",
+	}
+
+	filename := filepath.Join(testBaseDirUserHash, username+".user")
+	defer os.Remove(filename)
+
+	u := NewUserHash(testStoreUserHash, username)
+	for _, auxStr := range auxStrings {
+		if err := os.WriteFile(filename, []byte("hmac_sha256_scrypt:1454709438:1:aGVsbG8=:d29ybGQ=\n"+auxStr+"\n"), 0600); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		aux, err := u.GetAuxData()
+		if err != nil {
+			t.Fatalf("invalid aux data '%s' should be ignored, got error: %v", auxStr, err)
+		}
+		for name, value := range aux {
+			if name != "totp" || string(value) != "hello" {
+				t.Fatalf("invalid aux data '%s' should be ignored, got %s=%q", auxStr, name, value)
+			}
+		}
+	}
+}
+
+func TestAuxDataForeign(t *testing.T) {
+	username := "test-aux-data-foreign"
+	foreign := []string{
+		"no identifier",
+		"x-other-agent: $$no-base64$$",
+		"totp: d29ybGQ=",
+	}
+
+	u := NewUserHash(testStoreUserHash, username)
+	if err := u.Add("secret", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+	if err := u.SetAuxData("totp", []byte("hello")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	filename := filepath.Join(testBaseDirUserHash, username+".user")
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := file.WriteString(strings.Join(foreign, "\n") + "\n"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	file.Close()
+
+	// lines this agent doesn't understand must not break reading the file
+	if ok, _, _, _, err := u.Authenticate("secret"); err != nil || !ok {
+		t.Fatalf("authentication with foreign aux data lines failed: %v", err)
+	}
+	aux, err := u.GetAuxData()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(aux["totp"]) != "hello" {
+		t.Fatalf("the first line of an identifier should be used, got %q", aux["totp"])
+	}
+	list, err := testStoreUserHash.ListFull()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user, exists := list[username]; !exists || !user.IsValid {
+		t.Fatalf("user with foreign aux data lines should be listed as valid: %+v", user)
+	}
+
+	if err := u.Update("moresecret"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.SetAdmin(true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := u.Expire(true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	filename = filepath.Join(testBaseDirUserHash, username+".admin")
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, line := range foreign {
+		if !strings.Contains(string(content), "\n"+line+"\n") {
+			t.Fatalf("aux data line '%s' should have been kept: %q", line, content)
+		}
+	}
+	token, err := u.Expire(true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Reset(token, "resetsecret"); err != nil {
+		t.Fatal("reset with foreign aux data lines failed:", err)
+	}
+	if ok, _, _, _, err := u.Authenticate("resetsecret"); err != nil || !ok {
+		t.Fatalf("authentication after reset failed: %v", err)
+	}
+
+	// changing an identifier replaces lines with the same identifier
+	if err := u.SetAuxData("x-other-agent", []byte("hello")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if content, err = os.ReadFile(filename); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if strings.Contains(string(content), "$$no-base64$$") {
+		t.Fatalf("aux data line should have been replaced: %q", content)
+	}
+	if !strings.Contains(string(content), "\nno identifier\n") || !strings.Contains(string(content), "\ntotp: d29ybGQ=\n") {
+		t.Fatalf("other aux data lines should have been kept: %q", content)
+	}
+}
+
+func TestExpireReset(t *testing.T) {
+	username := "test-expire-reset"
+	password1 := "secret"
+	password2 := "moresecret"
+	password3 := "evenmoresecret"
+
+	u := NewUserHash(testStoreUserHash, username)
+
+	if _, err := u.Expire(false); err == nil {
+		t.Fatal("expiring not existing user should be an error")
+	}
+
+	if err := u.Add(password1, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	if token, err := u.Expire(false); err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if token != "" {
+		t.Fatal("expire without token shouldn't return a token")
+	}
+	if isAuthOk, _, _, _, err := u.Authenticate(password1); isAuthOk || err != ErrPasswordExpired {
+		t.Fatalf("authentication of expired user should fail with ErrPasswordExpired: %v", err)
+	}
+	if err := u.Reset("invalid", password2); err == nil {
+		t.Fatal("reset without a pending reset token should be an error")
+	}
+
+	token, err := u.Expire(true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	} else if token == "" {
+		t.Fatal("expire with token should return a token")
+	}
+	if err := u.Reset("invalid", password2); err == nil {
+		t.Fatal("reset with invalid token should be an error")
+	}
+	if err := u.Reset(token, password2); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Reset(token, password3); err == nil {
+		t.Fatal("reset tokens should only be valid once")
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate(password1); isAuthOk {
+		t.Fatal("authentication with old password shouldn't succeed")
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate(password2); !isAuthOk {
+		t.Fatal("authentication with new password should succeed")
+	}
+
+	if _, err := u.Expire(false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Update(password3); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate(password3); !isAuthOk {
+		t.Fatal("updating the password should clear the expired flag")
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	username := "test-rewrap"
+	password := "secret"
+	key := "iVFvz2PW5g1Tge9mLttgRxBuu0OBXgD7uAOHySqi4QI="
+	rewrapKey1 := "1rrhSZPW3v/BBpJOPQ/wd5XcRoZNEaDbHnfXEHOxoSc="
+	rewrapKey2 := "1m+FsEbJppUMaa0OeK5uMYIbuAb44IfMOxDdeuk+s9Q="
+
+	store := NewDir(testBaseDirUserHash)
+	params := []struct {
+		id     uint
+		key    string
+		cost   uint
+		rewrap []string
+	}{
+		{1, key, 10, nil},
+		{2, key, 10, []string{rewrapKey1}},
+		{3, key, 10, []string{rewrapKey1, rewrapKey2}},
+		{4, key, 10, []string{rewrapKey2}},
+		{5, key, 11, []string{rewrapKey1}},
+		{6, rewrapKey2, 10, []string{rewrapKey1}},
+	}
+	for _, p := range params {
+		h, err := NewScryptAuthHasher(&ScryptAuthParams{HmacKeyBase64: p.key, Cost: p.cost, RewrapKeysBase64: p.rewrap})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		store.Params[p.id] = h
+	}
+	store.Params[7], _ = NewArgon2IDHasher(&Argon2IDParams{Time: 1, Memory: 1024, Threads: 1, Length: 32})
+	store.Default = 1
+
+	u := NewUserHash(store, username)
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer u.Remove()
+
+	_, lastchange, _, _, err := readHashStr(u.getFilename(false), store)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	for _, id := range []uint{1, 5, 6, 7, 23} {
+		if err := u.Rewrap(id); err == nil {
+			t.Fatalf("rewrapping from parameter-set 1 to %d should fail", id)
+		}
+	}
+
+	for _, id := range []uint{2, 3} {
+		if err := u.Rewrap(id); err != nil {
+			t.Fatalf("unexpected error rewrapping to parameter-set %d: %v", id, err)
+		}
+		formatID, lc, paramID, _, err := readHashStr(u.getFilename(false), store)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if formatID != "hmac_sha256_scrypt_rewrap" || paramID != id || !lc.Equal(lastchange) {
+			t.Fatalf("rewrapping returned wrong hash string: %s:%d:%d", formatID, lc.Unix(), paramID)
+		}
+		if isAuthOk, _, upgradeable, _, _ := u.Authenticate(password); !isAuthOk {
+			t.Fatalf("authentication should succeed after rewrapping to parameter-set %d", id)
+		} else if !upgradeable {
+			t.Fatal("rewrapped password hashes should be upgradeable")
+		}
+		if isAuthOk, _, _, _, _ := u.Authenticate("wrong"); isAuthOk {
+			t.Fatal("authentication with wrong password shouldn't succeed")
+		}
+	}
+
+	for _, id := range []uint{2, 4} {
+		if err := u.Rewrap(id); err == nil {
+			t.Fatalf("rewrapping from parameter-set 3 to %d should fail", id)
+		}
+	}
+
+	store.Default = 4
+	if err := u.Update(password); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate(password); !isAuthOk {
+		t.Fatal("authentication using rewrap parameter-set as default should succeed")
+	}
+}
+
+type countingHasher struct {
+	Hasher
+	generated int
+}
+
+func (h *countingHasher) Generate(password string) (string, error) {
+	h.generated++
+	return h.Hasher.Generate(password)
+}
+
+func TestAuthenticateDummyCheck(t *testing.T) {
+	username := "test-auth-dummy"
+	password := "secret"
+
+	store := NewDir(testBaseDirUserHash)
+	hasher, err := NewArgon2IDHasher(&Argon2IDParams{Time: 1, Memory: 1024, Threads: 1, Length: 32})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	counter := &countingHasher{Hasher: hasher}
+	store.Params[1] = counter
+	store.Default = 1
+
+	u := NewUserHash(store, username)
+	if _, _, _, _, err := u.Authenticate(password); err == nil {
+		t.Fatal("authenticating not exisiting user should be an error")
+	}
+	if counter.generated != 1 {
+		t.Fatal("authenticating not existing user should compute a dummy hash")
+	}
+
+	filename := filepath.Join(testBaseDirUserHash, username+".user")
+	defer os.Remove(filename)
+	if err := os.WriteFile(filename, []byte("hmac_sha256_scrypt:1454709438:23:aGVsbG8=:d29ybGQ=\n"), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, _, _, _, err := u.Authenticate(password); err == nil {
+		t.Fatal("authenticating user with unknown parameter-set should be an error")
+	}
+	if counter.generated != 2 {
+		t.Fatal("authenticating user with unknown parameter-set should compute a dummy hash")
+	}
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := u.Add(password, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	counter.generated = 0
+	if isAuthOk, _, _, _, _ := u.Authenticate(password); !isAuthOk {
+		t.Fatal("authentication should succeed")
+	}
+	if isAuthOk, _, _, _, _ := u.Authenticate("wrong"); isAuthOk {
+		t.Fatal("authentication shouldn't succeed")
+	}
+	if counter.generated != 0 {
+		t.Fatal("authenticating existing user shouldn't compute a dummy hash")
+	}
+}
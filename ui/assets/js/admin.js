@@ -29,6 +29,7 @@ var auth_username = null;
 var auth_admin = false;
 var auth_lastchanged = new Date();
 var auth_session = null;
+var auth_readonly = false;
 
 function auth_loginSuccess(data) {
   if (data.session) {
@@ -38,11 +39,13 @@ function auth_loginSuccess(data) {
     auth_admin = data.admin;
     auth_lastchanged = new Date(data.lastchanged);
     auth_session = data.session;
+    auth_readonly = data.readonly;
 
     sessionStorage.setItem("auth_username", auth_username);
     sessionStorage.setItem("auth_admin", (auth_admin) ? "true" : "false");
     sessionStorage.setItem("auth_lastchanged", auth_lastchanged.toISOString());
     sessionStorage.setItem("auth_session", auth_session);
+    sessionStorage.setItem("auth_readonly", (auth_readonly) ? "true" : "false");
 
     $('#login-box').slideUp();
 
@@ -82,7 +85,7 @@ function auth_logout() {
     $("#login-username").trigger("focus");
   });
 
-  window.location.replace("/"); // make chrome use newly changed passwords..
+  window.location.replace("./"); // make chrome use newly changed passwords..
 }
 
 function auth_init() {
@@ -90,6 +93,7 @@ function auth_init() {
   auth_admin = (sessionStorage.getItem("auth_admin") == "true") ? true : false;
   auth_lastchanged = new Date(sessionStorage.getItem("auth_lastchanged"));
   auth_session = sessionStorage.getItem("auth_session");
+  auth_readonly = (sessionStorage.getItem("auth_readonly") == "true") ? true : false;
 
   if(auth_session && auth_username) {
     $("#login-box").hide();
@@ -107,7 +111,7 @@ function auth_init() {
   }
   $("#login-btn").on("click", function(event) {
     var data = JSON.stringify({ username: $("#login-username").val(), password: $("#login-password").val() })
-    $.post("/api/authenticate", data, auth_loginSuccess, 'json').fail(auth_loginError);
+    $.post("../api/authenticate", data, auth_loginSuccess, 'json').fail(auth_loginError);
   });
   $("#login-username").on("keypress", function(event) { overrideEnter(event, $("#login-btn")); });
   $("#login-password").on("keypress", function(event) { overrideEnter(event, $("#login-btn")); });
@@ -118,11 +122,13 @@ function auth_cleanup() {
   sessionStorage.removeItem("auth_admin");
   sessionStorage.removeItem("auth_lastchanged");
   sessionStorage.removeItem("auth_session");
+  sessionStorage.removeItem("auth_readonly");
 
   auth_username = null;
   auth_admin = false;
   auth_lastchanged = null;
   auth_session = null;
+  auth_readonly = false;
 
   $("#login-username").val('');
   $("#login-password").val('');
@@ -153,7 +159,7 @@ function main_getUpdateButton(user) {
     $("#changepw-btn").on("click", function(event) {
       var newpassword = $("#changepw-password").val();
       var data = JSON.stringify({ session: auth_session, username: user, newpassword: newpassword });
-      $.post("/api/update", data, main_updateSuccess, 'json').fail(main_reqError);
+      $.post("../api/update", data, main_updateSuccess, 'json').fail(main_reqError);
       $("#changepw-modal").modal('hide');
     });
     $("#changepw-btn").text("Change");
@@ -163,6 +169,14 @@ function main_getUpdateButton(user) {
   });
 }
 
+function main_getAppPasswordsButton(user) {
+  var btn = $('<button>').addClass("btn").addClass("btn-secondary").addClass("btn-sm");
+  btn.html('<i class="fa-solid fa-key" aria-hidden="true"></i>&nbsp;&nbsp;App Passwords')
+  return btn.on("click", function() {
+    apppw_show(user);
+  });
+}
+
 function main_removeSuccess(data) {
   alertbox.success('mainwindow', "Remove User", "successfully removed user " + data.username);
   main_updateUserlist();
@@ -173,7 +187,7 @@ function main_getRemoveButton(user) {
   btn.html('<i class="fa-solid fa-trash" aria-hidden="true"></i>&nbsp;&nbsp;Remove')
   return btn.on("click", function() {
     var data = JSON.stringify({ session: auth_session, username: user });
-    $.post("/api/remove", data, main_removeSuccess, 'json').fail(main_reqError);
+    $.post("../api/remove", data, main_removeSuccess, 'json').fail(main_reqError);
   });
 }
 
@@ -187,7 +201,7 @@ function main_getSetAdminButton(user, oldstate) {
   var newstate = !oldstate;
   return btn.on("click", function() {
     var data = JSON.stringify({ session: auth_session, username: user, admin: newstate });
-    $.post("/api/set-admin", data, main_setadminSuccess, 'json').fail(main_reqError);
+    $.post("../api/set-admin", data, main_setadminSuccess, 'json').fail(main_reqError);
   });
 }
 
@@ -217,6 +231,13 @@ function getLastChange(lastchange) {
   return $('<string>').addClass("last-change").text(getDateTimeString(lastchange))
 }
 
+function getOptionalDate(d) {
+  if (!d) {
+    return $('<span>').addClass("text-muted").text("never")
+  }
+  return getLastChange(new Date(d))
+}
+
 function main_userlistSuccess(data) {
   $('#user-list tbody').find('tr').remove();
   for (var user in data.list) {
@@ -226,8 +247,11 @@ function main_userlistSuccess(data) {
         .append($('<td>').addClass("text-center").append(main_getBoolIcon(data.list[user].valid)))
         .append($('<td>').addClass("text-center").append(main_getBoolIcon(data.list[user].supported)))
         .append($('<td>').text(data.list[user].formatid + ' (' + data.list[user].paramid + ')'))
+        .append($('<td>').append(getOptionalDate(data.list[user].lastlogin)))
+        .append($('<td>').append(getOptionalDate(data.list[user].lastfailedlogin)))
         .append($('<td>').addClass("text-center").append(main_getSetAdminButton(user, data.list[user].admin))
                                                  .append(main_getUpdateButton(user))
+                                                 .append(main_getAppPasswordsButton(user))
                                                  .append(main_getRemoveButton(user)));
     $('#user-list > tbody:last').append(row);
   }
@@ -258,7 +282,7 @@ function main_setupAddButton() {
       $("#changepw-password").val(''); // we don't want the browser to add this user to it's password store...
       $("#changepw-password-retype").val('');
       var data = JSON.stringify({ session: auth_session, username: user, password: newpassword, admin: admin });
-      $.post("/api/add", data, main_addSuccess, 'json').fail(main_reqError);
+      $.post("../api/add", data, main_addSuccess, 'json').fail(main_reqError);
       $("#changepw-modal").modal('hide');
     });
     $("#changepw-btn").text("Add");
@@ -270,12 +294,94 @@ function main_setupAddButton() {
 
 function main_updateUserlist() {
   var data = JSON.stringify({ session: auth_session });
-  $.post("/api/list-full", data, main_userlistSuccess, 'json').fail(main_reqError);
+  $.post("../api/list-full", data, main_userlistSuccess, 'json').fail(main_reqError);
 }
 
 function main_adminViewInit() {
   main_setupAddButton();
   main_updateUserlist();
+  audit_init();
+}
+
+
+/*
+ *
+ * Main: audit log
+ *
+ */
+var audit_filter = null;
+var audit_cursor = "";
+
+function audit_getResultLabel(result) {
+  var label = $('<span>').addClass("badge").text(result);
+  if (result == "ok") {
+    return label.addClass("bg-success");
+  } else if (result == "error") {
+    return label.addClass("bg-danger");
+  }
+  return label.addClass("bg-warning").addClass("text-dark");
+}
+
+function audit_listSuccess(data) {
+  for (var i = 0; i < data.records.length; i++) {
+    var record = data.records[i];
+    var details = (record.error) ? record.details + ' (' + record.error + ')' : record.details;
+    var row = $('<tr>').append($('<td>').append(getLastChange(new Date(record.time))))
+        .append($('<td>').text(record.actor))
+        .append($('<td>').text(record.action))
+        .append($('<td>').text(record.target))
+        .append($('<td>').text(details))
+        .append($('<td>').text(record.listener))
+        .append($('<td>').text(record.source))
+        .append($('<td>').append(audit_getResultLabel(record.result)));
+    $('#audit-list > tbody:last').append(row);
+  }
+  audit_cursor = data.next;
+  if (audit_cursor) {
+    $("#audit-more-btn").show();
+  } else {
+    $("#audit-more-btn").hide();
+  }
+}
+
+function audit_getDate(id) {
+  var val = $(id).val();
+  if (val == "") {
+    return undefined;
+  }
+  return new Date(val).toISOString();
+}
+
+function audit_update() {
+  var req = $.extend({ session: auth_session, cursor: audit_cursor }, audit_filter);
+  $.post("../api/audit", JSON.stringify(req), audit_listSuccess, 'json').fail(main_reqError);
+}
+
+function audit_search() {
+  audit_filter = {
+    username: $("#audit-username").val(),
+    actor: $("#audit-actor").val(),
+    action: $("#audit-action").val(),
+    since: audit_getDate("#audit-since"),
+    until: audit_getDate("#audit-until")
+  };
+  audit_cursor = "";
+  $('#audit-list tbody').find('tr').remove();
+  audit_update();
+}
+
+function audit_init() {
+  $("#audit-more-btn").hide();
+  $("#audit-form").on("submit", function(event) {
+    event.preventDefault();
+    audit_search();
+  });
+  $("#audit-more-btn").on("click", audit_update);
+  $("#audit-tab").on("shown.bs.tab", function() {
+    if (audit_filter == null) {
+      audit_search();
+    }
+  });
 }
 
 
@@ -292,7 +398,10 @@ function main_userUpdateSuccess(data) {
 function main_userViewInit() {
   $("#user-view .username").text(auth_username);
   $("#user-view .lastchange").text(getDateTimeString(auth_lastchanged));
-  $('#user-view .btn').on("click", function() {
+  $('#user-apppw-btn').on("click", function() {
+    apppw_show(auth_username);
+  });
+  $('#user-changepw-btn').on("click", function() {
     main_cleanupPasswordModal();
 
     $('#changepw-userfield').text(auth_username);
@@ -300,7 +409,7 @@ function main_userViewInit() {
     $("#changepw-btn").on("click", function(event) {
       var newpassword = $("#changepw-password").val();
       var data = JSON.stringify({ session: auth_session, username: auth_username, newpassword: newpassword });
-      $.post("/api/update", data, main_userUpdateSuccess, 'json').fail(main_reqError);
+      $.post("../api/update", data, main_userUpdateSuccess, 'json').fail(main_reqError);
       $("#changepw-modal").modal('hide');
     });
     $("#changepw-btn").text("Change");
@@ -311,6 +420,80 @@ function main_userViewInit() {
 }
 
 
+/*
+ *
+ * Main: app passwords
+ *
+ */
+var apppw_username = null;
+
+function apppw_getRemoveButton(name) {
+  var btn = $('<button>').addClass("btn").addClass("btn-danger").addClass("btn-sm");
+  btn.html('<i class="fa-solid fa-trash" aria-hidden="true"></i>&nbsp;&nbsp;Revoke')
+  return btn.on("click", function() {
+    var data = JSON.stringify({ session: auth_session, username: apppw_username, name: name });
+    $.post("../api/remove-app-password", data, apppw_removeSuccess, 'json').fail(apppw_reqError);
+  });
+}
+
+function apppw_listSuccess(data) {
+  $('#apppw-list tbody').find('tr').remove();
+  for (var name in data.list) {
+    var scopes = (data.list[name].scopes) ? data.list[name].scopes.join(", ") : "any";
+    var row = $('<tr>').append($('<td>').text(name))
+        .append($('<td>').append(getLastChange(new Date(data.list[name].created))))
+        .append($('<td>').text(scopes))
+        .append($('<td>').addClass("text-center").append(apppw_getRemoveButton(name)));
+    $('#apppw-list > tbody:last').append(row);
+  }
+}
+
+function apppw_updateList() {
+  var data = JSON.stringify({ session: auth_session, username: apppw_username });
+  $.post("../api/list-app-passwords", data, apppw_listSuccess, 'json').fail(apppw_reqError);
+}
+
+function apppw_addSuccess(data) {
+  $("#apppw-name").val('');
+  $("#apppw-scopes").val('');
+  $('#apppw-modal .alertbox').html('<div class="alert alert-success" role="alert"><strong>App password ' + $('<span>').text(data.name).html() + ':</strong> <code></code><br>This password will not be shown again.</div>');
+  $('#apppw-modal .alertbox code').text(data.password);
+  apppw_updateList();
+}
+
+function apppw_removeSuccess(data) {
+  alertbox.success('apppw-modal', "Revoke App Password", "successfully revoked app password " + $('<span>').text(data.name).html());
+  apppw_updateList();
+}
+
+function apppw_reqError(req, status, error) {
+  if(req.status == 401) {
+    $("#apppw-modal").modal('hide');
+    main_reqError(req, status, error);
+    return;
+  }
+  var data = JSON.parse(req.responseText);
+  alertbox.error('apppw-modal', "API Error", status + ': ' + ((data.error != "") ? data.error : error));
+}
+
+function apppw_show(user) {
+  apppw_username = user;
+  $('#apppw-userfield').text(user);
+  $('#apppw-modal .alertbox').text('');
+  $('#apppw-list tbody').find('tr').remove();
+  $("#apppw-name").val('');
+  $("#apppw-scopes").val('');
+  $("#apppw-form").off('submit').on("submit", function(event) {
+    event.preventDefault();
+    var scopes = $("#apppw-scopes").val().split(",").map(function(s) { return s.trim(); }).filter(function(s) { return s != ""; });
+    var data = JSON.stringify({ session: auth_session, username: apppw_username, name: $("#apppw-name").val(), scopes: scopes });
+    $.post("../api/add-app-password", data, apppw_addSuccess, 'json').fail(apppw_reqError);
+  });
+  apppw_updateList();
+  $("#apppw-modal").modal('show');
+}
+
+
 /*
  *
  * Main: global
@@ -437,6 +620,10 @@ function main_enablePWChecks() {
 }
 
 function main_init() {
+  if (auth_readonly == true) {
+    $("#readonly-banner").show();
+    $("#adduser-form").hide();
+  }
   if (auth_admin == true) {
     $("#admin-view").show();
     $("#user-view").hide();